@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+	"statistics/web"
+)
+
+const apikeysUsage = `usage: statistics apikeys <command>
+
+commands:
+  create [-tenant TENANT] NAME SCOPE...
+                         create a key of TENANT (default) with scopes
+                         stats:read, stats:write, stats:delete or admin
+  list                   list keys without secrets
+  revoke ID              revoke a key
+  audit                  show the latest mutations and the keys which made them
+`
+
+// apikeys выполняет подкоманду apikeys с аргументами args.
+// Ключ выводится только при создании
+func apikeys(cfg *web.Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", apikeysUsage)
+	}
+	sdb, err := cfg.Database.Open()
+	if err != nil {
+		return err
+	}
+	defer sdb.DB.Close()
+
+	ctx := context.Background()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch args[0] {
+	case "create":
+		args = args[1:]
+		if len(args) > 1 && args[0] == "-tenant" {
+			if !uc.ValidTenant(args[1]) {
+				return fmt.Errorf("bad tenant name %q", args[1])
+			}
+			ctx = r.WithTenant(ctx, args[1])
+			args = args[2:]
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("%s", apikeysUsage)
+		}
+		key, err := uc.CreateAPIKey(ctx, args[0], args[1:], sdb)
+		if err == uc.ErrInvalid {
+			return fmt.Errorf("bad name or scopes, known scopes: %s", strings.Join(uc.Scopes, " "))
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created key %d %q of tenant %s, it is shown only once:\n%s\n", key.ID, key.Name, key.Tenant, key.Key)
+		return nil
+	case "list":
+		keys, err := uc.GetAPIKeys(ctx, sdb)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "ID\tNAME\tTENANT\tPREFIX\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.Revoked != nil {
+				revoked = key.Revoked.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Tenant, key.Prefix,
+				strings.Join(key.Scopes, " "), key.Created.Format(time.RFC3339), revoked)
+		}
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", apikeysUsage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad key id %q", args[1])
+		}
+		if err := uc.RevokeAPIKey(ctx, id, sdb); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key %d revoked\n", id)
+		return nil
+	case "audit":
+		entries, err := uc.GetAudit(ctx, sdb)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "TIME\tKEY\tMETHOD\tPATH\tSTATUS\tREQUEST")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%d %s\t%s\t%s\t%d\t%s\n", e.Created.Format(time.RFC3339),
+				e.KeyID, e.KeyName, e.Method, e.Path, e.Status, e.RequestID)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown apikeys command %q\n%s", args[0], apikeysUsage)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"statistics/web"
+)
+
+const configUsage = `usage: statistics [-config FILE] [-set KEY=VALUE]... config <command>
+
+commands:
+  check    validate the configuration and print the effective settings with their source
+`
+
+// config выполняет подкоманду config с аргументами args для конфигурации
+// cfg, загруженной с ошибкой loadErr
+func config(cfg *web.Config, loadErr error, args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("%s", configUsage)
+	}
+	var invalid web.ConfigError
+	if loadErr != nil && !errors.As(loadErr, &invalid) {
+		return loadErr
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tENV\tVALUE\tSOURCE\tRELOAD")
+	for _, s := range cfg.Settings() {
+		reload := ""
+		if s.Reload {
+			reload = "SIGHUP"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Key, s.Env, s.Value, s.Source, reload)
+	}
+	w.Flush()
+	if loadErr != nil {
+		fmt.Fprintln(out)
+		return loadErr
+	}
+	fmt.Fprintln(out, "\nconfiguration is valid")
+	return nil
+}
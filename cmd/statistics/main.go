@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"os"
+	"statistics/pkg/logging"
 	"statistics/web"
 )
 
@@ -13,14 +15,73 @@ import (
 // curl -G -d "from=2020-01-01&to=2020-01-10&orderby=date" http://localhost:8080/stats
 // curl -X DELETE http://localhost:8080/stats
 
+// statistics migrate up|down [N]|to VERSION|status - управление схемой базы
+// statistics rollups check|rebuild FROM TO - проверка и пересчет агрегатов
+// statistics apikeys create [-tenant TENANT] NAME SCOPE...|list|revoke ID|audit - управление ключами API
+// statistics tenants list|set TENANT MAX_ROWS - квоты арендаторов
+// statistics tokens jwks KID=KEY.pem...|sign KEY.pem KID CLAIMS [TTL] - ключи и токены для проверки входа SSO
+// statistics config check - проверка конфигурации и действующие значения настроек
+
+// Перед подкомандой задаются файл конфигурации и значения настроек:
+// statistics -config statistics.yaml -set log.level=debug migrate status
+
 func main() {
-	cfg, err := web.NewConfig()
+	cfg, args, err := web.NewConfig(os.Args[1:])
+	if len(args) > 0 && args[0] == "config" {
+		if err := config(cfg, err, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := cfg.Log.NewLogger(os.Stderr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	logging.SetDefault(logger)
+	// записи пакета log (в том числе ошибки http.Server) пишутся в структурированный журнал
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelError))
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := migrate(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "rollups" {
+		if err := rollups(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "apikeys" {
+		if err := apikeys(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "tenants" {
+		if err := tenants(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "tokens" {
+		if err := tokens(args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	// Init database
-	hdl := cfg.InitDB()
+	hdl, err := cfg.InitDB()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Run the server
-	cfg.Run(hdl)
+	// Run the server, the exit status is not zero if it is not stopped gracefully
+	if err := cfg.Run(hdl); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	r "statistics/pkg/repository"
+	"statistics/web"
+)
+
+const migrateUsage = `usage: statistics migrate <command>
+
+commands:
+  up            apply all pending migrations
+  down [N]      revert the last N applied migrations (default 1)
+  to VERSION    migrate up or down to VERSION (0 reverts everything)
+  status        list migrations and their state
+`
+
+// migrate выполняет подкоманду migrate с аргументами args
+func migrate(cfg *web.Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", migrateUsage)
+	}
+	number := func(def int) (int, error) {
+		if len(args) < 2 {
+			if def < 0 {
+				return 0, fmt.Errorf("%s", migrateUsage)
+			}
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad number %q", args[1])
+		}
+		return n, nil
+	}
+
+	sdb, err := cfg.Database.Open()
+	if err != nil {
+		return err
+	}
+	defer sdb.DB.Close()
+
+	ctx := context.Background()
+	var done []r.Migration
+	switch args[0] {
+	case "up":
+		done, err = sdb.Migrate(ctx, r.LatestVersion)
+	case "down":
+		var steps int
+		if steps, err = number(1); err == nil {
+			done, err = sdb.Rollback(ctx, steps)
+		}
+	case "to":
+		var version int
+		if version, err = number(-1); err == nil {
+			done, err = sdb.Migrate(ctx, version)
+		}
+	case "status":
+		return printStatus(ctx, sdb, out)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], migrateUsage)
+	}
+	for _, m := range done {
+		fmt.Fprintf(out, "%04d_%s\n", m.Version, m.Name)
+	}
+	if err == nil && len(done) == 0 {
+		fmt.Fprintln(out, "schema is up to date")
+	}
+	return err
+}
+
+func printStatus(ctx context.Context, sdb *r.StatsDB, out io.Writer) error {
+	states, err := sdb.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED")
+	for _, s := range states {
+		state := "applied"
+		switch {
+		case s.Pending():
+			state = "pending"
+		case s.Unknown:
+			state = "unknown"
+		case s.Modified:
+			state = "modified"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, state, s.Applied)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	r "statistics/pkg/repository"
+	"statistics/web"
+)
+
+const rollupsUsage = `usage: statistics rollups <command> FROM TO
+
+commands:
+  check      compare weekly and monthly rollups with daily statistics of every tenant
+  rebuild    recompute rollups of all periods between FROM and TO for every tenant
+`
+
+// rollups выполняет подкоманду rollups с аргументами args.
+// check завершается ошибкой, если найдены расхождения
+func rollups(cfg *web.Config, args []string, out io.Writer) error {
+	if len(args) != 3 {
+		return fmt.Errorf("%s", rollupsUsage)
+	}
+	from, to := args[1], args[2]
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return fmt.Errorf("bad date %q", date)
+		}
+	}
+
+	sdb, err := cfg.Database.Open()
+	if err != nil {
+		return err
+	}
+	defer sdb.DB.Close()
+
+	ctx := context.Background()
+	tenants, err := sdb.FindTenants(ctx)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "check":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		count := 0
+		for _, tenant := range tenants {
+			mismatches, err := sdb.CheckRollups(r.WithTenant(ctx, tenant.Name), from, to)
+			if err != nil {
+				return err
+			}
+			for _, m := range mismatches {
+				if count == 0 {
+					fmt.Fprintln(w, "TENANT\tGRANULARITY\tPERIOD\tEXPECTED\tACTUAL")
+				}
+				count++
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d/%d\t%d/%d/%d\n", tenant.Name, m.Granularity, m.Expected.Date,
+					m.Expected.Views, m.Expected.Clicks, m.Expected.Cost,
+					m.Actual.Views, m.Actual.Clicks, m.Actual.Cost)
+			}
+		}
+		if count == 0 {
+			fmt.Fprintln(out, "rollups are consistent")
+			return nil
+		}
+		w.Flush()
+		return fmt.Errorf("%d rollup mismatches, run rollups rebuild", count)
+	case "rebuild":
+		total := 0
+		for _, tenant := range tenants {
+			var count int
+			count, err = sdb.RebuildRollups(r.WithTenant(ctx, tenant.Name), from, to)
+			total += count
+			if err != nil {
+				break
+			}
+		}
+		fmt.Fprintf(out, "%d periods rebuilt\n", total)
+		return err
+	}
+	return fmt.Errorf("unknown rollups command %q\n%s", args[0], rollupsUsage)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	uc "statistics/pkg/usecases"
+	"statistics/web"
+)
+
+const tenantsUsage = `usage: statistics tenants <command>
+
+commands:
+  list                   list tenants with their quotas and number of dates
+  set TENANT MAX_ROWS    limit the number of dates with statistics of TENANT, 0 - no limit
+`
+
+// tenants выполняет подкоманду tenants с аргументами args.
+// Квота по умолчанию задается TENANT_MAX_ROWS
+func tenants(cfg *web.Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", tenantsUsage)
+	}
+	sdb, err := cfg.Database.Open()
+	if err != nil {
+		return err
+	}
+	defer sdb.DB.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		list, err := uc.GetTenants(ctx, cfg.Tenant.MaxRows, sdb)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		defer w.Flush()
+		fmt.Fprintln(w, "TENANT\tROWS\tMAX_ROWS")
+		for _, tenant := range list {
+			max := "unlimited"
+			if tenant.MaxRows > 0 {
+				max = strconv.Itoa(tenant.MaxRows)
+			}
+			if tenant.Default {
+				max += " (default)"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\n", tenant.Name, tenant.Rows, max)
+		}
+		return nil
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("%s", tenantsUsage)
+		}
+		maxRows, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("bad number of rows %q", args[2])
+		}
+		if err := uc.SetTenantQuota(ctx, args[1], maxRows, sdb); err != nil {
+			if err == uc.ErrInvalid {
+				return fmt.Errorf("bad tenant name %q or number of rows %d", args[1], maxRows)
+			}
+			return err
+		}
+		if maxRows == 0 {
+			fmt.Fprintf(out, "tenant %s is not limited\n", args[1])
+			return nil
+		}
+		fmt.Fprintf(out, "tenant %s is limited to %d dates\n", args[1], maxRows)
+		return nil
+	}
+	return fmt.Errorf("unknown tenants command %q\n%s", args[0], tenantsUsage)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"statistics/pkg/jwt"
+)
+
+const tokensUsage = `usage: statistics tokens <command>
+
+commands:
+  jwks KID=KEY.pem...    print the JWKS (AUTH_JWKS) of RSA or P-256 keys in PEM
+  sign KEY.pem KID CLAIMS [TTL]
+                         print a token with JSON CLAIMS signed with the private key,
+                         exp is set to now + TTL (default 1h) unless given in CLAIMS
+`
+
+// tokens выполняет подкоманду tokens с аргументами args. Ключи
+// и токены проверяют вход по токенам SSO без сервера SSO:
+//
+//	openssl ecparam -name prime256v1 -genkey -noout | openssl pkcs8 -topk8 -nocrypt > sso.pem
+//	statistics tokens jwks k1=sso.pem > jwks.json
+//	statistics tokens sign sso.pem k1 '{"sub":"alice","scope":"stats:read"}'
+func tokens(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", tokensUsage)
+	}
+	switch args[0] {
+	case "jwks":
+		if len(args) < 2 {
+			return fmt.Errorf("%s", tokensUsage)
+		}
+		keys := []jwt.Key{}
+		for _, arg := range args[1:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("bad key %q, expected KID=KEY.pem", arg)
+			}
+			public, err := readPublicKey(parts[1])
+			if err != nil {
+				return err
+			}
+			keys = append(keys, jwt.Key{ID: parts[0], Public: public})
+		}
+		data, err := json.MarshalIndent(jwt.NewKeySet(keys...), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", data)
+		return nil
+	case "sign":
+		if len(args) != 4 && len(args) != 5 {
+			return fmt.Errorf("%s", tokensUsage)
+		}
+		private, err := readPrivateKey(args[1])
+		if err != nil {
+			return err
+		}
+		claims := jwt.Claims{}
+		if err := json.Unmarshal([]byte(args[3]), &claims); err != nil {
+			return fmt.Errorf("bad claims: %w", err)
+		}
+		ttl := time.Hour
+		if len(args) == 5 {
+			if ttl, err = time.ParseDuration(args[4]); err != nil {
+				return fmt.Errorf("bad TTL %q", args[4])
+			}
+		}
+		if _, ok := claims["exp"]; !ok {
+			claims["exp"] = time.Now().Add(ttl).Unix()
+		}
+		token, err := jwt.Sign(claims, private, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, token)
+		return nil
+	}
+	return fmt.Errorf("unknown tokens command %q\n%s", args[0], tokensUsage)
+}
+
+// readPEM возвращает первый блок PEM файла path
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+// readPrivateKey читает закрытый ключ PKCS #8, PKCS #1 или SEC 1
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported private key", path)
+}
+
+// readPublicKey читает открытый ключ PKIX или открытую часть закрытого ключа
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.PublicKey
+	if block.Type != "PUBLIC KEY" {
+		private, err := readPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		key = private.Public()
+	} else if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch public := key.(type) {
+	case *rsa.PublicKey:
+		return public, nil
+	case *ecdsa.PublicKey:
+		if public.Curve == elliptic.P256() {
+			return public, nil
+		}
+	}
+	return nil, errors.New(path + ": unsupported public key")
+}
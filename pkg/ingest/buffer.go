@@ -0,0 +1,245 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+)
+
+// ErrFull буфер заполнен, запись нужно повторить позже
+var ErrFull = errors.New("ingest: buffer is full")
+
+// Stats счетчики буфера
+type Stats struct {
+	// Pending количество дат, ожидающих записи
+	Pending  int
+	Accepted uint64
+	Rejected uint64
+	Flushes  uint64
+	Failures uint64
+}
+
+// Buffer буфер отложенной записи статистики. Приращения арендатора за одну дату
+// объединяются (views и clicks суммируются, cost заменяется последним,
+// как при последовательных вызовах AddStat) и записываются пакетом
+// (по транзакции на арендатора), когда набирается FlushSize дат или проходит Interval.
+// Память ограничена MaxDates датами: приращение за новую дату в заполненный
+// буфер отклоняется с ErrFull. Во время записи пакета новые приращения
+// копятся в следующем, поэтому в памяти не больше двух пакетов
+type Buffer struct {
+	Rep r.StatsRepository
+	// Budgets проверяются после записи пакета, может быть nil
+	Budgets r.BudgetRepository
+	// Notifier получатель событий записанной статистики, может быть nil
+	Notifier uc.Notifier
+	// MaxDates максимальное количество дат, ожидающих записи
+	MaxDates int
+	// FlushSize количество дат, при котором пакет записывается сразу
+	FlushSize int
+	// Interval наибольшее время ожидания записи
+	Interval time.Duration
+
+	mu      sync.Mutex
+	pending map[pendingKey]r.Data
+	stats   Stats
+	// flushing допускает только одну запись пакета одновременно
+	flushing sync.Mutex
+	wake     chan struct{}
+}
+
+// NewBuffer возвращает буфер над rep на maxDates дат,
+// записывающий пакет при заполнении наполовину или раз в секунду
+func NewBuffer(rep r.StatsRepository, maxDates int) *Buffer {
+	flushSize := maxDates / 2
+	if flushSize < 1 {
+		flushSize = 1
+	}
+	return &Buffer{
+		Rep:       rep,
+		MaxDates:  maxDates,
+		FlushSize: flushSize,
+		Interval:  time.Second,
+		pending:   map[pendingKey]r.Data{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// pendingKey арендатор и дата ожидающего записи приращения
+type pendingKey struct {
+	tenant, date string
+}
+
+// coalesce добавляет к накопленному приращению более позднее
+func coalesce(older, newer r.Data) r.Data {
+	older.Views += newer.Views
+	older.Clicks += newer.Clicks
+	older.Cost = newer.Cost
+	return older
+}
+
+// Add ставит приращение арендатора контекста в очередь записи.
+// Возвращает ErrFull, если дата новая, а буфер заполнен
+func (b *Buffer) Add(ctx context.Context, data r.Data) error {
+	key := pendingKey{r.TenantFromContext(ctx), data.Date}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.pending[key]; ok {
+		b.pending[key] = coalesce(old, data)
+	} else {
+		if len(b.pending) >= b.MaxDates {
+			b.stats.Rejected++
+			return ErrFull
+		}
+		b.pending[key] = data
+	}
+	b.stats.Accepted++
+	if len(b.pending) >= b.FlushSize {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Stats возвращает текущие значения счетчиков
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.Pending = len(b.pending)
+	return stats
+}
+
+func (b *Buffer) notifiers() []uc.Notifier {
+	if b.Notifier == nil {
+		return nil
+	}
+	return []uc.Notifier{b.Notifier}
+}
+
+// Flush записывает накопленные приращения пакетами по арендаторам
+// и проверяет бюджеты по их датам. Если репозиторий транзакционный
+// (r.IsTransactional), пакет при ошибке возвращается в буфер и будет записан
+// следующим Flush; даты, для которых в заполненном буфере нет места,
+// отбрасываются. Новые даты сверх квоты арендатора отбрасываются
+// (повтор завершился бы той же ошибкой), остальные даты пакета
+// записываются. Возвращается первая ошибка
+func (b *Buffer) Flush(ctx context.Context) error {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = map[pendingKey]r.Data{}
+	b.mu.Unlock()
+
+	batches := map[string][]r.Data{}
+	for key, data := range pending {
+		batches[key.tenant] = append(batches[key.tenant], data)
+	}
+	tenants := make([]string, 0, len(batches))
+	for tenant := range batches {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var result error
+	for _, tenant := range tenants {
+		batch := batches[tenant]
+		sort.Slice(batch, func(i, j int) bool { return batch[i].Date < batch[j].Date })
+		if err := b.flush(r.WithTenant(ctx, tenant), batch); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// flush записывает пакет арендатора контекста
+func (b *Buffer) flush(ctx context.Context, batch []r.Data) error {
+	skipped, err := uc.AddStatsWithinQuota(ctx, batch, b.Rep, b.notifiers()...)
+	if err != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.stats.Failures++
+		if !r.IsTransactional(b.Rep) {
+			// часть пакета могла быть записана, повтор удвоил бы ее
+			logging.Error(ctx, "Ingest Flush. dates lost", "err", err, "dates", len(batch))
+			return err
+		}
+		tenant := r.TenantFromContext(ctx)
+		lost := 0
+		for _, data := range batch {
+			key := pendingKey{tenant, data.Date}
+			if newer, ok := b.pending[key]; ok {
+				data = coalesce(data, newer)
+			} else if len(b.pending) >= b.MaxDates {
+				// за время записи буфер заполнили новые даты
+				lost++
+				continue
+			}
+			b.pending[key] = data
+		}
+		if lost > 0 {
+			logging.Error(ctx, "Ingest Flush. buffer is full, dates lost", "err", err, "dates", lost)
+		}
+		return err
+	}
+	b.mu.Lock()
+	b.stats.Flushes++
+	if len(skipped) > 0 {
+		b.stats.Failures++
+		err = r.ErrQuotaExceeded
+	}
+	b.mu.Unlock()
+	if err != nil {
+		logging.Error(ctx, "Ingest Flush. tenant quota exceeded, dates dropped",
+			"tenant", r.TenantFromContext(ctx), "dates", len(skipped))
+	}
+
+	if b.Budgets == nil {
+		return err
+	}
+	dropped := map[string]bool{}
+	for _, data := range skipped {
+		dropped[data.Date] = true
+	}
+	for _, data := range batch {
+		if dropped[data.Date] {
+			continue
+		}
+		if _, err := uc.CheckBudgets(ctx, data.Date, b.Rep, b.Budgets, b.notifiers()...); err != nil {
+			logging.Error(ctx, "Ingest Flush. CheckBudgets", "err", err)
+		}
+	}
+	return err
+}
+
+// Run записывает пакеты раз в Interval и при заполнении FlushSize,
+// пока не отменен ctx. После отмены записывает оставшиеся приращения
+// и возвращается
+func (b *Buffer) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// последняя запись не должна прерываться отмененным контекстом
+			if err := b.Flush(context.Background()); err != nil {
+				logging.Error(ctx, "Ingest Run. final Flush", "err", err, "pending", b.Stats().Pending)
+			}
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		if err := b.Flush(ctx); err != nil {
+			logging.Error(ctx, "Ingest Run. Flush", "err", err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+)
+
+// failingDB транзакционный репозиторий, пакет в котором завершается ошибкой,
+// пока fail не сброшен
+type failingDB struct {
+	*r.MemoryDB
+	fail    bool
+	batches int
+	// during вызывается в начале каждого пакета, может быть nil
+	during func()
+}
+
+func (f *failingDB) Batch(ctx context.Context, fn func(rep r.StatsRepository) error) error {
+	f.batches++
+	if f.during != nil {
+		f.during()
+	}
+	if f.fail {
+		return errors.New("batch failed")
+	}
+	return fn(f.MemoryDB)
+}
+
+func (f *failingDB) Transactional() bool { return true }
+
+// partialDB нетранзакционный репозиторий, запись даты fail в котором
+// завершается ошибкой после записи предыдущих дат пакета
+type partialDB struct {
+	*r.MemoryDB
+	fail string
+}
+
+func (p *partialDB) Batch(ctx context.Context, fn func(rep r.StatsRepository) error) error {
+	return fn(p)
+}
+
+func (p *partialDB) Storage(ctx context.Context, data r.Data) error {
+	if data.Date == p.fail {
+		return errors.New("storage failed")
+	}
+	return p.MemoryDB.Storage(ctx, data)
+}
+
+type events []uc.Event
+
+func (e *events) Notify(event uc.Event) { *e = append(*e, event) }
+
+func TestBufferCoalesce(t *testing.T) {
+	ctx := context.Background()
+	rep := &failingDB{MemoryDB: r.NewMemoryDB()}
+	rep.Storage(ctx, r.Data{Date: "2021-01-01", Views: 1, Clicks: 1, Cost: 100})
+	b := NewBuffer(rep, 10)
+	sent := &events{}
+	b.Notifier = sent
+
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 10, Clicks: 1, Cost: 200})
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 5, Clicks: 2, Cost: 300})
+	b.Add(ctx, r.Data{Date: "2021-01-02", Views: 7})
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// как после трех последовательных AddStat
+	if got, _ := rep.FindByDate(ctx, "2021-01-01"); got != (r.Data{Date: "2021-01-01", Views: 16, Clicks: 4, Cost: 300}) {
+		t.Fatalf("got %+v", got)
+	}
+	if got, _ := rep.FindByDate(ctx, "2021-01-02"); got.Views != 7 {
+		t.Fatalf("got %+v", got)
+	}
+	if rep.batches != 1 || len(*sent) != 2 {
+		t.Fatalf("got %d batches and %d events; expected 1 and 2", rep.batches, len(*sent))
+	}
+	if stats := b.Stats(); stats.Accepted != 3 || stats.Flushes != 1 || stats.Pending != 0 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	ctx := context.Background()
+	b := NewBuffer(r.NewMemoryDB(), 2)
+	b.Add(ctx, r.Data{Date: "2021-01-01"})
+	b.Add(ctx, r.Data{Date: "2021-01-02"})
+	if err := b.Add(ctx, r.Data{Date: "2021-01-03"}); err != ErrFull {
+		t.Fatalf("new date in full buffer: got %v; expected %v", err, ErrFull)
+	}
+	// приращение за уже ожидающую дату не занимает места
+	if err := b.Add(ctx, r.Data{Date: "2021-01-02", Views: 1}); err != nil {
+		t.Fatalf("pending date in full buffer: got %v", err)
+	}
+	if stats := b.Stats(); stats.Rejected != 1 || stats.Pending != 2 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestBufferRequeue(t *testing.T) {
+	ctx := context.Background()
+	rep := &failingDB{MemoryDB: r.NewMemoryDB(), fail: true}
+	b := NewBuffer(rep, 10)
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 1, Cost: 100})
+	if err := b.Flush(ctx); err == nil {
+		t.Fatal("expected batch error")
+	}
+	// приращение, пришедшее после неудачной записи, применяется после нее
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 2, Cost: 200})
+	rep.fail = false
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := rep.FindByDate(ctx, "2021-01-01"); got.Views != 3 || got.Cost != 200 {
+		t.Fatalf("got %+v; expected 3 views and cost 200", got)
+	}
+	if stats := b.Stats(); stats.Failures != 1 || stats.Flushes != 1 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+// Пакет нетранзакционного репозитория за оберткой не возвращается
+// в буфер: записанная часть при повторе была бы учтена дважды
+func TestBufferNonTransactional(t *testing.T) {
+	ctx := context.Background()
+	rep := &partialDB{MemoryDB: r.NewMemoryDB(), fail: "2021-01-02"}
+	b := NewBuffer(r.NewCachedStats(rep, time.Minute, 10, 100), 10)
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 1})
+	b.Add(ctx, r.Data{Date: "2021-01-02", Views: 1})
+	if err := b.Flush(ctx); err == nil {
+		t.Fatal("expected storage error")
+	}
+	if stats := b.Stats(); stats.Pending != 0 || stats.Failures != 1 {
+		t.Fatalf("got %+v; expected batch not requeued", stats)
+	}
+	rep.fail = ""
+	b.Flush(ctx)
+	if got, _ := rep.FindByDate(ctx, "2021-01-01"); got.Views != 1 {
+		t.Fatalf("got %+v; expected 1 view", got)
+	}
+}
+
+// Возвращаемый в буфер пакет не превышает MaxDates
+func TestBufferRequeueFull(t *testing.T) {
+	ctx := context.Background()
+	rep := &failingDB{MemoryDB: r.NewMemoryDB(), fail: true}
+	b := NewBuffer(rep, 2)
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 1})
+	b.Add(ctx, r.Data{Date: "2021-01-02", Views: 1})
+	// пока пакет записывается, буфер заполняют новые даты
+	rep.during = func() {
+		rep.during = nil
+		b.Add(ctx, r.Data{Date: "2021-01-02", Views: 2})
+		b.Add(ctx, r.Data{Date: "2021-01-03", Views: 3})
+	}
+	if err := b.Flush(ctx); err == nil {
+		t.Fatal("expected batch error")
+	}
+	if stats := b.Stats(); stats.Pending != 2 {
+		t.Fatalf("got %+v; expected 2 pending dates", stats)
+	}
+	rep.fail = false
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := rep.FindByDate(ctx, "2021-01-02"); got.Views != 3 {
+		t.Fatalf("got %+v; expected coalesced 3 views", got)
+	}
+	if _, err := rep.FindByDate(ctx, "2021-01-01"); err == nil {
+		t.Fatal("2021-01-01: expected date dropped from full buffer")
+	}
+}
+
+func TestBufferRun(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	b := NewBuffer(rep, 4)
+	b.Interval = time.Hour
+
+	workers, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		b.Run(workers)
+		close(done)
+	}()
+
+	// заполнение FlushSize запускает запись, не дожидаясь Interval
+	b.Add(ctx, r.Data{Date: "2021-01-01"})
+	b.Add(ctx, r.Data{Date: "2021-01-02"})
+	deadline := time.Now().Add(time.Second)
+	for b.Stats().Flushes == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch was not written after FlushSize dates")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// остаток записывается при остановке
+	b.Add(ctx, r.Data{Date: "2021-01-03", Views: 1})
+	stop()
+	<-done
+	if got, err := rep.FindByDate(ctx, "2021-01-03"); err != nil || got.Views != 1 {
+		t.Fatalf("got %+v, %v after stop; expected flushed row", got, err)
+	}
+}
+
+func TestBufferTenants(t *testing.T) {
+	db := r.NewMemoryDB()
+	acme := r.WithTenant(context.Background(), "acme")
+	globex := r.WithTenant(context.Background(), "globex")
+	db.StoreTenant(acme, r.Tenant{Name: "acme", MaxRows: 1})
+	b := NewBuffer(r.NewQuotaStats(db, db, 0), 10)
+
+	b.Add(acme, r.Data{Date: "2021-01-01", Views: 1})
+	b.Add(globex, r.Data{Date: "2021-01-01", Views: 10})
+	b.Add(globex, r.Data{Date: "2021-01-01", Views: 5})
+	// вторая дата acme превышает квоту и отбрасывается, первая
+	// и пакет globex записываются
+	b.Add(acme, r.Data{Date: "2021-01-02", Views: 1})
+	if err := b.Flush(context.Background()); err != r.ErrQuotaExceeded {
+		t.Fatalf("got %v; expected %v", err, r.ErrQuotaExceeded)
+	}
+	if got, _ := db.FindByDate(globex, "2021-01-01"); got.Views != 15 {
+		t.Fatalf("globex: got %+v; expected 15 views", got)
+	}
+	if got, _ := db.FindByDate(acme, "2021-01-01"); got.Views != 1 {
+		t.Fatalf("acme: got %+v; expected 1 view", got)
+	}
+	if _, err := db.FindByDate(acme, "2021-01-02"); err == nil {
+		t.Fatal("acme: expected date over quota dropped")
+	}
+	if stats := b.Stats(); stats.Pending != 0 || stats.Failures != 1 || stats.Flushes != 2 {
+		t.Fatalf("got %+v; expected dropped acme date", stats)
+	}
+}
+
+// Новые даты сверх квоты не откатывают транзакцию: приращения
+// уже записанных дат пакета записываются
+func TestBufferQuotaTransactional(t *testing.T) {
+	ctx := r.WithTenant(context.Background(), "acme")
+	db, err := r.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	if _, err := db.Migrate(ctx, r.LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	db.StoreTenant(ctx, r.Tenant{Name: "acme", MaxRows: 1})
+	db.Storage(ctx, r.Data{Date: "2021-01-01", Views: 1})
+	b := NewBuffer(r.NewQuotaStats(db, db, 0), 10)
+
+	b.Add(ctx, r.Data{Date: "2021-01-01", Views: 2})
+	b.Add(ctx, r.Data{Date: "2021-01-02", Views: 1})
+	b.Add(ctx, r.Data{Date: "2021-01-03", Views: 1})
+	if err := b.Flush(ctx); err != r.ErrQuotaExceeded {
+		t.Fatalf("got %v; expected %v", err, r.ErrQuotaExceeded)
+	}
+	if got, _ := db.FindByDate(ctx, "2021-01-01"); got.Views != 3 {
+		t.Fatalf("got %+v; expected increment of existing date written", got)
+	}
+	if count, _ := db.CountStats(ctx); count != 1 {
+		t.Fatalf("got %d dates; expected new dates over quota dropped", count)
+	}
+	if stats := b.Stats(); stats.Pending != 0 {
+		t.Fatalf("got %+v; expected nothing requeued", stats)
+	}
+}
@@ -0,0 +1,381 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"statistics/pkg/logging"
+)
+
+// Алгоритмы подписи токенов
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Key открытый ключ проверки подписи: *rsa.PublicKey для RS256
+// или *ecdsa.PublicKey на кривой P-256 для ES256
+type Key struct {
+	ID        string
+	Algorithm string
+	Public    crypto.PublicKey
+}
+
+// KeySet набор ключей JWKS
+type KeySet struct {
+	Keys []Key
+}
+
+// NewKeySet возвращает набор ключей. Алгоритм ключа без Algorithm
+// определяется по типу открытого ключа
+func NewKeySet(keys ...Key) *KeySet {
+	set := &KeySet{}
+	for _, key := range keys {
+		if key.Algorithm == "" {
+			key.Algorithm = algorithm(key.Public)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return set
+}
+
+func algorithm(public crypto.PublicKey) string {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return RS256
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return ES256
+		}
+	}
+	return ""
+}
+
+// Find возвращает ключ kid для алгоритма alg. Токен без kid
+// проверяется единственным ключом алгоритма
+func (s *KeySet) Find(kid, alg string) (Key, bool) {
+	var found []Key
+	for _, key := range s.Keys {
+		if key.Algorithm == alg && (kid == "" || key.ID == kid) {
+			found = append(found, key)
+		}
+	}
+	if len(found) != 1 {
+		return Key{}, false
+	}
+	return found[0], true
+}
+
+// jwk ключ в формате JSON Web Key (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// ParseJWKS разбирает набор ключей {"keys": [...]}. Ключи шифрования
+// (use=enc) и ключи других типов и алгоритмов пропускаются
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("jwt: parse JWKS: %w", err)
+	}
+	set := &KeySet{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("jwt: parse JWKS key %q: %w", k.Kid, err)
+		}
+		if key.Algorithm == "" || (k.Alg != "" && k.Alg != key.Algorithm) {
+			continue
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return set, nil
+}
+
+func (k jwk) key() (Key, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return Key{}, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return Key{}, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return Key{}, errors.New("bad RSA exponent")
+		}
+		return Key{ID: k.Kid, Algorithm: RS256, Public: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return Key{ID: k.Kid}, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return Key{}, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return Key{}, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return Key{}, errors.New("point is not on P-256")
+		}
+		return Key{ID: k.Kid, Algorithm: ES256, Public: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	}
+	return Key{ID: k.Kid}, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func encodeInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// MarshalJSON записывает набор в формате JWKS
+func (s *KeySet) MarshalJSON() ([]byte, error) {
+	keys := []jwk{}
+	for _, key := range s.Keys {
+		k := jwk{Kid: key.ID, Use: "sig", Alg: key.Algorithm}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			k.Kty = "RSA"
+			k.N = encodeInt(public.N, 0)
+			k.E = encodeInt(big.NewInt(int64(public.E)), 0)
+		case *ecdsa.PublicKey:
+			k.Kty, k.Crv = "EC", "P-256"
+			k.X = encodeInt(public.X, 32)
+			k.Y = encodeInt(public.Y, 32)
+		default:
+			return nil, fmt.Errorf("jwt: unsupported key type %T", key.Public)
+		}
+		keys = append(keys, k)
+	}
+	return json.Marshal(map[string][]jwk{"keys": keys})
+}
+
+// KeySource источник ключей проверки подписи
+type KeySource interface {
+	Key(ctx context.Context, kid, alg string) (Key, error)
+}
+
+// Key is part of KeySource
+func (s *KeySet) Key(ctx context.Context, kid, alg string) (Key, error) {
+	if key, ok := s.Find(kid, alg); ok {
+		return key, nil
+	}
+	return Key{}, ErrUnknownKey
+}
+
+// JWKS набор ключей, загружаемый из файла или по URL. Набор кэшируется
+// на Refresh и загружается заново раньше, если токен подписан
+// неизвестным ключом (ротация ключей). Загрузки выполняются не чаще
+// MinRefresh, в том числе пока набор не загружен ни разу, и без блокировки
+// проверки токенов: одновременные запросы ждут одной загрузки, каждый
+// не дольше своего контекста. Загрузка не зависит от контекстов запросов
+// и прерывается через Timeout. При ошибке загрузки используется прежний набор
+type JWKS struct {
+	// Source файл или URL набора, для журнала
+	Source string
+	// Refresh время жизни загруженного набора
+	Refresh time.Duration
+	// MinRefresh наименьший интервал между загрузками
+	MinRefresh time.Duration
+	// Timeout наибольшее время загрузки
+	Timeout time.Duration
+
+	load func(ctx context.Context) ([]byte, error)
+	now  func() time.Time
+
+	mu      sync.Mutex
+	set     *KeySet
+	loaded  time.Time
+	attempt time.Time
+	// flight выполняющаяся загрузка, nil - загрузки нет
+	flight *flight
+}
+
+// flight загрузка набора, результат которой ждут одновременные запросы
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+func newJWKS(source string, load func(ctx context.Context) ([]byte, error)) *JWKS {
+	return &JWKS{
+		Source:     source,
+		Refresh:    5 * time.Minute,
+		MinRefresh: 30 * time.Second,
+		Timeout:    10 * time.Second,
+		load:       load,
+		now:        time.Now,
+	}
+}
+
+// NewFileJWKS возвращает набор ключей из файла path
+func NewFileJWKS(path string) *JWKS {
+	return newJWKS(path, func(ctx context.Context) ([]byte, error) {
+		return ioutil.ReadFile(path)
+	})
+}
+
+// maxJWKSBytes наибольший размер набора, загружаемого по URL
+const maxJWKSBytes = 1 << 20
+
+// NewURLJWKS возвращает набор ключей, загружаемый GET запросом по url.
+// Ответ больше 1 МиБ считается ошибкой
+func NewURLJWKS(url string, client *http.Client) *JWKS {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return newJWKS(url, func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("jwt: JWKS %s: %s", url, resp.Status)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes+1))
+		if err == nil && len(data) > maxJWKSBytes {
+			return nil, fmt.Errorf("jwt: JWKS %s is larger than %d bytes", url, maxJWKSBytes)
+		}
+		return data, err
+	})
+}
+
+// Load загружает набор ключей, не дожидаясь истечения Refresh
+func (j *JWKS) Load(ctx context.Context) error {
+	return j.reload(ctx)
+}
+
+// reload начинает загрузку набора, если он не загружается, и ждет
+// ее результата не дольше ctx. Отмена ctx не прерывает загрузку,
+// которую ждут другие запросы
+func (j *JWKS) reload(ctx context.Context) error {
+	j.mu.Lock()
+	f := j.flight
+	if f == nil {
+		f = &flight{done: make(chan struct{})}
+		j.flight = f
+		j.attempt = j.now()
+		go j.fetch(f)
+	}
+	j.mu.Unlock()
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetch выполняет загрузку f вне mu на собственном контексте с Timeout
+func (j *JWKS) fetch(f *flight) {
+	ctx, cancel := context.WithTimeout(context.Background(), j.Timeout)
+	defer cancel()
+	data, err := j.load(ctx)
+	var set *KeySet
+	if err == nil {
+		set, err = ParseJWKS(data)
+	}
+
+	j.mu.Lock()
+	if err == nil {
+		j.set, j.loaded = set, j.attempt
+	}
+	j.flight = nil
+	j.mu.Unlock()
+	f.err = err
+	close(f.done)
+	if err == nil {
+		logging.Debug(ctx, "JWKS loaded", "source", j.Source, "keys", len(set.Keys))
+	}
+}
+
+// state возвращает загруженный набор, время его загрузки
+// и время последней попытки загрузки
+func (j *JWKS) state() (*KeySet, time.Time, time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.set, j.loaded, j.attempt
+}
+
+// throttled проверяет, что с последней попытки загрузки к now
+// не прошло MinRefresh
+func (j *JWKS) throttled(now, attempt time.Time) bool {
+	return !attempt.IsZero() && now.Sub(attempt) < j.MinRefresh
+}
+
+// Key is part of KeySource
+func (j *JWKS) Key(ctx context.Context, kid, alg string) (Key, error) {
+	now := j.now()
+	set, loaded, attempt := j.state()
+	if (set == nil || now.Sub(loaded) >= j.Refresh) && !j.throttled(now, attempt) {
+		if err := j.reload(ctx); err != nil {
+			logging.Warn(ctx, "JWKS is not loaded", "source", j.Source, "err", err)
+		}
+		set, _, attempt = j.state()
+	}
+	if set == nil {
+		return Key{}, ErrKeysUnavailable
+	}
+	if key, ok := set.Find(kid, alg); ok {
+		return key, nil
+	}
+	// ключ мог появиться после ротации
+	if j.throttled(now, attempt) {
+		return Key{}, ErrUnknownKey
+	}
+	if err := j.reload(ctx); err != nil {
+		logging.Warn(ctx, "JWKS is not loaded", "source", j.Source, "err", err)
+	}
+	set, _, _ = j.state()
+	if key, ok := set.Find(kid, alg); ok {
+		return key, nil
+	}
+	return Key{}, ErrUnknownKey
+}
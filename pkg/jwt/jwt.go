@@ -0,0 +1,221 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Ошибки проверки токена
+var (
+	ErrMalformed       = errors.New("jwt: malformed token")
+	ErrAlgorithm       = errors.New("jwt: unsupported algorithm")
+	ErrUnknownKey      = errors.New("jwt: unknown signing key")
+	ErrKeysUnavailable = errors.New("jwt: signing keys are not loaded")
+	ErrSignature       = errors.New("jwt: invalid signature")
+	ErrExpired         = errors.New("jwt: token is expired")
+	ErrNotYetValid     = errors.New("jwt: token is not valid yet")
+	ErrIssuer          = errors.New("jwt: invalid issuer")
+	ErrAudience        = errors.New("jwt: invalid audience")
+)
+
+// Claims утверждения токена
+type Claims map[string]interface{}
+
+// String возвращает строковое утверждение name, пустое при отсутствии
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings возвращает утверждение name - массив строк
+// или строку со значениями через пробел (как scope в OAuth 2.0)
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		result := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// Time возвращает утверждение name - время в секундах Unix (NumericDate)
+func (c Claims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec, frac := int64(f), f-float64(int64(f))
+	return time.Unix(sec, int64(frac*1e9)), true
+}
+
+// header заголовок токена
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Validator проверяет подписанные RS256 и ES256 токены (JWS compact).
+// Токен обязан содержать exp; iss и aud проверяются, если заданы
+type Validator struct {
+	Keys KeySource
+	// Issuer ожидаемый iss, пустой - не проверяется
+	Issuer string
+	// Audience ожидаемое значение aud, пустое - не проверяется
+	Audience string
+	// Leeway допустимое расхождение часов при проверке exp и nbf
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+// NewValidator возвращает проверку токенов ключами keys
+func NewValidator(keys KeySource) *Validator {
+	return &Validator{Keys: keys, Leeway: time.Minute, now: time.Now}
+}
+
+// Validate проверяет подпись и сроки токена и возвращает его утверждения
+func (v *Validator) Validate(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	if h.Alg != RS256 && h.Alg != ES256 {
+		return nil, ErrAlgorithm
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	key, err := v.Keys.Key(ctx, h.Kid, h.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if !verify(key, parts[0]+"."+parts[1], sig) {
+		return nil, ErrSignature
+	}
+	claims := Claims{}
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	return claims, v.check(claims)
+}
+
+// check проверяет сроки, издателя и получателя токена
+func (v *Validator) check(claims Claims) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	exp, ok := claims.Time("exp")
+	if !ok || !now.Before(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return ErrIssuer
+	}
+	if v.Audience != "" {
+		for _, aud := range claims.Strings("aud") {
+			if aud == v.Audience {
+				return nil
+			}
+		}
+		return ErrAudience
+	}
+	return nil
+}
+
+func decodeJSON(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// verify проверяет подпись signed ключом key
+func verify(key Key, signed string, sig []byte) bool {
+	sum := sha256.Sum256([]byte(signed))
+	switch public := key.Public.(type) {
+	case *rsa.PublicKey:
+		return key.Algorithm == RS256 && rsa.VerifyPKCS1v15(public, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// подпись ES256 - r и s по 32 байта (RFC 7518, 3.4)
+		if key.Algorithm != ES256 || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(public, sum[:], r, s)
+	}
+	return false
+}
+
+// Sign подписывает утверждения закрытым ключом *rsa.PrivateKey (RS256)
+// или *ecdsa.PrivateKey на P-256 (ES256) с идентификатором kid.
+// Нужен для проверки сервиса с локально созданными ключами
+func Sign(claims Claims, private crypto.Signer, kid string) (string, error) {
+	alg := algorithm(private.Public())
+	if alg == "" {
+		return "", ErrAlgorithm
+	}
+	head, err := json.Marshal(header{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		return "", fmt.Errorf("jwt: unsupported key type %T", private)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,370 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func ecKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sign(t *testing.T, claims Claims, key crypto.Signer, kid string) string {
+	t.Helper()
+	token, err := Sign(claims, key, kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidate(t *testing.T) {
+	rsaPriv, ecPriv, other := rsaKey(t), ecKey(t), ecKey(t)
+	keys := NewKeySet(Key{ID: "rsa", Public: &rsaPriv.PublicKey}, Key{ID: "ec", Public: &ecPriv.PublicKey})
+	now := time.Unix(1700000000, 0)
+	v := NewValidator(keys)
+	v.Issuer = "https://sso.example.com"
+	v.Audience = "statistics"
+	v.now = func() time.Time { return now }
+
+	claims := func(extra Claims) Claims {
+		c := Claims{
+			"sub": "alice",
+			"iss": "https://sso.example.com",
+			"aud": []string{"portal", "statistics"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, value := range extra {
+			if value == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = value
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"RS256", sign(t, claims(nil), rsaPriv, "rsa"), nil},
+		{"ES256", sign(t, claims(nil), ecPriv, "ec"), nil},
+		{"audience string", sign(t, claims(Claims{"aud": "statistics"}), ecPriv, "ec"), nil},
+		{"leeway", sign(t, claims(Claims{"exp": now.Add(-30 * time.Second).Unix()}), ecPriv, "ec"), nil},
+		{"expired", sign(t, claims(Claims{"exp": now.Add(-2 * time.Minute).Unix()}), ecPriv, "ec"), ErrExpired},
+		{"no exp", sign(t, claims(Claims{"exp": nil}), ecPriv, "ec"), ErrExpired},
+		{"nbf", sign(t, claims(Claims{"nbf": now.Add(time.Hour).Unix()}), ecPriv, "ec"), ErrNotYetValid},
+		{"issuer", sign(t, claims(Claims{"iss": "https://evil.example.com"}), ecPriv, "ec"), ErrIssuer},
+		{"audience", sign(t, claims(Claims{"aud": "billing"}), ecPriv, "ec"), ErrAudience},
+		{"unknown kid", sign(t, claims(nil), ecPriv, "old"), ErrUnknownKey},
+		{"wrong key", sign(t, claims(nil), other, "ec"), ErrSignature},
+		{"kid of other alg", sign(t, claims(nil), ecPriv, "rsa"), ErrUnknownKey},
+		{"malformed", "a.b", ErrMalformed},
+		{"bad base64", "!!.e30.e30", ErrMalformed},
+		// подпись HMAC открытым ключом не принимается
+		{"HS256", "eyJhbGciOiJIUzI1NiJ9.e30.c2ln", ErrAlgorithm},
+		{"none", "eyJhbGciOiJub25lIn0.e30.", ErrAlgorithm},
+	} {
+		got, err := v.Validate(context.Background(), tc.token)
+		if err != tc.err {
+			t.Errorf("%s: got %v; expected %v", tc.name, err, tc.err)
+			continue
+		}
+		if err == nil && got.String("sub") != "alice" {
+			t.Errorf("%s: got claims %v", tc.name, got)
+		}
+	}
+
+	// измененные утверждения не проходят проверку подписи
+	token := sign(t, claims(nil), ecPriv, "ec")
+	parts := strings.Split(token, ".")
+	forged := sign(t, claims(Claims{"sub": "root"}), other, "ec")
+	parts[1] = strings.Split(forged, ".")[1]
+	if _, err := v.Validate(context.Background(), strings.Join(parts, ".")); err != ErrSignature {
+		t.Fatalf("got %v; expected %v", err, ErrSignature)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	c := Claims{}
+	if err := decodeJSON("eyJzY29wZSI6InN0YXRzOnJlYWQgYWRtaW4iLCJncm91cHMiOlsiYSIsMSwiYiJdLCJleHAiOjEuNX0", &c); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(c.Strings("scope"), ","); got != "stats:read,admin" {
+		t.Fatalf("scope %q", got)
+	}
+	if got := strings.Join(c.Strings("groups"), ","); got != "a,b" {
+		t.Fatalf("groups %q", got)
+	}
+	if exp, ok := c.Time("exp"); !ok || !exp.Equal(time.Unix(1, 5e8)) {
+		t.Fatalf("exp %v, %v", exp, ok)
+	}
+	if c.String("missing") != "" || c.Strings("missing") != nil {
+		t.Fatal("expected empty values")
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaPriv, ecPriv := rsaKey(t), ecKey(t)
+	data, err := json.Marshal(NewKeySet(Key{ID: "rsa", Public: &rsaPriv.PublicKey}, Key{ID: "ec", Public: &ecPriv.PublicKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ключи шифрования, других кривых и типов пропускаются
+	var doc map[string][]map[string]string
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["keys"] = append(doc["keys"],
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		map[string]string{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA"},
+		map[string]string{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	)
+	data, _ = json.Marshal(doc)
+
+	set, err := ParseJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("got %d keys; expected 2", len(set.Keys))
+	}
+	gotRSA, ok := set.Find("rsa", RS256)
+	if !ok || gotRSA.Public.(*rsa.PublicKey).N.Cmp(rsaPriv.N) != 0 {
+		t.Fatalf("rsa key %+v", gotRSA)
+	}
+	gotEC, ok := set.Find("ec", ES256)
+	if !ok || !gotEC.Public.(*ecdsa.PublicKey).Equal(&ecPriv.PublicKey) {
+		t.Fatalf("ec key %+v", gotEC)
+	}
+	// без kid выбирается единственный ключ алгоритма
+	if key, ok := set.Find("", ES256); !ok || key.ID != "ec" {
+		t.Fatalf("got %+v", key)
+	}
+
+	for _, bad := range []string{
+		`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "RSA", "n": "", "e": "AQAB"}]}`,
+		`not json`,
+	} {
+		if _, err := ParseJWKS([]byte(bad)); err == nil {
+			t.Errorf("ParseJWKS(%s) accepted", bad)
+		}
+	}
+}
+
+func TestFileJWKS(t *testing.T) {
+	oldKey, newKey := ecKey(t), ecKey(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	write := func(keys ...Key) {
+		data, err := json.Marshal(NewKeySet(keys...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(Key{ID: "old", Public: &oldKey.PublicKey})
+
+	now := time.Unix(1700000000, 0)
+	jwks := NewFileJWKS(path)
+	jwks.now = func() time.Time { return now }
+	ctx := context.Background()
+	if _, err := jwks.Key(ctx, "old", ES256); err != nil {
+		t.Fatal(err)
+	}
+
+	// ротация: новый ключ загружается при первом токене с ним,
+	// но не чаще MinRefresh
+	write(Key{ID: "old", Public: &oldKey.PublicKey}, Key{ID: "new", Public: &newKey.PublicKey})
+	if _, err := jwks.Key(ctx, "new", ES256); err != ErrUnknownKey {
+		t.Fatalf("got %v; expected %v", err, ErrUnknownKey)
+	}
+	now = now.Add(jwks.MinRefresh)
+	if _, err := jwks.Key(ctx, "new", ES256); err != nil {
+		t.Fatal(err)
+	}
+
+	// при ошибке загрузки остается прежний набор
+	if err := ioutil.WriteFile(path, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(jwks.Refresh)
+	if _, err := jwks.Key(ctx, "new", ES256); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.Load(ctx); err == nil {
+		t.Fatal("expected error of broken JWKS")
+	}
+
+	missing := NewFileJWKS(filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := missing.Key(ctx, "old", ES256); err != ErrKeysUnavailable {
+		t.Fatalf("got %v; expected %v", err, ErrKeysUnavailable)
+	}
+}
+
+// Недоступный набор загружается не чаще MinRefresh,
+// а загрузка не блокирует проверку токенов
+func TestJWKSThrottle(t *testing.T) {
+	ctx := context.Background()
+	var loads int32
+	release := make(chan struct{})
+	jwks := newJWKS("test", func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return nil, errors.New("unavailable")
+	})
+	now := time.Unix(1700000000, 0)
+	jwks.now = func() time.Time { return now }
+
+	errs := make(chan error, 1)
+	go func() { errs <- jwks.Load(ctx) }()
+	for atomic.LoadInt32(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// проверка токена во время загрузки не ждет ее и не начинает новую
+	if _, err := jwks.Key(ctx, "k1", RS256); err != ErrKeysUnavailable {
+		t.Fatalf("got %v; expected %v", err, ErrKeysUnavailable)
+	}
+	close(release)
+	if err := <-errs; err == nil {
+		t.Fatal("expected load error")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := jwks.Key(ctx, "k1", RS256); err != ErrKeysUnavailable {
+			t.Fatalf("got %v; expected %v", err, ErrKeysUnavailable)
+		}
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("got %d loads; expected no reload within MinRefresh", n)
+	}
+	now = now.Add(jwks.MinRefresh)
+	jwks.Key(ctx, "k1", RS256)
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Fatalf("got %d loads; expected reload after MinRefresh", n)
+	}
+}
+
+// Отмена контекста запроса не прерывает общую загрузку набора
+func TestJWKSCanceledWaiter(t *testing.T) {
+	key := rsaKey(t)
+	data, err := json.Marshal(NewKeySet(Key{ID: "k1", Public: &key.PublicKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads int32
+	release := make(chan struct{})
+	jwks := newJWKS("test", func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		select {
+		case <-release:
+			return data, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- jwks.Load(ctx) }()
+	for atomic.LoadInt32(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("got %v; expected %v", err, context.Canceled)
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := jwks.Key(context.Background(), "k1", RS256)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v; expected keys loaded after the request was canceled", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("got %d loads; expected 1", n)
+	}
+}
+
+func TestURLJWKS(t *testing.T) {
+	key := rsaKey(t)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(NewKeySet(Key{ID: "k1", Public: &key.PublicKey}))
+	}))
+	defer srv.Close()
+
+	now := time.Unix(1700000000, 0)
+	jwks := NewURLJWKS(srv.URL, nil)
+	jwks.now = func() time.Time { return now }
+	v := NewValidator(jwks)
+	v.now = jwks.now
+	token := sign(t, Claims{"sub": "bob", "exp": now.Add(time.Hour).Unix()}, key, "k1")
+	for i := 0; i < 3; i++ {
+		if _, err := v.Validate(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("got %d requests; expected cached JWKS", n)
+	}
+	now = now.Add(jwks.Refresh)
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("got %d requests; expected refresh after %s", n, jwks.Refresh)
+	}
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	if err := NewURLJWKS(failing.URL, nil).Load(context.Background()); err == nil || errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v; expected HTTP error", err)
+	}
+
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(make([]byte, maxJWKSBytes+1))
+	}))
+	defer large.Close()
+	if err := NewURLJWKS(large.URL, nil).Load(context.Background()); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("got %v; expected size error", err)
+	}
+}
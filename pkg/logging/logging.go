@@ -0,0 +1,261 @@
+// Package logging структурированный журнал с уровнями в формате logfmt или JSON.
+// Идентификатор запроса передается через контекст и добавляется
+// ко всем записям, сделанным в контексте запроса
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level уровень записи журнала
+type Level int
+
+// Уровни записей по возрастанию важности
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel разбирает название уровня, пустая строка - LevelInfo
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("logging: unknown level %q", name)
+}
+
+// Форматы записей журнала
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Redacted значение, которое записывается вместо секрета
+const Redacted = "[REDACTED]"
+
+// secretKeys части ключей, значения которых не попадают в журнал
+var secretKeys = []string{"password", "secret", "token", "authorization", "api_key", "apikey"}
+
+// secret ключ записи содержит секрет
+func secret(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Logger пишет записи не ниже заданного уровня.
+// Атрибуты записи передаются парами ключ-значение
+type Logger struct {
+	mu  *sync.Mutex
+	out io.Writer
+	// level общий для журнала и журналов, полученных из него With
+	level  *int32
+	format string
+	attrs  []interface{}
+	// Now источник времени записей
+	Now func() time.Time
+}
+
+// New возвращает журнал, пишущий в out записи не ниже level
+// в формате format (FormatLogfmt или FormatJSON)
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	if format == "" {
+		format = FormatLogfmt
+	}
+	if format != FormatLogfmt && format != FormatJSON {
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+	return &Logger{mu: &sync.Mutex{}, out: out, level: newLevel(level), format: format, Now: time.Now}, nil
+}
+
+// newLevel возвращает уровень, разделяемый журналами
+func newLevel(level Level) *int32 {
+	v := int32(level)
+	return &v
+}
+
+// With возвращает журнал, добавляющий атрибуты kv ко всем записям
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.attrs = append(append([]interface{}{}, l.attrs...), kv...)
+	return &child
+}
+
+// Enabled записи уровня level попадают в журнал
+func (l *Logger) Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(l.level)
+}
+
+// SetLevel меняет уровень журнала и всех журналов, полученных из него With
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Debug пишет отладочную запись
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+
+// Info пишет информационную запись
+func (l *Logger) Info(msg string, kv ...interface{}) { l.Log(LevelInfo, msg, kv...) }
+
+// Warn пишет предупреждение
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.Log(LevelWarn, msg, kv...) }
+
+// Error пишет запись об ошибке
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log пишет запись уровня level. Значения ключей, похожих на секреты
+// (password, secret, token, ...), заменяются на Redacted
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	pairs := []interface{}{"time", l.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}
+	pairs = append(append(pairs, l.attrs...), kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(MISSING)")
+	}
+
+	var b strings.Builder
+	if l.format == FormatJSON {
+		b.WriteByte('{')
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+		value := pairs[i+1]
+		if secret(key) {
+			value = Redacted
+		}
+		if l.format == FormatJSON {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSON(&b, key)
+			b.WriteByte(':')
+			writeJSON(&b, plain(value))
+			continue
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(logfmtKey(key))
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(fmt.Sprint(plain(value))))
+	}
+	if l.format == FormatJSON {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, b.String())
+}
+
+// plain приводит значение к виду, пригодному для записи
+func plain(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func writeJSON(b *strings.Builder, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(data)
+}
+
+// logfmtKey заменяет в ключе символы, недопустимые в logfmt
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// logfmtValue заключает значение в кавычки, если оно пустое
+// или содержит пробелы, кавычки, знак равенства или управляющие символы
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r > '~' {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// Writer возвращает io.Writer, каждая строка которого пишется записью уровня level.
+// Нужен для перенаправления стандартного пакета log
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.Log(level, line)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = &Logger{mu: &sync.Mutex{}, out: os.Stderr, level: newLevel(LevelInfo), format: FormatLogfmt, Now: time.Now}
+)
+
+// Default возвращает журнал процесса
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault заменяет журнал процесса
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, level Level, format string) (*Logger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	l, err := New(out, level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Now = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return l, out
+}
+
+func TestLogfmt(t *testing.T) {
+	l, out := newTestLogger(t, LevelInfo, FormatLogfmt)
+	l.With("request_id", "abc").Info("http request", "status", 200, "path", "/stats x", "err", errors.New(`bad "value"`), "empty", "")
+	l.Debug("hidden")
+	expected := `time=2021-01-02T03:04:05Z level=info msg="http request" request_id=abc status=200 path="/stats x" err="bad \"value\"" empty=""` + "\n"
+	if out.String() != expected {
+		t.Fatalf("got %q; expected %q", out.String(), expected)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, out := newTestLogger(t, LevelDebug, FormatJSON)
+	l.Debug("GetStats returned", "body", `[{"date":"2021-01-01"}]`, "rows", 1, "odd")
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	if record["level"] != "debug" || record["body"] != `[{"date":"2021-01-01"}]` || record["rows"] != 1.0 || record["odd"] != "(MISSING)" {
+		t.Fatalf("got %v", record)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected error for unknown level")
+	}
+	if _, err := New(nil, LevelInfo, "xml"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+	level, _ := ParseLevel("WARN")
+	l, out := newTestLogger(t, level, FormatLogfmt)
+	l.Info("skipped")
+	l.Warn("written")
+	l.Error("written")
+	if n := bytes.Count(out.Bytes(), []byte("\n")); n != 2 {
+		t.Fatalf("got %d records; expected 2:\n%s", n, out.String())
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	l, out := newTestLogger(t, LevelWarn, FormatLogfmt)
+	child := l.With("request_id", "abc")
+	child.Info("skipped")
+	// уровень общий для журнала и производных от него
+	l.SetLevel(LevelDebug)
+	child.Debug("written")
+	if !bytes.Contains(out.Bytes(), []byte("written")) || bytes.Contains(out.Bytes(), []byte("skipped")) {
+		t.Fatalf("got %s", out.String())
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	l, out := newTestLogger(t, LevelInfo, FormatLogfmt)
+	l.Info("config", "MYSQL_PASSWORD", "root", "secret", "s3", "Authorization", "Bearer x", "user", "user")
+	expected := `time=2021-01-02T03:04:05Z level=info msg=config MYSQL_PASSWORD=[REDACTED] secret=[REDACTED] Authorization=[REDACTED] user=user` + "\n"
+	if out.String() != expected {
+		t.Fatalf("got %q; expected %q", out.String(), expected)
+	}
+
+	for dsn, expected := range map[string]string{
+		"user:pa:ss@tcp(mysql:3306)/stats?parseTime=True":    "user:[REDACTED]@tcp(mysql:3306)/stats?parseTime=True",
+		"app:p@ss:w0rd@tcp(db)/x":                            "app:[REDACTED]@tcp(db)/x",
+		"app:p/w@d@unix(/tmp/mysql.sock)/x?loc=a@b":          "app:[REDACTED]@unix(/tmp/mysql.sock)/x?loc=a@b",
+		"postgres://user:pass@db:5432/stats?sslmode=disable": "postgres://user:[REDACTED]@db:5432/stats?sslmode=disable",
+		"postgres://user@db:5432/stats":                      "postgres://user@db:5432/stats",
+		"statistics.db":                                      "statistics.db",
+		"file:stats.db?cache=shared":                         "file:stats.db?cache=shared",
+	} {
+		if got := RedactDSN(dsn); got != expected {
+			t.Errorf("RedactDSN(%q) = %q; expected %q", dsn, got, expected)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	l, out := newTestLogger(t, LevelInfo, FormatLogfmt)
+	defer SetDefault(Default())
+	SetDefault(l)
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	Error(ctx, "Rep. Storage", "err", "failed")
+	Info(context.Background(), "no request")
+	expected := "time=2021-01-02T03:04:05Z level=error msg=\"Rep. Storage\" request_id=req-1 err=failed\n" +
+		"time=2021-01-02T03:04:05Z level=info msg=\"no request\"\n"
+	if out.String() != expected {
+		t.Fatalf("got %q; expected %q", out.String(), expected)
+	}
+	if a, b := NewRequestID(), NewRequestID(); len(a) != 32 || a == b {
+		t.Fatalf("got request ids %q, %q", a, b)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	l, out := newTestLogger(t, LevelInfo, FormatLogfmt)
+	std := log.New(l.Writer(LevelError), "", 0)
+	std.Println("http: TLS handshake error")
+	expected := "time=2021-01-02T03:04:05Z level=error msg=\"http: TLS handshake error\"\n"
+	if out.String() != expected {
+		t.Fatalf("got %q; expected %q", out.String(), expected)
+	}
+}
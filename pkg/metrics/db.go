@@ -0,0 +1,29 @@
+package metrics
+
+import "database/sql"
+
+// RegisterDBStats регистрирует показатели пула соединений db
+func (r *Registry) RegisterDBStats(db *sql.DB) {
+	gauge := func(name, help string, fn func(s sql.DBStats) float64) {
+		r.NewGaugeFunc(name, help, func() float64 { return fn(db.Stats()) })
+	}
+	counter := func(name, help string, fn func(s sql.DBStats) float64) {
+		r.NewCounterFunc(name, help, func() float64 { return fn(db.Stats()) })
+	}
+	gauge("statistics_db_max_open_connections", "Maximum number of open connections to the database.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	gauge("statistics_db_open_connections", "Number of established connections, both in use and idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	gauge("statistics_db_in_use_connections", "Number of connections currently in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	gauge("statistics_db_idle_connections", "Number of idle connections.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+	counter("statistics_db_wait_count_total", "Total number of connections waited for.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	counter("statistics_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	counter("statistics_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) })
+	counter("statistics_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.",
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) })
+}
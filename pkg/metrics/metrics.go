@@ -0,0 +1,304 @@
+// Package metrics реализует метрики в текстовом формате Prometheus
+// (счетчики, гистограммы и значения, читаемые при выдаче)
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType тип содержимого текстового формата Prometheus
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets границы гистограммы длительностей по умолчанию, секунды
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric метрика, выводимая реестром
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry реестр метрик
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry возвращает пустой реестр
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+// register добавляет метрику. Повторная регистрация имени - ошибка программы
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	r.metrics[m.name()] = m
+}
+
+// Write выводит все метрики, упорядоченные по имени
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	list := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		list = append(list, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name() < list[j].name() })
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+// ServeHTTP отдает метрики реестра
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.Write(w)
+}
+
+// desc имя, описание и метки метрики
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d desc) name() string { return d.metricName }
+
+func (d desc) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, escapeHelp(d.help), d.metricName, typ)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+// formatLabels выводит пары меток {a="1",b="2"}, пустые пары не выводятся
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey ключ набора значений меток
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (d desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+}
+
+// CounterVec счетчики с одинаковыми метками
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+// NewCounterVec регистрирует счетчик name с метками labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name, help, labels},
+		values: map[string]float64{},
+		keys:   map[string][]string{},
+	}
+	r.register(c)
+	return c
+}
+
+// Add увеличивает счетчик с метками values на v (v >= 0)
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.check(values)
+	if v < 0 {
+		panic("metrics: counter " + c.metricName + " cannot decrease")
+	}
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = append([]string(nil), values...)
+	}
+	c.values[key] += v
+}
+
+// Inc увеличивает счетчик с метками values на 1
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value возвращает значение счетчика с метками values
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelKey(values)]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, formatLabels(c.labels, c.keys[key]), formatValue(c.values[key]))
+	}
+}
+
+func sortedKeys(keys map[string][]string) []string {
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// histogram значения одной гистограммы
+type histogram struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec гистограммы с одинаковыми метками и границами
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+// NewHistogramVec регистрирует гистограмму name с границами buckets
+// (по возрастанию, nil - DefBuckets) и метками labels
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &HistogramVec{
+		desc:    desc{name, help, labels},
+		buckets: buckets,
+		series:  map[string]*histogram{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe добавляет значение v в гистограмму с метками values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.check(values)
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Count возвращает количество значений в гистограмме с метками values
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[labelKey(values)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			values := append(append([]string(nil), s.labels...), formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(bucketLabels, values), s.counts[i])
+		}
+		values := append(append([]string(nil), s.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(bucketLabels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+// funcMetric значение, читаемое функцией при каждой выдаче
+type funcMetric struct {
+	desc
+	typ    string
+	values []string
+	fn     func() float64
+}
+
+// NewGaugeFunc регистрирует показатель name, значение которого возвращает fn.
+// labelPairs - постоянные метки парами имя, значение
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64, labelPairs ...string) {
+	r.register(newFuncMetric(name, help, "gauge", fn, labelPairs))
+}
+
+// NewCounterFunc регистрирует счетчик name, значение которого возвращает fn
+// (для счетчиков, которые ведут другие компоненты)
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64, labelPairs ...string) {
+	r.register(newFuncMetric(name, help, "counter", fn, labelPairs))
+}
+
+func newFuncMetric(name, help, typ string, fn func() float64, labelPairs []string) *funcMetric {
+	if len(labelPairs)%2 != 0 {
+		panic("metrics: odd number of label pairs for " + name)
+	}
+	m := &funcMetric{desc: desc{metricName: name, help: help}, typ: typ, fn: fn}
+	for i := 0; i < len(labelPairs); i += 2 {
+		m.labels = append(m.labels, labelPairs[i])
+		m.values = append(m.values, labelPairs[i+1])
+	}
+	return m
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	m.header(w, m.typ)
+	fmt.Fprintf(w, "%s%s %s\n", m.metricName, formatLabels(m.labels, m.values), formatValue(m.fn()))
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounterVec("requests_total", "Number of requests.", "route", "status")
+	requests.Inc("/stats", "200")
+	requests.Add(2, "/stats", "200")
+	requests.Inc(`/a"b`, "500")
+	duration := reg.NewHistogramVec("duration_seconds", "Request\nduration.", []float64{0.1, 1}, "route")
+	duration.Observe(0.05, "/stats")
+	duration.Observe(0.5, "/stats")
+	duration.Observe(5, "/stats")
+	reg.NewGaugeFunc("build_info", "Build information.", func() float64 { return 1 }, "version", "dev")
+
+	buf := &bytes.Buffer{}
+	reg.Write(buf)
+	expect := `# HELP build_info Build information.
+# TYPE build_info gauge
+build_info{version="dev"} 1
+# HELP duration_seconds Request\nduration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/stats",le="0.1"} 1
+duration_seconds_bucket{route="/stats",le="1"} 2
+duration_seconds_bucket{route="/stats",le="+Inf"} 3
+duration_seconds_sum{route="/stats"} 5.55
+duration_seconds_count{route="/stats"} 3
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/a\"b",status="500"} 1
+requests_total{route="/stats",status="200"} 3
+`
+	if buf.String() != expect {
+		t.Fatalf("got\n%s\nexpected\n%s", buf.String(), expect)
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounterVec("a_total", "A.")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate metric")
+		}
+	}()
+	reg.NewGaugeFunc("a_total", "A.", func() float64 { return 0 })
+}
@@ -0,0 +1,152 @@
+// Package ratelimit ограничение частоты запросов клиентов алгоритмом
+// token bucket: у каждого клиента свой запас запросов Burst,
+// который пополняется со скоростью Rate запросов в секунду
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval период удаления запасов простаивающих клиентов
+const sweepInterval = time.Minute
+
+// Limit скорость Rate запросов в секунду и наибольший запас Burst.
+// Нулевая Rate - без ограничения
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// burst возвращает запас, по умолчанию не меньше секунды запросов
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Max(1, math.Ceil(l.Rate)))
+}
+
+// Result результат проверки запроса. Remaining - оставшийся запас,
+// Reset - время до полного восстановления запаса, RetryAfter -
+// время до следующего разрешенного запроса, если запрос отклонен
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// bucket запас запросов клиента на момент updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter ограничивает запросы клиентов, различаемых строковым ключом
+type Limiter struct {
+	mu      sync.Mutex
+	limit   Limit
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// New возвращает ограничение limit
+func New(limit Limit) *Limiter {
+	return &Limiter{limit: limit, buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// Allow расходует запрос из запаса клиента key
+func (l *Limiter) Allow(key string) Result {
+	return l.take(key, 1)
+}
+
+// Check проверяет, есть ли у клиента key запас на запрос, не расходуя его.
+// Позволяет отклонить запрос до дорогой проверки, а расходовать запас
+// только ее неудачами
+func (l *Limiter) Check(key string) Result {
+	return l.take(key, 0)
+}
+
+// take расходует cost запросов из запаса клиента key, если запас
+// есть хотя бы на один запрос
+func (l *Limiter) take(key string, cost float64) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(l.limit.burst())
+	if l.limit.Rate <= 0 {
+		return Result{Allowed: true, Limit: int(burst), Remaining: int(burst)}
+	}
+	now := l.now()
+	l.sweep(now, burst)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*l.limit.Rate)
+	b.updated = now
+
+	result := Result{Limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens -= cost
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.duration(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = l.duration(burst - b.tokens)
+	return result
+}
+
+// Limit возвращает текущее ограничение
+func (l *Limiter) Limit() Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// SetLimit меняет ограничение. Запасы клиентов сохраняются,
+// но не превышают новый Burst
+func (l *Limiter) SetLimit(limit Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	burst := float64(limit.burst())
+	for key, b := range l.buckets {
+		b.tokens = math.Min(burst, b.tokens)
+		if limit.Rate <= 0 {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// duration возвращает время восстановления tokens запросов.
+// Вызывается под mu
+func (l *Limiter) duration(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.limit.Rate * float64(time.Second)))
+}
+
+// sweep удаляет запасы клиентов, восстановившиеся полностью:
+// они не отличаются от запасов новых клиентов. Вызывается под mu
+func (l *Limiter) sweep(now time.Time, burst float64) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.limit.Rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Clients возвращает количество клиентов с неполным запасом
+func (l *Limiter) Clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
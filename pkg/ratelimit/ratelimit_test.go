@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limit Limit) (*Limiter, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	l := New(limit)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestAllow(t *testing.T) {
+	l, now := newTestLimiter(Limit{Rate: 2, Burst: 3})
+
+	for i := 2; i >= 0; i-- {
+		res := l.Allow("a")
+		if !res.Allowed || res.Remaining != i || res.Limit != 3 {
+			t.Fatalf("request %d: got %+v", 3-i, res)
+		}
+	}
+	res := l.Allow("a")
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond || res.Reset != 1500*time.Millisecond {
+		t.Fatalf("got %+v; expected rejection", res)
+	}
+	// у другого клиента свой запас
+	if res := l.Allow("b"); !res.Allowed {
+		t.Fatalf("got %+v", res)
+	}
+
+	// запас пополняется со скоростью Rate, но не больше Burst
+	*now = now.Add(500 * time.Millisecond)
+	if res := l.Allow("a"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("got %+v", res)
+	}
+	*now = now.Add(time.Hour)
+	if res := l.Allow("a"); !res.Allowed || res.Remaining != 2 {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestDefaultBurstAndUnlimited(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 0.5})
+	if res := l.Allow("a"); !res.Allowed || res.Limit != 1 {
+		t.Fatalf("got %+v", res)
+	}
+	if res := l.Allow("a"); res.Allowed || res.RetryAfter != 2*time.Second {
+		t.Fatalf("got %+v", res)
+	}
+
+	unlimited, _ := newTestLimiter(Limit{})
+	for i := 0; i < 100; i++ {
+		if res := unlimited.Allow("a"); !res.Allowed {
+			t.Fatalf("got %+v", res)
+		}
+	}
+	if unlimited.Clients() != 0 {
+		t.Fatal("unlimited limiter must not keep clients")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l, _ := newTestLimiter(Limit{Rate: 1, Burst: 2})
+	// проверка не расходует запас
+	for i := 0; i < 5; i++ {
+		if res := l.Check("a"); !res.Allowed || res.Remaining != 2 {
+			t.Fatalf("got %+v", res)
+		}
+	}
+	l.Allow("a")
+	l.Allow("a")
+	if res := l.Check("a"); res.Allowed || res.RetryAfter != time.Second {
+		t.Fatalf("got %+v; expected rejection", res)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l, now := newTestLimiter(Limit{Rate: 1, Burst: 10})
+	for i := 0; i < 100; i++ {
+		l.Allow(strconv.Itoa(i))
+	}
+	l.Allow("busy")
+	*now = now.Add(sweepInterval - time.Second)
+	for i := 0; i < 10; i++ {
+		l.Allow("busy")
+	}
+	if n := l.Clients(); n != 101 {
+		t.Fatalf("got %d clients before sweep", n)
+	}
+	*now = now.Add(time.Second)
+	l.Allow("busy")
+	if n := l.Clients(); n != 1 {
+		t.Fatalf("got %d clients; expected only the busy one", n)
+	}
+}
+
+func TestConcurrentAllow(t *testing.T) {
+	l := New(Limit{Rate: 0.001, Burst: 50})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if l.Allow("a").Allowed {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 50 {
+		t.Fatalf("got %d allowed requests; expected burst of 50", allowed)
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	l, now := newTestLimiter(Limit{Rate: 1, Burst: 10})
+	for i := 0; i < 5; i++ {
+		l.Allow("a")
+	}
+	// запас клиента урезается до нового Burst
+	l.SetLimit(Limit{Rate: 1, Burst: 2})
+	if res := l.Allow("a"); !res.Allowed || res.Remaining != 1 || res.Limit != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	if l.Limit() != (Limit{Rate: 1, Burst: 2}) {
+		t.Fatalf("got limit %+v", l.Limit())
+	}
+	// снятое ограничение не хранит клиентов
+	l.SetLimit(Limit{})
+	if res := l.Allow("a"); !res.Allowed || l.Clients() != 0 {
+		t.Fatalf("got %+v with %d clients", res, l.Clients())
+	}
+	*now = now.Add(time.Second)
+	l.SetLimit(Limit{Rate: 1, Burst: 1})
+	if res := l.Allow("a"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("got %+v", res)
+	}
+}
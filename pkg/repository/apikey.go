@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// APIKeyRepository интерфейс, описывающий возможные
+// действия с ключами API и журналом аудита
+type APIKeyRepository interface {
+	StoreAPIKey(ctx context.Context, key APIKey) (int64, error)
+	FindAPIKey(ctx context.Context, prefix string) (APIKey, error)
+	FindAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int64, at time.Time) error
+	StoreAudit(ctx context.Context, entry AuditEntry) (int64, error)
+	FindAudit(ctx context.Context, limit int) ([]AuditEntry, error)
+}
+
+// APIKey ключ API. Хранится только хэш ключа Hash, ключ ищется
+// по открытой части Prefix. Tenant - арендатор, данные которого доступны
+// с ключом. Revoked - время отзыва, нулевое у действующего ключа
+type APIKey struct {
+	ID      int64
+	Name    string
+	Tenant  string
+	Prefix  string
+	Hash    string
+	Scopes  []string
+	Created time.Time
+	Revoked time.Time
+}
+
+// AuditEntry запись журнала аудита: изменяющий запрос и ключ, которым он выполнен
+type AuditEntry struct {
+	ID        int64
+	KeyID     int64
+	KeyName   string
+	Method    string
+	Path      string
+	Status    int
+	RequestID string
+	Created   time.Time
+}
+
+// StoreAPIKey записывает ключ и возвращает его идентификатор
+func (h *StatsDB) StoreAPIKey(ctx context.Context, key APIKey) (int64, error) {
+	id, err := h.insert(ctx,
+		"INSERT INTO api_key (name, tenant, prefix, hash, scopes, created) VALUES (?, ?, ?, ?, ?, ?);",
+		key.Name,
+		key.Tenant,
+		key.Prefix,
+		key.Hash,
+		strings.Join(key.Scopes, " "),
+		key.Created.UTC(),
+	)
+	return id, checkError(ctx, "StoreAPIKey", err)
+}
+
+const apiKeyColumns = "id, name, tenant, prefix, hash, scopes, created, revoked"
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	key := APIKey{}
+	var scopes string
+	var revoked sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &key.Tenant, &key.Prefix, &key.Hash, &scopes, &key.Created, &revoked)
+	key.Scopes = strings.Fields(scopes)
+	if revoked.Valid {
+		key.Revoked = revoked.Time
+	}
+	return key, err
+}
+
+// FindAPIKey находит ключ по открытой части
+func (h *StatsDB) FindAPIKey(ctx context.Context, prefix string) (APIKey, error) {
+	key, err := scanAPIKey(h.queryRow(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_key WHERE prefix = ?;", prefix))
+	if err == sql.ErrNoRows {
+		return key, ErrNotFound
+	}
+	return key, checkError(ctx, "FindAPIKey", err)
+}
+
+// FindAPIKeys возвращает все ключи, включая отозванные
+func (h *StatsDB) FindAPIKeys(ctx context.Context) ([]APIKey, error) {
+	result := []APIKey{}
+	rows, err := h.query(ctx, "SELECT "+apiKeyColumns+" FROM api_key ORDER BY id;")
+	if err != nil {
+		return nil, checkError(ctx, "FindAPIKeys", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, checkError(ctx, "FindAPIKeys", err)
+		}
+		result = append(result, key)
+	}
+	return result, checkError(ctx, "FindAPIKeys", rows.Err())
+}
+
+// RevokeAPIKey отзывает ключ. Время отзыва уже отозванного ключа не меняется
+func (h *StatsDB) RevokeAPIKey(ctx context.Context, id int64, at time.Time) error {
+	var revoked sql.NullTime
+	err := h.queryRow(ctx, "SELECT revoked FROM api_key WHERE id = ?;", id).Scan(&revoked)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil || revoked.Valid {
+		return checkError(ctx, "RevokeAPIKey", err)
+	}
+	_, err = h.exec(ctx, "UPDATE api_key SET revoked = ? WHERE id = ?;", at.UTC(), id)
+	return checkError(ctx, "RevokeAPIKey", err)
+}
+
+// StoreAudit записывает запись журнала аудита и возвращает ее идентификатор
+func (h *StatsDB) StoreAudit(ctx context.Context, entry AuditEntry) (int64, error) {
+	id, err := h.insert(ctx,
+		"INSERT INTO audit_log (key_id, key_name, method, path, status, request_id, created) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?);",
+		entry.KeyID,
+		entry.KeyName,
+		entry.Method,
+		entry.Path,
+		entry.Status,
+		entry.RequestID,
+		entry.Created.UTC(),
+	)
+	return id, checkError(ctx, "StoreAudit", err)
+}
+
+// FindAudit возвращает последние limit записей журнала аудита, начиная с последних
+func (h *StatsDB) FindAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	result := []AuditEntry{}
+	rows, err := h.query(ctx,
+		"SELECT id, key_id, key_name, method, path, status, request_id, created "+
+			"FROM audit_log ORDER BY id DESC LIMIT ?;", limit)
+	if err != nil {
+		return nil, checkError(ctx, "FindAudit", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := AuditEntry{}
+		err := rows.Scan(&e.ID, &e.KeyID, &e.KeyName, &e.Method, &e.Path, &e.Status, &e.RequestID, &e.Created)
+		if err != nil {
+			return nil, checkError(ctx, "FindAudit", err)
+		}
+		result = append(result, e)
+	}
+	return result, checkError(ctx, "FindAudit", rows.Err())
+}
@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"statistics/pkg/logging"
+	"time"
+)
+
+// ErrNotFound запись с заданным идентификатором не найдена
+var ErrNotFound = errors.New("repository: not found")
+
+// layout формат дат, в котором репозиторий возвращает поля DATE
+const layout = "2006-01-02"
+
+// BudgetRepository интерфейс, описывающий возможные
+// действия с бюджетами и оповещениями о превышении темпа расходов.
+// Бюджеты и оповещения принадлежат арендатору контекста (WithTenant)
+type BudgetRepository interface {
+	StoreBudget(ctx context.Context, budget Budget) (int64, error)
+	FindBudget(ctx context.Context, id int64) (Budget, error)
+	FindBudgets(ctx context.Context) ([]Budget, error)
+	UpdateBudget(ctx context.Context, budget Budget) error
+	DeleteBudget(ctx context.Context, id int64) error
+	StoreAlert(ctx context.Context, alert Alert) (int64, error)
+	FindAlert(ctx context.Context, budgetID int64, periodStart string) (Alert, error)
+	FindAlerts(ctx context.Context) ([]Alert, error)
+}
+
+// Budget бюджет расходов на период.
+// Amount задается в копейках, как и Data.Cost.
+// Period - day, week или month.
+// Threshold - допустимый темп расходования (доля потраченного бюджета,
+// деленная на долю прошедшего периода), при превышении создается Alert.
+// Бюджет относится ко всей статистике арендатора: у статистики нет
+// измерений (кампаний), по которым его можно было бы ограничить
+type Budget struct {
+	ID        int64
+	Name      string
+	Amount    int
+	Period    string
+	Threshold float64
+}
+
+// Alert запись о превышении темпа расходования бюджета в периоде,
+// начинающемся с PeriodStart. Date - дата статистики, на которой
+// обнаружено превышение. На один период бюджета создается одна запись
+type Alert struct {
+	ID          int64
+	BudgetID    int64
+	PeriodStart string
+	Date        string
+	Spent       int
+	Amount      int
+	Pacing      float64
+	Created     time.Time
+}
+
+// StoreBudget записывает новый бюджет и возвращает его идентификатор
+func (h *StatsDB) StoreBudget(ctx context.Context, budget Budget) (int64, error) {
+	id, err := h.insert(ctx,
+		"INSERT INTO budget (tenant, name, amount, period, threshold) VALUES (?, ?, ?, ?, ?);",
+		TenantFromContext(ctx),
+		budget.Name,
+		budget.Amount,
+		budget.Period,
+		budget.Threshold,
+	)
+	return id, checkError(ctx, "StoreBudget", err)
+}
+
+// FindBudget находит бюджет по идентификатору
+func (h *StatsDB) FindBudget(ctx context.Context, id int64) (Budget, error) {
+	budget := Budget{}
+	err := h.queryRow(ctx,
+		"SELECT id, name, amount, period, threshold FROM budget WHERE tenant = ? AND id = ?;",
+		TenantFromContext(ctx), id).
+		Scan(&budget.ID, &budget.Name, &budget.Amount, &budget.Period, &budget.Threshold)
+	if err == sql.ErrNoRows {
+		return budget, ErrNotFound
+	}
+	return budget, checkError(ctx, "FindBudget", err)
+}
+
+// FindBudgets возвращает все бюджеты
+func (h *StatsDB) FindBudgets(ctx context.Context) ([]Budget, error) {
+	result := []Budget{}
+	rows, err := h.query(ctx,
+		"SELECT id, name, amount, period, threshold FROM budget WHERE tenant = ? ORDER BY id;",
+		TenantFromContext(ctx))
+	if err != nil {
+		return nil, checkError(ctx, "FindBudgets", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		budget := Budget{}
+		err = rows.Scan(&budget.ID, &budget.Name, &budget.Amount, &budget.Period, &budget.Threshold)
+		if err != nil {
+			return nil, checkError(ctx, "FindBudgets", err)
+		}
+		result = append(result, budget)
+	}
+	return result, checkError(ctx, "FindBudgets", rows.Err())
+}
+
+// UpdateBudget обновляет бюджет с идентификатором budget.ID
+func (h *StatsDB) UpdateBudget(ctx context.Context, budget Budget) error {
+	_, err := h.exec(ctx,
+		"UPDATE budget SET name = ?, amount = ?, period = ?, threshold = ? WHERE tenant = ? AND id = ?;",
+		budget.Name,
+		budget.Amount,
+		budget.Period,
+		budget.Threshold,
+		TenantFromContext(ctx),
+		budget.ID,
+	)
+	return checkError(ctx, "UpdateBudget", err)
+}
+
+// DeleteBudget удаляет бюджет вместе с его оповещениями
+func (h *StatsDB) DeleteBudget(ctx context.Context, id int64) error {
+	result, err := h.exec(ctx, "DELETE FROM budget WHERE tenant = ? AND id = ?;", TenantFromContext(ctx), id)
+	if err != nil {
+		return checkError(ctx, "DeleteBudget", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return checkError(ctx, "DeleteBudget", err)
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	_, err = h.exec(ctx, "DELETE FROM alert WHERE budget_id = ?;", id)
+	return checkError(ctx, "DeleteBudget", err)
+}
+
+// StoreAlert записывает оповещение и возвращает его идентификатор
+func (h *StatsDB) StoreAlert(ctx context.Context, alert Alert) (int64, error) {
+	id, err := h.insert(ctx,
+		"INSERT INTO alert (tenant, budget_id, period_start, dat, spent, amount, pacing, created) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		TenantFromContext(ctx),
+		alert.BudgetID,
+		alert.PeriodStart,
+		alert.Date,
+		alert.Spent,
+		alert.Amount,
+		alert.Pacing,
+		alert.Created.UTC(),
+	)
+	return id, checkError(ctx, "StoreAlert", err)
+}
+
+const alertColumns = "id, budget_id, period_start, dat, spent, amount, pacing, created"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAlert(row scanner) (Alert, error) {
+	alert := Alert{}
+	var start, date time.Time
+	err := row.Scan(&alert.ID, &alert.BudgetID, &start, &date,
+		&alert.Spent, &alert.Amount, &alert.Pacing, &alert.Created)
+	alert.PeriodStart = start.Format(layout)
+	alert.Date = date.Format(layout)
+	return alert, err
+}
+
+// FindAlert находит оповещение бюджета за период, начинающийся с periodStart
+func (h *StatsDB) FindAlert(ctx context.Context, budgetID int64, periodStart string) (Alert, error) {
+	alert, err := scanAlert(h.queryRow(ctx,
+		"SELECT "+alertColumns+" FROM alert WHERE tenant = ? AND budget_id = ? AND period_start = ?;",
+		TenantFromContext(ctx),
+		budgetID,
+		periodStart,
+	))
+	if err == sql.ErrNoRows {
+		return alert, ErrNotFound
+	}
+	return alert, checkError(ctx, "FindAlert", err)
+}
+
+// FindAlerts возвращает все оповещения, начиная с последних
+func (h *StatsDB) FindAlerts(ctx context.Context) ([]Alert, error) {
+	result := []Alert{}
+	rows, err := h.query(ctx,
+		"SELECT "+alertColumns+" FROM alert WHERE tenant = ? ORDER BY id DESC;",
+		TenantFromContext(ctx))
+	if err != nil {
+		return nil, checkError(ctx, "FindAlerts", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			logging.Error(ctx, "Rep. FindAlerts", "err", err)
+			return nil, err
+		}
+		result = append(result, alert)
+	}
+	return result, checkError(ctx, "FindAlerts", rows.Err())
+}
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// noCacheKey ключ контекста, отключающий чтение из кэша
+type noCacheKey struct{}
+
+// WithoutCache возвращает контекст, запросы в котором читают данные
+// из базы в обход кэша. Полученный результат обновляет кэш
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(noCacheKey{}).(bool)
+	return bypass
+}
+
+// CacheStats счетчики кэша
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+	Entries       int
+	Rows          int
+}
+
+// periodKey ключ кэша: арендатор, период и гранулярность запроса
+type periodKey struct {
+	tenant, from, to, granularity string
+}
+
+type cacheEntry struct {
+	key     periodKey
+	data    []Data
+	expires time.Time
+}
+
+// CachedStats декоратор StatsRepository, кэширующий результаты
+// FindByPeriodDate и FindByPeriodGranularity (LRU с ограничением времени жизни, числа записей
+// и суммарного числа строк). Запись статистики за дату удаляет из кэша
+// только периоды арендатора, содержащие эту дату, удаление статистики
+// арендатора удаляет все его периоды.
+// Кэш локален для процесса: изменения, сделанные другими экземплярами
+// сервиса, становятся видны не позже чем через TTL
+type CachedStats struct {
+	rep        StatsRepository
+	ttl        time.Duration
+	maxEntries int
+	maxRows    int
+
+	// Now возвращает текущее время, подменяется в тестах
+	Now func() time.Time
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[periodKey]*list.Element
+	rows  int
+	// gen увеличивается при каждой записи: результат чтения, начатого
+	// до записи, может быть устаревшим и не сохраняется
+	gen   uint64
+	stats CacheStats
+}
+
+// NewCachedStats возвращает кэш над rep, хранящий не более maxEntries
+// периодов и maxRows строк суммарно не дольше ttl
+func NewCachedStats(rep StatsRepository, ttl time.Duration, maxEntries, maxRows int) *CachedStats {
+	return &CachedStats{
+		rep:        rep,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxRows:    maxRows,
+		Now:        time.Now,
+		ll:         list.New(),
+		items:      map[periodKey]*list.Element{},
+	}
+}
+
+// Stats возвращает текущие значения счетчиков
+func (c *CachedStats) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.ll.Len()
+	stats.Rows = c.rows
+	return stats
+}
+
+// FindByPeriodDate возвращает записи периода из кэша или из базы
+func (c *CachedStats) FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error) {
+	return c.find(ctx, periodKey{tenant: TenantFromContext(ctx), from: from, to: to}, func() ([]Data, error) {
+		return c.rep.FindByPeriodDate(ctx, from, to)
+	})
+}
+
+// FindByPeriodGranularity возвращает суммы периода из кэша или из базы
+func (c *CachedStats) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]Data, error) {
+	return c.find(ctx, periodKey{TenantFromContext(ctx), from, to, granularity}, func() ([]Data, error) {
+		return c.rep.FindByPeriodGranularity(ctx, from, to, granularity)
+	})
+}
+
+// find возвращает записи по ключу key из кэша или загружает их вызовом load
+func (c *CachedStats) find(ctx context.Context, key periodKey, load func() ([]Data, error)) ([]Data, error) {
+	c.mu.Lock()
+	if !cacheBypassed(ctx) {
+		if el, ok := c.items[key]; ok {
+			entry := el.Value.(*cacheEntry)
+			if c.Now().Before(entry.expires) {
+				c.ll.MoveToFront(el)
+				c.stats.Hits++
+				c.mu.Unlock()
+				return append([]Data{}, entry.data...), nil
+			}
+			c.remove(el)
+		}
+	}
+	c.stats.Misses++
+	gen := c.gen
+	c.mu.Unlock()
+
+	data, err := load()
+	if err != nil {
+		return data, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen && c.maxEntries > 0 && len(data) <= c.maxRows {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+		c.items[key] = c.ll.PushFront(&cacheEntry{
+			key:     key,
+			data:    append([]Data{}, data...),
+			expires: c.Now().Add(c.ttl),
+		})
+		c.rows += len(data)
+		c.evict()
+	}
+	return data, nil
+}
+
+// evict вытесняет давно не использованные записи сверх ограничений,
+// вызывается под блокировкой
+func (c *CachedStats) evict() {
+	for c.ll.Len() > c.maxEntries || c.rows > c.maxRows {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// SetLimits меняет ограничения кэша. Записи сверх новых ограничений
+// вытесняются сразу, новое время жизни применяется к новым записям
+func (c *CachedStats) SetLimits(ttl time.Duration, maxEntries, maxRows int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl, c.maxEntries, c.maxRows = ttl, maxEntries, maxRows
+	c.evict()
+}
+
+// remove удаляет запись кэша, вызывается под блокировкой
+func (c *CachedStats) remove(el *list.Element) {
+	entry := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.rows -= len(entry.data)
+}
+
+// invalidate удаляет из кэша периоды арендатора tenant, содержащие date
+func (c *CachedStats) invalidate(tenant, date string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, el := range c.items {
+		if key.tenant == tenant && key.from <= date && date <= key.to {
+			c.remove(el)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// FindByDate находит запись по заданной дате, не используя кэш
+func (c *CachedStats) FindByDate(ctx context.Context, date string) (Data, error) {
+	return c.rep.FindByDate(ctx, date)
+}
+
+// Storage записывает входные данные и сбрасывает периоды с их датой
+func (c *CachedStats) Storage(ctx context.Context, data Data) error {
+	defer c.invalidate(TenantFromContext(ctx), data.Date)
+	return c.rep.Storage(ctx, data)
+}
+
+// Update обновляет запись и сбрасывает периоды с ее датой
+func (c *CachedStats) Update(ctx context.Context, data Data) error {
+	defer c.invalidate(TenantFromContext(ctx), data.Date)
+	return c.rep.Update(ctx, data)
+}
+
+// writeTracker запоминает даты, измененные в транзакции Batch
+type writeTracker struct {
+	StatsRepository
+	dates   []string
+	deleted bool
+}
+
+func (t *writeTracker) Storage(ctx context.Context, data Data) error {
+	t.dates = append(t.dates, data.Date)
+	return t.StatsRepository.Storage(ctx, data)
+}
+
+func (t *writeTracker) Update(ctx context.Context, data Data) error {
+	t.dates = append(t.dates, data.Date)
+	return t.StatsRepository.Update(ctx, data)
+}
+
+func (t *writeTracker) DeleteFromRepository(ctx context.Context) (int, error) {
+	t.deleted = true
+	return t.StatsRepository.DeleteFromRepository(ctx)
+}
+
+// Batch выполняет fn в транзакции кэшируемого репозитория, если он
+// реализует Batcher, и сбрасывает периоды с измененными датами.
+// Чтения внутри транзакции идут мимо кэша
+func (c *CachedStats) Batch(ctx context.Context, fn func(rep StatsRepository) error) error {
+	batcher, ok := c.rep.(Batcher)
+	if !ok {
+		return fn(c)
+	}
+	tracker := &writeTracker{}
+	tenant := TenantFromContext(ctx)
+	defer func() {
+		if tracker.deleted {
+			c.clear(tenant)
+			return
+		}
+		for _, date := range tracker.dates {
+			c.invalidate(tenant, date)
+		}
+	}()
+	return batcher.Batch(ctx, func(rep StatsRepository) error {
+		tracker.StatsRepository = rep
+		return fn(tracker)
+	})
+}
+
+// Transactional is part of Transactor
+func (c *CachedStats) Transactional() bool {
+	return IsTransactional(c.rep)
+}
+
+// DeleteFromRepository удаляет статистику арендатора и его периоды из кэша
+func (c *CachedStats) DeleteFromRepository(ctx context.Context) (int, error) {
+	defer c.clear(TenantFromContext(ctx))
+	return c.rep.DeleteFromRepository(ctx)
+}
+
+// clear удаляет из кэша все периоды арендатора tenant
+func (c *CachedStats) clear(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, el := range c.items {
+		if key.tenant == tenant {
+			c.remove(el)
+			c.stats.Invalidations++
+		}
+	}
+}
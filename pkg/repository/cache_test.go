@@ -0,0 +1,166 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// countingStats считает обращения к FindByPeriodDate
+type countingStats struct {
+	*MemoryDB
+	calls int
+}
+
+func (c *countingStats) FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error) {
+	c.calls++
+	return c.MemoryDB.FindByPeriodDate(ctx, from, to)
+}
+
+func newTestCache(maxEntries, maxRows int) (*CachedStats, *countingStats, *time.Time) {
+	rep := &countingStats{MemoryDB: NewMemoryDB()}
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCachedStats(rep, time.Minute, maxEntries, maxRows)
+	c.Now = func() time.Time { return now }
+	return c, rep, &now
+}
+
+func TestCachedStatsConformance(t *testing.T) {
+	c, _, _ := newTestCache(10, 100)
+	testStatsRepository(t, c)
+}
+
+func TestCachedStatsInvalidation(t *testing.T) {
+	ctx := context.Background()
+	c, rep, _ := newTestCache(10, 100)
+	c.Storage(ctx, Data{Date: "2021-01-05", Views: 1})
+
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10")
+	c.FindByPeriodDate(ctx, "2021-02-01", "2021-02-28")
+	data, _ := c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10")
+	if rep.calls != 2 || len(data) != 1 {
+		t.Fatalf("got %d queries and %v; expected 2 queries and cached row", rep.calls, data)
+	}
+	// изменение возвращенного среза не портит кэш
+	data[0].Views = 100
+
+	// запись за январь сбрасывает только январский период
+	c.Update(ctx, Data{Date: "2021-01-05", Views: 2})
+	data, _ = c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10")
+	c.FindByPeriodDate(ctx, "2021-02-01", "2021-02-28")
+	if rep.calls != 3 || data[0].Views != 2 {
+		t.Fatalf("got %d queries and %v; expected January reloaded", rep.calls, data)
+	}
+
+	c.DeleteFromRepository(ctx)
+	if data, _ = c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10"); len(data) != 0 || rep.calls != 4 {
+		t.Fatalf("got %d queries and %v after delete; expected empty reload", rep.calls, data)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Invalidations != 3 || stats.Entries != 1 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestCachedStatsBounds(t *testing.T) {
+	ctx := context.Background()
+	c, rep, now := newTestCache(2, 3)
+	for _, date := range []string{"2021-01-01", "2021-01-02", "2021-01-03", "2021-01-04"} {
+		c.Storage(ctx, Data{Date: date})
+	}
+
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-01")
+	c.FindByPeriodDate(ctx, "2021-01-02", "2021-01-02")
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-01")
+	// третий период вытесняет давно не использованный второй
+	c.FindByPeriodDate(ctx, "2021-01-03", "2021-01-03")
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-01")
+	if rep.calls != 3 {
+		t.Fatalf("got %d queries; expected 3", rep.calls)
+	}
+	c.FindByPeriodDate(ctx, "2021-01-02", "2021-01-02")
+	if rep.calls != 4 {
+		t.Fatalf("got %d queries; expected evicted period reloaded", rep.calls)
+	}
+
+	// период больше ограничения строк не кэшируется
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-04")
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-04")
+	if rep.calls != 6 {
+		t.Fatalf("got %d queries; expected oversized period not cached", rep.calls)
+	}
+	if stats := c.Stats(); stats.Rows > 3 || stats.Entries > 2 {
+		t.Fatalf("got %+v; expected bounds kept", stats)
+	}
+
+	// устаревшие записи перечитываются
+	c.FindByPeriodDate(ctx, "2021-01-02", "2021-01-02")
+	*now = now.Add(time.Minute)
+	c.FindByPeriodDate(ctx, "2021-01-02", "2021-01-02")
+	if rep.calls != 7 {
+		t.Fatalf("got %d queries; expected expired period reloaded", rep.calls)
+	}
+}
+
+func TestCachedStatsBypass(t *testing.T) {
+	ctx := context.Background()
+	c, rep, _ := newTestCache(10, 100)
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10")
+	rep.MemoryDB.Storage(ctx, Data{Date: "2021-01-02"})
+
+	if data, _ := c.FindByPeriodDate(WithoutCache(ctx), "2021-01-01", "2021-01-10"); len(data) != 1 {
+		t.Fatalf("bypass: got %v; expected fresh row", data)
+	}
+	// обход обновляет кэш
+	if data, _ := c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10"); len(data) != 1 || rep.calls != 2 {
+		t.Fatalf("got %v after %d queries; expected refreshed cache", data, rep.calls)
+	}
+}
+
+func TestCachedStatsBatch(t *testing.T) {
+	ctx := context.Background()
+	c, rep, _ := newTestCache(10, 100)
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10")
+	c.FindByPeriodDate(ctx, "2021-02-01", "2021-02-28")
+
+	err := c.Batch(ctx, func(tx StatsRepository) error {
+		return tx.Storage(ctx, Data{Date: "2021-01-05", Views: 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-10"); len(data) != 1 || rep.calls != 3 {
+		t.Fatalf("got %v after %d queries; expected January reloaded", data, rep.calls)
+	}
+	if c.FindByPeriodDate(ctx, "2021-02-01", "2021-02-28"); rep.calls != 3 {
+		t.Fatalf("got %d queries; expected February cached", rep.calls)
+	}
+}
+
+func TestCachedStatsSetLimits(t *testing.T) {
+	ctx := context.Background()
+	c, rep, now := newTestCache(10, 100)
+	for _, date := range []string{"2021-01-01", "2021-01-02", "2021-01-03"} {
+		c.Storage(ctx, Data{Date: date})
+		c.FindByPeriodDate(ctx, date, date)
+	}
+
+	// уменьшенные ограничения вытесняют лишние записи сразу
+	c.SetLimits(time.Hour, 1, 100)
+	if stats := c.Stats(); stats.Entries != 1 || stats.Evictions != 2 {
+		t.Fatalf("got %+v; expected one entry left", stats)
+	}
+	c.FindByPeriodDate(ctx, "2021-01-03", "2021-01-03")
+	if rep.calls != 3 {
+		t.Fatalf("got %d queries; expected most recent period kept", rep.calls)
+	}
+
+	// новое время жизни действует для новых записей
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-01")
+	*now = now.Add(30 * time.Minute)
+	c.FindByPeriodDate(ctx, "2021-01-01", "2021-01-01")
+	if rep.calls != 4 {
+		t.Fatalf("got %d queries; expected period cached for an hour", rep.calls)
+	}
+}
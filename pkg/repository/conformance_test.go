@@ -0,0 +1,706 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Общий набор проверок, который должна пройти каждая реализация репозитория.
+// MemoryDB и SQLite проверяются всегда, PostgreSQL и MySQL - если заданы
+// TEST_POSTGRES_DSN и TEST_MYSQL_DSN (таблицы очищаются перед каждой проверкой)
+
+// tables таблицы, очищаемые перед проверкой на внешней базе
+var tables = []string{"stat", "stat_week", "stat_month", "budget", "alert", "webhook", "webhook_delivery", "idempotency_key", "api_key", "audit_log", "tenant"}
+
+// openTestDB открывает базу driver, применяет миграции и очищает ее таблицы.
+// Пропускает тест, если для внешней базы не задана переменная окружения env
+func openTestDB(t *testing.T, driver, env string) *StatsDB {
+	ctx := context.Background()
+	dsn := ":memory:"
+	if env != "" {
+		if dsn = os.Getenv(env); dsn == "" {
+			t.Skipf("%s is not set", env)
+		}
+	}
+	h, err := Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.DB.Close() })
+	if _, err := h.Migrate(ctx, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if _, err := h.exec(ctx, "DELETE FROM "+table+";"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// backends реализации, проходящие общий набор проверок
+var backends = []struct {
+	name string
+	open func(t *testing.T) Repository
+}{
+	{"memory", func(t *testing.T) Repository { return NewMemoryDB() }},
+	{"sqlite", func(t *testing.T) Repository { return openTestDB(t, "sqlite", "") }},
+	{"postgres", func(t *testing.T) Repository { return openTestDB(t, "postgres", "TEST_POSTGRES_DSN") }},
+	{"mysql", func(t *testing.T) Repository { return openTestDB(t, "mysql", "TEST_MYSQL_DSN") }},
+}
+
+func TestConformance(t *testing.T) {
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Run("Stats", func(t *testing.T) { testStatsRepository(t, backend.open(t)) })
+			t.Run("Granularity", func(t *testing.T) { testGranularity(t, backend.open(t)) })
+			t.Run("ConcurrentWrites", func(t *testing.T) { testConcurrentWrites(t, backend.open(t)) })
+			t.Run("Budgets", func(t *testing.T) { testBudgetRepository(t, backend.open(t)) })
+			t.Run("Webhooks", func(t *testing.T) { testWebhookRepository(t, backend.open(t)) })
+			t.Run("Idempotency", func(t *testing.T) { testIdempotencyRepository(t, backend.open(t)) })
+			t.Run("APIKeys", func(t *testing.T) { testAPIKeyRepository(t, backend.open(t)) })
+			t.Run("TenantIsolation", func(t *testing.T) { testTenantIsolation(t, backend.open(t)) })
+			t.Run("Tenants", func(t *testing.T) { testTenantRepository(t, backend.open(t)) })
+		})
+	}
+}
+
+func testStatsRepository(t *testing.T, rep StatsRepository) {
+	ctx := context.Background()
+	if _, err := rep.FindByDate(ctx, "2021-01-01"); err == nil {
+		t.Fatal("FindByDate on empty repository: expected error")
+	}
+
+	for _, data := range []Data{
+		{Date: "2021-01-01", Views: 10, Clicks: 1, Cost: 100},
+		{Date: "2021-01-02", Views: 20, Clicks: 2, Cost: 200},
+		{Date: "2021-01-03", Views: 30, Clicks: 3, Cost: 300},
+		{Date: "2021-01-05", Views: 50, Clicks: 5, Cost: 500},
+	} {
+		if err := rep.Storage(ctx, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := rep.FindByDate(ctx, "2021-01-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (Data{Date: "2021-01-02", Views: 20, Clicks: 2, Cost: 200}); got != expect {
+		t.Fatalf("FindByDate: got %+v; expected %+v", got, expect)
+	}
+
+	updated := Data{Date: "2021-01-02", Views: 25, Clicks: 4, Cost: 250}
+	if err := rep.Update(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = rep.FindByDate(ctx, "2021-01-02"); got != updated {
+		t.Fatalf("FindByDate after Update: got %+v; expected %+v", got, updated)
+	}
+
+	// повторная запись даты (параллельная первая запись) прибавляет
+	// просмотры и клики и заменяет стоимость, а не затирает запись
+	if err := rep.Storage(ctx, Data{Date: "2021-01-03", Views: 5, Clicks: 1, Cost: 350}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = rep.FindByDate(ctx, "2021-01-03"); got != (Data{Date: "2021-01-03", Views: 35, Clicks: 4, Cost: 350}) {
+		t.Fatalf("FindByDate after repeated Storage: got %+v", got)
+	}
+	// месяц целиком читается из агрегатов
+	month, err := rep.FindByPeriodGranularity(ctx, "2021-01-01", "2021-01-31", GranularityMonth)
+	if err != nil || len(month) != 1 || month[0].Views != 120 || month[0].Cost != 1200 {
+		t.Fatalf("FindByPeriodGranularity after repeated Storage: got %+v, %v", month, err)
+	}
+
+	// границы периода включаются
+	period, err := rep.FindByPeriodDate(ctx, "2021-01-02", "2021-01-05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(period, func(i, j int) bool { return period[i].Date < period[j].Date })
+	dates := []string{}
+	for _, data := range period {
+		dates = append(dates, data.Date)
+	}
+	if len(dates) != 3 || dates[0] != "2021-01-02" || dates[1] != "2021-01-03" || dates[2] != "2021-01-05" {
+		t.Fatalf("FindByPeriodDate: got dates %v; expected [2021-01-02 2021-01-03 2021-01-05]", dates)
+	}
+	if period[0] != updated {
+		t.Fatalf("FindByPeriodDate: got %+v; expected %+v", period[0], updated)
+	}
+
+	if period, err = rep.FindByPeriodDate(ctx, "2021-02-01", "2021-02-28"); err != nil || len(period) != 0 {
+		t.Fatalf("FindByPeriodDate on empty period: got %v, %v; expected no rows", period, err)
+	}
+
+	affected, err := rep.DeleteFromRepository(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected != 4 {
+		t.Fatalf("DeleteFromRepository: got %d; expected %d", affected, 4)
+	}
+	if period, _ = rep.FindByPeriodDate(ctx, "2021-01-01", "2021-12-31"); len(period) != 0 {
+		t.Fatalf("FindByPeriodDate after delete: got %d rows; expected none", len(period))
+	}
+}
+
+func testGranularity(t *testing.T, rep StatsRepository) {
+	ctx := context.Background()
+	for i, date := range []string{
+		"2021-01-29", "2021-01-31", "2021-02-03", "2021-02-10", "2021-02-28", "2021-03-01", "2021-03-05",
+	} {
+		views := 1 << uint(i)
+		if err := rep.Storage(ctx, Data{Date: date, Views: views, Clicks: 1, Cost: views * 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rep.Update(ctx, Data{Date: "2021-02-03", Views: 5, Clicks: 1, Cost: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func(date string, views, clicks int) Data {
+		return Data{Date: date, Views: views, Clicks: clicks, Cost: views * 10}
+	}
+	for _, test := range []struct {
+		from, to, granularity string
+		expect                []Data
+	}{
+		// неполные периоды на границах учитывают только дни внутри диапазона
+		{"2021-01-30", "2021-03-02", GranularityWeek, []Data{
+			sum("2021-01-25", 2, 1), sum("2021-02-01", 5, 1), sum("2021-02-08", 8, 1),
+			sum("2021-02-22", 16, 1), sum("2021-03-01", 32, 1),
+		}},
+		{"2021-01-30", "2021-03-02", GranularityMonth, []Data{
+			sum("2021-01-01", 2, 1), sum("2021-02-01", 29, 3), sum("2021-03-01", 32, 1),
+		}},
+		{"2021-02-01", "2021-02-28", GranularityMonth, []Data{sum("2021-02-01", 29, 3)}},
+		{"2021-02-02", "2021-02-04", GranularityWeek, []Data{sum("2021-02-01", 5, 1)}},
+		{"2021-04-01", "2021-05-31", GranularityMonth, []Data{}},
+	} {
+		got, err := rep.FindByPeriodGranularity(ctx, test.from, test.to, test.granularity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(test.expect) {
+			t.Fatalf("%s %s..%s: got %+v; expected %+v", test.granularity, test.from, test.to, got, test.expect)
+		}
+		for i := range got {
+			if got[i] != test.expect[i] {
+				t.Fatalf("%s %s..%s: got %+v; expected %+v", test.granularity, test.from, test.to, got, test.expect)
+			}
+		}
+	}
+
+	days, err := rep.FindByPeriodGranularity(ctx, "2021-01-30", "2021-02-10", GranularityDay)
+	if err != nil || len(days) != 3 {
+		t.Fatalf("day: got %v, %v; expected 3 rows", days, err)
+	}
+
+	rep.DeleteFromRepository(ctx)
+	if got, _ := rep.FindByPeriodGranularity(ctx, "2021-01-01", "2021-12-31", GranularityMonth); len(got) != 0 {
+		t.Fatalf("month after delete: got %+v; expected none", got)
+	}
+}
+
+// Параллельные записи разных дат одной недели и одного месяца
+// и параллельные обновления одной даты не теряют изменений агрегатов
+func testConcurrentWrites(t *testing.T, rep StatsRepository) {
+	ctx := context.Background()
+	dates := []string{"2021-02-01", "2021-02-02", "2021-02-03", "2021-02-04", "2021-02-05", "2021-02-06", "2021-02-07"}
+	for _, date := range dates {
+		if err := rep.Storage(ctx, Data{Date: date, Views: 1, Clicks: 1, Cost: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(dates)*2)
+	for i, date := range dates {
+		for w := 0; w < 2; w++ {
+			wg.Add(1)
+			go func(i, w int, date string) {
+				defer wg.Done()
+				for k := 1; k <= 10; k++ {
+					n := (i+1)*100 + w*10 + k
+					if err := rep.Update(ctx, Data{Date: date, Views: n, Clicks: n, Cost: n}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(i, w, date)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	days, err := rep.FindByPeriodDate(ctx, dates[0], dates[len(dates)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Data{Date: dates[0]}
+	for _, day := range days {
+		expect.Views += day.Views
+		expect.Clicks += day.Clicks
+		expect.Cost += day.Cost
+	}
+	for _, g := range []string{GranularityWeek, GranularityMonth} {
+		// неделя и месяц целиком читаются из таблиц агрегатов
+		from, to := dates[0], dates[len(dates)-1]
+		if g == GranularityMonth {
+			to = "2021-02-28"
+		}
+		got, err := rep.FindByPeriodGranularity(ctx, from, to, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != expect {
+			t.Fatalf("%s: got %+v; expected %+v", g, got, expect)
+		}
+	}
+}
+
+func testBudgetRepository(t *testing.T, rep BudgetRepository) {
+	ctx := context.Background()
+	budget := Budget{Name: "january", Amount: 100000, Period: "month", Threshold: 1.2}
+	id, err := rep.StoreBudget(ctx, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget.ID = id
+	if got, err := rep.FindBudget(ctx, id); err != nil || got != budget {
+		t.Fatalf("FindBudget: got %+v, %v; expected %+v", got, err, budget)
+	}
+	if _, err := rep.FindBudget(ctx, id+100); err != ErrNotFound {
+		t.Fatalf("FindBudget of missing budget: got %v; expected %v", err, ErrNotFound)
+	}
+
+	budget.Amount = 200000
+	if err := rep.UpdateBudget(ctx, budget); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := rep.FindBudgets(ctx); err != nil || len(list) != 1 || list[0] != budget {
+		t.Fatalf("FindBudgets: got %+v, %v; expected [%+v]", list, err, budget)
+	}
+
+	created := time.Date(2021, 1, 10, 8, 30, 0, 0, time.UTC)
+	alert := Alert{BudgetID: id, PeriodStart: "2021-01-01", Date: "2021-01-10",
+		Spent: 150000, Amount: 200000, Pacing: 2.33, Created: created}
+	if alert.ID, err = rep.StoreAlert(ctx, alert); err != nil {
+		t.Fatal(err)
+	}
+	got, err := rep.FindAlert(ctx, id, "2021-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Created.Equal(created) {
+		t.Fatalf("FindAlert: got created %v; expected %v", got.Created, created)
+	}
+	got.Created = created
+	if got != alert {
+		t.Fatalf("FindAlert: got %+v; expected %+v", got, alert)
+	}
+	if _, err := rep.FindAlert(ctx, id, "2021-02-01"); err != ErrNotFound {
+		t.Fatalf("FindAlert of missing period: got %v; expected %v", err, ErrNotFound)
+	}
+
+	if err := rep.DeleteBudget(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := rep.DeleteBudget(ctx, id); err != ErrNotFound {
+		t.Fatalf("second DeleteBudget: got %v; expected %v", err, ErrNotFound)
+	}
+	if alerts, _ := rep.FindAlerts(ctx); len(alerts) != 0 {
+		t.Fatalf("FindAlerts after DeleteBudget: got %d; expected none", len(alerts))
+	}
+}
+
+func testWebhookRepository(t *testing.T, rep WebhookRepository) {
+	ctx := context.Background()
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	id, err := rep.StoreWebhook(ctx, Webhook{URL: "http://localhost/hook",
+		Events: []string{"stat.created", "stats.deleted"}, Secret: "secret", Created: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := rep.FindWebhook(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.Events) != 2 || hook.Events[1] != "stats.deleted" || hook.Secret != "secret" {
+		t.Fatalf("FindWebhook: got %+v", hook)
+	}
+
+	due := Delivery{WebhookID: id, Event: "stat.created", Payload: "{}", Status: DeliveryPending,
+		NextAttempt: now, Created: now, Updated: now}
+	if due.ID, err = rep.StoreDelivery(ctx, due); err != nil {
+		t.Fatal(err)
+	}
+	later := due
+	later.NextAttempt = now.Add(time.Hour)
+	if later.ID, err = rep.StoreDelivery(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+
+	// время в другой зоне сравнивается как момент времени
+	list, err := rep.FindDueDeliveries(ctx, now.Add(time.Minute).In(time.FixedZone("MSK", 3*3600)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != due.ID {
+		t.Fatalf("FindDueDeliveries: got %+v; expected delivery %d", list, due.ID)
+	}
+
+	due.Status = DeliveryDelivered
+	due.Attempts = 1
+	due.ResponseCode = 200
+	if err := rep.UpdateDelivery(ctx, due); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = rep.FindDueDeliveries(ctx, now.Add(2*time.Hour), 10); len(list) != 1 || list[0].ID != later.ID {
+		t.Fatalf("FindDueDeliveries after delivery: got %+v; expected delivery %d", list, later.ID)
+	}
+	if list, _ = rep.FindDeliveries(ctx, id, 10); len(list) != 2 || list[0].ID != later.ID {
+		t.Fatalf("FindDeliveries: got %+v; expected newest first", list)
+	}
+
+	if err := rep.DeleteWebhook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rep.FindWebhook(ctx, id); err != ErrNotFound {
+		t.Fatalf("FindWebhook after delete: got %v; expected %v", err, ErrNotFound)
+	}
+	if list, _ = rep.FindDeliveries(ctx, id, 10); len(list) != 0 {
+		t.Fatalf("FindDeliveries after delete: got %d; expected none", len(list))
+	}
+}
+
+func testIdempotencyRepository(t *testing.T, rep IdempotencyRepository) {
+	ctx := context.Background()
+	created := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := IdempotencyKey{Key: "a", Fingerprint: "f1", Created: created}
+	if _, ok, err := rep.ReserveKey(ctx, key); err != nil || !ok {
+		t.Fatalf("ReserveKey: got %v, %v; expected new key", ok, err)
+	}
+	key.Status, key.ContentType, key.Body = 202, "text/plain", "accepted"
+	if err := rep.CompleteKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, ok, err := rep.ReserveKey(ctx, IdempotencyKey{Key: "a", Fingerprint: "f2", Created: created.Add(time.Hour)})
+	if err != nil || ok {
+		t.Fatalf("ReserveKey of existing key: got %v, %v", ok, err)
+	}
+	if existing.Fingerprint != "f1" || existing.Status != 202 || existing.Body != "accepted" ||
+		existing.ContentType != "text/plain" || !existing.Created.Equal(created) {
+		t.Fatalf("ReserveKey of existing key: got %+v; expected %+v", existing, key)
+	}
+
+	b := IdempotencyKey{Key: "b", Fingerprint: "f", Created: created.Add(2 * time.Hour)}
+	rep.ReserveKey(ctx, b)
+	if count, err := rep.DeleteExpiredKeys(ctx, created.Add(time.Hour), created.Add(time.Hour)); err != nil || count != 1 {
+		t.Fatalf("DeleteExpiredKeys: got %d, %v; expected 1", count, err)
+	}
+	if err := rep.DeleteKey(ctx, IdempotencyKey{Key: "b", Fingerprint: "other"}); err != ErrLeaseLost {
+		t.Fatalf("DeleteKey of another request: got %v; expected %v", err, ErrLeaseLost)
+	}
+	if err := rep.DeleteKey(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	// резервирование узнается и по сроку аренды с долями секунды
+	precise := IdempotencyKey{Key: "d", Fingerprint: "f", Created: created.Add(3 * time.Hour), LockedUntil: created.Add(1500 * time.Millisecond)}
+	rep.ReserveKey(ctx, precise)
+	if precise.Status = 201; rep.CompleteKey(ctx, precise) != nil {
+		t.Fatal("CompleteKey with fractional lease: expected the reservation to match")
+	}
+	if _, ok, _ := rep.ReserveKey(ctx, IdempotencyKey{Key: "b", Fingerprint: "f", Created: created}); !ok {
+		t.Fatal("ReserveKey after DeleteKey: expected new key")
+	}
+
+	// аренда обрабатываемого запроса
+	lease := IdempotencyKey{Key: "c", Fingerprint: "f1", Created: created, LockedUntil: created.Add(time.Minute)}
+	rep.ReserveKey(ctx, lease)
+	if existing, _, _ := rep.ReserveKey(ctx, lease); !existing.LockedUntil.Equal(lease.LockedUntil) {
+		t.Fatalf("ReserveKey of existing key: got lease %v; expected %v", existing.LockedUntil, lease.LockedUntil)
+	}
+	again := IdempotencyKey{Key: "c", Fingerprint: "f2", Created: created.Add(time.Minute), LockedUntil: created.Add(2 * time.Minute)}
+	if ok, err := rep.ReplaceKey(ctx, again, created.Add(-time.Hour), created.Add(30*time.Second)); err != nil || ok {
+		t.Fatalf("ReplaceKey with active lease: got %v, %v; expected key kept", ok, err)
+	}
+	if count, _ := rep.DeleteExpiredKeys(ctx, created.Add(time.Hour), created.Add(30*time.Second)); count != 1 {
+		t.Fatalf("DeleteExpiredKeys: got %d; expected key with active lease kept", count)
+	}
+	if ok, err := rep.ReplaceKey(ctx, again, created.Add(-time.Hour), created.Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("ReplaceKey with expired lease: got %v, %v; expected key replaced", ok, err)
+	}
+	if existing, _, _ := rep.ReserveKey(ctx, lease); existing.Fingerprint != "f2" || existing.Status != 0 {
+		t.Fatalf("ReplaceKey: got %+v; expected %+v", existing, again)
+	}
+
+	// запрос, потерявший аренду, не изменяет ключ нового резервирования,
+	// в том числе с тем же отпечатком
+	lost := lease
+	lost.Status, lost.Body = 200, "lost"
+	if err := rep.CompleteKey(ctx, lost); err != ErrLeaseLost {
+		t.Fatalf("CompleteKey after lost lease: got %v; expected %v", err, ErrLeaseLost)
+	}
+	lost.Fingerprint = "f2"
+	if err := rep.CompleteKey(ctx, lost); err != ErrLeaseLost {
+		t.Fatalf("CompleteKey with lost lease: got %v; expected %v", err, ErrLeaseLost)
+	}
+	if err := rep.DeleteKey(ctx, lost); err != ErrLeaseLost {
+		t.Fatalf("DeleteKey with lost lease: got %v; expected %v", err, ErrLeaseLost)
+	}
+	if existing, _, _ := rep.ReserveKey(ctx, lease); existing.Status != 0 || existing.Body != "" {
+		t.Fatalf("key after lost lease: got %+v; expected reservation kept", existing)
+	}
+
+	// сохраненный результат заменяется только после истечения ключа
+	again.Status = 200
+	if err := rep.CompleteKey(ctx, again); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := rep.ReplaceKey(ctx, lease, created, created.Add(time.Hour)); ok {
+		t.Fatal("ReplaceKey of saved result: expected key kept")
+	}
+	if ok, _ := rep.ReplaceKey(ctx, lease, created.Add(time.Minute), created.Add(time.Hour)); !ok {
+		t.Fatal("ReplaceKey of expired result: expected key replaced")
+	}
+}
+
+func testAPIKeyRepository(t *testing.T, rep APIKeyRepository) {
+	ctx := context.Background()
+	created := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := APIKey{Name: "ci", Tenant: "acme", Prefix: "p1", Hash: "h1", Scopes: []string{"stats:read", "stats:write"}, Created: created}
+	id, err := rep.StoreAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.StoreAPIKey(ctx, APIKey{Name: "admin", Prefix: "p2", Hash: "h2", Scopes: []string{"admin"}, Created: created})
+
+	found, err := rep.FindAPIKey(ctx, "p1")
+	if err != nil || found.ID != id || found.Name != "ci" || found.Tenant != "acme" || found.Hash != "h1" ||
+		!reflect.DeepEqual(found.Scopes, key.Scopes) || !found.Created.Equal(created) || !found.Revoked.IsZero() {
+		t.Fatalf("FindAPIKey: got %+v, %v", found, err)
+	}
+	if _, err := rep.FindAPIKey(ctx, "missing"); err != ErrNotFound {
+		t.Fatalf("FindAPIKey of missing key: got %v; expected %v", err, ErrNotFound)
+	}
+
+	revoked := created.Add(time.Hour)
+	if err := rep.RevokeAPIKey(ctx, id, revoked); err != nil {
+		t.Fatal(err)
+	}
+	rep.RevokeAPIKey(ctx, id, revoked.Add(time.Hour))
+	if err := rep.RevokeAPIKey(ctx, id+100, revoked); err != ErrNotFound {
+		t.Fatalf("RevokeAPIKey of missing key: got %v; expected %v", err, ErrNotFound)
+	}
+	keys, err := rep.FindAPIKeys(ctx)
+	if err != nil || len(keys) != 2 || keys[0].Name != "ci" || !keys[0].Revoked.Equal(revoked) || !keys[1].Revoked.IsZero() {
+		t.Fatalf("FindAPIKeys: got %+v, %v", keys, err)
+	}
+
+	for i, method := range []string{"POST", "DELETE", "PUT"} {
+		_, err := rep.StoreAudit(ctx, AuditEntry{KeyID: id, KeyName: "ci", Method: method, Path: "/stats",
+			Status: 200, RequestID: "r", Created: created.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := rep.FindAudit(ctx, 2)
+	if err != nil || len(entries) != 2 || entries[0].Method != "PUT" || entries[1].Method != "DELETE" ||
+		entries[0].KeyID != id || entries[0].RequestID != "r" || !entries[0].Created.Equal(created.Add(2*time.Minute)) {
+		t.Fatalf("FindAudit: got %+v, %v", entries, err)
+	}
+}
+
+// testTenantIsolation проверяет, что арендатор не читает, не изменяет
+// и не удаляет статистику и бюджеты другого арендатора
+func testTenantIsolation(t *testing.T, rep Repository) {
+	acme := WithTenant(context.Background(), "acme")
+	globex := WithTenant(context.Background(), "globex")
+	for _, data := range []Data{{Date: "2021-03-01", Views: 1}, {Date: "2021-03-08", Views: 2}} {
+		if err := rep.Storage(acme, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// та же дата у другого арендатора - отдельная запись
+	if err := rep.Storage(globex, Data{Date: "2021-03-01", Views: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rep.FindByDate(globex, "2021-03-08"); err == nil {
+		t.Fatal("FindByDate: globex read a date of acme")
+	}
+	rep.Update(globex, Data{Date: "2021-03-08", Views: 500})
+	if data, _ := rep.FindByDate(acme, "2021-03-08"); data.Views != 2 {
+		t.Fatalf("Update of globex changed acme: got %+v", data)
+	}
+	for _, g := range []string{GranularityDay, GranularityWeek, GranularityMonth} {
+		data, err := rep.FindByPeriodGranularity(globex, "2021-03-01", "2021-03-31", g)
+		if err != nil || len(data) != 1 || data[0].Views != 100 {
+			t.Fatalf("%s: globex got %+v, %v", g, data, err)
+		}
+	}
+	if data, _ := rep.FindByPeriodDate(context.Background(), "2021-03-01", "2021-03-31"); len(data) != 0 {
+		t.Fatalf("default tenant got %+v", data)
+	}
+
+	if affected, err := rep.DeleteFromRepository(globex); err != nil || affected != 1 {
+		t.Fatalf("DeleteFromRepository: got %d, %v; expected 1", affected, err)
+	}
+	data, err := rep.FindByPeriodGranularity(acme, "2021-03-01", "2021-03-31", GranularityMonth)
+	if err != nil || len(data) != 1 || data[0].Views != 3 {
+		t.Fatalf("acme after delete of globex: got %+v, %v", data, err)
+	}
+
+	id, _ := rep.StoreBudget(acme, Budget{Name: "acme", Amount: 100, Period: "month", Threshold: 1})
+	rep.StoreAlert(acme, Alert{BudgetID: id, PeriodStart: "2021-03-01", Date: "2021-03-08", Created: time.Now()})
+	if _, err := rep.FindBudget(globex, id); err != ErrNotFound {
+		t.Fatalf("FindBudget: globex got %v; expected %v", err, ErrNotFound)
+	}
+	rep.UpdateBudget(globex, Budget{ID: id, Name: "stolen", Amount: 1, Period: "day", Threshold: 1})
+	if err := rep.DeleteBudget(globex, id); err != ErrNotFound {
+		t.Fatalf("DeleteBudget: globex got %v; expected %v", err, ErrNotFound)
+	}
+	if budgets, _ := rep.FindBudgets(globex); len(budgets) != 0 {
+		t.Fatalf("FindBudgets: globex got %+v", budgets)
+	}
+	if alerts, _ := rep.FindAlerts(globex); len(alerts) != 0 {
+		t.Fatalf("FindAlerts: globex got %+v", alerts)
+	}
+	if _, err := rep.FindAlert(globex, id, "2021-03-01"); err != ErrNotFound {
+		t.Fatalf("FindAlert: globex got %v; expected %v", err, ErrNotFound)
+	}
+	if budget, err := rep.FindBudget(acme, id); err != nil || budget.Name != "acme" {
+		t.Fatalf("FindBudget: acme got %+v, %v", budget, err)
+	}
+
+	hook, _ := rep.StoreWebhook(acme, Webhook{URL: "http://localhost/hook", Events: []string{"stat.created"}, Created: time.Now()})
+	if _, err := rep.FindWebhook(globex, hook); err != ErrNotFound {
+		t.Fatalf("FindWebhook: globex got %v; expected %v", err, ErrNotFound)
+	}
+	if hooks, _ := rep.FindWebhooks(globex); len(hooks) != 0 {
+		t.Fatalf("FindWebhooks: globex got %+v", hooks)
+	}
+	if err := rep.DeleteWebhook(globex, hook); err != ErrNotFound {
+		t.Fatalf("DeleteWebhook: globex got %v; expected %v", err, ErrNotFound)
+	}
+	// очередь доставок общая, доставка хранит арендатора подписки
+	now := time.Now()
+	rep.StoreDelivery(acme, Delivery{WebhookID: hook, Event: "stat.created", Payload: "{}",
+		Status: DeliveryPending, NextAttempt: now, Created: now, Updated: now})
+	due, err := rep.FindDueDeliveries(globex, now.Add(time.Minute), 10)
+	if err != nil || len(due) != 1 || due[0].Tenant != "acme" {
+		t.Fatalf("FindDueDeliveries: got %+v, %v; expected acme delivery", due, err)
+	}
+	if hooks, _ := rep.FindWebhooks(acme); len(hooks) != 1 {
+		t.Fatalf("FindWebhooks: acme got %+v", hooks)
+	}
+}
+
+func testTenantRepository(t *testing.T, rep Repository) {
+	ctx := context.Background()
+	if _, err := rep.FindTenant(ctx, "acme"); err != ErrNotFound {
+		t.Fatalf("FindTenant of missing tenant: got %v; expected %v", err, ErrNotFound)
+	}
+	rep.StoreTenant(ctx, Tenant{Name: "acme", MaxRows: 5})
+	if err := rep.StoreTenant(ctx, Tenant{Name: "acme", MaxRows: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant, err := rep.FindTenant(ctx, "acme"); err != nil || tenant.MaxRows != 10 {
+		t.Fatalf("FindTenant: got %+v, %v", tenant, err)
+	}
+	globex := WithTenant(ctx, "globex")
+	rep.Storage(globex, Data{Date: "2021-01-01"})
+	rep.Storage(globex, Data{Date: "2021-01-02"})
+	if count, err := rep.CountStats(globex); err != nil || count != 2 {
+		t.Fatalf("CountStats: got %d, %v; expected 2", count, err)
+	}
+	tenants, err := rep.FindTenants(ctx)
+	expected := []Tenant{{Name: "acme", MaxRows: 10}, {Name: "globex", Rows: 2}}
+	if err != nil || !reflect.DeepEqual(tenants, expected) {
+		t.Fatalf("FindTenants: got %+v, %v; expected %+v", tenants, err, expected)
+	}
+}
+
+func TestQuotaStats(t *testing.T) {
+	ctx := WithTenant(context.Background(), "acme")
+	for _, backend := range backends[:2] {
+		db := backend.open(t)
+		db.StoreTenant(ctx, Tenant{Name: "acme", MaxRows: 2})
+		rep := NewQuotaStats(db, db, 1)
+
+		for _, date := range []string{"2021-01-01", "2021-01-02"} {
+			if err := rep.Storage(ctx, Data{Date: date}); err != nil {
+				t.Fatalf("%s: Storage within quota: %v", backend.name, err)
+			}
+		}
+		if err := rep.Storage(ctx, Data{Date: "2021-01-03"}); err != ErrQuotaExceeded {
+			t.Fatalf("%s: Storage over quota: got %v; expected %v", backend.name, err, ErrQuotaExceeded)
+		}
+		// существующая дата обновляется и при исчерпанной квоте
+		if err := rep.Update(ctx, Data{Date: "2021-01-01", Views: 1}); err != nil {
+			t.Fatal(err)
+		}
+		// арендатор без записи ограничен квотой по умолчанию
+		other := WithTenant(ctx, "globex")
+		rep.Storage(other, Data{Date: "2021-01-01"})
+		if err := rep.Storage(other, Data{Date: "2021-01-02"}); err != ErrQuotaExceeded {
+			t.Fatalf("%s: default quota: got %v; expected %v", backend.name, err, ErrQuotaExceeded)
+		}
+	}
+
+	// пакет, превышающий квоту, не записывается целиком
+	db := openTestDB(t, "sqlite", "")
+	rep := NewQuotaStats(db, db, 2)
+	err := rep.Batch(ctx, func(tx StatsRepository) error {
+		for _, date := range []string{"2021-01-01", "2021-01-02", "2021-01-03"} {
+			if err := tx.Storage(ctx, Data{Date: date}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if count, _ := db.CountStats(ctx); err != ErrQuotaExceeded || count != 0 {
+		t.Fatalf("Batch over quota: got %v and %d dates; expected %v and 0", err, count, ErrQuotaExceeded)
+	}
+}
+
+func TestCanceledQuery(t *testing.T) {
+	h := openTestDB(t, "sqlite", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.FindByPeriodDate(ctx, "2021-01-01", "2021-12-31"); err != context.Canceled {
+		t.Fatalf("FindByPeriodDate with canceled context: got %v; expected %v", err, context.Canceled)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	ctx := context.Background()
+	h := openTestDB(t, "sqlite", "")
+	err := h.Batch(ctx, func(tx StatsRepository) error {
+		if err := tx.Storage(ctx, Data{Date: "2021-01-01", Views: 1}); err != nil {
+			return err
+		}
+		// несуществующая дата не относится ни к одному периоду
+		return tx.Storage(ctx, Data{Date: "2021-02-30", Views: 2})
+	})
+	if err == nil {
+		t.Fatal("expected invalid date error")
+	}
+	if data, _ := h.FindByPeriodGranularity(ctx, "2021-01-01", "2021-01-31", GranularityMonth); len(data) != 0 {
+		t.Fatalf("got %+v; expected batch rolled back with rollups", data)
+	}
+	if _, err := h.FindByDate(ctx, "2021-01-01"); err != sql.ErrNoRows {
+		t.Fatalf("got %v; expected batch rolled back", err)
+	}
+}
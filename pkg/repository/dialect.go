@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"statistics/pkg/tracing"
+)
+
+// Dialect особенности SQL и драйвера конкретной СУБД.
+// Нулевое значение соответствует MySQL
+type Dialect struct {
+	// Driver имя драйвера database/sql
+	Driver string
+	// Numbered плейсхолдеры параметров нумеруются ($1, $2, ...) вместо ?
+	Numbered bool
+	// Returning идентификатор вставленной строки возвращается
+	// через RETURNING id, а не LastInsertId
+	Returning bool
+	// OnConflict вставка с обновлением существующей строки записывается
+	// через ON CONFLICT ... DO UPDATE, а не ON DUPLICATE KEY UPDATE
+	OnConflict bool
+	// NoRowLocks СУБД не поддерживает SELECT ... FOR UPDATE,
+	// транзакции записи и так выполняются по очереди
+	NoRowLocks bool
+	// MaxOpenConns ограничение открытых соединений, 0 - по умолчанию
+	MaxOpenConns int
+	// Migrations каталог миграций схемы диалекта в migrations
+	Migrations string
+	// LockMigrations запрос, ожидающий блокировку миграций соединения
+	// и возвращающий 1, когда она получена; UnlockMigrations снимает ее.
+	// Пустой запрос - без блокировки (база с единственным соединением)
+	LockMigrations   string
+	UnlockMigrations string
+}
+
+// dialects поддерживаемые СУБД по имени в настройке DB_DRIVER.
+// Заполняется в файлах конкретных СУБД
+var dialects = map[string]Dialect{}
+
+// Open подключается к базе данных driver (mysql, postgres или sqlite)
+// и возвращает репозиторий, работающий с ее диалектом SQL.
+// Схема базы не изменяется, ее создают миграции (Migrate)
+func Open(driver, dsn string) (*StatsDB, error) {
+	dialect, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("repository: unknown driver %q", driver)
+	}
+	db, err := sql.Open(dialect.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(dialect.MaxOpenConns)
+	}
+	return &StatsDB{DB: db, Dialect: dialect}, nil
+}
+
+// rebind заменяет плейсхолдеры ? в запросе на синтаксис диалекта
+func (h *StatsDB) rebind(query string) string {
+	if !h.Dialect.Numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// forUpdate возвращает окончание запроса SELECT, блокирующее
+// прочитанные строки до конца транзакции
+func (h *StatsDB) forUpdate() string {
+	if h.Dialect.NoRowLocks {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// conn общие методы *sql.DB и *sql.Tx
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn возвращает транзакцию репозитория или пул соединений
+func (h *StatsDB) conn() conn {
+	if h.tx != nil {
+		return h.tx
+	}
+	return h.DB
+}
+
+// inTx выполняет fn с репозиторием, запросы которого идут в одной
+// транзакции. Транзакция фиксируется, если fn не вернула ошибку.
+// Вложенный вызов использует уже открытую транзакцию. При временной
+// ошибке fn вызывается заново в новой транзакции
+func (h *StatsDB) inTx(ctx context.Context, fn func(tx *StatsDB) error) error {
+	if h.tx != nil {
+		return fn(h)
+	}
+	// транзакция, прерванная временной ошибкой, выполняется заново
+	return h.retry(ctx, true, func() error {
+		tx, err := h.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(&StatsDB{DB: h.DB, Dialect: h.Dialect, Retry: h.Retry, tx: tx}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// statement возвращает имя запроса для трассировки:
+// операцию и таблицу, например "SELECT stat"
+func statement(query string) string {
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return ""
+	}
+	op := strings.ToUpper(words[0])
+	for i, w := range words[:len(words)-1] {
+		switch strings.ToUpper(w) {
+		case "FROM", "INTO", "UPDATE":
+			return op + " " + strings.Trim(words[i+1], "(;")
+		}
+	}
+	return op
+}
+
+// startSQL начинает span запроса query. Для чтения span завершается
+// после выполнения запроса, до чтения строк результата
+func (h *StatsDB) startSQL(ctx context.Context, query string) *tracing.Span {
+	_, span := tracing.Start(ctx, statement(query),
+		"db.system", h.Dialect.Driver,
+		"db.statement", query)
+	return span
+}
+
+func (h *StatsDB) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	span := h.startSQL(ctx, query)
+	defer span.Finish()
+	var result sql.Result
+	err := h.retry(ctx, !readOnly(query), func() (err error) {
+		result, err = h.conn().ExecContext(ctx, h.rebind(query), args...)
+		return err
+	})
+	span.RecordError(err)
+	return result, err
+}
+
+func (h *StatsDB) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	span := h.startSQL(ctx, query)
+	defer span.Finish()
+	var rows *sql.Rows
+	err := h.retry(ctx, !readOnly(query), func() (err error) {
+		rows, err = h.conn().QueryContext(ctx, h.rebind(query), args...)
+		return err
+	})
+	span.RecordError(err)
+	return rows, err
+}
+
+func (h *StatsDB) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	span := h.startSQL(ctx, query)
+	defer span.Finish()
+	var row *sql.Row
+	err := h.retry(ctx, !readOnly(query), func() error {
+		row = h.conn().QueryRowContext(ctx, h.rebind(query), args...)
+		return row.Err()
+	})
+	if err != sql.ErrNoRows {
+		span.RecordError(err)
+	}
+	return row
+}
+
+// insert выполняет INSERT и возвращает идентификатор вставленной строки
+func (h *StatsDB) insert(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	if h.Dialect.Returning {
+		var id int64
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";") + " RETURNING id;"
+		err := h.queryRow(ctx, query, args...).Scan(&id)
+		return id, err
+	}
+	result, err := h.exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrLeaseLost ключ не зарезервирован запросом: после истечения аренды
+// его зарезервировал другой запрос, или ключ удален
+var ErrLeaseLost = errors.New("repository: idempotency key lease lost")
+
+// IdempotencyRepository интерфейс, описывающий возможные
+// действия с ключами идемпотентности запросов
+type IdempotencyRepository interface {
+	ReserveKey(ctx context.Context, key IdempotencyKey) (IdempotencyKey, bool, error)
+	ReplaceKey(ctx context.Context, key IdempotencyKey, expired, now time.Time) (bool, error)
+	CompleteKey(ctx context.Context, key IdempotencyKey) error
+	DeleteKey(ctx context.Context, key IdempotencyKey) error
+	DeleteExpiredKeys(ctx context.Context, before, now time.Time) (int, error)
+}
+
+// IdempotencyKey ключ идемпотентности с отпечатком запроса и его результатом.
+// Status 0 - запрос с ключом еще обрабатывается
+type IdempotencyKey struct {
+	Key         string
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        string
+	Created     time.Time
+	// LockedUntil срок аренды ключа обрабатываемого запроса. Ключ запроса,
+	// не завершенного к этому времени (например, при аварийной остановке
+	// сервиса), можно зарезервировать заново. Нулевой - аренда истекла
+	LockedUntil time.Time
+}
+
+const idempotencyColumns = "idem_key, fingerprint, status, content_type, body, created, locked_until"
+
+// lockedUntil возвращает срок аренды ключа для записи, NULL - без аренды.
+// Срок округляется вверх до секунды: DATETIME в MySQL хранит секунды,
+// а резервирование запроса узнается по точному сроку (см. reserved)
+func lockedUntil(key IdempotencyKey) sql.NullTime {
+	locked := key.LockedUntil.UTC()
+	if rounded := locked.Truncate(time.Second); rounded.Before(locked) {
+		locked = rounded.Add(time.Second)
+	}
+	return sql.NullTime{Time: locked, Valid: !key.LockedUntil.IsZero()}
+}
+
+// reserved возвращает условие WHERE, выбирающее ключ, пока он
+// зарезервирован запросом key: ключ того же запроса с той же арендой
+// еще обрабатывается
+func reserved(key IdempotencyKey) (string, []interface{}) {
+	where := "idem_key = ? AND fingerprint = ? AND status = 0 AND "
+	if key.LockedUntil.IsZero() {
+		return where + "locked_until IS NULL", []interface{}{key.Key, key.Fingerprint}
+	}
+	return where + "locked_until = ?", []interface{}{key.Key, key.Fingerprint, lockedUntil(key)}
+}
+
+// isReserved сообщает, что сохраненный ключ existing зарезервирован запросом key
+func isReserved(existing, key IdempotencyKey) bool {
+	return existing.Fingerprint == key.Fingerprint && existing.Status == 0 && existing.LockedUntil.Equal(key.LockedUntil)
+}
+
+// leaseExpired проверяет, что запрос с ключом key обрабатывается,
+// но его аренда истекла к now
+func leaseExpired(key IdempotencyKey, now time.Time) bool {
+	return key.Status == 0 && !key.LockedUntil.After(now)
+}
+
+// ReserveKey записывает новый ключ. Если ключ уже записан,
+// возвращает сохраненную запись и false
+func (h *StatsDB) ReserveKey(ctx context.Context, key IdempotencyKey) (IdempotencyKey, bool, error) {
+	_, insertErr := h.exec(ctx,
+		"INSERT INTO idempotency_key ("+idempotencyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?);",
+		key.Key,
+		key.Fingerprint,
+		key.Status,
+		key.ContentType,
+		key.Body,
+		key.Created.UTC(),
+		lockedUntil(key),
+	)
+	if insertErr == nil {
+		return key, true, nil
+	}
+	// ошибка вставки из-за существующего ключа не отличается
+	// от остальных одинаково во всех драйверах, поэтому ключ ищется
+	existing := IdempotencyKey{}
+	// ключи, записанные до появления аренды, ее не имеют
+	var locked sql.NullTime
+	err := h.queryRow(ctx,
+		"SELECT "+idempotencyColumns+" FROM idempotency_key WHERE idem_key = ?;", key.Key).
+		Scan(&existing.Key, &existing.Fingerprint, &existing.Status,
+			&existing.ContentType, &existing.Body, &existing.Created, &locked)
+	if err == sql.ErrNoRows {
+		return existing, false, checkError(ctx, "ReserveKey", insertErr)
+	}
+	if err != nil {
+		return existing, false, checkError(ctx, "ReserveKey", err)
+	}
+	existing.LockedUntil = locked.Time
+	return existing, false, nil
+}
+
+// ReplaceKey заменяет записанный ключ новым резервированием key, если
+// сохраненный результат создан не позже expired или аренда обрабатываемого
+// запроса истекла к now. Возвращает false, если ключ не заменен
+func (h *StatsDB) ReplaceKey(ctx context.Context, key IdempotencyKey, expired, now time.Time) (bool, error) {
+	result, err := h.exec(ctx,
+		"UPDATE idempotency_key SET fingerprint = ?, status = ?, content_type = ?, body = ?, created = ?, locked_until = ? "+
+			"WHERE idem_key = ? AND ((status <> 0 AND created <= ?) OR "+
+			"(status = 0 AND (locked_until IS NULL OR locked_until <= ?)));",
+		key.Fingerprint,
+		key.Status,
+		key.ContentType,
+		key.Body,
+		key.Created.UTC(),
+		lockedUntil(key),
+		key.Key,
+		expired.UTC(),
+		now.UTC(),
+	)
+	if err != nil {
+		return false, checkError(ctx, "ReplaceKey", err)
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, checkError(ctx, "ReplaceKey", err)
+}
+
+// CompleteKey сохраняет результат запроса, зарезервировавшего ключ key
+// (отпечаток и аренда key). Если ключ зарезервирован другим запросом,
+// возвращает ErrLeaseLost и не изменяет его
+func (h *StatsDB) CompleteKey(ctx context.Context, key IdempotencyKey) error {
+	where, args := reserved(key)
+	result, err := h.exec(ctx,
+		"UPDATE idempotency_key SET status = ?, content_type = ?, body = ? WHERE "+where+";",
+		append([]interface{}{key.Status, key.ContentType, key.Body}, args...)...)
+	return checkError(ctx, "CompleteKey", leaseLost(result, err))
+}
+
+// DeleteKey удаляет ключ, зарезервированный запросом key. Если ключ
+// зарезервирован другим запросом, возвращает ErrLeaseLost и не удаляет его
+func (h *StatsDB) DeleteKey(ctx context.Context, key IdempotencyKey) error {
+	where, args := reserved(key)
+	result, err := h.exec(ctx, "DELETE FROM idempotency_key WHERE "+where+";", args...)
+	return checkError(ctx, "DeleteKey", leaseLost(result, err))
+}
+
+// leaseLost возвращает ErrLeaseLost, если запрос по резервированию
+// ключа не изменил ни одной строки
+func leaseLost(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err == nil && rows == 0 {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// DeleteExpiredKeys удаляет ключи, созданные раньше before, кроме ключей
+// запросов, аренда которых не истекла к now, и возвращает их количество
+func (h *StatsDB) DeleteExpiredKeys(ctx context.Context, before, now time.Time) (int, error) {
+	result, err := h.exec(ctx,
+		"DELETE FROM idempotency_key WHERE created < ? AND "+
+			"(status <> 0 OR locked_until IS NULL OR locked_until <= ?);",
+		before.UTC(), now.UTC())
+	if err != nil {
+		return 0, checkError(ctx, "DeleteExpiredKeys", err)
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), checkError(ctx, "DeleteExpiredKeys", err)
+}
@@ -0,0 +1,554 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Repository объединяет все хранилища сервиса.
+// Реализуется StatsDB и MemoryDB
+type Repository interface {
+	StatsRepository
+	BudgetRepository
+	WebhookRepository
+	IdempotencyRepository
+	APIKeyRepository
+	TenantRepository
+}
+
+// MemoryDB потокобезопасный репозиторий в памяти процесса.
+// Позволяет запускать сервис и тесты без базы данных, данные теряются при остановке.
+// Операции не блокируются на вводе-выводе, поэтому контекст не проверяется
+type MemoryDB struct {
+	mu sync.RWMutex
+	// batch выполняет пакеты по очереди, как транзакции с блокировкой строк
+	batch sync.Mutex
+	// stats статистика по арендаторам и датам
+	stats      map[string]map[string]Data
+	budgets    map[int64]Budget
+	alerts     []Alert
+	webhooks   map[int64]Webhook
+	deliveries []Delivery
+	keys       map[string]IdempotencyKey
+	apiKeys    map[int64]APIKey
+	audit      []AuditEntry
+	quotas     map[string]Tenant
+	// owners арендаторы бюджетов, оповещений и подписок по идентификатору
+	owners map[int64]string
+	lastID int64
+}
+
+// NewMemoryDB возвращает пустой репозиторий в памяти
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		stats:    map[string]map[string]Data{},
+		budgets:  map[int64]Budget{},
+		webhooks: map[int64]Webhook{},
+		keys:     map[string]IdempotencyKey{},
+		apiKeys:  map[int64]APIKey{},
+		quotas:   map[string]Tenant{},
+		owners:   map[int64]string{},
+	}
+}
+
+// nextID возвращает новый идентификатор записи, вызывается под блокировкой
+func (m *MemoryDB) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+// owned проверяет, что бюджет, оповещение или подписка id принадлежит
+// арендатору контекста, вызывается под блокировкой
+func (m *MemoryDB) owned(ctx context.Context, id int64) bool {
+	return m.owners[id] == TenantFromContext(ctx)
+}
+
+// FindByDate находит запись по заданной дате
+func (m *MemoryDB) FindByDate(ctx context.Context, date string) (Data, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.stats[TenantFromContext(ctx)][date]
+	if !ok {
+		return Data{}, sql.ErrNoRows
+	}
+	return data, nil
+}
+
+// Storage записывает входные данные. Если дата уже записана,
+// clicks и views прибавляются к записи, а cost заменяется, как в StatsDB
+func (m *MemoryDB) Storage(ctx context.Context, data Data) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	if m.stats[tenant] == nil {
+		m.stats[tenant] = map[string]Data{}
+	}
+	if old, ok := m.stats[tenant][data.Date]; ok {
+		data.Views += old.Views
+		data.Clicks += old.Clicks
+	}
+	m.stats[tenant][data.Date] = data
+	return nil
+}
+
+// Update обновляет запись с уже существующей датой
+func (m *MemoryDB) Update(ctx context.Context, data Data) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats[TenantFromContext(ctx)]
+	if _, ok := stats[data.Date]; ok {
+		stats[data.Date] = data
+	}
+	return nil
+}
+
+// FindByPeriodDate находит записи, которые >= from и <= to, упорядоченные по дате
+func (m *MemoryDB) FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Data{}
+	for date, data := range m.stats[TenantFromContext(ctx)] {
+		if date >= from && date <= to {
+			result = append(result, data)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result, nil
+}
+
+// Batch выполняет fn над репозиторием. Пакеты выполняются по очереди,
+// поэтому чтение и запись даты в пакете не теряют изменений других пакетов.
+// Операции в памяти не откатываются: при ошибке fn уже выполненные
+// изменения сохраняются
+func (m *MemoryDB) Batch(ctx context.Context, fn func(rep StatsRepository) error) error {
+	m.batch.Lock()
+	defer m.batch.Unlock()
+	return fn(m)
+}
+
+// Transactional is part of Transactor
+func (m *MemoryDB) Transactional() bool {
+	return false
+}
+
+// FindByPeriodGranularity возвращает суммы статистики за период [from, to]
+// по дням, неделям или месяцам. Агрегаты считаются по дневным записям
+func (m *MemoryDB) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]Data, error) {
+	data, _ := m.FindByPeriodDate(ctx, from, to)
+	if _, ok := rollupTables[granularity]; !ok {
+		return data, nil
+	}
+	return aggregate(data, granularity)
+}
+
+// DeleteFromRepository удаляет статистику арендатора
+// и возвращает количество удаленных записей
+func (m *MemoryDB) DeleteFromRepository(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant := TenantFromContext(ctx)
+	affected := len(m.stats[tenant])
+	delete(m.stats, tenant)
+	return affected, nil
+}
+
+// StoreBudget записывает новый бюджет и возвращает его идентификатор
+func (m *MemoryDB) StoreBudget(ctx context.Context, budget Budget) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	budget.ID = m.nextID()
+	m.budgets[budget.ID] = budget
+	m.owners[budget.ID] = TenantFromContext(ctx)
+	return budget.ID, nil
+}
+
+// FindBudget находит бюджет по идентификатору
+func (m *MemoryDB) FindBudget(ctx context.Context, id int64) (Budget, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	budget, ok := m.budgets[id]
+	if !ok || !m.owned(ctx, id) {
+		return Budget{}, ErrNotFound
+	}
+	return budget, nil
+}
+
+// FindBudgets возвращает все бюджеты
+func (m *MemoryDB) FindBudgets(ctx context.Context) ([]Budget, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Budget{}
+	for _, budget := range m.budgets {
+		if m.owned(ctx, budget.ID) {
+			result = append(result, budget)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// UpdateBudget обновляет бюджет с идентификатором budget.ID
+func (m *MemoryDB) UpdateBudget(ctx context.Context, budget Budget) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.budgets[budget.ID]; ok && m.owned(ctx, budget.ID) {
+		m.budgets[budget.ID] = budget
+	}
+	return nil
+}
+
+// DeleteBudget удаляет бюджет вместе с его оповещениями
+func (m *MemoryDB) DeleteBudget(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.budgets[id]; !ok || !m.owned(ctx, id) {
+		return ErrNotFound
+	}
+	delete(m.budgets, id)
+	alerts := m.alerts[:0]
+	for _, alert := range m.alerts {
+		if alert.BudgetID != id {
+			alerts = append(alerts, alert)
+		}
+	}
+	m.alerts = alerts
+	return nil
+}
+
+// StoreAlert записывает оповещение и возвращает его идентификатор
+func (m *MemoryDB) StoreAlert(ctx context.Context, alert Alert) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alert.ID = m.nextID()
+	m.alerts = append(m.alerts, alert)
+	m.owners[alert.ID] = TenantFromContext(ctx)
+	return alert.ID, nil
+}
+
+// FindAlert находит оповещение бюджета за период, начинающийся с periodStart
+func (m *MemoryDB) FindAlert(ctx context.Context, budgetID int64, periodStart string) (Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, alert := range m.alerts {
+		if alert.BudgetID == budgetID && alert.PeriodStart == periodStart && m.owned(ctx, alert.ID) {
+			return alert, nil
+		}
+	}
+	return Alert{}, ErrNotFound
+}
+
+// FindAlerts возвращает все оповещения, начиная с последних
+func (m *MemoryDB) FindAlerts(ctx context.Context) ([]Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Alert{}
+	for i := len(m.alerts) - 1; i >= 0; i-- {
+		if m.owned(ctx, m.alerts[i].ID) {
+			result = append(result, m.alerts[i])
+		}
+	}
+	return result, nil
+}
+
+// StoreWebhook записывает подписку и возвращает ее идентификатор
+func (m *MemoryDB) StoreWebhook(ctx context.Context, hook Webhook) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hook.ID = m.nextID()
+	hook.Events = append([]string(nil), hook.Events...)
+	m.webhooks[hook.ID] = hook
+	m.owners[hook.ID] = TenantFromContext(ctx)
+	return hook.ID, nil
+}
+
+// FindWebhook находит подписку по идентификатору
+func (m *MemoryDB) FindWebhook(ctx context.Context, id int64) (Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hook, ok := m.webhooks[id]
+	if !ok || !m.owned(ctx, id) {
+		return Webhook{}, ErrNotFound
+	}
+	hook.Events = append([]string(nil), hook.Events...)
+	return hook, nil
+}
+
+// FindWebhooks возвращает все подписки арендатора контекста
+func (m *MemoryDB) FindWebhooks(ctx context.Context) ([]Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Webhook{}
+	for _, hook := range m.webhooks {
+		if !m.owned(ctx, hook.ID) {
+			continue
+		}
+		hook.Events = append([]string(nil), hook.Events...)
+		result = append(result, hook)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// DeleteWebhook удаляет подписку вместе с журналом ее доставок
+func (m *MemoryDB) DeleteWebhook(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok || !m.owned(ctx, id) {
+		return ErrNotFound
+	}
+	delete(m.webhooks, id)
+	deliveries := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.WebhookID != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
+
+// StoreDelivery ставит доставку в очередь и возвращает ее идентификатор
+func (m *MemoryDB) StoreDelivery(ctx context.Context, delivery Delivery) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delivery.ID = m.nextID()
+	delivery.Tenant = TenantFromContext(ctx)
+	m.deliveries = append(m.deliveries, delivery)
+	return delivery.ID, nil
+}
+
+// UpdateDelivery сохраняет результат попытки доставки
+func (m *MemoryDB) UpdateDelivery(ctx context.Context, delivery Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == delivery.ID {
+			m.deliveries[i] = delivery
+		}
+	}
+	return nil
+}
+
+// FindDueDeliveries возвращает не более limit ожидающих доставок,
+// время очередной попытки которых наступило к моменту now
+func (m *MemoryDB) FindDueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Delivery{}
+	for _, d := range m.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttempt.After(now) {
+			result = append(result, d)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].NextAttempt.Before(result[j].NextAttempt) })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// FindDeliveries возвращает журнал последних limit доставок подписки
+func (m *MemoryDB) FindDeliveries(ctx context.Context, webhookID int64, limit int) ([]Delivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Delivery{}
+	for i := len(m.deliveries) - 1; i >= 0 && len(result) < limit; i-- {
+		if m.deliveries[i].WebhookID == webhookID {
+			result = append(result, m.deliveries[i])
+		}
+	}
+	return result, nil
+}
+
+// ReserveKey записывает новый ключ. Если ключ уже записан,
+// возвращает сохраненную запись и false
+func (m *MemoryDB) ReserveKey(ctx context.Context, key IdempotencyKey) (IdempotencyKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.keys[key.Key]; ok {
+		return existing, false, nil
+	}
+	m.keys[key.Key] = key
+	return key, true, nil
+}
+
+// CompleteKey сохраняет результат запроса, зарезервировавшего ключ key.
+// Если ключ зарезервирован другим запросом, возвращает ErrLeaseLost
+func (m *MemoryDB) CompleteKey(ctx context.Context, key IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.keys[key.Key]
+	if !ok || !isReserved(existing, key) {
+		return ErrLeaseLost
+	}
+	existing.Status = key.Status
+	existing.ContentType = key.ContentType
+	existing.Body = key.Body
+	m.keys[key.Key] = existing
+	return nil
+}
+
+// DeleteKey удаляет ключ, зарезервированный запросом key.
+// Если ключ зарезервирован другим запросом, возвращает ErrLeaseLost
+func (m *MemoryDB) DeleteKey(ctx context.Context, key IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.keys[key.Key]
+	if !ok || !isReserved(existing, key) {
+		return ErrLeaseLost
+	}
+	delete(m.keys, key.Key)
+	return nil
+}
+
+// ReplaceKey заменяет записанный ключ новым резервированием key, если
+// сохраненный результат создан не позже expired или аренда обрабатываемого
+// запроса истекла к now. Возвращает false, если ключ не заменен
+func (m *MemoryDB) ReplaceKey(ctx context.Context, key IdempotencyKey, expired, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.keys[key.Key]
+	if !ok || !(existing.Status != 0 && !existing.Created.After(expired) || leaseExpired(existing, now)) {
+		return false, nil
+	}
+	m.keys[key.Key] = key
+	return true, nil
+}
+
+// DeleteExpiredKeys удаляет ключи, созданные раньше before, кроме ключей
+// запросов, аренда которых не истекла к now, и возвращает их количество
+func (m *MemoryDB) DeleteExpiredKeys(ctx context.Context, before, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for name, key := range m.keys {
+		if key.Created.Before(before) && (key.Status != 0 || leaseExpired(key, now)) {
+			delete(m.keys, name)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// StoreAPIKey записывает ключ и возвращает его идентификатор
+func (m *MemoryDB) StoreAPIKey(ctx context.Context, key APIKey) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key.ID = m.nextID()
+	key.Scopes = append([]string(nil), key.Scopes...)
+	m.apiKeys[key.ID] = key
+	return key.ID, nil
+}
+
+// FindAPIKey находит ключ по открытой части
+func (m *MemoryDB) FindAPIKey(ctx context.Context, prefix string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range m.apiKeys {
+		if key.Prefix == prefix {
+			key.Scopes = append([]string(nil), key.Scopes...)
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+// FindAPIKeys возвращает все ключи, включая отозванные
+func (m *MemoryDB) FindAPIKeys(ctx context.Context) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []APIKey{}
+	for _, key := range m.apiKeys {
+		key.Scopes = append([]string(nil), key.Scopes...)
+		result = append(result, key)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// RevokeAPIKey отзывает ключ. Время отзыва уже отозванного ключа не меняется
+func (m *MemoryDB) RevokeAPIKey(ctx context.Context, id int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if key.Revoked.IsZero() {
+		key.Revoked = at
+		m.apiKeys[id] = key
+	}
+	return nil
+}
+
+// StoreAudit записывает запись журнала аудита и возвращает ее идентификатор
+func (m *MemoryDB) StoreAudit(ctx context.Context, entry AuditEntry) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ID = m.nextID()
+	m.audit = append(m.audit, entry)
+	return entry.ID, nil
+}
+
+// FindAudit возвращает последние limit записей журнала аудита, начиная с последних
+func (m *MemoryDB) FindAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, m.audit[i])
+	}
+	return result, nil
+}
+
+// StoreTenant записывает квоту арендатора, заменяя прежнюю
+func (m *MemoryDB) StoreTenant(ctx context.Context, tenant Tenant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenant.Rows = 0
+	m.quotas[tenant.Name] = tenant
+	return nil
+}
+
+// FindTenant находит квоту арендатора по имени
+func (m *MemoryDB) FindTenant(ctx context.Context, name string) (Tenant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tenant, ok := m.quotas[name]
+	if !ok {
+		return Tenant{}, ErrNotFound
+	}
+	return tenant, nil
+}
+
+// FindTenants возвращает арендаторов с квотами и арендаторов,
+// у которых есть статистика, с количеством их дат
+func (m *MemoryDB) FindTenants(ctx context.Context) ([]Tenant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tenants := map[string]*Tenant{}
+	for name, tenant := range m.quotas {
+		tenant := tenant
+		tenants[name] = &tenant
+	}
+	for name, stats := range m.stats {
+		if len(stats) == 0 {
+			continue
+		}
+		if _, ok := tenants[name]; !ok {
+			tenants[name] = &Tenant{Name: name}
+		}
+		tenants[name].Rows = len(stats)
+	}
+	return sortTenants(tenants), nil
+}
+
+// CountStats возвращает количество дат статистики арендатора контекста
+func (m *MemoryDB) CountStats(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.stats[TenantFromContext(ctx)]), nil
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDBConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryDB()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for day := 1; day <= 28; day++ {
+				date := fmt.Sprintf("2021-%02d-%02d", i+1, day)
+				m.Storage(ctx, Data{Date: date, Views: day})
+				m.FindByPeriodDate(ctx, "2021-01-01", "2021-12-31")
+				m.StoreBudget(ctx, Budget{Name: date})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, _ := m.FindByPeriodDate(ctx, "2021-01-01", "2021-12-31")
+	if len(data) != 8*28 {
+		t.Fatalf("got %d rows; expected %d", len(data), 8*28)
+	}
+	for i := 1; i < len(data); i++ {
+		if data[i-1].Date >= data[i].Date {
+			t.Fatalf("rows aren't ordered by date: %s before %s", data[i-1].Date, data[i].Date)
+		}
+	}
+	budgets, _ := m.FindBudgets(ctx)
+	if len(budgets) != 8*28 || budgets[len(budgets)-1].ID != int64(8*28) {
+		t.Fatalf("got %d budgets; expected %d with unique ids", len(budgets), 8*28)
+	}
+}
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"statistics/pkg/metrics"
+)
+
+// MeteredStats декоратор StatsRepository, измеряющий длительность
+// и считающий ошибки вызовов каждого метода
+type MeteredStats struct {
+	rep      StatsRepository
+	duration *metrics.HistogramVec
+	errors   *metrics.CounterVec
+}
+
+// NewMeteredStats возвращает декоратор rep, метрики которого
+// регистрируются в reg
+func NewMeteredStats(rep StatsRepository, reg *metrics.Registry) *MeteredStats {
+	return &MeteredStats{
+		rep: rep,
+		duration: reg.NewHistogramVec("statistics_repository_duration_seconds",
+			"Duration of statistics repository calls.", nil, "method"),
+		errors: reg.NewCounterVec("statistics_repository_errors_total",
+			"Number of failed statistics repository calls.", "method"),
+	}
+}
+
+// observe учитывает вызов method, начатый в start и завершившийся err
+func (m *MeteredStats) observe(method string, start time.Time, err error) {
+	m.duration.Observe(time.Since(start).Seconds(), method)
+	if err != nil {
+		m.errors.Inc(method)
+	}
+}
+
+// FindByDate is part of StatsRepository
+func (m *MeteredStats) FindByDate(ctx context.Context, date string) (Data, error) {
+	start := time.Now()
+	data, err := m.rep.FindByDate(ctx, date)
+	// отсутствие записи за дату - обычный результат, а не ошибка базы
+	if err == sql.ErrNoRows {
+		m.observe("FindByDate", start, nil)
+	} else {
+		m.observe("FindByDate", start, err)
+	}
+	return data, err
+}
+
+// Storage is part of StatsRepository
+func (m *MeteredStats) Storage(ctx context.Context, data Data) error {
+	start := time.Now()
+	err := m.rep.Storage(ctx, data)
+	m.observe("Storage", start, err)
+	return err
+}
+
+// Update is part of StatsRepository
+func (m *MeteredStats) Update(ctx context.Context, data Data) error {
+	start := time.Now()
+	err := m.rep.Update(ctx, data)
+	m.observe("Update", start, err)
+	return err
+}
+
+// FindByPeriodDate is part of StatsRepository
+func (m *MeteredStats) FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error) {
+	start := time.Now()
+	data, err := m.rep.FindByPeriodDate(ctx, from, to)
+	m.observe("FindByPeriodDate", start, err)
+	return data, err
+}
+
+// FindByPeriodGranularity is part of StatsRepository
+func (m *MeteredStats) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]Data, error) {
+	start := time.Now()
+	data, err := m.rep.FindByPeriodGranularity(ctx, from, to, granularity)
+	m.observe("FindByPeriodGranularity", start, err)
+	return data, err
+}
+
+// DeleteFromRepository is part of StatsRepository
+func (m *MeteredStats) DeleteFromRepository(ctx context.Context) (int, error) {
+	start := time.Now()
+	affected, err := m.rep.DeleteFromRepository(ctx)
+	m.observe("DeleteFromRepository", start, err)
+	return affected, err
+}
+
+// Batch выполняет fn в транзакции репозитория, если он реализует Batcher.
+// Вызовы внутри транзакции измеряются так же, как вне ее
+func (m *MeteredStats) Batch(ctx context.Context, fn func(rep StatsRepository) error) error {
+	batcher, ok := m.rep.(Batcher)
+	if !ok {
+		return fn(m)
+	}
+	start := time.Now()
+	err := batcher.Batch(ctx, func(rep StatsRepository) error {
+		tx := *m
+		tx.rep = rep
+		return fn(&tx)
+	})
+	m.observe("Batch", start, err)
+	return err
+}
+
+// Transactional is part of Transactor
+func (m *MeteredStats) Transactional() bool {
+	return IsTransactional(m.rep)
+}
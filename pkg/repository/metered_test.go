@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"statistics/pkg/metrics"
+)
+
+func TestMeteredStatsConformance(t *testing.T) {
+	testStatsRepository(t, NewMeteredStats(NewMemoryDB(), metrics.NewRegistry()))
+}
+
+func TestMeteredStats(t *testing.T) {
+	ctx := context.Background()
+	m := NewMeteredStats(openTestDB(t, "sqlite", ""), metrics.NewRegistry())
+
+	// отсутствие записи не считается ошибкой
+	m.FindByDate(ctx, "2021-01-01")
+	err := m.Batch(ctx, func(tx StatsRepository) error {
+		if err := tx.Storage(ctx, Data{Date: "2021-01-01"}); err != nil {
+			return err
+		}
+		return tx.Storage(ctx, Data{Date: "2021-02-30"})
+	})
+	if err == nil {
+		t.Fatal("expected invalid date error")
+	}
+	if n := m.duration.Count("FindByDate"); n != 1 || m.errors.Value("FindByDate") != 0 {
+		t.Fatalf("FindByDate: got %d calls and %v errors; expected 1 call without errors", n, m.errors.Value("FindByDate"))
+	}
+	if n := m.duration.Count("Storage"); n != 2 || m.errors.Value("Storage") != 1 {
+		t.Fatalf("Storage in batch: got %d calls and %v errors; expected 2 and 1", n, m.errors.Value("Storage"))
+	}
+	if m.errors.Value("Batch") != 1 {
+		t.Fatalf("Batch: got %v errors; expected 1", m.errors.Value("Batch"))
+	}
+}
@@ -0,0 +1,360 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"statistics/pkg/logging"
+)
+
+// Миграции схемы хранятся в migrations/<диалект> в файлах
+// NNNN_name.up.sql и NNNN_name.down.sql и встраиваются в бинарный файл.
+// Примененные версии записываются в таблицу schema_version вместе с
+// контрольной суммой up-скрипта: изменение уже примененной миграции
+// обнаруживается до запуска следующих. Экземпляры сервиса применяют
+// миграции по очереди под блокировкой миграций диалекта
+
+//go:embed migrations
+var migrationFS embed.FS
+
+// LatestVersion цель Migrate: последняя известная версия схемы
+const LatestVersion = -1
+
+// schemaVersionTable таблица примененных миграций. Время применения
+// хранится строкой RFC3339 в UTC, чтобы DDL был одинаковым для всех СУБД
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+  version INT NOT NULL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  checksum CHAR(64) NOT NULL,
+  applied VARCHAR(32) NOT NULL
+)`
+
+// Migration версия схемы базы данных
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationState состояние версии схемы в базе.
+// Unknown - версия применена, но отсутствует в бинарном файле (база новее);
+// Modified - up-скрипт изменился после применения
+type MigrationState struct {
+	Version  int
+	Name     string
+	Applied  string
+	Unknown  bool
+	Modified bool
+}
+
+// Pending миграция еще не применена
+func (s MigrationState) Pending() bool {
+	return s.Applied == ""
+}
+
+// appliedVersion запись таблицы schema_version
+type appliedVersion struct {
+	name     string
+	checksum string
+	applied  string
+}
+
+// loadMigrations читает миграции каталога dir, упорядоченные по версии
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		var base string
+		up := strings.HasSuffix(name, ".up.sql")
+		switch {
+		case up:
+			base = strings.TrimSuffix(name, ".up.sql")
+		case strings.HasSuffix(name, ".down.sql"):
+			base = strings.TrimSuffix(name, ".down.sql")
+		default:
+			continue
+		}
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 || len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("repository: bad migration file name %q", name)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("repository: migration %d has different names %q and %q", version, m.Name, parts[1])
+		}
+		if up {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+	result := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("repository: migration %d_%s needs both up and down scripts", m.Version, m.Name)
+		}
+		sum := sha256.Sum256([]byte(m.Up))
+		m.Checksum = hex.EncodeToString(sum[:])
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// statements разбивает скрипт на отдельные запросы, отбрасывая комментарии
+func statements(script string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	result := []string{}
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			result = append(result, stmt)
+		}
+	}
+	return result
+}
+
+// Migrations возвращает миграции диалекта, встроенные в бинарный файл
+func (h *StatsDB) Migrations() ([]Migration, error) {
+	return loadMigrations(migrationFS, path.Join("migrations", h.Dialect.Migrations))
+}
+
+// Migrate приводит схему к версии target (LatestVersion - к последней,
+// 0 - откатывает все миграции) и возвращает выполненные миграции
+func (h *StatsDB) Migrate(ctx context.Context, target int) ([]Migration, error) {
+	migrations, err := h.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return h.migrate(ctx, migrations, target)
+}
+
+// Rollback откатывает steps последних примененных миграций
+func (h *StatsDB) Rollback(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := h.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := h.appliedVersions(ctx, h.DB)
+	if err != nil {
+		return nil, err
+	}
+	versions := []int{}
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	target := 0
+	if steps < len(versions) {
+		target = versions[len(versions)-steps-1]
+	}
+	return h.migrate(ctx, migrations, target)
+}
+
+// MigrationStatus возвращает состояние всех известных и примененных версий схемы
+func (h *StatsDB) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := h.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return h.migrationStatus(ctx, h.DB, migrations)
+}
+
+func (h *StatsDB) migrationStatus(ctx context.Context, c migrator, migrations []Migration) ([]MigrationState, error) {
+	applied, err := h.appliedVersions(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	result := []MigrationState{}
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if v, ok := applied[m.Version]; ok {
+			state.Applied = v.applied
+			state.Modified = v.checksum != m.Checksum
+			delete(applied, m.Version)
+		}
+		result = append(result, state)
+	}
+	for version, v := range applied {
+		result = append(result, MigrationState{Version: version, Name: v.name, Applied: v.applied, Unknown: true})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// migrator соединение, на котором выполняются миграции: пул соединений
+// или выделенное соединение, получившее блокировку миграций
+type migrator interface {
+	conn
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// lockMigrations ожидает блокировку миграций на выделенном соединении,
+// чтобы экземпляры, одновременно запущенные с AUTO_MIGRATE, не применяли
+// одни и те же миграции. Миграции выполняются на этом же соединении:
+// пул может быть ограничен одним соединением. Возвращает соединение
+// и функцию снятия блокировки
+func (h *StatsDB) lockMigrations(ctx context.Context) (migrator, func(), error) {
+	if h.Dialect.LockMigrations == "" {
+		return h.DB, func() {}, nil
+	}
+	c, err := h.DB.Conn(ctx)
+	if err != nil {
+		return nil, nil, checkError(ctx, "lockMigrations", err)
+	}
+	var locked sql.NullInt64
+	if err := c.QueryRowContext(ctx, h.Dialect.LockMigrations).Scan(&locked); err != nil {
+		c.Close()
+		return nil, nil, checkError(ctx, "lockMigrations", err)
+	}
+	if locked.Int64 != 1 {
+		c.Close()
+		return nil, nil, errors.New("repository: migrations are locked by another process")
+	}
+	unlock := func() {
+		if _, err := c.ExecContext(context.Background(), h.Dialect.UnlockMigrations); err != nil {
+			logging.Error(ctx, "Rep. lockMigrations. Unlock", "err", err)
+			// соединение с блокировкой не возвращается в пул: она снимается при его закрытии
+			c.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		c.Close()
+	}
+	return c, unlock, nil
+}
+
+// appliedVersions создает таблицу schema_version при необходимости
+// и возвращает примененные версии
+func (h *StatsDB) appliedVersions(ctx context.Context, c migrator) (map[int]appliedVersion, error) {
+	if _, err := c.ExecContext(ctx, schemaVersionTable); err != nil {
+		return nil, checkError(ctx, "appliedVersions", err)
+	}
+	rows, err := c.QueryContext(ctx, "SELECT version, name, checksum, applied FROM schema_version;")
+	if err != nil {
+		return nil, checkError(ctx, "appliedVersions", err)
+	}
+	defer rows.Close()
+	result := map[int]appliedVersion{}
+	for rows.Next() {
+		var version int
+		v := appliedVersion{}
+		if err := rows.Scan(&version, &v.name, &v.checksum, &v.applied); err != nil {
+			return nil, checkError(ctx, "appliedVersions", err)
+		}
+		result[version] = v
+	}
+	return result, checkError(ctx, "appliedVersions", rows.Err())
+}
+
+func (h *StatsDB) migrate(ctx context.Context, migrations []Migration, target int) ([]Migration, error) {
+	c, unlock, err := h.lockMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	states, err := h.migrationStatus(ctx, c, migrations)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if state.Unknown {
+			return nil, fmt.Errorf("repository: database has migration %d_%s unknown to this build", state.Version, state.Name)
+		}
+		if state.Modified {
+			return nil, fmt.Errorf("repository: applied migration %d_%s was modified (checksum mismatch)", state.Version, state.Name)
+		}
+	}
+	if target == LatestVersion {
+		target = 0
+		if len(migrations) > 0 {
+			target = migrations[len(migrations)-1].Version
+		}
+	}
+	known := target == 0
+	for _, m := range migrations {
+		known = known || m.Version == target
+	}
+	if !known {
+		return nil, fmt.Errorf("repository: unknown migration version %d", target)
+	}
+
+	done := []Migration{}
+	for i, m := range migrations {
+		if m.Version <= target && states[i].Pending() {
+			if err := h.applyMigration(ctx, c, m, true); err != nil {
+				return done, err
+			}
+			done = append(done, m)
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > target && !states[i].Pending() {
+			if err := h.applyMigration(ctx, c, m, false); err != nil {
+				return done, err
+			}
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// applyMigration выполняет up- или down-скрипт миграции в транзакции
+// вместе с записью в schema_version. DDL в MySQL фиксируется неявно,
+// поэтому там прерванная миграция может остаться частично примененной
+func (h *StatsDB) applyMigration(ctx context.Context, c migrator, m Migration, up bool) error {
+	script := m.Down
+	if up {
+		script = m.Up
+	}
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return checkError(ctx, "applyMigration", err)
+	}
+	defer tx.Rollback()
+	for _, stmt := range statements(script) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("repository: migration %d_%s: %v", m.Version, m.Name, err)
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, h.rebind("INSERT INTO schema_version (version, name, checksum, applied) VALUES (?, ?, ?, ?);"),
+			m.Version, m.Name, m.Checksum, time.Now().UTC().Format(time.RFC3339))
+	} else {
+		_, err = tx.ExecContext(ctx, h.rebind("DELETE FROM schema_version WHERE version = ?;"), m.Version)
+	}
+	if err != nil {
+		return checkError(ctx, "applyMigration", err)
+	}
+	return checkError(ctx, "applyMigration", tx.Commit())
+}
@@ -0,0 +1,313 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// migrationLock блокировка драйвера sqlite3_locking, повторяющая
+// GET_LOCK и RELEASE_LOCK MySQL для проверки миграций под блокировкой
+var migrationLock = make(chan struct{}, 1)
+
+func init() {
+	sql.Register("sqlite3_locking", &sqlite3.SQLiteDriver{ConnectHook: func(c *sqlite3.SQLiteConn) error {
+		err := c.RegisterFunc("GET_LOCK", func(name string, timeout int) int {
+			select {
+			case migrationLock <- struct{}{}:
+				return 1
+			case <-time.After(time.Duration(timeout) * time.Second):
+				return 0
+			}
+		}, false)
+		if err != nil {
+			return err
+		}
+		return c.RegisterFunc("RELEASE_LOCK", func(name string) int {
+			<-migrationLock
+			return 1
+		}, false)
+	}})
+	dialects["locking"] = Dialect{
+		Driver:           "sqlite3_locking",
+		OnConflict:       true,
+		NoRowLocks:       true,
+		MaxOpenConns:     1,
+		Migrations:       "sqlite",
+		LockMigrations:   "SELECT GET_LOCK('statistics_migrate', 10);",
+		UnlockMigrations: "SELECT RELEASE_LOCK('statistics_migrate');",
+	}
+}
+
+func testMigrations() fstest.MapFS {
+	return fstest.MapFS{
+		"m/0001_init.up.sql":     {Data: []byte("-- таблица\nCREATE TABLE a (id INT);\nCREATE TABLE b (id INT);\n")},
+		"m/0001_init.down.sql":   {Data: []byte("DROP TABLE b;\nDROP TABLE a;\n")},
+		"m/0002_index.up.sql":    {Data: []byte("CREATE UNIQUE INDEX a_id ON a (id);\n")},
+		"m/0002_index.down.sql":  {Data: []byte("DROP INDEX a_id;\n")},
+		"m/README.md":            {Data: []byte("not a migration")},
+		"m/0003_column.up.sql":   {Data: []byte("ALTER TABLE b ADD COLUMN name VARCHAR(255);\n")},
+		"m/0003_column.down.sql": {Data: []byte("ALTER TABLE b DROP COLUMN name;\n")},
+	}
+}
+
+func openEmptySQLite(t *testing.T) *StatsDB {
+	h, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.DB.Close() })
+	return h
+}
+
+func versions(list []Migration) []int {
+	result := []int{}
+	for _, m := range list {
+		result = append(result, m.Version)
+	}
+	return result
+}
+
+func TestLoadMigrations(t *testing.T) {
+	list, err := loadMigrations(testMigrations(), "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(list); len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("got versions %v; expected [1 2 3]", got)
+	}
+	if list[0].Name != "init" || list[0].Checksum == "" || list[0].Checksum == list[1].Checksum {
+		t.Fatalf("got %+v", list[0])
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"bad name":     {"m/init.up.sql": {}, "m/init.down.sql": {}},
+		"no down":      {"m/0001_init.up.sql": {Data: []byte("SELECT 1;")}},
+		"name differs": {"m/0001_a.up.sql": {Data: []byte("SELECT 1;")}, "m/0001_b.down.sql": {Data: []byte("SELECT 1;")}},
+	} {
+		if _, err := loadMigrations(fsys, "m"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	h := openEmptySQLite(t)
+	list, _ := loadMigrations(testMigrations(), "m")
+
+	done, err := h.migrate(ctx, list, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(done); len(got) != 2 || got[1] != 2 {
+		t.Fatalf("migrate to 2: applied %v; expected [1 2]", got)
+	}
+	if done, _ = h.migrate(ctx, list, 2); len(done) != 0 {
+		t.Fatalf("second migrate to 2: applied %v; expected nothing", versions(done))
+	}
+
+	done, err = h.migrate(ctx, list, LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(done); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("migrate to latest: applied %v; expected [3]", got)
+	}
+	if _, err := h.DB.Exec("INSERT INTO b (id, name) VALUES (1, 'one');"); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := h.migrationStatus(ctx, h.DB, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range states {
+		if state.Pending() || state.Modified || state.Unknown {
+			t.Fatalf("status: got %+v; expected applied", state)
+		}
+	}
+
+	// откат в обратном порядке
+	if done, err = h.migrate(ctx, list, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(done); len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Fatalf("migrate to 1: reverted %v; expected [3 2]", got)
+	}
+	if _, err := h.DB.Exec("INSERT INTO a (id) VALUES (1), (1);"); err != nil {
+		t.Fatalf("unique index is still there: %v", err)
+	}
+
+	if _, err := h.migrate(ctx, list, 5); err == nil {
+		t.Fatal("migrate to unknown version: expected error")
+	}
+	if done, err = h.migrate(ctx, list, 0); err != nil || len(done) != 1 {
+		t.Fatalf("migrate to 0: got %v, %v; expected init reverted", versions(done), err)
+	}
+	if _, err := h.DB.Exec("SELECT * FROM a;"); err == nil {
+		t.Fatal("table a still exists after migrate to 0")
+	}
+}
+
+func TestMigrateChecksMigrations(t *testing.T) {
+	ctx := context.Background()
+	h := openEmptySQLite(t)
+	list, _ := loadMigrations(testMigrations(), "m")
+	if _, err := h.migrate(ctx, list, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	// примененная миграция изменена
+	modified := append([]Migration(nil), list...)
+	modified[1].Checksum = "changed"
+	if _, err := h.migrate(ctx, modified, LatestVersion); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("got %v; expected checksum mismatch", err)
+	}
+	states, _ := h.migrationStatus(ctx, h.DB, modified)
+	if !states[1].Modified {
+		t.Fatalf("status: got %+v; expected modified", states[1])
+	}
+
+	// в базе версия, неизвестная бинарному файлу
+	if _, err := h.migrate(ctx, list[:2], LatestVersion); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Fatalf("got %v; expected unknown migration error", err)
+	}
+	states, _ = h.migrationStatus(ctx, h.DB, list[:2])
+	if len(states) != 3 || !states[2].Unknown {
+		t.Fatalf("status: got %+v; expected unknown version 3", states)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	ctx := context.Background()
+	h := openEmptySQLite(t)
+	if _, err := h.Migrate(ctx, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Storage(ctx, Data{Date: "2021-01-01"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.exec(ctx, "INSERT INTO stat (tenant, dat) VALUES (?, ?);", DefaultTenant, "2021-01-01"); err == nil {
+		t.Fatal("second row with the same date: expected unique index violation")
+	}
+
+	// откат в обратном порядке до версии 2
+	done, err := h.Migrate(ctx, 2)
+	if err != nil || len(done) == 0 || done[len(done)-1].Name != "stat_rollups" {
+		t.Fatalf("Migrate down to 2: got %+v, %v", done, err)
+	}
+	if _, err := h.exec(ctx, "SELECT COUNT(*) FROM stat_week;"); err == nil {
+		t.Fatal("stat_week after rollback: expected missing table")
+	}
+	if done, err = h.Rollback(ctx, 1); err != nil || len(done) != 1 || done[0].Name != "stat_unique_date" {
+		t.Fatalf("Rollback: got %+v, %v", done, err)
+	}
+	if _, err := h.exec(ctx, "INSERT INTO stat (dat) VALUES (?);", "2021-01-01"); err != nil {
+		t.Fatalf("insert after rollback: %v", err)
+	}
+	if done, err = h.Rollback(ctx, 10); err != nil || len(done) != 1 || done[0].Name != "init" {
+		t.Fatalf("Rollback of all: got %+v, %v", done, err)
+	}
+}
+
+// Каждый диалект описывает одинаковые версии схемы
+func TestDialectMigrationsMatch(t *testing.T) {
+	var expect []Migration
+	for driver, dialect := range dialects {
+		list, err := (&StatsDB{Dialect: dialect}).Migrations()
+		if err != nil {
+			t.Fatalf("%s: %v", driver, err)
+		}
+		if expect == nil {
+			expect = list
+			continue
+		}
+		if len(list) != len(expect) {
+			t.Fatalf("%s: got %d migrations; expected %d", driver, len(list), len(expect))
+		}
+		for i := range list {
+			if list[i].Version != expect[i].Version || list[i].Name != expect[i].Name {
+				t.Fatalf("%s: got migration %d_%s; expected %d_%s",
+					driver, list[i].Version, list[i].Name, expect[i].Version, expect[i].Name)
+			}
+		}
+	}
+}
+
+func TestMigrateMergesDuplicateDates(t *testing.T) {
+	ctx := context.Background()
+	h := openEmptySQLite(t)
+	if _, err := h.Migrate(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// записи, созданные гонкой первых сохранений даты до уникального индекса
+	for _, row := range [][]interface{}{
+		{"2021-01-01", 10, 1, 100}, {"2021-01-02", 7, 0, 50}, {"2021-01-01", 5, 2, 150}, {"2021-01-01", 1, 1, 120},
+	} {
+		if _, err := h.exec(ctx, "INSERT INTO stat (dat, views, clicks, cost) VALUES (?, ?, ?, ?);", row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.Migrate(ctx, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	data, err := h.FindByPeriodDate(ctx, "2021-01-01", "2021-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data[0] != (Data{Date: "2021-01-01", Views: 16, Clicks: 4, Cost: 120}) {
+		t.Fatalf("got %+v; expected views and clicks summed and the last cost", data)
+	}
+	week, err := h.FindByPeriodGranularity(ctx, "2021-01-01", "2021-01-31", "month")
+	if err != nil || len(week) != 1 || week[0].Views != 23 {
+		t.Fatalf("month rollup: got %+v, %v", week, err)
+	}
+}
+
+func TestMigrateLock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	file := filepath.Join(t.TempDir(), "statistics.db")
+
+	// экземпляры, запущенные одновременно, применяют миграции по очереди
+	// на соединении с блокировкой: пул ограничен одним соединением
+	var wg sync.WaitGroup
+	applied := make([]int, 3)
+	errs := make([]error, 3)
+	for i := range applied {
+		h, err := Open("locking", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.DB.Close()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done, err := h.Migrate(ctx, LatestVersion)
+			applied[i], errs[i] = len(done), err
+		}(i)
+	}
+	wg.Wait()
+	list, _ := (&StatsDB{Dialect: dialects["sqlite"]}).Migrations()
+	total := 0
+	for i := range applied {
+		if errs[i] != nil {
+			t.Fatalf("instance %d: %v", i, errs[i])
+		}
+		total += applied[i]
+	}
+	if total != len(list) {
+		t.Fatalf("applied %v migrations; expected each of %d once", applied, len(list))
+	}
+	if len(migrationLock) != 0 {
+		t.Fatal("migration lock is not released")
+	}
+}
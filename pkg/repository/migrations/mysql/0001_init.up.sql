@@ -0,0 +1,58 @@
+-- начальная схема, ранее создаваемая init.sql: таблицы уже могут существовать
+-- в базах, созданных до появления миграций
+CREATE TABLE IF NOT EXISTS stat (
+  id BIGINT AUTO_INCREMENT,
+  dat DATE NOT NULL,
+  clicks INT DEFAULT NULL,
+  cost INT DEFAULT NULL,
+  views INT DEFAULT NULL,
+  PRIMARY KEY(id)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS budget (
+  id BIGINT AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  amount INT NOT NULL,
+  period VARCHAR(16) NOT NULL,
+  threshold DOUBLE NOT NULL DEFAULT 1,
+  PRIMARY KEY(id)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS alert (
+  id BIGINT AUTO_INCREMENT,
+  budget_id BIGINT NOT NULL,
+  period_start DATE NOT NULL,
+  dat DATE NOT NULL,
+  spent INT NOT NULL,
+  amount INT NOT NULL,
+  pacing DOUBLE NOT NULL,
+  created DATETIME NOT NULL,
+  PRIMARY KEY(id),
+  UNIQUE KEY(budget_id, period_start)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS webhook (
+  id BIGINT AUTO_INCREMENT,
+  url VARCHAR(2048) NOT NULL,
+  events VARCHAR(255) NOT NULL,
+  secret VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL,
+  PRIMARY KEY(id)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+  id BIGINT AUTO_INCREMENT,
+  webhook_id BIGINT NOT NULL,
+  event VARCHAR(64) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt DATETIME NOT NULL,
+  response_code INT NOT NULL DEFAULT 0,
+  last_error VARCHAR(1024) NOT NULL DEFAULT '',
+  created DATETIME NOT NULL,
+  updated DATETIME NOT NULL,
+  PRIMARY KEY(id),
+  KEY(status, next_attempt),
+  KEY(webhook_id)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,14 @@
+-- одна запись статистики на дату. Одновременные первые сохранения даты
+-- могли создать несколько записей: просмотры и клики суммируются
+-- в первую запись даты, стоимость берется из последней, остальные удаляются
+UPDATE stat s
+  JOIN (SELECT dat, MIN(id) AS first_id, MAX(id) AS last_id, SUM(clicks) AS clicks, SUM(views) AS views
+          FROM stat GROUP BY dat HAVING COUNT(*) > 1) d ON s.id = d.first_id
+  JOIN stat l ON l.id = d.last_id
+   SET s.clicks = d.clicks, s.views = d.views, s.cost = l.cost;
+
+DELETE s FROM stat s
+  JOIN (SELECT dat, MIN(id) AS first_id FROM stat GROUP BY dat HAVING COUNT(*) > 1) d
+    ON s.dat = d.dat AND s.id <> d.first_id;
+
+CREATE UNIQUE INDEX stat_dat ON stat (dat);
@@ -0,0 +1,25 @@
+-- агрегаты статистики по неделям (с понедельника) и месяцам,
+-- period - первый день периода
+CREATE TABLE stat_week (
+  period DATE NOT NULL,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY(period)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE stat_month (
+  period DATE NOT NULL,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY(period)
+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+INSERT INTO stat_week (period, views, clicks, cost)
+SELECT DATE_SUB(dat, INTERVAL WEEKDAY(dat) DAY), COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0)
+FROM stat GROUP BY DATE_SUB(dat, INTERVAL WEEKDAY(dat) DAY);
+
+INSERT INTO stat_month (period, views, clicks, cost)
+SELECT DATE_SUB(dat, INTERVAL DAYOFMONTH(dat) - 1 DAY), COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0)
+FROM stat GROUP BY DATE_SUB(dat, INTERVAL DAYOFMONTH(dat) - 1 DAY);
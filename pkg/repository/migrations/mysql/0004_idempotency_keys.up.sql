@@ -0,0 +1,12 @@
+-- результаты запросов с заголовком Idempotency-Key,
+-- status 0 - запрос еще обрабатывается
+CREATE TABLE idempotency_key (
+  idem_key VARCHAR(255) NOT NULL,
+  fingerprint VARCHAR(64) NOT NULL,
+  status INT NOT NULL DEFAULT 0,
+  content_type VARCHAR(255) NOT NULL DEFAULT '',
+  body TEXT NOT NULL,
+  created DATETIME NOT NULL,
+  PRIMARY KEY(idem_key),
+  KEY(created)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,27 @@
+-- ключи API: хранится только SHA-256 ключа, prefix - открытая часть
+-- ключа для поиска, scopes - права через пробел, revoked - время отзыва
+CREATE TABLE api_key (
+  id BIGINT AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL,
+  prefix VARCHAR(32) NOT NULL,
+  hash VARCHAR(64) NOT NULL,
+  scopes VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL,
+  revoked DATETIME NULL,
+  PRIMARY KEY(id),
+  UNIQUE KEY(prefix)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- журнал изменяющих запросов с ключом, которым они выполнены
+CREATE TABLE audit_log (
+  id BIGINT AUTO_INCREMENT,
+  key_id BIGINT NOT NULL,
+  key_name VARCHAR(255) NOT NULL,
+  method VARCHAR(16) NOT NULL,
+  path VARCHAR(2048) NOT NULL,
+  status INT NOT NULL,
+  request_id VARCHAR(128) NOT NULL,
+  created DATETIME NOT NULL,
+  PRIMARY KEY(id),
+  KEY(created)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
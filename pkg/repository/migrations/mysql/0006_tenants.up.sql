@@ -0,0 +1,23 @@
+-- арендатор (tenant) записей: существующие данные принадлежат арендатору default
+ALTER TABLE stat ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+DROP INDEX stat_dat ON stat;
+-- одна запись статистики арендатора на дату
+CREATE UNIQUE INDEX stat_dat ON stat (tenant, dat);
+
+ALTER TABLE stat_week ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default' FIRST,
+  DROP PRIMARY KEY, ADD PRIMARY KEY(tenant, period);
+ALTER TABLE stat_month ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default' FIRST,
+  DROP PRIMARY KEY, ADD PRIMARY KEY(tenant, period);
+
+ALTER TABLE budget ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE alert ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE api_key ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+-- ключ идемпотентности хранится с именем арендатора
+ALTER TABLE idempotency_key MODIFY idem_key VARCHAR(320) NOT NULL;
+
+-- квоты арендаторов: max_rows - наибольшее число дат статистики, 0 - без ограничения
+CREATE TABLE tenant (
+  name VARCHAR(64) NOT NULL,
+  max_rows INT NOT NULL DEFAULT 0,
+  PRIMARY KEY(name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,54 @@
+-- начальная схема: таблицы уже могут существовать
+-- в базах, созданных до появления миграций
+CREATE TABLE IF NOT EXISTS stat (
+  id BIGSERIAL PRIMARY KEY,
+  dat DATE NOT NULL,
+  clicks INT DEFAULT NULL,
+  cost INT DEFAULT NULL,
+  views INT DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS budget (
+  id BIGSERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  amount INT NOT NULL,
+  period VARCHAR(16) NOT NULL,
+  threshold DOUBLE PRECISION NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS alert (
+  id BIGSERIAL PRIMARY KEY,
+  budget_id BIGINT NOT NULL,
+  period_start DATE NOT NULL,
+  dat DATE NOT NULL,
+  spent INT NOT NULL,
+  amount INT NOT NULL,
+  pacing DOUBLE PRECISION NOT NULL,
+  created TIMESTAMP NOT NULL,
+  UNIQUE (budget_id, period_start)
+);
+
+CREATE TABLE IF NOT EXISTS webhook (
+  id BIGSERIAL PRIMARY KEY,
+  url VARCHAR(2048) NOT NULL,
+  events VARCHAR(255) NOT NULL,
+  secret VARCHAR(255) NOT NULL,
+  created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+  id BIGSERIAL PRIMARY KEY,
+  webhook_id BIGINT NOT NULL,
+  event VARCHAR(64) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt TIMESTAMP NOT NULL,
+  response_code INT NOT NULL DEFAULT 0,
+  last_error VARCHAR(1024) NOT NULL DEFAULT '',
+  created TIMESTAMP NOT NULL,
+  updated TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery (status, next_attempt);
+CREATE INDEX IF NOT EXISTS webhook_delivery_webhook ON webhook_delivery (webhook_id);
@@ -0,0 +1,15 @@
+-- одна запись статистики на дату. Одновременные первые сохранения даты
+-- могли создать несколько записей: просмотры и клики суммируются
+-- в первую запись даты, стоимость берется из последней, остальные удаляются
+UPDATE stat s
+   SET clicks = d.clicks, views = d.views, cost = l.cost
+  FROM (SELECT dat, MIN(id) AS first_id, MAX(id) AS last_id, SUM(clicks) AS clicks, SUM(views) AS views
+          FROM stat GROUP BY dat HAVING COUNT(*) > 1) d
+  JOIN stat l ON l.id = d.last_id
+ WHERE s.id = d.first_id;
+
+DELETE FROM stat s
+ USING (SELECT dat, MIN(id) AS first_id FROM stat GROUP BY dat HAVING COUNT(*) > 1) d
+ WHERE s.dat = d.dat AND s.id <> d.first_id;
+
+CREATE UNIQUE INDEX stat_dat ON stat (dat);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS stat_month;
+DROP TABLE IF EXISTS stat_week;
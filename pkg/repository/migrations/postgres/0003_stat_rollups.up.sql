@@ -0,0 +1,23 @@
+-- агрегаты статистики по неделям (с понедельника) и месяцам,
+-- period - первый день периода
+CREATE TABLE stat_week (
+  period DATE PRIMARY KEY,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE stat_month (
+  period DATE PRIMARY KEY,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0
+);
+
+INSERT INTO stat_week (period, views, clicks, cost)
+SELECT date_trunc('week', dat)::date, COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0)
+FROM stat GROUP BY date_trunc('week', dat)::date;
+
+INSERT INTO stat_month (period, views, clicks, cost)
+SELECT date_trunc('month', dat)::date, COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0)
+FROM stat GROUP BY date_trunc('month', dat)::date;
@@ -0,0 +1,25 @@
+-- ключи API: хранится только SHA-256 ключа, prefix - открытая часть
+-- ключа для поиска, scopes - права через пробел, revoked - время отзыва
+CREATE TABLE api_key (
+  id BIGSERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  prefix VARCHAR(32) NOT NULL UNIQUE,
+  hash VARCHAR(64) NOT NULL,
+  scopes VARCHAR(255) NOT NULL,
+  created TIMESTAMP NOT NULL,
+  revoked TIMESTAMP NULL
+);
+
+-- журнал изменяющих запросов с ключом, которым они выполнены
+CREATE TABLE audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  key_id BIGINT NOT NULL,
+  key_name VARCHAR(255) NOT NULL,
+  method VARCHAR(16) NOT NULL,
+  path VARCHAR(2048) NOT NULL,
+  status INT NOT NULL,
+  request_id VARCHAR(128) NOT NULL,
+  created TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_log_created ON audit_log (created);
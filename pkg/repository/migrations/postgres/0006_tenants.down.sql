@@ -0,0 +1,24 @@
+-- схема без арендаторов не различает их записи:
+-- остаются только данные арендатора default
+DROP TABLE IF EXISTS tenant;
+DELETE FROM idempotency_key WHERE LENGTH(idem_key) > 255;
+ALTER TABLE idempotency_key ALTER COLUMN idem_key TYPE VARCHAR(255);
+ALTER TABLE api_key DROP COLUMN tenant;
+DELETE FROM alert WHERE tenant <> 'default';
+ALTER TABLE alert DROP COLUMN tenant;
+DELETE FROM budget WHERE tenant <> 'default';
+ALTER TABLE budget DROP COLUMN tenant;
+
+DELETE FROM stat_month WHERE tenant <> 'default';
+ALTER TABLE stat_month DROP CONSTRAINT stat_month_pkey;
+ALTER TABLE stat_month DROP COLUMN tenant;
+ALTER TABLE stat_month ADD PRIMARY KEY (period);
+DELETE FROM stat_week WHERE tenant <> 'default';
+ALTER TABLE stat_week DROP CONSTRAINT stat_week_pkey;
+ALTER TABLE stat_week DROP COLUMN tenant;
+ALTER TABLE stat_week ADD PRIMARY KEY (period);
+
+DELETE FROM stat WHERE tenant <> 'default';
+DROP INDEX stat_dat;
+CREATE UNIQUE INDEX stat_dat ON stat (dat);
+ALTER TABLE stat DROP COLUMN tenant;
@@ -0,0 +1,24 @@
+-- арендатор (tenant) записей: существующие данные принадлежат арендатору default
+ALTER TABLE stat ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+DROP INDEX stat_dat;
+-- одна запись статистики арендатора на дату
+CREATE UNIQUE INDEX stat_dat ON stat (tenant, dat);
+
+ALTER TABLE stat_week ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE stat_week DROP CONSTRAINT stat_week_pkey;
+ALTER TABLE stat_week ADD PRIMARY KEY (tenant, period);
+ALTER TABLE stat_month ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE stat_month DROP CONSTRAINT stat_month_pkey;
+ALTER TABLE stat_month ADD PRIMARY KEY (tenant, period);
+
+ALTER TABLE budget ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE alert ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE api_key ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+-- ключ идемпотентности хранится с именем арендатора
+ALTER TABLE idempotency_key ALTER COLUMN idem_key TYPE VARCHAR(320);
+
+-- квоты арендаторов: max_rows - наибольшее число дат статистики, 0 - без ограничения
+CREATE TABLE tenant (
+  name VARCHAR(64) PRIMARY KEY,
+  max_rows INT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,3 @@
+-- срок аренды ключа обрабатываемого запроса: после него ключ,
+-- оставшийся от прерванного запроса, резервируется заново
+ALTER TABLE idempotency_key ADD COLUMN locked_until TIMESTAMP NULL;
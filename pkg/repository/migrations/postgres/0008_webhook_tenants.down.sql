@@ -0,0 +1,2 @@
+ALTER TABLE webhook_delivery DROP COLUMN tenant;
+ALTER TABLE webhook DROP COLUMN tenant;
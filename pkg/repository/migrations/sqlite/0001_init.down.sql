@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS webhook_delivery;
+DROP TABLE IF EXISTS webhook;
+DROP TABLE IF EXISTS alert;
+DROP TABLE IF EXISTS budget;
+DROP TABLE IF EXISTS stat;
@@ -0,0 +1,54 @@
+-- начальная схема: таблицы уже могут существовать
+-- в базах, созданных до появления миграций
+CREATE TABLE IF NOT EXISTS stat (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  dat DATE NOT NULL,
+  clicks INT DEFAULT NULL,
+  cost INT DEFAULT NULL,
+  views INT DEFAULT NULL
+);
+
+CREATE TABLE IF NOT EXISTS budget (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL,
+  amount INT NOT NULL,
+  period VARCHAR(16) NOT NULL,
+  threshold DOUBLE NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS alert (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  budget_id BIGINT NOT NULL,
+  period_start DATE NOT NULL,
+  dat DATE NOT NULL,
+  spent INT NOT NULL,
+  amount INT NOT NULL,
+  pacing DOUBLE NOT NULL,
+  created DATETIME NOT NULL,
+  UNIQUE (budget_id, period_start)
+);
+
+CREATE TABLE IF NOT EXISTS webhook (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  url VARCHAR(2048) NOT NULL,
+  events VARCHAR(255) NOT NULL,
+  secret VARCHAR(255) NOT NULL,
+  created DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  webhook_id BIGINT NOT NULL,
+  event VARCHAR(64) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt DATETIME NOT NULL,
+  response_code INT NOT NULL DEFAULT 0,
+  last_error VARCHAR(1024) NOT NULL DEFAULT '',
+  created DATETIME NOT NULL,
+  updated DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery (status, next_attempt);
+CREATE INDEX IF NOT EXISTS webhook_delivery_webhook ON webhook_delivery (webhook_id);
@@ -0,0 +1 @@
+DROP INDEX stat_dat;
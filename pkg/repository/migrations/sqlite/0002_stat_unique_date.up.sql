@@ -0,0 +1,12 @@
+-- одна запись статистики на дату. Одновременные первые сохранения даты
+-- могли создать несколько записей: просмотры и клики суммируются
+-- в первую запись даты, стоимость берется из последней, остальные удаляются
+UPDATE stat SET
+  clicks = (SELECT SUM(s.clicks) FROM stat s WHERE s.dat = stat.dat),
+  views = (SELECT SUM(s.views) FROM stat s WHERE s.dat = stat.dat),
+  cost = (SELECT s.cost FROM stat s WHERE s.dat = stat.dat ORDER BY s.id DESC LIMIT 1)
+ WHERE id IN (SELECT MIN(id) FROM stat GROUP BY dat HAVING COUNT(*) > 1);
+
+DELETE FROM stat WHERE id NOT IN (SELECT MIN(id) FROM stat GROUP BY dat);
+
+CREATE UNIQUE INDEX stat_dat ON stat (dat);
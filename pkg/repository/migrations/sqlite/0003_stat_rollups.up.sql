@@ -0,0 +1,24 @@
+-- агрегаты статистики по неделям (с понедельника) и месяцам,
+-- period - первый день периода
+CREATE TABLE stat_week (
+  period DATE PRIMARY KEY,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE stat_month (
+  period DATE PRIMARY KEY,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0
+);
+
+-- 'weekday 0' переносит дату на ближайшее воскресенье, -6 дней - понедельник той же недели
+INSERT INTO stat_week (period, views, clicks, cost)
+SELECT date(dat, 'weekday 0', '-6 days'), COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0)
+FROM stat GROUP BY date(dat, 'weekday 0', '-6 days');
+
+INSERT INTO stat_month (period, views, clicks, cost)
+SELECT date(dat, 'start of month'), COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0)
+FROM stat GROUP BY date(dat, 'start of month');
@@ -0,0 +1,12 @@
+-- результаты запросов с заголовком Idempotency-Key,
+-- status 0 - запрос еще обрабатывается
+CREATE TABLE idempotency_key (
+  idem_key VARCHAR(255) PRIMARY KEY,
+  fingerprint VARCHAR(64) NOT NULL,
+  status INT NOT NULL DEFAULT 0,
+  content_type VARCHAR(255) NOT NULL DEFAULT '',
+  body TEXT NOT NULL,
+  created DATETIME NOT NULL
+);
+
+CREATE INDEX idempotency_key_created ON idempotency_key (created);
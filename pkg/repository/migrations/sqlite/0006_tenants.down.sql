@@ -0,0 +1,35 @@
+-- схема без арендаторов не различает их записи:
+-- остаются только данные арендатора default
+DROP TABLE IF EXISTS tenant;
+ALTER TABLE api_key DROP COLUMN tenant;
+DELETE FROM alert WHERE tenant <> 'default';
+ALTER TABLE alert DROP COLUMN tenant;
+DELETE FROM budget WHERE tenant <> 'default';
+ALTER TABLE budget DROP COLUMN tenant;
+
+CREATE TABLE stat_month_period (
+  period DATE PRIMARY KEY,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0
+);
+INSERT INTO stat_month_period (period, views, clicks, cost)
+SELECT period, views, clicks, cost FROM stat_month WHERE tenant = 'default';
+DROP TABLE stat_month;
+ALTER TABLE stat_month_period RENAME TO stat_month;
+
+CREATE TABLE stat_week_period (
+  period DATE PRIMARY KEY,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0
+);
+INSERT INTO stat_week_period (period, views, clicks, cost)
+SELECT period, views, clicks, cost FROM stat_week WHERE tenant = 'default';
+DROP TABLE stat_week;
+ALTER TABLE stat_week_period RENAME TO stat_week;
+
+DELETE FROM stat WHERE tenant <> 'default';
+DROP INDEX stat_dat;
+CREATE UNIQUE INDEX stat_dat ON stat (dat);
+ALTER TABLE stat DROP COLUMN tenant;
@@ -0,0 +1,40 @@
+-- арендатор (tenant) записей: существующие данные принадлежат арендатору default
+ALTER TABLE stat ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+DROP INDEX stat_dat;
+-- одна запись статистики арендатора на дату
+CREATE UNIQUE INDEX stat_dat ON stat (tenant, dat);
+
+-- SQLite не изменяет первичный ключ, таблицы агрегатов пересоздаются
+CREATE TABLE stat_week_tenant (
+  tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+  period DATE NOT NULL,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (tenant, period)
+);
+INSERT INTO stat_week_tenant (period, views, clicks, cost) SELECT period, views, clicks, cost FROM stat_week;
+DROP TABLE stat_week;
+ALTER TABLE stat_week_tenant RENAME TO stat_week;
+
+CREATE TABLE stat_month_tenant (
+  tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+  period DATE NOT NULL,
+  views BIGINT NOT NULL DEFAULT 0,
+  clicks BIGINT NOT NULL DEFAULT 0,
+  cost BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (tenant, period)
+);
+INSERT INTO stat_month_tenant (period, views, clicks, cost) SELECT period, views, clicks, cost FROM stat_month;
+DROP TABLE stat_month;
+ALTER TABLE stat_month_tenant RENAME TO stat_month;
+
+ALTER TABLE budget ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE alert ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE api_key ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+
+-- квоты арендаторов: max_rows - наибольшее число дат статистики, 0 - без ограничения
+CREATE TABLE tenant (
+  name VARCHAR(64) PRIMARY KEY,
+  max_rows INT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,5 @@
+-- арендатор подписки получает только события своей статистики,
+-- подписки, созданные до появления арендаторов, принадлежат default
+ALTER TABLE webhook ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+-- арендатор доставки определяет арендатора подписки при отправке
+ALTER TABLE webhook_delivery ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT 'default';
@@ -0,0 +1,17 @@
+package repository
+
+import (
+	// MySQL driver
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func init() {
+	dialects["mysql"] = Dialect{
+		Driver:       "mysql",
+		MaxOpenConns: 10,
+		Migrations:   "mysql",
+		// блокировка сессии, снимается и при разрыве соединения
+		LockMigrations:   "SELECT GET_LOCK('statistics_migrate', 600);",
+		UnlockMigrations: "SELECT RELEASE_LOCK('statistics_migrate');",
+	}
+}
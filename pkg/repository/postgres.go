@@ -0,0 +1,20 @@
+package repository
+
+import (
+	// PostgreSQL driver
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	dialects["postgres"] = Dialect{
+		Driver:       "postgres",
+		Numbered:     true,
+		Returning:    true,
+		OnConflict:   true,
+		MaxOpenConns: 10,
+		Migrations:   "postgres",
+		// рекомендательная блокировка сессии с ключом миграций сервиса
+		LockMigrations:   "SELECT 1 FROM pg_advisory_lock(7318290410);",
+		UnlockMigrations: "SELECT pg_advisory_unlock(7318290410);",
+	}
+}
@@ -1,18 +1,44 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"statistics/pkg/logging"
+	"time"
 )
 
 // StatsRepository интерфейс, описывающий возможные
-// действия с базой данных статистики
+// действия с базой данных статистики. Запросы читают и изменяют
+// только статистику арендатора контекста (WithTenant)
 type StatsRepository interface {
-	FindByDate(date string) (Data, error)
-	Storage(data Data) error
-	Update(data Data) error
-	FindByPeriodDate(from, to string) ([]Data, error)
-	DeleteFromRepository() (int, error)
+	FindByDate(ctx context.Context, date string) (Data, error)
+	Storage(ctx context.Context, data Data) error
+	Update(ctx context.Context, data Data) error
+	FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error)
+	FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]Data, error)
+	DeleteFromRepository(ctx context.Context) (int, error)
+}
+
+// Batcher репозиторий статистики, выполняющий группу операций
+// в одной транзакции. fn получает репозиторий, запросы которого
+// идут в транзакции; транзакция фиксируется, если fn не вернула ошибку
+type Batcher interface {
+	Batch(ctx context.Context, fn func(rep StatsRepository) error) error
+}
+
+// Transactor репозиторий, сообщающий, откатывает ли его Batch
+// при ошибке fn все изменения пакета. Обертки репозитория
+// отвечают так же, как репозиторий, который они оборачивают
+type Transactor interface {
+	Transactional() bool
+}
+
+// IsTransactional сообщает, что Batch репозитория rep при ошибке
+// не оставляет записанной части пакета. Репозиторий, не реализующий
+// Transactor, считается нетранзакционным
+func IsTransactional(rep StatsRepository) bool {
+	t, ok := rep.(Transactor)
+	return ok && t.Transactional()
 }
 
 // Data структура, приходящая с "верхнего" уровня (usecase).
@@ -27,88 +53,190 @@ type Data struct {
 // StatsDB структура содержащая хэндлер базы данных и
 // реализующая интерфейс StatsRepository
 type StatsDB struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Dialect Dialect
+	// Retry политика повторения запросов при временных ошибках
+	Retry Retry
+	// tx транзакция, в которой выполняются запросы (см. inTx)
+	tx *sql.Tx
 }
 
-// FindByDate находит запись по заданной дате
-func (h *StatsDB) FindByDate(date string) (Data, error) {
+// FindByDate находит запись по заданной дате. В транзакции (Batch)
+// строка блокируется до ее конца: запись, вычисленная по прочитанной,
+// не затирает параллельные изменения даты
+func (h *StatsDB) FindByDate(ctx context.Context, date string) (Data, error) {
 	data := Data{}
+	var dat time.Time
+	lock := ""
+	if h.tx != nil {
+		lock = h.forUpdate()
+	}
 
-	err := h.DB.QueryRow(
+	err := h.queryRow(ctx,
 		"SELECT dat, clicks, views, cost "+
-			"FROM stat WHERE dat = ?;",
-		date).
-		Scan(&data.Date, &data.Clicks, &data.Views, &data.Cost)
+			"FROM stat WHERE tenant = ? AND dat = ?"+lock+";",
+		TenantFromContext(ctx), date).
+		Scan(&dat, &data.Clicks, &data.Views, &data.Cost)
 	if err != nil {
 		return data, err
 	}
+	data.Date = dat.Format(layout)
 	return data, nil
 }
 
-func checkError(method string, err error) error {
+func checkError(ctx context.Context, method string, err error) error {
 	if err != nil {
-		log.Printf("Rep. %s: %v", method, err)
+		logging.Error(ctx, "Rep. "+method, "err", err)
 		return err
 	}
 	return nil
 }
 
 // Storage записывает в таблицу входные данные
-func (h *StatsDB) Storage(data Data) error {
-	_, err := h.DB.Exec(
-		"INSERT INTO stat (dat, clicks, cost, views) VALUES (?, ?, ?, ?);",
-		data.Date,
-		data.Clicks,
-		data.Cost,
-		data.Views,
-	)
-	return checkError("Storage", err)
+// и в той же транзакции прибавляет их к агрегатам.
+// Если дату уже записал параллельный запрос, clicks и views
+// прибавляются к его записи, а cost заменяется (как в uc.AddStat)
+func (h *StatsDB) Storage(ctx context.Context, data Data) error {
+	err := h.inTx(ctx, func(tx *StatsDB) error {
+		query := "INSERT INTO stat (tenant, dat, clicks, cost, views) VALUES (?, ?, ?, ?, ?) "
+		if tx.Dialect.OnConflict {
+			query += "ON CONFLICT (tenant, dat) DO NOTHING;"
+		} else {
+			query += "ON DUPLICATE KEY UPDATE dat = dat;"
+		}
+		result, err := tx.exec(ctx, query,
+			TenantFromContext(ctx),
+			data.Date,
+			data.Clicks,
+			data.Cost,
+			data.Views,
+		)
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			return tx.update(ctx, data.Date, func(old Data) Data {
+				return Data{Date: data.Date, Views: old.Views + data.Views, Clicks: old.Clicks + data.Clicks, Cost: data.Cost}
+			})
+		}
+		return tx.addRollups(ctx, data.Date, data)
+	})
+	return checkError(ctx, "Storage", err)
 }
 
 // Update обновляет запись в таблице с уже существующей датой
-func (h *StatsDB) Update(data Data) error {
-	_, err := h.DB.Exec(
-		"UPDATE stat SET clicks = ?, cost = ?, views = ? WHERE dat = ?;",
+// и в той же транзакции прибавляет к агрегатам изменение записи.
+// Прежние значения читаются с блокировкой строки, поэтому агрегаты
+// получают ровно изменение записи. Сами значения data не зависят
+// от прежних: чтобы не потерять параллельное изменение, читайте
+// запись FindByDate и обновляйте ее в одной транзакции Batch
+func (h *StatsDB) Update(ctx context.Context, data Data) error {
+	err := h.inTx(ctx, func(tx *StatsDB) error {
+		return tx.update(ctx, data.Date, func(Data) Data { return data })
+	})
+	return checkError(ctx, "Update", err)
+}
+
+// update заменяет запись за date значениями set(old), где old - запись,
+// прочитанная с блокировкой строки, и прибавляет изменение к агрегатам.
+// Вызывается в транзакции; если даты нет, ничего не делает
+func (h *StatsDB) update(ctx context.Context, date string, set func(old Data) Data) error {
+	var old Data
+	err := h.queryRow(ctx,
+		"SELECT clicks, cost, views FROM stat WHERE tenant = ? AND dat = ?"+h.forUpdate()+";",
+		TenantFromContext(ctx), date).
+		Scan(&old.Clicks, &old.Cost, &old.Views)
+	if err == sql.ErrNoRows {
+		// даты нет, обновлять нечего
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data := set(old)
+	_, err = h.exec(ctx,
+		"UPDATE stat SET clicks = ?, cost = ?, views = ? WHERE tenant = ? AND dat = ?;",
 		data.Clicks,
 		data.Cost,
 		data.Views,
-		data.Date,
+		TenantFromContext(ctx),
+		date,
 	)
-	return checkError("Update", err)
+	if err != nil {
+		return err
+	}
+	return h.addRollups(ctx, date, Data{
+		Views:  data.Views - old.Views,
+		Clicks: data.Clicks - old.Clicks,
+		Cost:   data.Cost - old.Cost,
+	})
+}
+
+// Batch выполняет fn в одной транзакции
+func (h *StatsDB) Batch(ctx context.Context, fn func(rep StatsRepository) error) error {
+	return h.inTx(ctx, func(tx *StatsDB) error { return fn(tx) })
+}
+
+// Transactional is part of Transactor
+func (h *StatsDB) Transactional() bool {
+	return true
 }
 
 // FindByPeriodDate находит записи, которые >= from и <= to
 // Возвращает все поля
-func (h *StatsDB) FindByPeriodDate(from, to string) ([]Data, error) {
+func (h *StatsDB) FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error) {
 	result := []Data{}
-	rows, err := h.DB.Query(
-		"SELECT dat, clicks, cost, views FROM stat WHERE dat >= ? AND dat <= ?;",
+	rows, err := h.query(ctx,
+		"SELECT dat, clicks, cost, views FROM stat WHERE tenant = ? AND dat >= ? AND dat <= ?;",
+		TenantFromContext(ctx),
 		from,
 		to,
 	)
 	if err != nil {
-		return nil, err
+		return nil, checkError(ctx, "FindByPeriodDate", err)
 	}
+	defer rows.Close()
 	for rows.Next() {
 		row := &Data{}
-		err = rows.Scan(&row.Date, &row.Clicks, &row.Cost, &row.Views)
+		var dat time.Time
+		err = rows.Scan(&dat, &row.Clicks, &row.Cost, &row.Views)
 		if err != nil {
-			log.Println("Rep. FindByPeriodDate: ", err)
+			logging.Error(ctx, "Rep. FindByPeriodDate", "err", err)
 			return nil, err
 		}
+		row.Date = dat.Format(layout)
 		result = append(result, *row)
 	}
-	rows.Close()
-	return result, nil
+	// прерванный по контексту запрос обнаруживается только здесь
+	return result, checkError(ctx, "FindByPeriodDate", rows.Err())
 }
 
-// DeleteFromRepository очищает таблицу
-// и возвращаем количество удаленных строк
-func (h *StatsDB) DeleteFromRepository() (int, error) {
-	result, err := h.DB.Exec("DELETE FROM stat;")
-	rows, err := result.RowsAffected()
+// DeleteFromRepository удаляет статистику арендатора контекста вместе
+// с агрегатами и возвращаем количество удаленных строк
+func (h *StatsDB) DeleteFromRepository(ctx context.Context) (int, error) {
+	var rows int64
+	tenant := TenantFromContext(ctx)
+	err := h.inTx(ctx, func(tx *StatsDB) error {
+		result, err := tx.exec(ctx, "DELETE FROM stat WHERE tenant = ?;", tenant)
+		if err != nil {
+			return err
+		}
+		if rows, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		for _, g := range rollupOrder {
+			if _, err := tx.exec(ctx, "DELETE FROM "+rollupTables[g]+" WHERE tenant = ?;", tenant); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("Rep. DeleteFromRepository: ", err)
+		logging.Error(ctx, "Rep. DeleteFromRepository", "err", err)
 		return 0, err
 	}
 	return int(rows), nil
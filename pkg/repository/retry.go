@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+
+	"statistics/pkg/logging"
+)
+
+// Pool ограничения пула соединений с базой. Нулевые значения
+// оставляют ограничения диалекта и database/sql по умолчанию
+type Pool struct {
+	// MaxOpenConns наибольшее число открытых соединений
+	MaxOpenConns int
+	// MaxIdleConns наибольшее число простаивающих соединений
+	MaxIdleConns int
+	// ConnMaxLifetime время, после которого соединение закрывается
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime время простоя, после которого соединение закрывается
+	ConnMaxIdleTime time.Duration
+}
+
+// SetPool применяет ограничения пула соединений
+func (h *StatsDB) SetPool(pool Pool) {
+	if pool.MaxOpenConns > 0 {
+		h.DB.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		h.DB.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		h.DB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	if pool.ConnMaxIdleTime > 0 {
+		h.DB.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	}
+}
+
+// Retry политика повторения запросов при временных ошибках базы:
+// Attempts попыток с задержкой от Delay, удваивающейся до MaxDelay.
+// Attempts 0 или 1 - без повторов
+type Retry struct {
+	Attempts int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// errorClass вид ошибки базы для решения о повторе
+type errorClass int
+
+const (
+	// permanentError ошибка, которая повторится при повторе запроса
+	permanentError errorClass = iota
+	// conflictError запрос отменен базой из-за конкурирующих транзакций
+	// (взаимоблокировка, ожидание блокировки, конфликт сериализации)
+	// и не изменил данные
+	conflictError
+	// connectionError соединение потеряно, запрос записи мог выполниться
+	connectionError
+)
+
+// Коды ошибок MySQL взаимоблокировки и истечения ожидания блокировки
+const (
+	mysqlLockWaitTimeout = 1205
+	mysqlDeadlock        = 1213
+)
+
+// classify определяет вид ошибки драйверов MySQL, PostgreSQL и SQLite
+func classify(err error) errorClass {
+	var mysqlErr *mysql.MySQLError
+	var pqErr *pq.Error
+	var sqliteErr sqlite3.Error
+	switch {
+	case err == nil:
+		return permanentError
+	case errors.As(err, &mysqlErr):
+		if mysqlErr.Number == mysqlDeadlock || mysqlErr.Number == mysqlLockWaitTimeout {
+			return conflictError
+		}
+	case errors.As(err, &pqErr):
+		switch {
+		case pqErr.Code == "40001" || pqErr.Code == "40P01":
+			return conflictError
+		case pqErr.Code.Class() == "08" || pqErr.Code == "57P01":
+			return connectionError
+		}
+	case errors.As(err, &sqliteErr):
+		if sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked {
+			return conflictError
+		}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return connectionError
+	}
+	return permanentError
+}
+
+// readOnly сообщает, что запрос только читает данные
+func readOnly(query string) bool {
+	words := strings.Fields(query)
+	return len(words) > 0 && strings.EqualFold(words[0], "SELECT")
+}
+
+// retry выполняет op, повторяя ее по политике Retry при временных ошибках.
+// Запись (write) после потери соединения не повторяется: она могла выполниться.
+// Запросы внутри транзакции не повторяются, повторяется транзакция целиком (inTx)
+func (h *StatsDB) retry(ctx context.Context, write bool, op func() error) error {
+	if h.tx != nil {
+		return op()
+	}
+	delay := h.Retry.Delay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		class := classify(err)
+		if attempt >= h.Retry.Attempts || class == permanentError || write && class == connectionError {
+			return err
+		}
+		logging.Warn(ctx, "Retrying database query", "attempt", attempt, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; h.Retry.MaxDelay > 0 && delay > h.Retry.MaxDelay {
+			delay = h.Retry.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// faultyDriver драйвер SQLite, возвращающий заданные ошибки
+// вместо выполнения очередных запросов
+type faultyDriver struct {
+	mu      sync.Mutex
+	faults  []error
+	queries int
+}
+
+// inject задает ошибки следующих запросов
+func (d *faultyDriver) inject(faults ...error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faults, d.queries = faults, 0
+}
+
+// fault возвращает ошибку очередного запроса, nil - запрос выполняется
+func (d *faultyDriver) fault() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries++
+	if len(d.faults) == 0 {
+		return nil
+	}
+	err := d.faults[0]
+	d.faults = d.faults[1:]
+	return err
+}
+
+func (d *faultyDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return faultyConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), d: d}, nil
+}
+
+type faultyConn struct {
+	*sqlite3.SQLiteConn
+	d *faultyDriver
+}
+
+func (c faultyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.d.fault(); err != nil {
+		return nil, err
+	}
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (c faultyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.d.fault(); err != nil {
+		return nil, err
+	}
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+var faulty = &faultyDriver{}
+
+func init() {
+	sql.Register("sqlite3_faulty", faulty)
+	dialects["faulty"] = Dialect{Driver: "sqlite3_faulty", OnConflict: true, NoRowLocks: true, MaxOpenConns: 1, Migrations: "sqlite"}
+}
+
+var (
+	errDeadlock = &mysql.MySQLError{Number: mysqlDeadlock, Message: "Deadlock found when trying to get lock"}
+	errReset    = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected errorClass
+	}{
+		{nil, permanentError},
+		{errors.New("syntax error"), permanentError},
+		{errDeadlock, conflictError},
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, permanentError},
+		{&pq.Error{Code: "40P01"}, conflictError},
+		{&pq.Error{Code: "08006"}, connectionError},
+		{&pq.Error{Code: "23505"}, permanentError},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, conflictError},
+		{errReset, connectionError},
+		{mysql.ErrInvalidConn, connectionError},
+		{driver.ErrBadConn, connectionError},
+	} {
+		if class := classify(tc.err); class != tc.expected {
+			t.Errorf("classify(%v): got %d; expected %d", tc.err, class, tc.expected)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	h := openTestDB(t, "faulty", "")
+	h.Retry = Retry{Attempts: 3, Delay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	if err := h.Storage(ctx, Data{Date: "2021-01-01", Views: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// чтение повторяется после взаимоблокировки и потери соединения
+	faulty.inject(errDeadlock, errReset)
+	if data, err := h.FindByPeriodDate(ctx, "2021-01-01", "2021-01-31"); err != nil || len(data) != 1 || faulty.queries != 3 {
+		t.Fatalf("got %v, %v after %d queries", data, err, faulty.queries)
+	}
+
+	// транзакция записи, прерванная взаимоблокировкой, выполняется заново
+	faulty.inject(errDeadlock)
+	if err := h.Storage(ctx, Data{Date: "2021-01-02", Views: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := h.FindByDate(ctx, "2021-01-02"); data.Views != 2 {
+		t.Fatalf("got %+v", data)
+	}
+
+	// запись после потери соединения не повторяется: она могла выполниться
+	faulty.inject(errReset)
+	if err := h.Storage(ctx, Data{Date: "2021-01-03", Views: 3}); !errors.Is(err, syscall.ECONNRESET) || faulty.queries != 1 {
+		t.Fatalf("got %v after %d queries; expected connection error without retry", err, faulty.queries)
+	}
+
+	// постоянные ошибки не повторяются, временные - не больше Attempts раз
+	faulty.inject(errors.New("no such table"))
+	if _, err := h.FindByPeriodDate(ctx, "2021-01-01", "2021-01-31"); err == nil || faulty.queries != 1 {
+		t.Fatalf("got %v after %d queries", err, faulty.queries)
+	}
+	faulty.inject(errDeadlock, errDeadlock, errDeadlock, errDeadlock)
+	if _, err := h.FindByPeriodDate(ctx, "2021-01-01", "2021-01-31"); !errors.Is(err, errDeadlock) || faulty.queries != 3 {
+		t.Fatalf("got %v after %d queries; expected 3 attempts", err, faulty.queries)
+	}
+	faulty.inject()
+}
+
+// Пакет, прерванный взаимоблокировкой, выполняется заново без
+// учета в квоте дат, откатанных вместе с прерванной попыткой
+func TestBatchRetry(t *testing.T) {
+	ctx := context.Background()
+	h := openTestDB(t, "faulty", "")
+	h.Retry = Retry{Attempts: 3, Delay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	q := NewQuotaStats(h, h, 2)
+	defer faulty.inject()
+
+	attempts := 0
+	err := q.Batch(ctx, func(rep StatsRepository) error {
+		attempts++
+		for _, date := range []string{"2021-01-01", "2021-01-02"} {
+			if err := rep.Storage(ctx, Data{Date: date, Views: 1}); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// следующий запрос первой попытки прерывается
+				faulty.inject(errDeadlock)
+			}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("got %v after %d attempts; expected success on retry", err, attempts)
+	}
+	data, _ := h.FindByPeriodDate(ctx, "2021-01-01", "2021-01-31")
+	if len(data) != 2 || data[0].Views != 1 || data[1].Views != 1 {
+		t.Fatalf("got %+v", data)
+	}
+	if rollups, _ := h.FindByPeriodGranularity(ctx, "2021-01-01", "2021-01-31", "month"); len(rollups) != 1 || rollups[0].Views != 2 {
+		t.Fatalf("got rollups %+v", rollups)
+	}
+}
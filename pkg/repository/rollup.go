@@ -0,0 +1,314 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Гранулярность выборки статистики
+const (
+	GranularityDay   = "day"
+	GranularityWeek  = "week"
+	GranularityMonth = "month"
+)
+
+// rollupTables таблицы агрегатов по гранулярности.
+// Строка агрегата - сумма статистики за период, начинающийся с period
+var rollupTables = map[string]string{
+	GranularityWeek:  "stat_week",
+	GranularityMonth: "stat_month",
+}
+
+// rollupOrder гранулярности агрегатов от крупной к мелкой
+var rollupOrder = []string{GranularityMonth, GranularityWeek}
+
+// RollupMismatch расхождение агрегата с исходной статистикой.
+// Expected посчитан по дневным записям, Actual прочитан из таблицы агрегатов
+// (нулевой, если строки агрегата нет)
+type RollupMismatch struct {
+	Granularity string
+	Expected    Data
+	Actual      Data
+}
+
+// bucket возвращает первый и последний день периода гранулярности g,
+// содержащего день t. Неделя начинается с понедельника
+func bucket(g string, t time.Time) (time.Time, time.Time) {
+	switch g {
+	case GranularityWeek:
+		start := t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 6)
+	case GranularityMonth:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, -1)
+	}
+	return t, t
+}
+
+// aggregate суммирует дневные записи по периодам гранулярности g.
+// Date результата - первый день периода, записи упорядочены по дате
+func aggregate(data []Data, g string) ([]Data, error) {
+	sums := map[string]*Data{}
+	for _, row := range data {
+		day, err := time.Parse(layout, row.Date)
+		if err != nil {
+			return nil, err
+		}
+		start, _ := bucket(g, day)
+		key := start.Format(layout)
+		sum, ok := sums[key]
+		if !ok {
+			sum = &Data{Date: key}
+			sums[key] = sum
+		}
+		sum.Views += row.Views
+		sum.Clicks += row.Clicks
+		sum.Cost += row.Cost
+	}
+	result := []Data{}
+	for _, sum := range sums {
+		result = append(result, *sum)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result, nil
+}
+
+// merge объединяет суммы периодов, упорядоченные по дате
+func merge(parts ...[]Data) []Data {
+	result := []Data{}
+	for _, part := range parts {
+		for _, row := range part {
+			if n := len(result); n > 0 && result[n-1].Date == row.Date {
+				result[n-1].Views += row.Views
+				result[n-1].Clicks += row.Clicks
+				result[n-1].Cost += row.Cost
+				continue
+			}
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// FindByPeriodGranularity возвращает суммы статистики за период [from, to]
+// по дням, неделям или месяцам. Полные недели и месяцы читаются из таблиц
+// агрегатов, неполные периоды на границах считаются по дневным записям
+// (учитываются только дни внутри [from, to])
+func (h *StatsDB) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]Data, error) {
+	table, ok := rollupTables[granularity]
+	if !ok {
+		return h.FindByPeriodDate(ctx, from, to)
+	}
+	fromDay, err := time.Parse(layout, from)
+	if err != nil {
+		return nil, err
+	}
+	toDay, err := time.Parse(layout, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// первый и последний полные периоды внутри [from, to]
+	first, _ := bucket(granularity, fromDay)
+	if first.Before(fromDay) {
+		_, end := bucket(granularity, fromDay)
+		first = end.AddDate(0, 0, 1)
+	}
+	last, end := bucket(granularity, toDay)
+	if end.After(toDay) {
+		last = last.AddDate(0, 0, -1)
+	}
+	if last.Before(first) {
+		data, err := h.FindByPeriodDate(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(data, granularity)
+	}
+
+	head, err := h.FindByPeriodDate(ctx, from, first.AddDate(0, 0, -1).Format(layout))
+	if err != nil {
+		return nil, err
+	}
+	_, lastEnd := bucket(granularity, last)
+	tail, err := h.FindByPeriodDate(ctx, lastEnd.AddDate(0, 0, 1).Format(layout), to)
+	if err != nil {
+		return nil, err
+	}
+	full, err := h.findRollups(ctx, table, first.Format(layout), last.Format(layout))
+	if err != nil {
+		return nil, err
+	}
+	headSums, err := aggregate(head, granularity)
+	if err != nil {
+		return nil, err
+	}
+	tailSums, err := aggregate(tail, granularity)
+	if err != nil {
+		return nil, err
+	}
+	return merge(headSums, full, tailSums), nil
+}
+
+// findRollups читает агрегаты table за периоды, начинающиеся в [from, to]
+func (h *StatsDB) findRollups(ctx context.Context, table, from, to string) ([]Data, error) {
+	result := []Data{}
+	rows, err := h.query(ctx,
+		"SELECT period, views, clicks, cost FROM "+table+" WHERE tenant = ? AND period >= ? AND period <= ? ORDER BY period;",
+		TenantFromContext(ctx), from, to)
+	if err != nil {
+		return nil, checkError(ctx, "findRollups", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := Data{}
+		var period time.Time
+		if err := rows.Scan(&period, &row.Views, &row.Clicks, &row.Cost); err != nil {
+			return nil, checkError(ctx, "findRollups", err)
+		}
+		row.Date = period.Format(layout)
+		result = append(result, row)
+	}
+	return result, checkError(ctx, "findRollups", rows.Err())
+}
+
+// addRollups прибавляет изменение delta записи за date к агрегатам
+// всех периодов, содержащих date. Вызывается в транзакции записи
+// статистики. Агрегат изменяется одним запросом, поэтому параллельные
+// записи в тот же период не теряют обновлений друг друга
+func (h *StatsDB) addRollups(ctx context.Context, date string, delta Data) error {
+	day, err := time.Parse(layout, date)
+	if err != nil {
+		return err
+	}
+	tenant := TenantFromContext(ctx)
+	for _, g := range rollupOrder {
+		start, _ := bucket(g, day)
+		table := rollupTables[g]
+		query := "INSERT INTO " + table + " (tenant, period, views, clicks, cost) VALUES (?, ?, ?, ?, ?) "
+		if h.Dialect.OnConflict {
+			query += "ON CONFLICT (tenant, period) DO UPDATE SET views = " + table + ".views + excluded.views, " +
+				"clicks = " + table + ".clicks + excluded.clicks, cost = " + table + ".cost + excluded.cost;"
+		} else {
+			query += "ON DUPLICATE KEY UPDATE views = views + VALUES(views), " +
+				"clicks = clicks + VALUES(clicks), cost = cost + VALUES(cost);"
+		}
+		_, err := h.exec(ctx, query, tenant, start.Format(layout), delta.Views, delta.Clicks, delta.Cost)
+		if err != nil {
+			return checkError(ctx, "addRollups", err)
+		}
+	}
+	return nil
+}
+
+// refreshRollup пересчитывает агрегат гранулярности g за период,
+// содержащий date, для арендатора контекста по дневным записям
+func (h *StatsDB) refreshRollup(ctx context.Context, g, date string) error {
+	day, err := time.Parse(layout, date)
+	if err != nil {
+		return err
+	}
+	start, end := bucket(g, day)
+	tenant := TenantFromContext(ctx)
+	var count, views, clicks, cost int
+	err = h.queryRow(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(views), 0), COALESCE(SUM(clicks), 0), COALESCE(SUM(cost), 0) "+
+			"FROM stat WHERE tenant = ? AND dat >= ? AND dat <= ?;",
+		tenant, start.Format(layout), end.Format(layout)).
+		Scan(&count, &views, &clicks, &cost)
+	if err != nil {
+		return checkError(ctx, "refreshRollup", err)
+	}
+	table := rollupTables[g]
+	if _, err := h.exec(ctx, "DELETE FROM "+table+" WHERE tenant = ? AND period = ?;", tenant, start.Format(layout)); err != nil {
+		return checkError(ctx, "refreshRollup", err)
+	}
+	if count == 0 {
+		return nil
+	}
+	_, err = h.exec(ctx,
+		"INSERT INTO "+table+" (tenant, period, views, clicks, cost) VALUES (?, ?, ?, ?, ?);",
+		tenant, start.Format(layout), views, clicks, cost)
+	return checkError(ctx, "refreshRollup", err)
+}
+
+// rollupRange расширяет [from, to] до границ периодов гранулярности g
+func rollupRange(g, from, to string) (time.Time, time.Time, error) {
+	fromDay, err := time.Parse(layout, from)
+	if err != nil {
+		return fromDay, fromDay, err
+	}
+	toDay, err := time.Parse(layout, to)
+	if err != nil {
+		return fromDay, toDay, err
+	}
+	start, _ := bucket(g, fromDay)
+	_, end := bucket(g, toDay)
+	return start, end, nil
+}
+
+// CheckRollups сравнивает агрегаты арендатора контекста за периоды,
+// пересекающие [from, to], с суммами дневных записей и возвращает расхождения
+func (h *StatsDB) CheckRollups(ctx context.Context, from, to string) ([]RollupMismatch, error) {
+	result := []RollupMismatch{}
+	for _, g := range rollupOrder {
+		start, end, err := rollupRange(g, from, to)
+		if err != nil {
+			return nil, err
+		}
+		data, err := h.FindByPeriodDate(ctx, start.Format(layout), end.Format(layout))
+		if err != nil {
+			return nil, err
+		}
+		expected, err := aggregate(data, g)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := h.findRollups(ctx, rollupTables[g], start.Format(layout), end.Format(layout))
+		if err != nil {
+			return nil, err
+		}
+		stored := map[string]Data{}
+		for _, row := range actual {
+			stored[row.Date] = row
+		}
+		for _, want := range expected {
+			got := stored[want.Date]
+			delete(stored, want.Date)
+			if got != want {
+				result = append(result, RollupMismatch{Granularity: g, Expected: want, Actual: got})
+			}
+		}
+		// агрегаты периодов без дневных записей
+		for _, got := range actual {
+			if _, ok := stored[got.Date]; ok {
+				result = append(result, RollupMismatch{Granularity: g, Expected: Data{Date: got.Date}, Actual: got})
+			}
+		}
+	}
+	return result, nil
+}
+
+// RebuildRollups пересчитывает агрегаты арендатора контекста за все периоды,
+// пересекающие [from, to], и возвращает количество пересчитанных периодов
+func (h *StatsDB) RebuildRollups(ctx context.Context, from, to string) (int, error) {
+	count := 0
+	for _, g := range rollupOrder {
+		start, end, err := rollupRange(g, from, to)
+		if err != nil {
+			return count, err
+		}
+		for day := start; !day.After(end); {
+			date := day.Format(layout)
+			err := h.inTx(ctx, func(tx *StatsDB) error { return tx.refreshRollup(ctx, g, date) })
+			if err != nil {
+				return count, err
+			}
+			count++
+			_, last := bucket(g, day)
+			day = last.AddDate(0, 0, 1)
+		}
+	}
+	return count, nil
+}
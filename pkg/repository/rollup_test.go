@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	for _, test := range []struct {
+		granularity, date, start, end string
+	}{
+		{GranularityWeek, "2021-02-01", "2021-02-01", "2021-02-07"},
+		{GranularityWeek, "2021-02-07", "2021-02-01", "2021-02-07"},
+		{GranularityWeek, "2021-01-01", "2020-12-28", "2021-01-03"},
+		{GranularityMonth, "2020-02-15", "2020-02-01", "2020-02-29"},
+		{GranularityMonth, "2021-12-31", "2021-12-01", "2021-12-31"},
+		{GranularityDay, "2021-03-03", "2021-03-03", "2021-03-03"},
+	} {
+		day, _ := time.Parse(layout, test.date)
+		start, end := bucket(test.granularity, day)
+		if start.Format(layout) != test.start || end.Format(layout) != test.end {
+			t.Errorf("%s %s: got %s..%s; expected %s..%s", test.granularity, test.date,
+				start.Format(layout), end.Format(layout), test.start, test.end)
+		}
+	}
+}
+
+func TestRollupCheckAndRebuild(t *testing.T) {
+	ctx := context.Background()
+	h := openTestDB(t, "sqlite", "")
+	for _, data := range []Data{
+		{Date: "2021-01-04", Views: 10, Clicks: 1, Cost: 100},
+		{Date: "2021-01-05", Views: 20, Clicks: 2, Cost: 200},
+		{Date: "2021-02-01", Views: 30, Clicks: 3, Cost: 300},
+	} {
+		if err := h.Storage(ctx, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mismatches, err := h.CheckRollups(ctx, "2021-01-01", "2021-02-28"); err != nil || len(mismatches) != 0 {
+		t.Fatalf("got %+v, %v; expected consistent rollups", mismatches, err)
+	}
+
+	// расхождение суммы и агрегат периода без дневных записей
+	h.exec(ctx, "UPDATE stat_week SET views = 11 WHERE period = ?;", "2021-01-04")
+	h.exec(ctx, "INSERT INTO stat_month (period, views, clicks, cost) VALUES (?, 1, 1, 1);", "2021-03-01")
+	mismatches, err := h.CheckRollups(ctx, "2021-01-01", "2021-03-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 2 {
+		t.Fatalf("got %+v; expected 2 mismatches", mismatches)
+	}
+	if m := mismatches[0]; m.Granularity != GranularityMonth || m.Actual.Date != "2021-03-01" || m.Expected.Views != 0 {
+		t.Fatalf("got %+v; expected stale March rollup", m)
+	}
+	if m := mismatches[1]; m.Granularity != GranularityWeek || m.Actual.Views != 11 || m.Expected.Views != 30 {
+		t.Fatalf("got %+v; expected week 2021-01-04 with 30 views", m)
+	}
+
+	// 3 месяца и 14 недель с 2020-12-28 по 2021-04-04
+	count, err := h.RebuildRollups(ctx, "2021-01-01", "2021-03-31")
+	if err != nil || count != 17 {
+		t.Fatalf("got %d, %v; expected 17 rebuilt periods", count, err)
+	}
+	if mismatches, err = h.CheckRollups(ctx, "2021-01-01", "2021-03-31"); err != nil || len(mismatches) != 0 {
+		t.Fatalf("got %+v, %v after rebuild; expected consistent rollups", mismatches, err)
+	}
+}
+
+// Миграция заполняет агрегаты по уже записанной статистике
+func TestRollupMigrationBackfill(t *testing.T) {
+	ctx := context.Background()
+	h := openEmptySQLite(t)
+	if _, err := h.Migrate(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, date := range []string{"2021-01-03", "2021-01-04", "2021-01-10", "2021-01-31", "2021-02-01"} {
+		if _, err := h.exec(ctx, "INSERT INTO stat (dat, views, clicks, cost) VALUES (?, 1, 2, 3);", date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.Migrate(ctx, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches, err := h.CheckRollups(ctx, "2021-01-01", "2021-02-28"); err != nil || len(mismatches) != 0 {
+		t.Fatalf("got %+v, %v; expected backfilled rollups", mismatches, err)
+	}
+}
@@ -0,0 +1,18 @@
+package repository
+
+import (
+	// SQLite driver (cgo)
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	// одно соединение: SQLite не допускает параллельной записи,
+	// а каждое соединение с :memory: открывает отдельную базу
+	dialects["sqlite"] = Dialect{
+		Driver:       "sqlite3",
+		OnConflict:   true,
+		NoRowLocks:   true,
+		MaxOpenConns: 1,
+		Migrations:   "sqlite",
+	}
+}
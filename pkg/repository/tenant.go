@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+// DefaultTenant арендатор запросов, в контексте которых арендатор не задан,
+// и данных, записанных до появления арендаторов
+const DefaultTenant = "default"
+
+// ErrQuotaExceeded запись новой даты превысила бы квоту арендатора
+var ErrQuotaExceeded = errors.New("repository: tenant quota exceeded")
+
+// tenantKey ключ контекста с арендатором
+type tenantKey struct{}
+
+// WithTenant возвращает контекст, запросы в котором читают и изменяют
+// только данные арендатора tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext возвращает арендатора контекста, по умолчанию DefaultTenant
+func TenantFromContext(ctx context.Context) string {
+	if tenant, _ := ctx.Value(tenantKey{}).(string); tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// TenantRepository интерфейс, описывающий возможные
+// действия с квотами арендаторов
+type TenantRepository interface {
+	StoreTenant(ctx context.Context, tenant Tenant) error
+	FindTenant(ctx context.Context, name string) (Tenant, error)
+	FindTenants(ctx context.Context) ([]Tenant, error)
+	CountStats(ctx context.Context) (int, error)
+}
+
+// Tenant квота арендатора. MaxRows - наибольшее количество дат статистики,
+// 0 - без ограничения. Rows - количество записанных дат, заполняется FindTenants
+type Tenant struct {
+	Name    string
+	MaxRows int
+	Rows    int
+}
+
+// StoreTenant записывает квоту арендатора, заменяя прежнюю
+func (h *StatsDB) StoreTenant(ctx context.Context, tenant Tenant) error {
+	err := h.inTx(ctx, func(tx *StatsDB) error {
+		if _, err := tx.exec(ctx, "DELETE FROM tenant WHERE name = ?;", tenant.Name); err != nil {
+			return err
+		}
+		_, err := tx.exec(ctx, "INSERT INTO tenant (name, max_rows) VALUES (?, ?);", tenant.Name, tenant.MaxRows)
+		return err
+	})
+	return checkError(ctx, "StoreTenant", err)
+}
+
+// FindTenant находит квоту арендатора по имени
+func (h *StatsDB) FindTenant(ctx context.Context, name string) (Tenant, error) {
+	tenant := Tenant{}
+	err := h.queryRow(ctx, "SELECT name, max_rows FROM tenant WHERE name = ?;", name).
+		Scan(&tenant.Name, &tenant.MaxRows)
+	if err == sql.ErrNoRows {
+		return tenant, ErrNotFound
+	}
+	return tenant, checkError(ctx, "FindTenant", err)
+}
+
+// FindTenants возвращает арендаторов с квотами и арендаторов, у которых
+// есть статистика, с количеством их дат. Квота арендатора без записи - 0
+func (h *StatsDB) FindTenants(ctx context.Context) ([]Tenant, error) {
+	tenants := map[string]*Tenant{}
+	rows, err := h.query(ctx, "SELECT name, max_rows FROM tenant;")
+	if err != nil {
+		return nil, checkError(ctx, "FindTenants", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tenant := &Tenant{}
+		if err := rows.Scan(&tenant.Name, &tenant.MaxRows); err != nil {
+			return nil, checkError(ctx, "FindTenants", err)
+		}
+		tenants[tenant.Name] = tenant
+	}
+	if err := rows.Err(); err != nil {
+		return nil, checkError(ctx, "FindTenants", err)
+	}
+
+	counts, err := h.query(ctx, "SELECT tenant, COUNT(*) FROM stat GROUP BY tenant;")
+	if err != nil {
+		return nil, checkError(ctx, "FindTenants", err)
+	}
+	defer counts.Close()
+	for counts.Next() {
+		var name string
+		var count int
+		if err := counts.Scan(&name, &count); err != nil {
+			return nil, checkError(ctx, "FindTenants", err)
+		}
+		if _, ok := tenants[name]; !ok {
+			tenants[name] = &Tenant{Name: name}
+		}
+		tenants[name].Rows = count
+	}
+	if err := counts.Err(); err != nil {
+		return nil, checkError(ctx, "FindTenants", err)
+	}
+	return sortTenants(tenants), nil
+}
+
+func sortTenants(tenants map[string]*Tenant) []Tenant {
+	result := []Tenant{}
+	for _, tenant := range tenants {
+		result = append(result, *tenant)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// CountStats возвращает количество дат статистики арендатора контекста
+func (h *StatsDB) CountStats(ctx context.Context) (int, error) {
+	var count int
+	err := h.queryRow(ctx, "SELECT COUNT(*) FROM stat WHERE tenant = ?;", TenantFromContext(ctx)).Scan(&count)
+	return count, checkError(ctx, "CountStats", err)
+}
+
+// QuotaStats декоратор StatsRepository, отклоняющий запись новой даты
+// с ErrQuotaExceeded, если у арендатора контекста уже MaxRows дат.
+// Квота берется из tenants, для арендатора без записи - DefaultMaxRows.
+// Количество дат читается перед записью, поэтому параллельные запросы
+// одного арендатора могут превысить квоту на число одновременных записей
+type QuotaStats struct {
+	StatsRepository
+	tenants TenantRepository
+	// DefaultMaxRows квота арендаторов без записи в tenants, 0 - без ограничения
+	DefaultMaxRows int
+}
+
+// NewQuotaStats возвращает декоратор квот над rep
+func NewQuotaStats(rep StatsRepository, tenants TenantRepository, defaultMaxRows int) *QuotaStats {
+	return &QuotaStats{StatsRepository: rep, tenants: tenants, DefaultMaxRows: defaultMaxRows}
+}
+
+// limit возвращает квоту арендатора контекста
+func (q *QuotaStats) limit(ctx context.Context) (int, error) {
+	tenant, err := q.tenants.FindTenant(ctx, TenantFromContext(ctx))
+	if err == ErrNotFound {
+		return q.DefaultMaxRows, nil
+	}
+	return tenant.MaxRows, err
+}
+
+// quotaCounter проверяет квоту при записи новых дат: added - даты,
+// записанные после подсчета rows
+type quotaCounter struct {
+	StatsRepository
+	max   int
+	rows  int
+	added int
+}
+
+func (c *quotaCounter) Storage(ctx context.Context, data Data) error {
+	if c.max > 0 && c.rows+c.added >= c.max {
+		return ErrQuotaExceeded
+	}
+	if err := c.StatsRepository.Storage(ctx, data); err != nil {
+		return err
+	}
+	c.added++
+	return nil
+}
+
+// counter возвращает rep с проверкой квоты арендатора контекста
+func (q *QuotaStats) counter(ctx context.Context, rep StatsRepository) (*quotaCounter, error) {
+	max, err := q.limit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counter := &quotaCounter{StatsRepository: rep, max: max}
+	if max > 0 {
+		if counter.rows, err = q.tenants.CountStats(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return counter, nil
+}
+
+// Storage записывает новую дату, если квота арендатора не исчерпана
+func (q *QuotaStats) Storage(ctx context.Context, data Data) error {
+	counter, err := q.counter(ctx, q.StatsRepository)
+	if err != nil {
+		return err
+	}
+	return counter.Storage(ctx, data)
+}
+
+// Batch выполняет fn в транзакции декорируемого репозитория, если он
+// реализует Batcher. Даты, записанные в fn, учитываются в квоте
+// вместе с уже записанными до начала транзакции
+func (q *QuotaStats) Batch(ctx context.Context, fn func(rep StatsRepository) error) error {
+	batcher, ok := q.StatsRepository.(Batcher)
+	if !ok {
+		return fn(q)
+	}
+	// количество читается вне транзакции: SQLite работает через одно соединение
+	counter, err := q.counter(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return batcher.Batch(ctx, func(rep StatsRepository) error {
+		// даты прерванной попытки откатаны вместе с транзакцией
+		counter.StatsRepository, counter.added = rep, 0
+		return fn(counter)
+	})
+}
+
+// Transactional is part of Transactor
+func (q *QuotaStats) Transactional() bool {
+	return IsTransactional(q.StatsRepository)
+}
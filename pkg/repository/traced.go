@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"statistics/pkg/tracing"
+)
+
+// TracedStats декоратор StatsRepository, начинающий span
+// на каждый вызов метода. Запросы к базе внутри вызова
+// становятся его дочерними span
+type TracedStats struct {
+	rep StatsRepository
+}
+
+// NewTracedStats возвращает декоратор rep
+func NewTracedStats(rep StatsRepository) *TracedStats {
+	return &TracedStats{rep: rep}
+}
+
+// finish завершает span вызова, завершившегося err
+func finish(span *tracing.Span, err error) {
+	span.RecordError(err)
+	span.Finish()
+}
+
+// FindByDate is part of StatsRepository
+func (t *TracedStats) FindByDate(ctx context.Context, date string) (Data, error) {
+	ctx, span := tracing.Start(ctx, "StatsRepository.FindByDate", "date", date)
+	data, err := t.rep.FindByDate(ctx, date)
+	// отсутствие записи за дату - обычный результат, а не ошибка базы
+	if err == sql.ErrNoRows {
+		finish(span, nil)
+	} else {
+		finish(span, err)
+	}
+	return data, err
+}
+
+// Storage is part of StatsRepository
+func (t *TracedStats) Storage(ctx context.Context, data Data) error {
+	ctx, span := tracing.Start(ctx, "StatsRepository.Storage", "date", data.Date)
+	err := t.rep.Storage(ctx, data)
+	finish(span, err)
+	return err
+}
+
+// Transactional is part of Transactor
+func (t *TracedStats) Transactional() bool {
+	return IsTransactional(t.rep)
+}
+
+// Update is part of StatsRepository
+func (t *TracedStats) Update(ctx context.Context, data Data) error {
+	ctx, span := tracing.Start(ctx, "StatsRepository.Update", "date", data.Date)
+	err := t.rep.Update(ctx, data)
+	finish(span, err)
+	return err
+}
+
+// FindByPeriodDate is part of StatsRepository
+func (t *TracedStats) FindByPeriodDate(ctx context.Context, from, to string) ([]Data, error) {
+	ctx, span := tracing.Start(ctx, "StatsRepository.FindByPeriodDate", "from", from, "to", to)
+	data, err := t.rep.FindByPeriodDate(ctx, from, to)
+	span.SetAttributes("rows", len(data))
+	finish(span, err)
+	return data, err
+}
+
+// FindByPeriodGranularity is part of StatsRepository
+func (t *TracedStats) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]Data, error) {
+	ctx, span := tracing.Start(ctx, "StatsRepository.FindByPeriodGranularity",
+		"from", from, "to", to, "granularity", granularity)
+	data, err := t.rep.FindByPeriodGranularity(ctx, from, to, granularity)
+	span.SetAttributes("rows", len(data))
+	finish(span, err)
+	return data, err
+}
+
+// DeleteFromRepository is part of StatsRepository
+func (t *TracedStats) DeleteFromRepository(ctx context.Context) (int, error) {
+	ctx, span := tracing.Start(ctx, "StatsRepository.DeleteFromRepository")
+	affected, err := t.rep.DeleteFromRepository(ctx)
+	finish(span, err)
+	return affected, err
+}
+
+// Batch выполняет fn в транзакции репозитория, если он реализует Batcher.
+// Вызовы внутри транзакции трассируются так же, как вне ее
+func (t *TracedStats) Batch(ctx context.Context, fn func(rep StatsRepository) error) error {
+	batcher, ok := t.rep.(Batcher)
+	if !ok {
+		return fn(t)
+	}
+	ctx, span := tracing.Start(ctx, "StatsRepository.Batch")
+	err := batcher.Batch(ctx, func(rep StatsRepository) error {
+		return fn(&TracedStats{rep: rep})
+	})
+	finish(span, err)
+	return err
+}
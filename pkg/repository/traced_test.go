@@ -0,0 +1,19 @@
+package repository
+
+import "testing"
+
+func TestStatement(t *testing.T) {
+	for query, expected := range map[string]string{
+		"SELECT dat, clicks, views, cost FROM stat WHERE dat = ?;":                 "SELECT stat",
+		"SELECT COUNT(*), COALESCE(SUM(views), 0) FROM stat WHERE dat >= ?;":       "SELECT stat",
+		"INSERT INTO stat_week (period, views, clicks, cost) VALUES (?, ?, ?, ?);": "INSERT stat_week",
+		"UPDATE stat SET clicks = ? WHERE dat = ?;":                                "UPDATE stat",
+		"DELETE FROM stat;": "DELETE stat",
+		"select 1":          "SELECT",
+		"":                  "",
+	} {
+		if got := statement(query); got != expected {
+			t.Errorf("statement(%q) = %q; expected %q", query, got, expected)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Статусы доставки события подписчику
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookRepository интерфейс, описывающий возможные
+// действия с подписками на события и очередью их доставки.
+// Подписки и доставки принадлежат арендатору контекста, очередь
+// доставок (FindDueDeliveries) общая для всех арендаторов
+type WebhookRepository interface {
+	StoreWebhook(ctx context.Context, hook Webhook) (int64, error)
+	FindWebhook(ctx context.Context, id int64) (Webhook, error)
+	FindWebhooks(ctx context.Context) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, id int64) error
+	StoreDelivery(ctx context.Context, delivery Delivery) (int64, error)
+	UpdateDelivery(ctx context.Context, delivery Delivery) error
+	FindDueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error)
+	FindDeliveries(ctx context.Context, webhookID int64, limit int) ([]Delivery, error)
+}
+
+// Webhook подписка на события: на URL отправляются события типов Events,
+// тело запроса подписывается HMAC с ключом Secret
+type Webhook struct {
+	ID      int64
+	URL     string
+	Events  []string
+	Secret  string
+	Created time.Time
+}
+
+// Delivery доставка одного события подписчику.
+// Запись служит одновременно элементом очереди (Status pending и NextAttempt)
+// и журналом доставки (Attempts, ResponseCode, LastError)
+type Delivery struct {
+	ID        int64
+	WebhookID int64
+	// Tenant арендатор подписки, записывается из контекста StoreDelivery
+	Tenant       string
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	NextAttempt  time.Time
+	ResponseCode int
+	LastError    string
+	Created      time.Time
+	Updated      time.Time
+}
+
+// StoreWebhook записывает подписку и возвращает ее идентификатор
+func (h *StatsDB) StoreWebhook(ctx context.Context, hook Webhook) (int64, error) {
+	id, err := h.insert(ctx,
+		"INSERT INTO webhook (tenant, url, events, secret, created) VALUES (?, ?, ?, ?, ?);",
+		TenantFromContext(ctx),
+		hook.URL,
+		strings.Join(hook.Events, ","),
+		hook.Secret,
+		hook.Created.UTC(),
+	)
+	return id, checkError(ctx, "StoreWebhook", err)
+}
+
+const webhookColumns = "id, url, events, secret, created"
+
+func scanWebhook(row scanner) (Webhook, error) {
+	hook := Webhook{}
+	var events string
+	err := row.Scan(&hook.ID, &hook.URL, &events, &hook.Secret, &hook.Created)
+	if events != "" {
+		hook.Events = strings.Split(events, ",")
+	}
+	return hook, err
+}
+
+// FindWebhook находит подписку по идентификатору
+func (h *StatsDB) FindWebhook(ctx context.Context, id int64) (Webhook, error) {
+	hook, err := scanWebhook(h.queryRow(ctx,
+		"SELECT "+webhookColumns+" FROM webhook WHERE tenant = ? AND id = ?;", TenantFromContext(ctx), id))
+	if err == sql.ErrNoRows {
+		return hook, ErrNotFound
+	}
+	return hook, checkError(ctx, "FindWebhook", err)
+}
+
+// FindWebhooks возвращает все подписки арендатора контекста
+func (h *StatsDB) FindWebhooks(ctx context.Context) ([]Webhook, error) {
+	result := []Webhook{}
+	rows, err := h.query(ctx, "SELECT "+webhookColumns+" FROM webhook WHERE tenant = ? ORDER BY id;", TenantFromContext(ctx))
+	if err != nil {
+		return nil, checkError(ctx, "FindWebhooks", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, checkError(ctx, "FindWebhooks", err)
+		}
+		result = append(result, hook)
+	}
+	return result, checkError(ctx, "FindWebhooks", rows.Err())
+}
+
+// DeleteWebhook удаляет подписку вместе с журналом ее доставок
+func (h *StatsDB) DeleteWebhook(ctx context.Context, id int64) error {
+	result, err := h.exec(ctx, "DELETE FROM webhook WHERE tenant = ? AND id = ?;", TenantFromContext(ctx), id)
+	if err != nil {
+		return checkError(ctx, "DeleteWebhook", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return checkError(ctx, "DeleteWebhook", err)
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	_, err = h.exec(ctx, "DELETE FROM webhook_delivery WHERE webhook_id = ?;", id)
+	return checkError(ctx, "DeleteWebhook", err)
+}
+
+// StoreDelivery ставит доставку в очередь и возвращает ее идентификатор
+func (h *StatsDB) StoreDelivery(ctx context.Context, delivery Delivery) (int64, error) {
+	id, err := h.insert(ctx,
+		"INSERT INTO webhook_delivery (webhook_id, tenant, event, payload, status, attempts, "+
+			"next_attempt, response_code, last_error, created, updated) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		delivery.WebhookID,
+		TenantFromContext(ctx),
+		delivery.Event,
+		delivery.Payload,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttempt.UTC(),
+		delivery.ResponseCode,
+		delivery.LastError,
+		delivery.Created.UTC(),
+		delivery.Updated.UTC(),
+	)
+	return id, checkError(ctx, "StoreDelivery", err)
+}
+
+// UpdateDelivery сохраняет результат попытки доставки
+func (h *StatsDB) UpdateDelivery(ctx context.Context, delivery Delivery) error {
+	_, err := h.exec(ctx,
+		"UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt = ?, "+
+			"response_code = ?, last_error = ?, updated = ? WHERE id = ?;",
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttempt.UTC(),
+		delivery.ResponseCode,
+		delivery.LastError,
+		delivery.Updated.UTC(),
+		delivery.ID,
+	)
+	return checkError(ctx, "UpdateDelivery", err)
+}
+
+const deliveryColumns = "id, webhook_id, tenant, event, payload, status, attempts, " +
+	"next_attempt, response_code, last_error, created, updated"
+
+func (h *StatsDB) findDeliveries(ctx context.Context, method, query string, args ...interface{}) ([]Delivery, error) {
+	result := []Delivery{}
+	rows, err := h.query(ctx, query, args...)
+	if err != nil {
+		return nil, checkError(ctx, method, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := Delivery{}
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.Tenant, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttempt, &d.ResponseCode, &d.LastError, &d.Created, &d.Updated)
+		if err != nil {
+			return nil, checkError(ctx, method, err)
+		}
+		result = append(result, d)
+	}
+	return result, checkError(ctx, method, rows.Err())
+}
+
+// FindDueDeliveries возвращает не более limit ожидающих доставок,
+// время очередной попытки которых наступило к моменту now.
+// Время хранится в UTC: SQLite сравнивает его как строки
+func (h *StatsDB) FindDueDeliveries(ctx context.Context, now time.Time, limit int) ([]Delivery, error) {
+	return h.findDeliveries(ctx, "FindDueDeliveries",
+		"SELECT "+deliveryColumns+" FROM webhook_delivery "+
+			"WHERE status = ? AND next_attempt <= ? ORDER BY next_attempt, id LIMIT ?;",
+		DeliveryPending, now.UTC(), limit)
+}
+
+// FindDeliveries возвращает журнал последних limit доставок подписки
+func (h *StatsDB) FindDeliveries(ctx context.Context, webhookID int64, limit int) ([]Delivery, error) {
+	return h.findDeliveries(ctx, "FindDeliveries",
+		"SELECT "+deliveryColumns+" FROM webhook_delivery "+
+			"WHERE webhook_id = ? ORDER BY id DESC LIMIT ?;",
+		webhookID, limit)
+}
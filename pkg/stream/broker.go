@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"sync"
+
+	uc "statistics/pkg/usecases"
+)
+
+// subscriptionBuffer размер очереди сообщений подписчика.
+// Подписчик, не успевающий читать сообщения, отключается
+const subscriptionBuffer = 64
+
+// Message событие с порядковым номером, используемым как id SSE
+type Message struct {
+	ID    uint64
+	Event uc.Event
+}
+
+// Subscription подписка на сообщения брокера об изменениях статистики
+// арендатора с фильтром по датам.
+// Канал C закрывается при отписке или отключении медленного подписчика
+type Subscription struct {
+	C      chan Message
+	tenant string
+	from   string
+	to     string
+}
+
+// match проверяет, что событие относится к арендатору подписки, а его дата
+// попадает в диапазон подписки. Пустая граница диапазона не ограничивает его
+func (s *Subscription) match(event uc.Event) bool {
+	if event.Tenant != s.tenant {
+		return false
+	}
+	date := event.Date
+	if len(date) > len("2006-01-02") {
+		date = date[:len("2006-01-02")]
+	}
+	return (s.from == "" || date >= s.from) && (s.to == "" || date <= s.to)
+}
+
+// Broker внутрипроцессный брокер событий изменения статистики
+// (реализует usecases.Notifier). Хранит последние сообщения
+// в ограниченном буфере для возобновления по Last-Event-ID
+type Broker struct {
+	mu     sync.Mutex
+	lastID uint64
+	replay []Message
+	size   int
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewBroker возвращает брокер с буфером повторной отправки на size сообщений
+func NewBroker(size int) *Broker {
+	return &Broker{
+		size: size,
+		subs: map[*Subscription]struct{}{},
+	}
+}
+
+// Notify рассылает подписчикам события сохранения статистики
+func (b *Broker) Notify(event uc.Event) {
+	if event.Type != uc.EventStatCreated && event.Type != uc.EventStatUpdated {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	msg := Message{ID: b.lastID, Event: event}
+	if b.size > 0 {
+		if len(b.replay) == b.size {
+			b.replay = append(b.replay[:0], b.replay[1:]...)
+		}
+		b.replay = append(b.replay, msg)
+	}
+	for s := range b.subs {
+		if !s.match(event) {
+			continue
+		}
+		select {
+		case s.C <- msg:
+		default:
+			// подписчик переподключится и получит пропущенное из буфера
+			delete(b.subs, s)
+			close(s.C)
+		}
+	}
+}
+
+// Subscribe создает подписку на события арендатора tenant
+// с датами в диапазоне [from, to]. Канал подписки на закрытый брокер закрыт.
+// Если lastID не равен нулю, возвращает сообщения из буфера после lastID.
+// Если lastID больше последнего выданного номера (брокер перезапущен),
+// возвращается весь буфер
+func (b *Broker) Subscribe(tenant, from, to string, lastID uint64) (*Subscription, []Message) {
+	s := &Subscription{
+		C:      make(chan Message, subscriptionBuffer),
+		tenant: tenant,
+		from:   from,
+		to:     to,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.C)
+		return s, nil
+	}
+	missed := []Message{}
+	if lastID != 0 {
+		if lastID > b.lastID {
+			lastID = 0
+		}
+		for _, msg := range b.replay {
+			if msg.ID > lastID && s.match(msg.Event) {
+				missed = append(missed, msg)
+			}
+		}
+	}
+	b.subs[s] = struct{}{}
+	return s, missed
+}
+
+// Unsubscribe отменяет подписку
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.C)
+	}
+}
+
+// Close закрывает все подписки, например при остановке сервера:
+// клиенты переподключаются к другому экземпляру с Last-Event-ID
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.C)
+	}
+}
@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"testing"
+
+	uc "statistics/pkg/usecases"
+)
+
+func statEvent(date string) uc.Event {
+	return uc.Event{Type: uc.EventStatUpdated, Tenant: "acme", Date: date}
+}
+
+func TestBrokerFiltersByDateRange(t *testing.T) {
+	b := NewBroker(10)
+	sub, _ := b.Subscribe("acme", "2021-01-10", "2021-01-20", 0)
+	defer b.Unsubscribe(sub)
+
+	b.Notify(statEvent("2021-01-09"))
+	b.Notify(statEvent("2021-01-10"))
+	b.Notify(uc.Event{Type: uc.EventStatsDeleted, Tenant: "acme"})
+	// события другого арендатора не рассылаются
+	b.Notify(uc.Event{Type: uc.EventStatUpdated, Tenant: "globex", Date: "2021-01-15"})
+	b.Notify(statEvent("2021-01-21"))
+	b.Notify(statEvent("2021-01-20"))
+
+	for _, expect := range []string{"2021-01-10", "2021-01-20"} {
+		msg := <-sub.C
+		if msg.Event.Date != expect {
+			t.Fatalf("got %s; expected %s", msg.Event.Date, expect)
+		}
+	}
+	if len(sub.C) != 0 {
+		t.Fatalf("got %d extra messages; expected none", len(sub.C))
+	}
+}
+
+func TestBrokerReplaysAfterLastEventID(t *testing.T) {
+	b := NewBroker(3)
+	for _, date := range []string{"2021-01-01", "2021-01-02", "2021-01-03", "2021-01-04", "2021-01-05"} {
+		b.Notify(statEvent(date))
+	}
+
+	// буфер хранит три последних сообщения: 3, 4, 5
+	sub, missed := b.Subscribe("acme", "", "", 3)
+	b.Unsubscribe(sub)
+	if len(missed) != 2 || missed[0].ID != 4 || missed[1].ID != 5 {
+		t.Fatalf("got %+v; expected messages 4 and 5", missed)
+	}
+
+	sub, missed = b.Subscribe("acme", "", "", 1)
+	b.Unsubscribe(sub)
+	if len(missed) != 3 || missed[0].ID != 3 {
+		t.Fatalf("got %+v; expected messages 3 to 5", missed)
+	}
+
+	// номер из прошлого запуска: весь буфер
+	sub, missed = b.Subscribe("acme", "", "", 100)
+	b.Unsubscribe(sub)
+	if len(missed) != 3 {
+		t.Fatalf("got %d messages; expected %d", len(missed), 3)
+	}
+
+	sub, missed = b.Subscribe("acme", "", "", 0)
+	b.Unsubscribe(sub)
+	if len(missed) != 0 {
+		t.Fatalf("got %d messages without Last-Event-ID; expected none", len(missed))
+	}
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	b := NewBroker(0)
+	sub, _ := b.Subscribe("acme", "", "", 0)
+	for i := 0; i <= subscriptionBuffer; i++ {
+		b.Notify(statEvent("2021-01-01"))
+	}
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != subscriptionBuffer {
+		t.Fatalf("got %d messages before close; expected %d", n, subscriptionBuffer)
+	}
+	// повторная отписка закрытой подписки безопасна
+	b.Unsubscribe(sub)
+}
+
+func TestBrokerClose(t *testing.T) {
+	b := NewBroker(0)
+	sub, _ := b.Subscribe("acme", "", "", 0)
+	b.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatal("expected subscription closed")
+	}
+	// подписка на закрытый брокер сразу закрыта
+	late, _ := b.Subscribe("acme", "", "", 0)
+	if _, ok := <-late.C; ok {
+		t.Fatal("expected late subscription closed")
+	}
+	b.Unsubscribe(late)
+	b.Notify(statEvent("2021-01-01"))
+}
@@ -0,0 +1,271 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"statistics/pkg/logging"
+)
+
+// StdoutExporter пишет каждый завершенный span строкой JSON в W
+type StdoutExporter struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// NewStdoutExporter возвращает экспортер, пишущий span в w
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{W: w}
+}
+
+// stdoutSpan представление span в StdoutExporter
+type stdoutSpan struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Kind       Kind                   `json:"kind"`
+	Start      time.Time              `json:"start"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// ExportSpan is part of Exporter
+func (e *StdoutExporter) ExportSpan(span *Span) {
+	out := stdoutSpan{
+		Name:       span.Name,
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		Kind:       span.Kind,
+		Start:      span.Start.UTC(),
+		DurationMS: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		Error:      span.Error,
+	}
+	if span.Parent != (SpanID{}) {
+		out.ParentID = span.Parent.String()
+	}
+	if len(span.Attrs) > 0 {
+		out.Attributes = map[string]interface{}{}
+		for _, attr := range span.Attrs {
+			out.Attributes[attr.Key] = attr.Value
+		}
+	}
+	// текст SQL-запросов читается без экранирования < и >
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(out); err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.W.Write(b.Bytes())
+}
+
+// OTLPExporter отправляет span пакетами в коллектор OpenTelemetry
+// по протоколу OTLP/HTTP в кодировке JSON. Span накапливаются в очереди
+// и отправляются методом Run; при переполнении очереди новые span отбрасываются
+type OTLPExporter struct {
+	// URL адрес приема трасс коллектора, например http://localhost:4318/v1/traces
+	URL    string
+	Client *http.Client
+	// Resource атрибуты сервиса (service.name, service.version, ...)
+	Resource []Attr
+	// BatchSize количество span, при котором пакет отправляется сразу
+	BatchSize int
+	// Interval наибольшая задержка отправки span
+	Interval time.Duration
+
+	queue   chan *Span
+	dropped int64
+}
+
+// NewOTLPExporter возвращает экспортер в коллектор endpoint
+// (например http://localhost:4318) с атрибутами сервиса resource,
+// переданными парами ключ-значение
+func NewOTLPExporter(endpoint string, resource ...interface{}) *OTLPExporter {
+	e := &OTLPExporter{
+		URL:       endpoint + "/v1/traces",
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		BatchSize: 512,
+		Interval:  5 * time.Second,
+		queue:     make(chan *Span, 2048),
+	}
+	for i := 0; i+1 < len(resource); i += 2 {
+		e.Resource = append(e.Resource, Attr{Key: fmt.Sprint(resource[i]), Value: resource[i+1]})
+	}
+	return e
+}
+
+// ExportSpan is part of Exporter
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Dropped количество span, отброшенных из-за переполнения очереди
+func (e *OTLPExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Run отправляет span из очереди пакетами, пока не отменен ctx.
+// После отмены отправляет оставшиеся в очереди span
+func (e *OTLPExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	batch := []*Span{}
+	send := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.Send(ctx, batch); err != nil {
+			logging.Error(ctx, "Tracing OTLP export", "err", err, "spans", len(batch))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			if batch = append(batch, span); len(batch) >= e.BatchSize {
+				send(ctx)
+			}
+		case <-ticker.C:
+			send(ctx)
+		case <-ctx.Done():
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			final, cancel := context.WithTimeout(context.Background(), e.Client.Timeout)
+			send(final)
+			cancel()
+			return
+		}
+	}
+}
+
+// Send отправляет span в коллектор одним запросом
+func (e *OTLPExporter) Send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("tracing: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Структуры запроса OTLP/HTTP JSON (ExportTraceServiceRequest)
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              Kind       `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr `json:"attributes,omitempty"`
+		Status            otlpStatus `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+// otlpStatusError код STATUS_CODE_ERROR
+const otlpStatusError = 2
+
+func otlpAttrs(attrs []Attr) []otlpAttr {
+	result := []otlpAttr{}
+	for _, attr := range attrs {
+		value := map[string]interface{}{}
+		switch v := attr.Value.(type) {
+		case bool:
+			value["boolValue"] = v
+		case int:
+			value["intValue"] = strconv.Itoa(v)
+		case int64:
+			value["intValue"] = strconv.FormatInt(v, 10)
+		case float64:
+			value["doubleValue"] = v
+		default:
+			value["stringValue"] = fmt.Sprint(v)
+		}
+		result = append(result, otlpAttr{Key: attr.Key, Value: value})
+	}
+	return result
+}
+
+func (e *OTLPExporter) request(spans []*Span) otlpRequest {
+	out := []otlpSpan{}
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(span.Attrs),
+		}
+		if span.Parent != (SpanID{}) {
+			s.ParentSpanID = span.Parent.String()
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		out = append(out, s)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttrs(e.Resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "statistics"}, Spans: out}},
+	}}}
+}
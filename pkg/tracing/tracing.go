@@ -0,0 +1,248 @@
+// Package tracing трассировка запросов в модели OpenTelemetry.
+// Span передается через контекст: сценарии и репозиторий начинают
+// дочерние span функцией Start, которая ничего не делает, если
+// в контексте нет span (трассировка выключена или запрос не выбран).
+// Контекст трассировки принимается и передается в заголовке W3C traceparent
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// TraceID идентификатор трассы
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanID идентификатор span
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext идентифицирует span внутри трассы
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled трасса записывается
+	Sampled bool
+}
+
+// Valid идентификаторы трассы и span не нулевые
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent возвращает значение заголовка W3C traceparent
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent разбирает заголовок W3C traceparent версии 00.
+// Возвращает false, если заголовок не соответствует формату
+func ParseTraceparent(header string) (SpanContext, bool) {
+	sc := SpanContext{}
+	// 00-<32 hex>-<16 hex>-<2 hex>
+	if len(header) != 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' || header[:2] != "00" {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(header[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(header[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(header[53:55])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+// Kind роль span в обмене
+type Kind int
+
+// Роли span, значения совпадают с OTLP SpanKind
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr атрибут span
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span операция трассы. Методы nil *Span ничего не делают,
+// поэтому результат Start можно использовать без проверок
+type Span struct {
+	Name    string
+	Kind    Kind
+	Context SpanContext
+	Parent  SpanID
+	Start   time.Time
+	End     time.Time
+	Attrs   []Attr
+	// Error описание ошибки операции, пустое - операция успешна
+	Error string
+
+	mu     sync.Mutex
+	tracer *Tracer
+	ended  bool
+}
+
+// SetAttributes добавляет атрибуты, переданные парами ключ-значение
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.Attrs = append(s.Attrs, Attr{Key: fmt.Sprint(kv[i]), Value: kv[i+1]})
+	}
+}
+
+// RecordError отмечает операцию как завершившуюся ошибкой err, nil игнорируется
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish завершает span и передает его экспортеру. Повторные вызовы игнорируются
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = s.tracer.Now()
+	s.mu.Unlock()
+	s.tracer.Exporter.ExportSpan(s)
+}
+
+// SpanContext возвращает контекст span, для nil - нулевой
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// Exporter получает завершенные span
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer начинает корневые span запросов
+type Tracer struct {
+	Exporter Exporter
+	// Ratio доля записываемых трасс без входящего контекста, от 0 до 1.
+	// Для запросов с traceparent решение принимает вызывающая сторона
+	Ratio float64
+	// Now источник времени span
+	Now func() time.Time
+}
+
+// NewTracer возвращает Tracer, записывающий все трассы в exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{Exporter: exporter, Ratio: 1, Now: time.Now}
+}
+
+type spanKey struct{}
+
+// FromContext возвращает текущий span контекста или nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartRemote начинает корневой span запроса name, продолжающий трассу parent
+// (если parent.Valid()), и возвращает контекст с ним. Если трасса не записывается,
+// возвращается исходный контекст и nil
+func (t *Tracer) StartRemote(ctx context.Context, parent SpanContext, name string, kind Kind, kv ...interface{}) (context.Context, *Span) {
+	sc := SpanContext{Sampled: true}
+	if parent.Valid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sample()
+	}
+	if !sc.Sampled {
+		return ctx, nil
+	}
+	sc.SpanID = newSpanID()
+	span := &Span{Name: name, Kind: kind, Context: sc, Parent: parent.SpanID, Start: t.Now(), tracer: t}
+	span.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sample решает, записывать ли новую трассу
+func (t *Tracer) sample() bool {
+	if t.Ratio >= 1 {
+		return true
+	}
+	if t.Ratio <= 0 {
+		return false
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return false
+	}
+	return float64(n.Int64())/math.MaxInt64 < t.Ratio
+}
+
+// Start начинает дочерний span name текущего span контекста и возвращает
+// контекст с ним. Если в контексте нет span, возвращает исходный контекст и nil.
+// Span завершается вызовом Finish
+func Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	t := parent.tracer
+	span := &Span{
+		Name:    name,
+		Kind:    KindInternal,
+		Context: SpanContext{TraceID: parent.Context.TraceID, SpanID: newSpanID(), Sampled: true},
+		Parent:  parent.Context.SpanID,
+		Start:   t.Now(),
+		tracer:  t,
+	}
+	span.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func newTraceID() TraceID {
+	id := TraceID{}
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	id := SpanID{}
+	rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,165 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder экспортер, сохраняющий span в памяти
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) ExportSpan(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("got %+v, %v", sc, ok)
+	}
+	if sc.Traceparent() != header {
+		t.Fatalf("got %q; expected %q", sc.Traceparent(), header)
+	}
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	// без span в контексте Start ничего не делает
+	ctx, span := Start(context.Background(), "noop")
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatal("expected no span without a parent")
+	}
+	span.SetAttributes("key", "value")
+	span.RecordError(errors.New("ignored"))
+	span.Finish()
+
+	rec := &recorder{}
+	tracer := NewTracer(rec)
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.StartRemote(context.Background(), parent, "GET /stats", KindServer)
+	_, child := Start(ctx, "usecases.GetStatWithinFromAndTo", "from", "2021-01-01")
+	child.RecordError(errors.New("failed"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("got %d spans; expected 2", len(rec.spans))
+	}
+	if root.Context.TraceID != parent.TraceID || root.Parent != parent.SpanID || root.Kind != KindServer {
+		t.Fatalf("root does not continue the remote trace: %+v", root)
+	}
+	if child.Context.TraceID != parent.TraceID || child.Parent != root.Context.SpanID ||
+		child.Error != "failed" || child.Attrs[0] != (Attr{"from", "2021-01-01"}) {
+		t.Fatalf("got child %+v", child)
+	}
+
+	// трасса, не выбранная вызывающей стороной, не записывается
+	parent.Sampled = false
+	if _, span := tracer.StartRemote(context.Background(), parent, "GET /stats", KindServer); span != nil {
+		t.Fatal("expected no span for a not sampled trace")
+	}
+	tracer.Ratio = 0
+	if _, span := tracer.StartRemote(context.Background(), SpanContext{}, "GET /stats", KindServer); span != nil {
+		t.Fatal("expected no span with zero ratio")
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	out := &bytes.Buffer{}
+	tracer := NewTracer(NewStdoutExporter(out))
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tracer.Now = func() time.Time { now = now.Add(1500 * time.Microsecond); return now }
+	ctx, root := tracer.StartRemote(context.Background(), SpanContext{}, "GET /stats", KindServer)
+	_, child := Start(ctx, "SELECT stat", "db.statement", "SELECT 1")
+	child.Finish()
+	root.Finish()
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; expected 2:\n%s", len(lines), out.String())
+	}
+	span := map[string]interface{}{}
+	if err := json.Unmarshal(lines[0], &span); err != nil {
+		t.Fatal(err)
+	}
+	if span["name"] != "SELECT stat" || span["parent_id"] != root.Context.SpanID.String() ||
+		span["duration_ms"] != 1.5 || span["attributes"].(map[string]interface{})["db.statement"] != "SELECT 1" {
+		t.Fatalf("got %v", span)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "service.name", "statistics")
+	exporter.Interval = time.Hour
+	tracer := NewTracer(exporter)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(done)
+	}()
+
+	_, span := tracer.StartRemote(context.Background(), SpanContext{}, "GET /stats", KindServer, "http.status_code", 500)
+	span.RecordError(errors.New("Internal Server Error"))
+	span.Finish()
+	// оставшиеся span отправляются после остановки
+	cancel()
+	<-done
+
+	request := otlpRequest{}
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("no spans sent to the collector")
+	}
+	rs := request.ResourceSpans[0]
+	got := rs.ScopeSpans[0].Spans
+	if rs.Resource.Attributes[0].Key != "service.name" || len(got) != 1 {
+		t.Fatalf("got %+v", request)
+	}
+	if got[0].TraceID != span.Context.TraceID.String() || got[0].Kind != KindServer ||
+		got[0].Status.Code != otlpStatusError || got[0].Attributes[0].Value["intValue"] != "500" {
+		t.Fatalf("got span %+v", got[0])
+	}
+}
@@ -0,0 +1,221 @@
+package usecases
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	"strings"
+	"time"
+)
+
+// Права ключей API. ScopeAdmin включает все остальные
+const (
+	ScopeStatsRead   = "stats:read"
+	ScopeStatsWrite  = "stats:write"
+	ScopeStatsDelete = "stats:delete"
+	ScopeAdmin       = "admin"
+)
+
+// Scopes все права ключей API
+var Scopes = []string{ScopeStatsRead, ScopeStatsWrite, ScopeStatsDelete, ScopeAdmin}
+
+// ErrUnauthorized ключ API не задан, не найден или отозван
+var ErrUnauthorized = errors.New("usecases: invalid API key")
+
+// apiKeyPrefix начало каждого ключа API, по нему ключ узнается в конфигурации и журналах
+const apiKeyPrefix = "sk_"
+
+// auditLimit количество последних записей журнала аудита
+const auditLimit = 100
+
+// OutputAPIKey структура ключа API, возвращаемая на "верхний" уровень (handlers).
+// Key возвращается только при создании ключа, далее ключ не восстановить
+type OutputAPIKey struct {
+	ID      int64
+	Name    string
+	Tenant  string
+	Key     string `json:",omitempty"`
+	Prefix  string
+	Scopes  []string
+	Created time.Time
+	Revoked *time.Time `json:",omitempty"`
+}
+
+// OutputAuditEntry запись журнала аудита
+type OutputAuditEntry struct {
+	ID        int64
+	KeyID     int64
+	KeyName   string
+	Method    string
+	Path      string
+	Status    int
+	RequestID string
+	Created   time.Time
+}
+
+func toOutputAPIKey(key r.APIKey) OutputAPIKey {
+	result := OutputAPIKey{
+		ID:      key.ID,
+		Name:    key.Name,
+		Tenant:  key.Tenant,
+		Prefix:  key.Prefix,
+		Scopes:  key.Scopes,
+		Created: key.Created,
+	}
+	if !key.Revoked.IsZero() {
+		revoked := key.Revoked
+		result.Revoked = &revoked
+	}
+	return result
+}
+
+// HashAPIKey возвращает хэш ключа, который хранится в базе.
+// Ключи случайные и длинные, поэтому медленный хэш не нужен
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasScope ключ key дает право scope
+func HasScope(key r.APIKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// checkScopes проверяет права и убирает повторы
+func checkScopes(scopes []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, ErrInvalid
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+	if len(result) == 0 {
+		return nil, ErrInvalid
+	}
+	return result, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateAPIKey сценарий создания ключа API с именем name и правами scopes
+// для арендатора контекста. Ключ вида sk_<prefix>_<secret> возвращается
+// один раз, в базе хранится его хэш
+func CreateAPIKey(ctx context.Context, name string, scopes []string, rep r.APIKeyRepository) (OutputAPIKey, error) {
+	name = strings.TrimSpace(name)
+	scopes, err := checkScopes(scopes)
+	if err != nil || name == "" {
+		return OutputAPIKey{}, ErrInvalid
+	}
+	prefix, err := randomHex(6)
+	if err != nil {
+		return OutputAPIKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return OutputAPIKey{}, err
+	}
+	plain := apiKeyPrefix + prefix + "_" + secret
+	key := r.APIKey{
+		Name:    name,
+		Tenant:  r.TenantFromContext(ctx),
+		Prefix:  prefix,
+		Hash:    HashAPIKey(plain),
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	if key.ID, err = rep.StoreAPIKey(ctx, key); err != nil {
+		logging.Error(ctx, "Usecase CreateAPIKey. StoreAPIKey", "err", err)
+		return OutputAPIKey{}, err
+	}
+	result := toOutputAPIKey(key)
+	result.Key = plain
+	return result, nil
+}
+
+// Authenticate сценарий проверки ключа API. Возвращает ErrUnauthorized,
+// если ключ имеет неверный формат, не найден, не совпадает или отозван
+func Authenticate(ctx context.Context, plain string, rep r.APIKeyRepository) (r.APIKey, error) {
+	parts := strings.Split(strings.TrimPrefix(plain, apiKeyPrefix), "_")
+	if !strings.HasPrefix(plain, apiKeyPrefix) || len(parts) != 2 || parts[0] == "" {
+		return r.APIKey{}, ErrUnauthorized
+	}
+	key, err := rep.FindAPIKey(ctx, parts[0])
+	if err == r.ErrNotFound {
+		return r.APIKey{}, ErrUnauthorized
+	}
+	if err != nil {
+		logging.Error(ctx, "Usecase Authenticate. FindAPIKey", "err", err)
+		return r.APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(HashAPIKey(plain)), []byte(key.Hash)) != 1 || !key.Revoked.IsZero() {
+		return r.APIKey{}, ErrUnauthorized
+	}
+	return key, nil
+}
+
+// GetAPIKeys сценарий получения всех ключей API без секретов
+func GetAPIKeys(ctx context.Context, rep r.APIKeyRepository) ([]OutputAPIKey, error) {
+	keys, err := rep.FindAPIKeys(ctx)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetAPIKeys. FindAPIKeys", "err", err)
+		return nil, err
+	}
+	result := []OutputAPIKey{}
+	for _, key := range keys {
+		result = append(result, toOutputAPIKey(key))
+	}
+	return result, nil
+}
+
+// RevokeAPIKey сценарий отзыва ключа API
+func RevokeAPIKey(ctx context.Context, id int64, rep r.APIKeyRepository) error {
+	return rep.RevokeAPIKey(ctx, id, time.Now())
+}
+
+// RecordAudit сценарий записи изменяющего запроса в журнал аудита
+func RecordAudit(ctx context.Context, entry r.AuditEntry, rep r.APIKeyRepository) error {
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+	_, err := rep.StoreAudit(ctx, entry)
+	return err
+}
+
+// GetAudit сценарий получения последних записей журнала аудита
+func GetAudit(ctx context.Context, rep r.APIKeyRepository) ([]OutputAuditEntry, error) {
+	entries, err := rep.FindAudit(ctx, auditLimit)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetAudit. FindAudit", "err", err)
+		return nil, err
+	}
+	result := []OutputAuditEntry{}
+	for _, e := range entries {
+		result = append(result, OutputAuditEntry(e))
+	}
+	return result, nil
+}
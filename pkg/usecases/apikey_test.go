@@ -0,0 +1,108 @@
+package usecases
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"statistics/pkg/jwt"
+	r "statistics/pkg/repository"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+
+	for _, scopes := range [][]string{nil, {"stats:everything"}} {
+		if _, err := CreateAPIKey(ctx, "ci", scopes, rep); err != ErrInvalid {
+			t.Fatalf("scopes %v: got %v; expected %v", scopes, err, ErrInvalid)
+		}
+	}
+	if _, err := CreateAPIKey(ctx, " ", []string{ScopeStatsRead}, rep); err != ErrInvalid {
+		t.Fatalf("empty name: got %v; expected %v", err, ErrInvalid)
+	}
+
+	created, err := CreateAPIKey(ctx, "ci", []string{ScopeStatsRead, ScopeStatsWrite, ScopeStatsRead}, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, "sk_"+created.Prefix+"_") || len(created.Scopes) != 2 {
+		t.Fatalf("got %+v", created)
+	}
+	stored, _ := rep.FindAPIKey(ctx, created.Prefix)
+	if stored.Hash != HashAPIKey(created.Key) || strings.Contains(stored.Hash, created.Key) {
+		t.Fatal("key must be stored hashed")
+	}
+
+	key, err := Authenticate(ctx, created.Key, rep)
+	if err != nil || key.ID != created.ID {
+		t.Fatalf("Authenticate: got %+v, %v", key, err)
+	}
+	if !HasScope(key, ScopeStatsWrite) || HasScope(key, ScopeStatsDelete) {
+		t.Fatalf("got scopes %v", key.Scopes)
+	}
+	if !HasScope(r.APIKey{Scopes: []string{ScopeAdmin}}, ScopeStatsDelete) {
+		t.Fatal("admin must have every scope")
+	}
+	for _, bad := range []string{"", "sk_", created.Key + "x", "sk_" + created.Prefix, "xx" + created.Key[2:], "sk_unknown_secret"} {
+		if _, err := Authenticate(ctx, bad, rep); err != ErrUnauthorized {
+			t.Errorf("Authenticate(%q): got %v; expected %v", bad, err, ErrUnauthorized)
+		}
+	}
+
+	if err := RevokeAPIKey(ctx, created.ID, rep); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(ctx, created.Key, rep); err != ErrUnauthorized {
+		t.Fatalf("revoked key: got %v; expected %v", err, ErrUnauthorized)
+	}
+	keys, _ := GetAPIKeys(ctx, rep)
+	if len(keys) != 1 || keys[0].Key != "" || keys[0].Revoked == nil {
+		t.Fatalf("GetAPIKeys: got %+v", keys)
+	}
+}
+
+// stubValidator проверка токена, возвращающая заданные утверждения
+type stubValidator struct {
+	claims jwt.Claims
+	err    error
+}
+
+func (v stubValidator) Validate(ctx context.Context, token string) (jwt.Claims, error) {
+	return v.claims, v.err
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	ctx := context.Background()
+	mapping := TokenMapping{
+		ScopeClaim: "groups",
+		Scopes:     map[string][]string{"analysts": {ScopeStatsRead}, "ops": {ScopeStatsRead, ScopeStatsWrite}},
+	}
+	claims := jwt.Claims{"sub": "alice", "groups": []interface{}{"ops", "analysts", "stats:delete", "unknown"}}
+	key, err := AuthenticateToken(ctx, "token", stubValidator{claims: claims}, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Name != "jwt:alice" || key.Tenant != r.DefaultTenant || strings.Join(key.Scopes, " ") != "stats:read stats:write stats:delete" {
+		t.Fatalf("got %+v", key)
+	}
+
+	// права и арендатор по умолчанию берутся из scope и tenant
+	claims = jwt.Claims{"sub": "bob", "scope": "admin", "tenant": "acme"}
+	key, err = AuthenticateToken(ctx, "token", stubValidator{claims: claims}, TokenMapping{})
+	if err != nil || key.Tenant != "acme" || !HasScope(key, ScopeStatsDelete) {
+		t.Fatalf("got %+v, %v", key, err)
+	}
+
+	for _, v := range []stubValidator{
+		{err: jwt.ErrExpired},
+		{claims: jwt.Claims{"tenant": "Bad Tenant"}},
+	} {
+		if _, err := AuthenticateToken(ctx, "token", v, TokenMapping{}); err != ErrUnauthorized {
+			t.Fatalf("got %v; expected %v", err, ErrUnauthorized)
+		}
+	}
+	if _, err := AuthenticateToken(ctx, "token", stubValidator{err: jwt.ErrKeysUnavailable}, TokenMapping{}); err != jwt.ErrKeysUnavailable {
+		t.Fatalf("got %v; expected %v", err, jwt.ErrKeysUnavailable)
+	}
+}
@@ -0,0 +1,283 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	"time"
+)
+
+// ErrInvalid входные данные сценария некорректны
+var ErrInvalid = errors.New("usecases: invalid input")
+
+// defaultThreshold допустимый темп расходования по умолчанию:
+// бюджет тратится не быстрее, чем проходит период
+const defaultThreshold = 1.0
+
+// OutputBudget структура бюджета, возвращаемая на "верхний" уровень (handlers).
+// Amount в рублях
+type OutputBudget struct {
+	ID        int64
+	Name      string
+	Amount    float64
+	Period    string
+	Threshold float64
+}
+
+// BudgetStatus фактические расходы относительно бюджета в периоде [From, To],
+// посчитанные на дату Date. Spent и Amount в рублях.
+// Pacing = SpentFraction / ElapsedFraction
+type BudgetStatus struct {
+	Budget          OutputBudget
+	Date            string
+	From            string
+	To              string
+	Spent           float64
+	SpentFraction   float64
+	ElapsedFraction float64
+	Pacing          float64
+	Exceeded        bool
+}
+
+// OutputAlert структура оповещения, возвращаемая на "верхний" уровень (handlers).
+// Spent и Amount в рублях
+type OutputAlert struct {
+	ID          int64
+	BudgetID    int64
+	PeriodStart string
+	Date        string
+	Spent       float64
+	Amount      float64
+	Pacing      float64
+	Created     time.Time
+}
+
+func toOutputBudget(budget r.Budget) OutputBudget {
+	return OutputBudget{
+		ID:        budget.ID,
+		Name:      budget.Name,
+		Amount:    float64(budget.Amount) / 100,
+		Period:    budget.Period,
+		Threshold: budget.Threshold,
+	}
+}
+
+func toOutputAlert(alert r.Alert) OutputAlert {
+	return OutputAlert{
+		ID:          alert.ID,
+		BudgetID:    alert.BudgetID,
+		PeriodStart: alert.PeriodStart,
+		Date:        alert.Date,
+		Spent:       float64(alert.Spent) / 100,
+		Amount:      float64(alert.Amount) / 100,
+		Pacing:      alert.Pacing,
+		Created:     alert.Created,
+	}
+}
+
+// checkBudget проверяет бюджет и подставляет порог по умолчанию
+func checkBudget(budget *r.Budget) error {
+	if budget.Amount <= 0 {
+		return ErrInvalid
+	}
+	switch budget.Period {
+	case "day", "week", "month":
+	default:
+		return ErrInvalid
+	}
+	if budget.Threshold < 0 {
+		return ErrInvalid
+	}
+	if budget.Threshold == 0 {
+		budget.Threshold = defaultThreshold
+	}
+	return nil
+}
+
+// CreateBudget сценарий создания бюджета
+func CreateBudget(ctx context.Context, budget r.Budget, rep r.BudgetRepository) (OutputBudget, error) {
+	if err := checkBudget(&budget); err != nil {
+		return OutputBudget{}, err
+	}
+	id, err := rep.StoreBudget(ctx, budget)
+	if err != nil {
+		logging.Error(ctx, "Usecase CreateBudget. StoreBudget", "err", err, "budget", budget)
+		return OutputBudget{}, err
+	}
+	budget.ID = id
+	return toOutputBudget(budget), nil
+}
+
+// GetBudget сценарий получения бюджета по идентификатору
+func GetBudget(ctx context.Context, id int64, rep r.BudgetRepository) (OutputBudget, error) {
+	budget, err := rep.FindBudget(ctx, id)
+	if err != nil {
+		return OutputBudget{}, err
+	}
+	return toOutputBudget(budget), nil
+}
+
+// GetBudgets сценарий получения всех бюджетов
+func GetBudgets(ctx context.Context, rep r.BudgetRepository) ([]OutputBudget, error) {
+	budgets, err := rep.FindBudgets(ctx)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetBudgets. FindBudgets", "err", err)
+		return nil, err
+	}
+	result := []OutputBudget{}
+	for _, budget := range budgets {
+		result = append(result, toOutputBudget(budget))
+	}
+	return result, nil
+}
+
+// UpdateBudget сценарий изменения существующего бюджета
+func UpdateBudget(ctx context.Context, budget r.Budget, rep r.BudgetRepository) (OutputBudget, error) {
+	if err := checkBudget(&budget); err != nil {
+		return OutputBudget{}, err
+	}
+	if _, err := rep.FindBudget(ctx, budget.ID); err != nil {
+		return OutputBudget{}, err
+	}
+	if err := rep.UpdateBudget(ctx, budget); err != nil {
+		logging.Error(ctx, "Usecase UpdateBudget. UpdateBudget", "err", err, "budget", budget)
+		return OutputBudget{}, err
+	}
+	return toOutputBudget(budget), nil
+}
+
+// DeleteBudget сценарий удаления бюджета
+func DeleteBudget(ctx context.Context, id int64, rep r.BudgetRepository) error {
+	return rep.DeleteBudget(ctx, id)
+}
+
+// GetAlerts сценарий получения всех оповещений
+func GetAlerts(ctx context.Context, rep r.BudgetRepository) ([]OutputAlert, error) {
+	alerts, err := rep.FindAlerts(ctx)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetAlerts. FindAlerts", "err", err)
+		return nil, err
+	}
+	result := []OutputAlert{}
+	for _, alert := range alerts {
+		result = append(result, toOutputAlert(alert))
+	}
+	return result, nil
+}
+
+// periodBounds возвращает первый и последний день периода бюджета,
+// содержащего дату date. Неделя начинается с понедельника
+func periodBounds(period string, date time.Time) (time.Time, time.Time) {
+	switch period {
+	case "week":
+		from := date.AddDate(0, 0, -(int(date.Weekday())+6)%7)
+		return from, from.AddDate(0, 0, 6)
+	case "month":
+		from := date.AddDate(0, 0, 1-date.Day())
+		return from, from.AddDate(0, 1, -1)
+	}
+	return date, date
+}
+
+// budgetStatus считает расходы и темп расходования бюджета на дату date.
+// Прошедшая доля периода учитывает день date целиком
+func budgetStatus(ctx context.Context, budget r.Budget, date time.Time, rep r.StatsRepository) (BudgetStatus, int, error) {
+	from, to := periodBounds(budget.Period, date)
+	data, err := rep.FindByPeriodDate(ctx, from.Format(layout), to.Format(layout))
+	if err != nil {
+		return BudgetStatus{}, 0, err
+	}
+	spent := 0
+	for _, value := range data {
+		spent += value.Cost
+	}
+	days := to.Sub(from).Hours()/24 + 1
+	elapsed := (date.Sub(from).Hours()/24 + 1) / days
+	spentFraction := float64(spent) / float64(budget.Amount)
+	pacing := spentFraction / elapsed
+	return BudgetStatus{
+		Budget:          toOutputBudget(budget),
+		Date:            date.Format(layout),
+		From:            from.Format(layout),
+		To:              to.Format(layout),
+		Spent:           float64(spent) / 100,
+		SpentFraction:   round(spentFraction),
+		ElapsedFraction: round(elapsed),
+		Pacing:          round(pacing),
+		Exceeded:        pacing > budget.Threshold,
+	}, spent, nil
+}
+
+// GetBudgetStatus сценарий получения фактических расходов и темпа
+// расходования бюджета id на дату date
+func GetBudgetStatus(ctx context.Context, id int64, date string, stats r.StatsRepository, budgets r.BudgetRepository) (BudgetStatus, error) {
+	day, err := time.Parse(layout, date)
+	if err != nil {
+		return BudgetStatus{}, ErrInvalid
+	}
+	budget, err := budgets.FindBudget(ctx, id)
+	if err != nil {
+		return BudgetStatus{}, err
+	}
+	status, _, err := budgetStatus(ctx, budget, day, stats)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetBudgetStatus. FindByPeriodDate", "err", err)
+		return BudgetStatus{}, err
+	}
+	return status, nil
+}
+
+// CheckBudgets сценарий проверки темпа расходования всех бюджетов
+// в периодах, содержащих дату date. Запускается после AddStat.
+// Для каждого бюджета с превышенным порогом создается не более одного
+// оповещения за период. Возвращает созданные оповещения,
+// получатели notifiers оповещаются о каждом событием alert.fired
+func CheckBudgets(ctx context.Context, date string, stats r.StatsRepository, budgets r.BudgetRepository, notifiers ...Notifier) ([]OutputAlert, error) {
+	day, err := parseDate(date)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	list, err := budgets.FindBudgets(ctx)
+	if err != nil {
+		logging.Error(ctx, "Usecase CheckBudgets. FindBudgets", "err", err)
+		return nil, err
+	}
+	result := []OutputAlert{}
+	for _, budget := range list {
+		status, spent, err := budgetStatus(ctx, budget, day, stats)
+		if err != nil {
+			logging.Error(ctx, "Usecase CheckBudgets. FindByPeriodDate", "err", err)
+			return result, err
+		}
+		if !status.Exceeded {
+			continue
+		}
+		_, err = budgets.FindAlert(ctx, budget.ID, status.From)
+		if err == nil {
+			continue
+		}
+		if err != r.ErrNotFound {
+			return result, err
+		}
+		alert := r.Alert{
+			BudgetID:    budget.ID,
+			PeriodStart: status.From,
+			Date:        status.Date,
+			Spent:       spent,
+			Amount:      budget.Amount,
+			Pacing:      status.Pacing,
+			Created:     time.Now(),
+		}
+		if alert.ID, err = budgets.StoreAlert(ctx, alert); err != nil {
+			logging.Error(ctx, "Usecase CheckBudgets. StoreAlert", "err", err, "alert", alert)
+			return result, err
+		}
+		logging.Warn(ctx, "Budget pacing exceeds threshold", "budget", budget.ID, "pacing", status.Pacing, "threshold", budget.Threshold)
+		output := toOutputAlert(alert)
+		notify(notifiers, Event{Type: EventAlertFired, Tenant: r.TenantFromContext(ctx), Time: alert.Created,
+			Date: alert.Date, Alert: &output})
+		result = append(result, output)
+	}
+	return result, nil
+}
@@ -0,0 +1,134 @@
+package usecases
+
+import (
+	"context"
+	r "statistics/pkg/repository"
+	"testing"
+)
+
+// заглушка хранилища бюджетов для тестирования Usecase
+type MockBudgets struct {
+	budgets []r.Budget
+	alerts  []r.Alert
+}
+
+func (m *MockBudgets) StoreBudget(ctx context.Context, budget r.Budget) (int64, error) {
+	budget.ID = int64(len(m.budgets) + 1)
+	m.budgets = append(m.budgets, budget)
+	return budget.ID, nil
+}
+
+func (m *MockBudgets) FindBudget(ctx context.Context, id int64) (r.Budget, error) {
+	for _, budget := range m.budgets {
+		if budget.ID == id {
+			return budget, nil
+		}
+	}
+	return r.Budget{}, r.ErrNotFound
+}
+
+func (m *MockBudgets) FindBudgets(ctx context.Context) ([]r.Budget, error) {
+	return m.budgets, nil
+}
+
+func (m *MockBudgets) UpdateBudget(ctx context.Context, budget r.Budget) error {
+	for i := range m.budgets {
+		if m.budgets[i].ID == budget.ID {
+			m.budgets[i] = budget
+		}
+	}
+	return nil
+}
+
+func (m *MockBudgets) DeleteBudget(ctx context.Context, id int64) error {
+	return nil
+}
+
+func (m *MockBudgets) StoreAlert(ctx context.Context, alert r.Alert) (int64, error) {
+	alert.ID = int64(len(m.alerts) + 1)
+	m.alerts = append(m.alerts, alert)
+	return alert.ID, nil
+}
+
+func (m *MockBudgets) FindAlert(ctx context.Context, budgetID int64, periodStart string) (r.Alert, error) {
+	for _, alert := range m.alerts {
+		if alert.BudgetID == budgetID && alert.PeriodStart == periodStart {
+			return alert, nil
+		}
+	}
+	return r.Alert{}, r.ErrNotFound
+}
+
+func (m *MockBudgets) FindAlerts(ctx context.Context) ([]r.Alert, error) {
+	return m.alerts, nil
+}
+
+func TestBudgetStatus(t *testing.T) {
+	ctx := context.Background()
+	// 10 дней апреля по 100 рублей
+	stats := newSeries("2021-04-01", 10, func(t int) r.Data {
+		return r.Data{Cost: 10000}
+	})
+	budgets := &MockBudgets{}
+	budget, err := CreateBudget(ctx, r.Budget{Name: "april", Amount: 300000, Period: "month"}, budgets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Threshold != defaultThreshold {
+		t.Fatalf("got threshold %v; expected %v", budget.Threshold, defaultThreshold)
+	}
+
+	status, err := GetBudgetStatus(ctx, budget.ID, "2021-04-10", stats, budgets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := BudgetStatus{
+		Budget:          budget,
+		Date:            "2021-04-10",
+		From:            "2021-04-01",
+		To:              "2021-04-30",
+		Spent:           1000,
+		SpentFraction:   0.33,
+		ElapsedFraction: 0.33,
+		Pacing:          1,
+		Exceeded:        false,
+	}
+	if status != expect {
+		t.Fatalf("got %+v; expected %+v", status, expect)
+	}
+
+	if _, err := CreateBudget(ctx, r.Budget{Name: "bad", Amount: 0, Period: "month"}, budgets); err != ErrInvalid {
+		t.Fatalf("got %v; expected %v", err, ErrInvalid)
+	}
+}
+
+func TestCheckBudgetsCreatesOneAlertPerPeriod(t *testing.T) {
+	ctx := context.Background()
+	stats := newSeries("2021-04-05", 3, func(t int) r.Data {
+		return r.Data{Cost: 10000}
+	})
+	budgets := &MockBudgets{}
+	// неделя 5-11 апреля: 300 рублей за 3 дня из 7 при бюджете 500
+	CreateBudget(ctx, r.Budget{Name: "week", Amount: 50000, Period: "week"}, budgets)
+	// месяц: 300 рублей за 7 дней из 30 при бюджете 10000
+	CreateBudget(ctx, r.Budget{Name: "month", Amount: 1000000, Period: "month"}, budgets)
+
+	alerts, err := CheckBudgets(ctx, "2021-04-07", stats, budgets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].BudgetID != 1 || alerts[0].PeriodStart != "2021-04-05" {
+		t.Fatalf("got %+v; expected one alert for budget 1 since 2021-04-05", alerts)
+	}
+	if alerts[0].Pacing != 1.4 {
+		t.Fatalf("got pacing %v; expected %v", alerts[0].Pacing, 1.4)
+	}
+
+	alerts, err = CheckBudgets(ctx, "2021-04-07", stats, budgets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 || len(budgets.alerts) != 1 {
+		t.Fatalf("got %d new alerts, %d stored; expected 0 and 1", len(alerts), len(budgets.alerts))
+	}
+}
@@ -0,0 +1,59 @@
+package usecases
+
+import (
+	"time"
+)
+
+// Типы событий, публикуемых сценариями
+const (
+	EventStatCreated  = "stat.created"
+	EventStatUpdated  = "stat.updated"
+	EventStatsDeleted = "stats.deleted"
+	EventAlertFired   = "alert.fired"
+)
+
+// EventTypes все типы событий
+var EventTypes = []string{EventStatCreated, EventStatUpdated, EventStatsDeleted, EventAlertFired}
+
+// StatValues значения метрик в событии. Cost в рублях
+type StatValues struct {
+	Views  int     `json:"views"`
+	Clicks int     `json:"clicks"`
+	Cost   float64 `json:"cost"`
+}
+
+// Event событие изменения данных арендатора Tenant.
+// Для stat.* заполнены Date, Total (значения после изменения) и Delta (изменение),
+// для stats.deleted - Affected, для alert.fired - Alert
+type Event struct {
+	Type     string       `json:"type"`
+	Tenant   string       `json:"tenant"`
+	Time     time.Time    `json:"time"`
+	Date     string       `json:"date,omitempty"`
+	Total    *StatValues  `json:"total,omitempty"`
+	Delta    *StatValues  `json:"delta,omitempty"`
+	Affected int          `json:"affected,omitempty"`
+	Alert    *OutputAlert `json:"alert,omitempty"`
+}
+
+// Notifier получатель событий сценариев
+type Notifier interface {
+	Notify(event Event)
+}
+
+// Notifiers рассылает событие всем получателям по очереди
+type Notifiers []Notifier
+
+// Notify is part of Notifier
+func (n Notifiers) Notify(event Event) {
+	for _, notifier := range n {
+		notifier.Notify(event)
+	}
+}
+
+func notify(notifiers []Notifier, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	Notifiers(notifiers).Notify(event)
+}
@@ -0,0 +1,315 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"math"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	"time"
+)
+
+const (
+	// layout формат дат, в котором хранится и передается статистика
+	layout = "2006-01-02"
+	// z квантиль нормального распределения для 95% интервала предсказания
+	z = 1.96
+	// seasonMinDays минимальная длина истории (две недели),
+	// начиная с которой учитывается недельная сезонность
+	seasonMinDays = 14
+	// MaxForecastHistory наибольшая длина истории прогноза в днях (два года):
+	// запрос не должен читать всю таблицу статистики
+	MaxForecastHistory = 731
+)
+
+// Interval точечный прогноз и границы интервала предсказания
+type Interval struct {
+	Value float64
+	Lower float64
+	Upper float64
+}
+
+// ForecastData прогноз метрик на одну дату
+type ForecastData struct {
+	Date   string
+	Views  Interval
+	Clicks Interval
+	Cost   Interval
+}
+
+// Forecast результат сценария прогнозирования.
+// Total - суммарный прогноз за весь горизонт, Total.Date - последняя дата горизонта
+type Forecast struct {
+	Days  []ForecastData
+	Total ForecastData
+}
+
+// ForecastStat сценарий прогнозирования статистики на horizon дней после to
+// по истории за период [from, to].
+// Для каждой метрики строится модель линейного тренда с недельной сезонностью,
+// дни без статистики считаются нулевыми.
+// Если horizon равен 0, прогноз строится до конца месяца.
+// История длиннее MaxForecastHistory дней отклоняется с ErrInvalid
+func ForecastStat(ctx context.Context, from, to string, horizon int, rep r.StatsRepository) (Forecast, error) {
+	start, err := time.Parse(layout, from)
+	if err != nil {
+		return Forecast{}, err
+	}
+	end, err := time.Parse(layout, to)
+	if err != nil {
+		return Forecast{}, err
+	}
+	if end.Before(start) {
+		return Forecast{}, errors.New("ForecastStat: to is before from")
+	}
+	if int(end.Sub(start).Hours()/24)+1 > MaxForecastHistory {
+		return Forecast{}, ErrInvalid
+	}
+	first := end.AddDate(0, 0, 1)
+	if horizon == 0 {
+		horizon = daysIn(first) - first.Day() + 1
+	}
+
+	data, err := rep.FindByPeriodDate(ctx, from, to)
+	if err != nil {
+		logging.Error(ctx, "Usecase ForecastStat. FindByPeriodDate", "err", err)
+		return Forecast{}, err
+	}
+
+	// история по дням: пропущенные даты остаются нулевыми
+	n := int(end.Sub(start).Hours()/24) + 1
+	views := make([]float64, n)
+	clicks := make([]float64, n)
+	cost := make([]float64, n)
+	for _, value := range data {
+		date, err := parseDate(value.Date)
+		if err != nil {
+			return Forecast{}, err
+		}
+		i := int(date.Sub(start).Hours() / 24)
+		if i < 0 || i >= n {
+			continue
+		}
+		views[i] += float64(value.Views)
+		clicks[i] += float64(value.Clicks)
+		cost[i] += float64(value.Cost) / 100
+	}
+
+	mViews := fit(views)
+	mClicks := fit(clicks)
+	mCost := fit(cost)
+
+	result := Forecast{Days: make([]ForecastData, 0, horizon)}
+	var total [3]Interval
+	var spread [3]float64
+	for h := 0; h < horizon; h++ {
+		t := n + h
+		day := ForecastData{
+			Date:   first.AddDate(0, 0, h).Format(layout),
+			Views:  mViews.predict(t),
+			Clicks: mClicks.predict(t),
+			Cost:   mCost.predict(t),
+		}
+		for i, v := range []Interval{day.Views, day.Clicks, day.Cost} {
+			total[i].Value += v.Value
+			// ошибки прогнозов по дням считаются независимыми
+			half := (v.Upper - v.Lower) / 2
+			spread[i] += half * half
+		}
+		result.Days = append(result.Days, day.rounded())
+	}
+	for i := range total {
+		half := math.Sqrt(spread[i])
+		total[i].Lower = math.Max(total[i].Value-half, 0)
+		total[i].Upper = total[i].Value + half
+	}
+	result.Total = ForecastData{
+		Date:   first.AddDate(0, 0, horizon-1).Format(layout),
+		Views:  total[0],
+		Clicks: total[1],
+		Cost:   total[2],
+	}.rounded()
+	return result, nil
+}
+
+// parseDate разбирает дату записи репозитория. Драйвер с parseTime
+// возвращает DATE в формате RFC3339, поэтому учитывается только префикс YYYY-MM-DD
+func parseDate(date string) (time.Time, error) {
+	if len(date) > len(layout) {
+		date = date[:len(layout)]
+	}
+	return time.Parse(layout, date)
+}
+
+// daysIn возвращает количество дней в месяце даты t
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func (d ForecastData) rounded() ForecastData {
+	for _, v := range []*Interval{&d.Views, &d.Clicks, &d.Cost} {
+		v.Value, v.Lower, v.Upper = round(v.Value), round(v.Lower), round(v.Upper)
+	}
+	return d
+}
+
+// model линейная регрессия y = a + b*t + s[weekday(t)].
+// coef содержит a, b и (при наличии сезонности) шесть коэффициентов
+// дней недели относительно дня недели первой даты истории
+type model struct {
+	coef   []float64
+	cov    [][]float64 // (X'X)^-1
+	sigma  float64
+	season bool
+}
+
+// features строит вектор признаков для дня t от начала истории
+func (m model) features(t int) []float64 {
+	x := []float64{1, float64(t)}
+	if m.season {
+		wd := t % 7
+		for d := 1; d < 7; d++ {
+			if wd == d {
+				x = append(x, 1)
+			} else {
+				x = append(x, 0)
+			}
+		}
+	}
+	return x
+}
+
+// fit подбирает коэффициенты модели методом наименьших квадратов.
+// Если история короче двух недель или система вырождена,
+// сезонность не учитывается
+func fit(ys []float64) model {
+	m := model{season: len(ys) >= seasonMinDays}
+	for {
+		if m.solve(ys) {
+			return m
+		}
+		if !m.season {
+			break
+		}
+		m.season = false
+	}
+	// вырожденный случай (один день истории): константа
+	var mean float64
+	for _, y := range ys {
+		mean += y
+	}
+	mean /= float64(len(ys))
+	return model{coef: []float64{mean, 0}}
+}
+
+func (m *model) solve(ys []float64) bool {
+	p := len(m.features(0))
+	xtx := make([][]float64, p)
+	for i := range xtx {
+		xtx[i] = make([]float64, p)
+	}
+	xty := make([]float64, p)
+	for t, y := range ys {
+		x := m.features(t)
+		for i := 0; i < p; i++ {
+			xty[i] += x[i] * y
+			for j := 0; j < p; j++ {
+				xtx[i][j] += x[i] * x[j]
+			}
+		}
+	}
+	inv, ok := invert(xtx)
+	if !ok {
+		return false
+	}
+	m.cov = inv
+	m.coef = make([]float64, p)
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			m.coef[i] += inv[i][j] * xty[j]
+		}
+	}
+	var sse float64
+	for t, y := range ys {
+		e := y - dot(m.coef, m.features(t))
+		sse += e * e
+	}
+	if dof := len(ys) - p; dof > 0 {
+		m.sigma = math.Sqrt(sse / float64(dof))
+	}
+	return true
+}
+
+// predict возвращает прогноз на день t от начала истории
+// с 95% интервалом предсказания. Отрицательные значения обрезаются до нуля
+func (m model) predict(t int) Interval {
+	x := m.features(t)
+	value := dot(m.coef, x)
+	var half float64
+	if m.cov != nil {
+		var leverage float64
+		for i := range x {
+			leverage += x[i] * dot(m.cov[i], x)
+		}
+		half = z * m.sigma * math.Sqrt(1+leverage)
+	}
+	return Interval{
+		Value: math.Max(value, 0),
+		Lower: math.Max(value-half, 0),
+		Upper: math.Max(value+half, 0),
+	}
+}
+
+func dot(a, b []float64) float64 {
+	var s float64
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+// invert обращает квадратную матрицу методом Гаусса-Жордана.
+// Возвращает false для вырожденной матрицы
+func invert(a [][]float64) ([][]float64, bool) {
+	n := len(a)
+	m := make([][]float64, n)
+	for i := range a {
+		m[i] = make([]float64, 2*n)
+		copy(m[i], a[i])
+		m[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-9 {
+			return nil, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		div := m[col][col]
+		for j := range m[col] {
+			m[col][j] /= div
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			k := m[row][col]
+			for j := range m[row] {
+				m[row][j] -= k * m[col][j]
+			}
+		}
+	}
+	inv := make([][]float64, n)
+	for i := range m {
+		inv[i] = m[i][n:]
+	}
+	return inv, true
+}
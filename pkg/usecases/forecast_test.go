@@ -0,0 +1,145 @@
+package usecases
+
+import (
+	"context"
+	"math"
+	r "statistics/pkg/repository"
+	"testing"
+	"time"
+)
+
+// заглушка БД с заранее сгенерированным рядом для тестирования прогноза
+type SeriesDB struct {
+	MockDB
+	series []r.Data
+}
+
+func (m *SeriesDB) FindByPeriodDate(ctx context.Context, from, to string) ([]r.Data, error) {
+	return m.series, nil
+}
+
+// newSeries генерирует ряд за n дней начиная с from,
+// значения метрик задаются функцией gen от номера дня
+func newSeries(from string, n int, gen func(t int) r.Data) *SeriesDB {
+	start, _ := time.Parse(layout, from)
+	m := &SeriesDB{}
+	for t := 0; t < n; t++ {
+		data := gen(t)
+		data.Date = start.AddDate(0, 0, t).Format(layout)
+		m.series = append(m.series, data)
+	}
+	return m
+}
+
+func TestForecastLinearTrendWithSeason(t *testing.T) {
+	ctx := context.Background()
+	season := []int{0, 5, 10, 5, 0, -20, -30}
+	m := newSeries("2021-01-04", 28, func(t int) r.Data {
+		return r.Data{
+			Views:  1000 + 10*t + season[t%7],
+			Clicks: 100 + t,
+			Cost:   5000 + 100*t,
+		}
+	})
+
+	result, err := ForecastStat(ctx, "2021-01-04", "2021-01-31", 7, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Days) != 7 {
+		t.Fatalf("got %d days; expected %d", len(result.Days), 7)
+	}
+	if result.Days[0].Date != "2021-02-01" {
+		t.Fatalf("got first date %s; expected %s", result.Days[0].Date, "2021-02-01")
+	}
+	var total float64
+	for h, day := range result.Days {
+		step := 28 + h
+		views := float64(1000 + 10*step + season[step%7])
+		if day.Views.Value != views {
+			t.Fatalf("%s views: got %v; expected %v", day.Date, day.Views.Value, views)
+		}
+		// ряд без шума: интервал вырождается в точку
+		if day.Views.Lower != views || day.Views.Upper != views {
+			t.Fatalf("%s views interval: got [%v, %v]; expected %v",
+				day.Date, day.Views.Lower, day.Views.Upper, views)
+		}
+		cost := float64(5000+100*step) / 100
+		if day.Cost.Value != cost {
+			t.Fatalf("%s cost: got %v; expected %v", day.Date, day.Cost.Value, cost)
+		}
+		total += cost
+	}
+	if result.Total.Cost.Value != total {
+		t.Fatalf("total cost: got %v; expected %v", result.Total.Cost.Value, total)
+	}
+	if result.Total.Date != "2021-02-07" {
+		t.Fatalf("total date: got %s; expected %s", result.Total.Date, "2021-02-07")
+	}
+}
+
+func TestForecastIntervalWithNoise(t *testing.T) {
+	ctx := context.Background()
+	noise := []int{3, -3, 2, -2, 1, -1, 0, -1, 1, -2}
+	m := newSeries("2021-03-01", 10, func(t int) r.Data {
+		return r.Data{Clicks: 50 + 2*t + noise[t]}
+	})
+
+	result, err := ForecastStat(ctx, "2021-03-01", "2021-03-10", 3, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := 0.0
+	for _, day := range result.Days {
+		c := day.Clicks
+		if !(c.Lower < c.Value && c.Value < c.Upper) {
+			t.Fatalf("%s clicks: value %v outside of (%v, %v)", day.Date, c.Value, c.Lower, c.Upper)
+		}
+		// интервал расширяется по мере удаления от истории
+		if width := c.Upper - c.Lower; width <= prev {
+			t.Fatalf("%s clicks: interval width %v isn't greater than %v", day.Date, width, prev)
+		} else {
+			prev = width
+		}
+		// тренд без сезонности: 50 + 2t с точностью до шума
+		step := float64(10 + len(result.Days))
+		if math.Abs(c.Value-(50+2*step)) > 10 {
+			t.Fatalf("%s clicks: got %v; expected about %v", day.Date, c.Value, 50+2*step)
+		}
+	}
+	if result.Days[0].Views != (Interval{}) {
+		t.Fatalf("views: got %v; expected zero forecast", result.Days[0].Views)
+	}
+}
+
+func TestForecastDefaultHorizonToEndOfMonth(t *testing.T) {
+	ctx := context.Background()
+	m := newSeries("2021-02-01", 10, func(t int) r.Data {
+		return r.Data{Cost: 1000}
+	})
+
+	result, err := ForecastStat(ctx, "2021-02-01", "2021-02-10", 0, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Days) != 18 {
+		t.Fatalf("got %d days; expected %d", len(result.Days), 18)
+	}
+	if result.Total.Date != "2021-02-28" || result.Total.Cost.Value != 180 {
+		t.Fatalf("got total %v; expected 180 on %s", result.Total, "2021-02-28")
+	}
+}
+
+func TestForecastHistoryLimit(t *testing.T) {
+	ctx := context.Background()
+	m := newSeries("2021-01-01", 10, func(t int) r.Data {
+		return r.Data{Views: 100}
+	})
+
+	if _, err := ForecastStat(ctx, "2019-01-01", "2021-01-10", 7, m); err != ErrInvalid {
+		t.Fatalf("got %v; expected ErrInvalid for history over %d days", err, MaxForecastHistory)
+	}
+	if _, err := ForecastStat(ctx, "2019-01-11", "2021-01-10", 7, m); err != nil {
+		t.Fatalf("history of %d days: %v", MaxForecastHistory, err)
+	}
+}
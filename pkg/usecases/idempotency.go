@@ -0,0 +1,102 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	r "statistics/pkg/repository"
+)
+
+var (
+	// ErrKeyReused ключ идемпотентности уже использован с другим запросом
+	ErrKeyReused = errors.New("usecases: idempotency key reused with different request")
+	// ErrKeyInProgress запрос с тем же ключом еще обрабатывается
+	ErrKeyInProgress = errors.New("usecases: request with idempotency key is in progress")
+)
+
+// BeginIdempotent сценарий начала запроса с ключом идемпотентности key
+// и отпечатком запроса fingerprint. Для нового ключа ключ резервируется
+// на время lease и возвращается nil: запрос нужно выполнить и сохранить
+// результат резервирования reservation в FinishIdempotent. Для повтора того же
+// запроса возвращается сохраненный результат. Ключи старше ttl считаются
+// истекшими и резервируются заново, как и ключи запросов, не завершенных
+// за время аренды
+func BeginIdempotent(ctx context.Context, key, fingerprint string, now time.Time, ttl, lease time.Duration, rep r.IdempotencyRepository) (reservation r.IdempotencyKey, saved *r.IdempotencyKey, err error) {
+	reservation = r.IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+		Created:     now,
+		LockedUntil: now.Add(lease),
+	}
+	saved, err = beginIdempotent(ctx, reservation, now, ttl, rep)
+	return reservation, saved, err
+}
+
+// beginIdempotent резервирует ключ reservation, см. BeginIdempotent
+func beginIdempotent(ctx context.Context, reservation r.IdempotencyKey, now time.Time, ttl time.Duration, rep r.IdempotencyRepository) (*r.IdempotencyKey, error) {
+	fingerprint := reservation.Fingerprint
+	// вторая попытка - после замены ключа параллельным запросом
+	for attempt := 0; attempt < 2; attempt++ {
+		existing, reserved, err := rep.ReserveKey(ctx, reservation)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return nil, nil
+		}
+		inProgress := existing.Status == 0 && existing.LockedUntil.After(now)
+		if existing.Created.After(now.Add(-ttl)) {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				return nil, ErrKeyReused
+			case inProgress:
+				return nil, ErrKeyInProgress
+			case existing.Status != 0:
+				return &existing, nil
+			}
+			// аренда истекла: запрос прерван, не сохранив результат
+		} else if inProgress {
+			// истекший ключ еще обрабатывается
+			return nil, ErrKeyInProgress
+		}
+		replaced, err := rep.ReplaceKey(ctx, reservation, now.Add(-ttl), now)
+		if err != nil {
+			return nil, err
+		}
+		if replaced {
+			return nil, nil
+		}
+	}
+	return nil, ErrKeyInProgress
+}
+
+// retryable проверяет, что ответ с кодом status не окончательный:
+// повтор запроса может завершиться иначе
+func retryable(status int) bool {
+	return status >= http.StatusInternalServerError ||
+		status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout ||
+		status == 499
+}
+
+// FinishIdempotent сценарий сохранения результата запроса с ключом:
+// key - резервирование из BeginIdempotent с кодом, типом и телом ответа.
+// Для неокончательного результата (ошибка сервера, перегрузка, отмена)
+// ключ освобождается, чтобы запрос можно было повторить. Если аренда
+// истекла и ключ зарезервировал другой запрос, его резервирование
+// не изменяется и возвращается r.ErrLeaseLost
+func FinishIdempotent(ctx context.Context, key r.IdempotencyKey, rep r.IdempotencyRepository) error {
+	if retryable(key.Status) {
+		return rep.DeleteKey(ctx, key)
+	}
+	return rep.CompleteKey(ctx, key)
+}
+
+// ExpireIdempotencyKeys сценарий удаления ключей старше ttl. Ключи
+// запросов, которые еще обрабатываются, не удаляются до истечения аренды.
+// Возвращает количество удаленных ключей
+func ExpireIdempotencyKeys(ctx context.Context, now time.Time, ttl time.Duration, rep r.IdempotencyRepository) (int, error) {
+	return rep.DeleteExpiredKeys(ctx, now.Add(-ttl), now)
+}
@@ -0,0 +1,95 @@
+package usecases
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	r "statistics/pkg/repository"
+)
+
+func TestIdempotentKeyLifecycle(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	reservation, saved, err := BeginIdempotent(ctx, "k", "f", now, time.Hour, time.Minute, rep)
+	if saved != nil || err != nil {
+		t.Fatalf("new key: got %+v, %v; expected reservation", saved, err)
+	}
+	if _, _, err := BeginIdempotent(ctx, "k", "f", now, time.Hour, time.Minute, rep); err != ErrKeyInProgress {
+		t.Fatalf("key in progress: got %v; expected %v", err, ErrKeyInProgress)
+	}
+	reservation.Status, reservation.Body = 200, "ok"
+	if err := FinishIdempotent(ctx, reservation, rep); err != nil {
+		t.Fatal(err)
+	}
+	if _, saved, err := BeginIdempotent(ctx, "k", "f", now, time.Hour, time.Minute, rep); err != nil || saved == nil || saved.Body != "ok" {
+		t.Fatalf("replay: got %+v, %v; expected saved result", saved, err)
+	}
+	if _, _, err := BeginIdempotent(ctx, "k", "other", now, time.Hour, time.Minute, rep); err != ErrKeyReused {
+		t.Fatalf("reuse: got %v; expected %v", err, ErrKeyReused)
+	}
+
+	// истекший ключ резервируется заново
+	if _, saved, err := BeginIdempotent(ctx, "k", "other", now.Add(time.Hour), time.Hour, time.Minute, rep); saved != nil || err != nil {
+		t.Fatalf("expired key: got %+v, %v; expected reservation", saved, err)
+	}
+	if count, _ := ExpireIdempotencyKeys(ctx, now.Add(3*time.Hour), time.Hour, rep); count != 1 {
+		t.Fatalf("ExpireIdempotencyKeys: got %d; expected 1", count)
+	}
+}
+
+// Ключ запроса, прерванного без сохранения результата, резервируется
+// заново после истечения аренды, но не раньше
+func TestIdempotentKeyLease(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	first, _, _ := BeginIdempotent(ctx, "k", "f", now, time.Hour, time.Minute, rep)
+	if _, _, err := BeginIdempotent(ctx, "k", "f", now.Add(59*time.Second), time.Hour, time.Minute, rep); err != ErrKeyInProgress {
+		t.Fatalf("active lease: got %v; expected %v", err, ErrKeyInProgress)
+	}
+	if _, _, err := BeginIdempotent(ctx, "k", "other", now.Add(time.Minute), time.Hour, time.Minute, rep); err != ErrKeyReused {
+		t.Fatalf("expired lease with other request: got %v; expected %v", err, ErrKeyReused)
+	}
+	second, saved, err := BeginIdempotent(ctx, "k", "f", now.Add(time.Minute), time.Hour, time.Minute, rep)
+	if saved != nil || err != nil {
+		t.Fatalf("expired lease: got %+v, %v; expected reservation", saved, err)
+	}
+	if _, _, err := BeginIdempotent(ctx, "k", "f", now.Add(90*time.Second), time.Hour, time.Minute, rep); err != ErrKeyInProgress {
+		t.Fatalf("new lease: got %v; expected %v", err, ErrKeyInProgress)
+	}
+
+	// запрос, потерявший аренду, не затирает и не освобождает
+	// резервирование запроса, получившего ключ после него
+	first.Status, first.Body = 200, "first"
+	if err := FinishIdempotent(ctx, first, rep); err != r.ErrLeaseLost {
+		t.Fatalf("finish after lost lease: got %v; expected %v", err, r.ErrLeaseLost)
+	}
+	first.Status = 500
+	if err := FinishIdempotent(ctx, first, rep); err != r.ErrLeaseLost {
+		t.Fatalf("release after lost lease: got %v; expected %v", err, r.ErrLeaseLost)
+	}
+	second.Status, second.Body = 200, "second"
+	if err := FinishIdempotent(ctx, second, rep); err != nil {
+		t.Fatal(err)
+	}
+	if _, saved, _ := BeginIdempotent(ctx, "k", "f", now.Add(2*time.Minute), time.Hour, time.Minute, rep); saved == nil || saved.Body != "second" {
+		t.Fatalf("replay: got %+v; expected result of the second request", saved)
+	}
+
+	// истекший ключ с действующей арендой не удаляется и не заменяется
+	later := now.Add(2 * time.Hour)
+	BeginIdempotent(ctx, "slow", "f", later, time.Hour, 2*time.Hour, rep)
+	if _, _, err := BeginIdempotent(ctx, "slow", "other", later.Add(time.Hour), time.Hour, time.Minute, rep); err != ErrKeyInProgress {
+		t.Fatalf("expired key in progress: got %v; expected %v", err, ErrKeyInProgress)
+	}
+	if count, _ := ExpireIdempotencyKeys(ctx, later.Add(90*time.Minute), time.Hour, rep); count != 1 {
+		t.Fatalf("ExpireIdempotencyKeys: got %d; expected only the key with expired lease", count)
+	}
+	if count, _ := ExpireIdempotencyKeys(ctx, later.Add(2*time.Hour), time.Hour, rep); count != 1 {
+		t.Fatalf("ExpireIdempotencyKeys after lease: got %d; expected 1", count)
+	}
+}
@@ -0,0 +1,58 @@
+package usecases
+
+import (
+	"context"
+	"regexp"
+
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+)
+
+// tenantName допустимое имя арендатора: строчные латинские буквы,
+// цифры, "-" и "_", не длиннее 64 символов
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// OutputTenant квота арендатора и количество записанных дат.
+// MaxRows 0 - без ограничения, Default - квота не задана и берется по умолчанию
+type OutputTenant struct {
+	Name    string
+	MaxRows int
+	Rows    int
+	Default bool
+}
+
+// ValidTenant проверяет имя арендатора
+func ValidTenant(name string) bool {
+	return tenantName.MatchString(name)
+}
+
+// SetTenantQuota сценарий задания квоты арендатора name:
+// не больше maxRows дат статистики, 0 - без ограничения
+func SetTenantQuota(ctx context.Context, name string, maxRows int, rep r.TenantRepository) error {
+	if !ValidTenant(name) || maxRows < 0 {
+		return ErrInvalid
+	}
+	return rep.StoreTenant(ctx, r.Tenant{Name: name, MaxRows: maxRows})
+}
+
+// GetTenants сценарий получения арендаторов с квотами и количеством дат.
+// Для арендаторов без своей квоты возвращается defaultMaxRows
+func GetTenants(ctx context.Context, defaultMaxRows int, rep r.TenantRepository) ([]OutputTenant, error) {
+	tenants, err := rep.FindTenants(ctx)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetTenants. FindTenants", "err", err)
+		return nil, err
+	}
+	result := []OutputTenant{}
+	for _, tenant := range tenants {
+		output := OutputTenant{Name: tenant.Name, MaxRows: tenant.MaxRows, Rows: tenant.Rows}
+		if _, err := rep.FindTenant(ctx, tenant.Name); err == r.ErrNotFound {
+			output.MaxRows = defaultMaxRows
+			output.Default = true
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, output)
+	}
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package usecases
+
+import (
+	"context"
+
+	"statistics/pkg/jwt"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+)
+
+// TokenValidator проверка подписи и сроков токена
+type TokenValidator interface {
+	Validate(ctx context.Context, token string) (jwt.Claims, error)
+}
+
+// TokenMapping сопоставление утверждений токена правам и арендатору
+type TokenMapping struct {
+	// ScopeClaim утверждение с правами или группами, по умолчанию scope
+	ScopeClaim string
+	// TenantClaim утверждение с арендатором, по умолчанию tenant.
+	// Токен без арендатора дает доступ к DefaultTenant
+	TenantClaim string
+	// Scopes сопоставляет значению ScopeClaim (например, группе SSO)
+	// права сервиса. Значения, совпадающие с правами, действуют без записи
+	Scopes map[string][]string
+}
+
+// scopes возвращает права, которые дают значения утверждения
+func (m TokenMapping) scopes(values []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	add := func(scope string) {
+		for _, s := range Scopes {
+			if s == scope && !seen[scope] {
+				seen[scope] = true
+				result = append(result, scope)
+			}
+		}
+	}
+	for _, value := range values {
+		add(value)
+		for _, scope := range m.Scopes[value] {
+			add(scope)
+		}
+	}
+	return result
+}
+
+// AuthenticateToken сценарий проверки токена SSO. Возвращает ключ
+// без идентификатора с именем jwt:<sub>, правами и арендатором токена.
+// Возвращает ErrUnauthorized, если токен не прошел проверку
+// или содержит недопустимого арендатора
+func AuthenticateToken(ctx context.Context, token string, v TokenValidator, m TokenMapping) (r.APIKey, error) {
+	if m.ScopeClaim == "" {
+		m.ScopeClaim = "scope"
+	}
+	if m.TenantClaim == "" {
+		m.TenantClaim = "tenant"
+	}
+	claims, err := v.Validate(ctx, token)
+	if err == jwt.ErrKeysUnavailable {
+		return r.APIKey{}, err
+	}
+	if err != nil {
+		logging.Info(ctx, "Usecase AuthenticateToken. Validate", "err", err)
+		return r.APIKey{}, ErrUnauthorized
+	}
+	tenant := claims.String(m.TenantClaim)
+	if tenant == "" {
+		tenant = r.DefaultTenant
+	}
+	if !ValidTenant(tenant) {
+		logging.Info(ctx, "Usecase AuthenticateToken. Bad tenant claim", "tenant", tenant)
+		return r.APIKey{}, ErrUnauthorized
+	}
+	return r.APIKey{
+		Name:   "jwt:" + claims.String("sub"),
+		Tenant: tenant,
+		Scopes: m.scopes(claims.Strings(m.ScopeClaim)),
+	}, nil
+}
@@ -1,11 +1,13 @@
 package usecases
 
 import (
-	"log"
+	"context"
 	"math"
 	"reflect"
 	"sort"
+	"statistics/pkg/logging"
 	r "statistics/pkg/repository"
+	"statistics/pkg/tracing"
 	"strings"
 )
 
@@ -24,40 +26,159 @@ type OutputData struct {
 // обновления уже существующей дате
 // Параметры clicks, views прибавляются к уже существующим,
 // а cost заменяется на новый
-func AddStat(data r.Data, rep r.StatsRepository) error {
-	st, err := rep.FindByDate(data.Date)
+// Получатели notifiers оповещаются событием stat.created или stat.updated.
+// Если репозиторий реализует r.Batcher, запись читается и изменяется
+// в одной транзакции: параллельные добавления за ту же дату не теряются
+func AddStat(ctx context.Context, data r.Data, rep r.StatsRepository, notifiers ...Notifier) error {
+	batcher, ok := rep.(r.Batcher)
+	if !ok {
+		return addStat(ctx, data, rep, notifiers...)
+	}
+	var events eventLog
+	err := batcher.Batch(ctx, func(rep r.StatsRepository) error {
+		events = eventLog{}
+		return addStat(ctx, data, rep, &events)
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		Notifiers(notifiers).Notify(event)
+	}
+	return nil
+}
+
+// addStat добавляет статистику за дату, как AddStat, в репозитории rep
+// без открытия транзакции
+func addStat(ctx context.Context, data r.Data, rep r.StatsRepository, notifiers ...Notifier) error {
+	event := Event{Tenant: r.TenantFromContext(ctx), Date: data.Date}
+	st, err := rep.FindByDate(ctx, data.Date)
 	if err != nil {
+		// запрос прерван: отсутствие даты в базе не установлено
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		// there is not date in db
-		if err := rep.Storage(data); err != nil {
-			log.Println("Usecase AddStat. Storage: ", err, data)
+		if err := rep.Storage(ctx, data); err != nil {
+			logging.Error(ctx, "Usecase AddStat. Storage", "err", err, "data", data)
 			return err
 		}
+		event.Type = EventStatCreated
+		event.Total = toValues(data)
+		event.Delta = toValues(data)
 	} else {
+		delta := data
+		delta.Cost -= st.Cost
 		st.Cost = data.Cost
 		st.Clicks += data.Clicks
 		st.Views += data.Views
-		if err := rep.Update(st); err != nil {
-			log.Println("Usecase AddStat. Update: ", err, data)
+		if err := rep.Update(ctx, st); err != nil {
+			logging.Error(ctx, "Usecase AddStat. Update", "err", err, "data", data)
 			return err
 		}
+		event.Type = EventStatUpdated
+		event.Total = toValues(st)
+		event.Delta = toValues(delta)
 	}
+	notify(notifiers, event)
 	return nil
 }
 
+// eventLog накапливает события сценария до фиксации транзакции
+type eventLog []Event
+
+// Notify is part of Notifier
+func (l *eventLog) Notify(event Event) {
+	*l = append(*l, event)
+}
+
+// AddStats сценарий добавления пакета статистики. Каждая запись
+// применяется как в AddStat. Если репозиторий реализует r.Batcher,
+// пакет записывается в одной транзакции; транзакционный репозиторий
+// (r.IsTransactional) при ошибке не записывает пакет целиком. Получатели notifiers оповещаются о записанных изменениях
+// после завершения записи
+func AddStats(ctx context.Context, batch []r.Data, rep r.StatsRepository, notifiers ...Notifier) error {
+	_, err := addStats(ctx, batch, rep, false, notifiers)
+	return err
+}
+
+// AddStatsWithinQuota сценарий добавления пакета статистики, как AddStats,
+// в котором новые даты сверх квоты арендатора (r.ErrQuotaExceeded)
+// пропускаются, а остальные записи пакета записываются.
+// Возвращает пропущенные записи
+func AddStatsWithinQuota(ctx context.Context, batch []r.Data, rep r.StatsRepository, notifiers ...Notifier) ([]r.Data, error) {
+	return addStats(ctx, batch, rep, true, notifiers)
+}
+
+// addStats записывает пакет; skipQuota - пропускать даты сверх квоты
+func addStats(ctx context.Context, batch []r.Data, rep r.StatsRepository, skipQuota bool, notifiers []Notifier) ([]r.Data, error) {
+	var events eventLog
+	var skipped []r.Data
+	apply := func(rep r.StatsRepository) error {
+		// транзакция, прерванная временной ошибкой, выполняется заново:
+		// события и пропуски прежней попытки откатаны вместе с ней
+		events, skipped = eventLog{}, nil
+		for _, data := range batch {
+			err := addStat(ctx, data, rep, &events)
+			if err == r.ErrQuotaExceeded && skipQuota {
+				// квота проверяется до записи, транзакция продолжается
+				skipped = append(skipped, data)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	batcher, ok := rep.(r.Batcher)
+	var err error
+	if ok {
+		err = batcher.Batch(ctx, apply)
+	} else {
+		err = apply(rep)
+	}
+	if err != nil {
+		logging.Error(ctx, "Usecase AddStats", "err", err)
+		if ok && r.IsTransactional(rep) {
+			// транзакция откатана, изменений не было
+			return nil, err
+		}
+	}
+	for _, event := range events {
+		Notifiers(notifiers).Notify(event)
+	}
+	return skipped, err
+}
+
+func toValues(data r.Data) *StatValues {
+	return &StatValues{
+		Views:  data.Views,
+		Clicks: data.Clicks,
+		Cost:   float64(data.Cost) / 100,
+	}
+}
+
 // GetStatWithinFromAndTo сценарий, в котором возвращется статистика за даты между
 // двумя заданными (from, to) и отсортированными по полю by
 // Параметр by по умолчанию равен "date"
+// Параметр granularity (day, week, month) задает период суммирования,
+// по умолчанию статистика возвращается по дням
 // Считаются поля cpc, cpm до 2х знаков после запятой
-func GetStatWithinFromAndTo(from, to, by string, rep r.StatsRepository) ([]OutputData, error) {
+func GetStatWithinFromAndTo(ctx context.Context, from, to, by, granularity string, rep r.StatsRepository) ([]OutputData, error) {
 	// сортировка по умолчанию
 	if by == "" {
 		by = "date"
 	}
 	by = strings.Title(by)
+	ctx, span := tracing.Start(ctx, "usecases.GetStatWithinFromAndTo",
+		"from", from, "to", to, "by", by, "granularity", granularity)
+	defer span.Finish()
 	var data []r.Data
-	data, err := rep.FindByPeriodDate(from, to)
+	data, err := rep.FindByPeriodGranularity(ctx, from, to, granularity)
 	if err != nil {
-		log.Println("Usecase GetStatWithinFromAndTo. FindByPeriodDate: ", err)
+		logging.Error(ctx, "Usecase GetStatWithinFromAndTo. FindByPeriodGranularity", "err", err)
+		span.RecordError(err)
 		return nil, err
 	}
 	var result []OutputData
@@ -92,13 +213,21 @@ func GetStatWithinFromAndTo(from, to, by string, rep r.StatsRepository) ([]Outpu
 			Cpm:    cpm(newcost, value.Views),
 		})
 	}
+	_, sorting := tracing.Start(ctx, "usecases.By", "field", by, "rows", len(result))
 	By(Prop(by, false)).Sort(result)
+	sorting.Finish()
 	return result, nil
 }
 
-// ClearRepository сценарий очистки таблицы
-func ClearRepository(rep r.StatsRepository) (int, error) {
-	return rep.DeleteFromRepository()
+// ClearRepository сценарий удаления статистики арендатора контекста
+// Получатели notifiers оповещаются событием stats.deleted
+func ClearRepository(ctx context.Context, rep r.StatsRepository, notifiers ...Notifier) (int, error) {
+	affected, err := rep.DeleteFromRepository(ctx)
+	if err != nil {
+		return affected, err
+	}
+	notify(notifiers, Event{Type: EventStatsDeleted, Tenant: r.TenantFromContext(ctx), Affected: affected})
+	return affected, nil
 }
 
 // Далее реализованы вспомогательные функции для сортировки по
@@ -1,10 +1,13 @@
 package usecases
 
 import (
+	"context"
 	"errors"
 	"math"
 	r "statistics/pkg/repository"
+	"sync"
 	"testing"
+	"time"
 )
 
 type MockStatsDB struct {
@@ -14,48 +17,53 @@ type MockStatsDB struct {
 // заглушка БД для тестирования Usecase
 type MockDB map[string]r.Data
 
-func (m *MockDB) FindByDate(date string) (r.Data, error) {
-	result := r.Data{"2020-01-01", 10, 11, 12}
+func (m *MockDB) FindByDate(ctx context.Context, date string) (r.Data, error) {
+	result := r.Data{Date: "2020-01-01", Views: 10, Clicks: 11, Cost: 12}
 	if date == result.Date {
 		return result, nil
 	}
 	return r.Data{}, errors.New("Date not found")
 }
 
-func (m *MockDB) Storage(data r.Data) error {
+func (m *MockDB) Storage(ctx context.Context, data r.Data) error {
 	(*m)[data.Date] = data
 	return nil
 }
 
-func (m *MockDB) Update(data r.Data) error {
+func (m *MockDB) Update(ctx context.Context, data r.Data) error {
 	(*m)[data.Date] = data
 	return nil
 }
 
-func (m *MockDB) FindByPeriodDate(from, to string) ([]r.Data, error) {
+func (m *MockDB) FindByPeriodDate(ctx context.Context, from, to string) ([]r.Data, error) {
 	return []r.Data{
-			{"2021-11-25", 112, 123, 166},
-			{"2021-08-23", 51, 11, 440},
-			{"2021-06-17", 18, 12, 120},
-			{"2021-05-12", 12, 15, 16}},
+			{Date: "2021-11-25", Views: 112, Clicks: 123, Cost: 166},
+			{Date: "2021-08-23", Views: 51, Clicks: 11, Cost: 440},
+			{Date: "2021-06-17", Views: 18, Clicks: 12, Cost: 120},
+			{Date: "2021-05-12", Views: 12, Clicks: 15, Cost: 16}},
 		nil
 }
 
-func (m *MockDB) DeleteFromRepository() (int, error) {
+func (m *MockDB) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]r.Data, error) {
+	return m.FindByPeriodDate(ctx, from, to)
+}
+
+func (m *MockDB) DeleteFromRepository(ctx context.Context) (int, error) {
 	(*m) = make(map[string]r.Data)
 	return 0, nil
 }
 
 func TestAddUsecase(t *testing.T) {
+	ctx := context.Background()
 	// Инициализируем заглушку.
 	// "2020-05-05": Data{"2020-05-05", 110, 111, 115}
 	// m := &MockStatsDB{db: map[string]Data{"2020-01-01": Data{"2020-01-01", 10, 11, 12}}}
-	m := &MockDB{"2020-01-01": r.Data{"2020-01-01", 10, 11, 12}}
+	m := &MockDB{"2020-01-01": r.Data{Date: "2020-01-01", Views: 10, Clicks: 11, Cost: 12}}
 	// Передает закглушку в usecase Add()
-	AddStat(r.Data{"2020-01-01", 50, 120, 150}, m)
+	AddStat(ctx, r.Data{Date: "2020-01-01", Views: 50, Clicks: 120, Cost: 150}, m)
 
 	// Проверяем значение по этой дате в бд
-	var exp = r.Data{"2020-01-01", 60, 131, 150}
+	var exp = r.Data{Date: "2020-01-01", Views: 60, Clicks: 131, Cost: 150}
 
 	// Проверяем, соответствует ли возвращаемое значение ожиданиям на основе
 	// фальшивых входных данных.
@@ -64,34 +72,244 @@ func TestAddUsecase(t *testing.T) {
 	}
 
 	// Передаю новое значение
-	AddStat(r.Data{"2020-05-05", 100, 101, 102}, m)
-	var exp1 = r.Data{"2020-05-05", 100, 101, 102}
+	AddStat(ctx, r.Data{Date: "2020-05-05", Views: 100, Clicks: 101, Cost: 102}, m)
+	var exp1 = r.Data{Date: "2020-05-05", Views: 100, Clicks: 101, Cost: 102}
 	if (*m)["2020-05-05"] != exp1 {
 		t.Fatalf("got %v; expected %v", (*m)["2020-05-05"], exp1)
 	}
 }
 
+func TestAddUsecaseCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := &MockDB{}
+	// заглушка не находит дату, но запрос прерван: запись не создается
+	if err := AddStat(ctx, r.Data{Date: "2020-05-05", Views: 100}, m); err != context.Canceled {
+		t.Fatalf("got %v; expected %v", err, context.Canceled)
+	}
+	if len(*m) != 0 {
+		t.Fatalf("got %v; expected no stored data", *m)
+	}
+}
+
+// BatchDB заглушка транзакционной БД: пакет записывается в копию
+// и переносится в MockDB, только если fn завершилась без ошибки.
+// Запись за дату failDate завершается ошибкой. Первые retries
+// попыток откатываются, как транзакции, прерванные взаимоблокировкой
+type BatchDB struct {
+	MockDB
+	failDate string
+	retries  int
+}
+
+func (m *BatchDB) Batch(ctx context.Context, fn func(rep r.StatsRepository) error) error {
+	for {
+		tx := MockDB{}
+		for date, data := range m.MockDB {
+			tx[date] = data
+		}
+		if err := fn(failingStorage{&tx, m.failDate}); err != nil {
+			return err
+		}
+		if m.retries > 0 {
+			m.retries--
+			continue
+		}
+		m.MockDB = tx
+		return nil
+	}
+}
+
+func (m *BatchDB) Transactional() bool { return true }
+
+// failingStorage отклоняет запись за дату date
+type failingStorage struct {
+	*MockDB
+	date string
+}
+
+func (f failingStorage) Storage(ctx context.Context, data r.Data) error {
+	if data.Date == f.date {
+		return errors.New("storage failed")
+	}
+	return f.MockDB.Storage(ctx, data)
+}
+
+func TestAddStatsUsecase(t *testing.T) {
+	ctx := context.Background()
+	m := &BatchDB{MockDB: MockDB{}}
+	sent := eventLog{}
+	batch := []r.Data{
+		{Date: "2020-01-01", Views: 50, Clicks: 120, Cost: 150},
+		{Date: "2020-05-05", Views: 100},
+	}
+	if err := AddStats(ctx, batch, m, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if m.MockDB["2020-01-01"].Views != 60 || m.MockDB["2020-05-05"].Views != 100 || len(sent) != 2 {
+		t.Fatalf("got %v and %d events", m.MockDB, len(sent))
+	}
+	if sent[0].Type != EventStatUpdated || sent[1].Type != EventStatCreated {
+		t.Fatalf("got %+v", sent)
+	}
+
+	// ошибка откатывает пакет целиком, события не рассылаются
+	m = &BatchDB{MockDB: MockDB{}, failDate: "2020-05-05"}
+	sent = eventLog{}
+	if err := AddStats(ctx, batch, m, &sent); err == nil {
+		t.Fatal("expected storage error")
+	}
+	if len(m.MockDB) != 0 || len(sent) != 0 {
+		t.Fatalf("got %v and %d events; expected nothing written", m.MockDB, len(sent))
+	}
+
+	// события повторенной транзакции рассылаются один раз
+	m = &BatchDB{MockDB: MockDB{}, retries: 2}
+	sent = eventLog{}
+	if err := AddStats(ctx, batch, m, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[1].Type != EventStatCreated {
+		t.Fatalf("got %+v; expected 2 events", sent)
+	}
+}
+
+// readBarrier возвращает результат FindByDate, только когда дату
+// прочитали все writers параллельных запросов
+type readBarrier struct {
+	r.StatsRepository
+	reads *sync.WaitGroup
+}
+
+func (b readBarrier) FindByDate(ctx context.Context, date string) (r.Data, error) {
+	data, err := b.StatsRepository.FindByDate(ctx, date)
+	b.reads.Done()
+	b.reads.Wait()
+	return data, err
+}
+
+// Параллельные первые записи даты не нарушают уникальный индекс
+// и не теряют просмотров и кликов друг друга
+func TestAddStatConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db, err := r.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	if _, err := db.Migrate(ctx, r.LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	var wg, reads sync.WaitGroup
+	errs := make(chan error, 10)
+	// все запросы не находят дату и записывают ее как новую
+	rep := readBarrier{db, &reads}
+	reads.Add(10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := AddStat(ctx, r.Data{Date: "2021-01-01", Views: 1, Clicks: 1, Cost: 5}, rep); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if data, err := db.FindByDate(ctx, "2021-01-01"); err != nil || data.Views != 10 || data.Clicks != 10 || data.Cost != 5 {
+		t.Fatalf("got %+v, %v", data, err)
+	}
+	if month, _ := db.FindByPeriodGranularity(ctx, "2021-01-01", "2021-01-31", r.GranularityMonth); len(month) != 1 || month[0].Views != 10 || month[0].Cost != 5 {
+		t.Fatalf("got rollups %+v", month)
+	}
+}
+
+// slowReads задерживает ответ FindByDate, чтобы параллельные
+// запросы успели прочитать ту же запись до ее обновления
+type slowReads struct {
+	r.StatsRepository
+}
+
+func (s slowReads) FindByDate(ctx context.Context, date string) (r.Data, error) {
+	data, err := s.StatsRepository.FindByDate(ctx, date)
+	time.Sleep(2 * time.Millisecond)
+	return data, err
+}
+
+func (s slowReads) Batch(ctx context.Context, fn func(rep r.StatsRepository) error) error {
+	return s.StatsRepository.(r.Batcher).Batch(ctx, func(rep r.StatsRepository) error {
+		return fn(slowReads{rep})
+	})
+}
+
+// Параллельные добавления к существующей дате не теряют
+// просмотров и кликов ни в записи, ни в агрегатах
+func TestAddStatConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	db, err := r.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	if _, err := db.Migrate(ctx, r.LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	for name, rep := range map[string]r.StatsRepository{"sqlite": db, "memory": r.NewMemoryDB()} {
+		if err := rep.Storage(ctx, r.Data{Date: "2021-01-01", Views: 1, Clicks: 1}); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := AddStat(ctx, r.Data{Date: "2021-01-01", Views: 1, Clicks: 1, Cost: 5}, slowReads{rep}); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		if data, _ := rep.FindByDate(ctx, "2021-01-01"); data.Views != 11 || data.Clicks != 11 || data.Cost != 5 {
+			t.Fatalf("%s: got %+v; expected 11 views and clicks", name, data)
+		}
+		month, _ := rep.FindByPeriodGranularity(ctx, "2021-01-01", "2021-01-31", r.GranularityMonth)
+		if len(month) != 1 || month[0].Views != 11 || month[0].Cost != 5 {
+			t.Fatalf("%s: got rollups %+v", name, month)
+		}
+	}
+}
+
 func TestGetUsecase(t *testing.T) {
+	ctx := context.Background()
 	m := &MockDB{}
 
-	result, _ := GetStatWithinFromAndTo("2020-06-06", "2020-11-30", "date", m)
+	result, _ := GetStatWithinFromAndTo(ctx, "2020-06-06", "2020-11-30", "date", "", m)
 
+	// cost хранится в копейках, а возвращается в рублях
 	cpc := func(cost, clicks int) float64 {
-		result := float64(cost) / float64(clicks)
+		result := float64(cost) / 100 / float64(clicks)
 		return math.Round(result*100) / 100
 		// return float64(cost) / float64(clicks)
 	}
 	cpm := func(cost, views int) float64 {
-		result := (float64(cost) / float64(views)) * 1000
+		result := (float64(cost) / 100 / float64(views)) * 1000
 		return math.Round(result*100) / 100
 		// return (float64(cost) / float64(views)) * 1000
 	}
 
 	expect := []OutputData{
-		{"2021-11-25", 112, 123, 166, cpc(166, 123), cpm(166, 112)},
-		{"2021-08-23", 51, 11, 440, cpc(440, 11), cpm(440, 51)},
-		{"2021-06-17", 18, 12, 120, cpc(120, 12), cpm(120, 18)},
-		{"2021-05-12", 12, 15, 16, cpc(16, 15), cpm(16, 12)},
+		{"2021-11-25", 112, 123, 1.66, cpc(166, 123), cpm(166, 112)},
+		{"2021-08-23", 51, 11, 4.4, cpc(440, 11), cpm(440, 51)},
+		{"2021-06-17", 18, 12, 1.2, cpc(120, 12), cpm(120, 18)},
+		{"2021-05-12", 12, 15, 0.16, cpc(16, 15), cpm(16, 12)},
 	}
 
 	for i, value := range result {
@@ -102,8 +320,9 @@ func TestGetUsecase(t *testing.T) {
 }
 
 func TestClearUsecase(t *testing.T) {
-	m := &MockDB{"2020-01-01": r.Data{"2020-01-01", 10, 11, 12}}
-	ClearRepository(m)
+	ctx := context.Background()
+	m := &MockDB{"2020-01-01": r.Data{Date: "2020-01-01", Views: 10, Clicks: 11, Cost: 12}}
+	ClearRepository(ctx, m)
 	if len(*m) != 0 {
 		t.Fatalf("got %v; expected %v", len(*m), 0)
 	}
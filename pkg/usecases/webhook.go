@@ -0,0 +1,226 @@
+package usecases
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	"time"
+)
+
+// deliveriesLimit количество последних доставок в журнале подписки
+const deliveriesLimit = 100
+
+// OutputWebhook структура подписки, возвращаемая на "верхний" уровень (handlers).
+// Secret возвращается только при создании подписки
+type OutputWebhook struct {
+	ID      int64
+	URL     string
+	Events  []string
+	Secret  string `json:",omitempty"`
+	Created time.Time
+}
+
+// OutputDelivery запись журнала доставки события
+type OutputDelivery struct {
+	ID           int64
+	Event        string
+	Status       string
+	Attempts     int
+	NextAttempt  time.Time
+	ResponseCode int
+	LastError    string
+	Created      time.Time
+	Updated      time.Time
+}
+
+func toOutputWebhook(hook r.Webhook) OutputWebhook {
+	return OutputWebhook{
+		ID:      hook.ID,
+		URL:     hook.URL,
+		Events:  hook.Events,
+		Created: hook.Created,
+	}
+}
+
+// ErrPrivateTarget адрес получателя событий внутренний
+var ErrPrivateTarget = errors.New("usecases: webhook target is not a public address")
+
+// privateNets внутренние и служебные сети, не являющиеся loopback,
+// link-local или multicast (они проверяются методами net.IP)
+var privateNets = func() []*net.IPNet {
+	result := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.0.0.0/24",
+		"192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96", "fc00::/7",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		result = append(result, n)
+	}
+	return result
+}()
+
+// TargetPolicy проверяет адреса получателей событий, чтобы подписка
+// не направляла запросы сервиса во внутреннюю сеть (SSRF).
+// Нулевое значение запрещает loopback, link-local, частные и служебные адреса
+type TargetPolicy struct {
+	// AllowPrivate разрешает внутренние адреса, например получателей в той же сети
+	AllowPrivate bool
+	// Resolver находит адреса узла получателя, nil - net.DefaultResolver
+	Resolver *net.Resolver
+}
+
+// CheckIP возвращает ErrPrivateTarget, если адрес запрещен политикой
+func (p TargetPolicy) CheckIP(ip net.IP) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return ErrPrivateTarget
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return ErrPrivateTarget
+		}
+	}
+	return nil
+}
+
+// CheckHost находит адреса узла и проверяет каждый из них
+func (p TargetPolicy) CheckHost(ctx context.Context, host string) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := p.CheckIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWebhook проверяет адрес и типы событий подписки
+func checkWebhook(hook r.Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrInvalid
+	}
+	if len(hook.Events) == 0 {
+		return ErrInvalid
+	}
+	for _, event := range hook.Events {
+		known := false
+		for _, t := range EventTypes {
+			known = known || t == event
+		}
+		if !known {
+			return ErrInvalid
+		}
+	}
+	return nil
+}
+
+// CreateWebhook сценарий создания подписки на события.
+// Узел получателя должен разрешаться только в адреса, допустимые policy.
+// Если секрет не задан, он генерируется
+func CreateWebhook(ctx context.Context, hook r.Webhook, policy TargetPolicy, rep r.WebhookRepository) (OutputWebhook, error) {
+	if err := checkWebhook(hook); err != nil {
+		return OutputWebhook{}, err
+	}
+	u, _ := url.Parse(hook.URL)
+	if err := policy.CheckHost(ctx, u.Hostname()); err != nil {
+		logging.Warn(ctx, "Usecase CreateWebhook. Target is rejected", "host", u.Hostname(), "err", err)
+		if err == ErrPrivateTarget {
+			return OutputWebhook{}, err
+		}
+		return OutputWebhook{}, ErrInvalid
+	}
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return OutputWebhook{}, err
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+	hook.Created = time.Now()
+	id, err := rep.StoreWebhook(ctx, hook)
+	if err != nil {
+		logging.Error(ctx, "Usecase CreateWebhook. StoreWebhook", "err", err)
+		return OutputWebhook{}, err
+	}
+	hook.ID = id
+	result := toOutputWebhook(hook)
+	result.Secret = hook.Secret
+	return result, nil
+}
+
+// GetWebhook сценарий получения подписки по идентификатору
+func GetWebhook(ctx context.Context, id int64, rep r.WebhookRepository) (OutputWebhook, error) {
+	hook, err := rep.FindWebhook(ctx, id)
+	if err != nil {
+		return OutputWebhook{}, err
+	}
+	return toOutputWebhook(hook), nil
+}
+
+// GetWebhooks сценарий получения всех подписок
+func GetWebhooks(ctx context.Context, rep r.WebhookRepository) ([]OutputWebhook, error) {
+	hooks, err := rep.FindWebhooks(ctx)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetWebhooks. FindWebhooks", "err", err)
+		return nil, err
+	}
+	result := []OutputWebhook{}
+	for _, hook := range hooks {
+		result = append(result, toOutputWebhook(hook))
+	}
+	return result, nil
+}
+
+// DeleteWebhook сценарий удаления подписки
+func DeleteWebhook(ctx context.Context, id int64, rep r.WebhookRepository) error {
+	return rep.DeleteWebhook(ctx, id)
+}
+
+// GetDeliveries сценарий получения журнала доставок подписки
+func GetDeliveries(ctx context.Context, id int64, rep r.WebhookRepository) ([]OutputDelivery, error) {
+	if _, err := rep.FindWebhook(ctx, id); err != nil {
+		return nil, err
+	}
+	deliveries, err := rep.FindDeliveries(ctx, id, deliveriesLimit)
+	if err != nil {
+		logging.Error(ctx, "Usecase GetDeliveries. FindDeliveries", "err", err)
+		return nil, err
+	}
+	result := []OutputDelivery{}
+	for _, d := range deliveries {
+		result = append(result, OutputDelivery{
+			ID:           d.ID,
+			Event:        d.Event,
+			Status:       d.Status,
+			Attempts:     d.Attempts,
+			NextAttempt:  d.NextAttempt,
+			ResponseCode: d.ResponseCode,
+			LastError:    d.LastError,
+			Created:      d.Created,
+			Updated:      d.Updated,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,49 @@
+package usecases
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	r "statistics/pkg/repository"
+)
+
+func TestTargetPolicy(t *testing.T) {
+	policy := TargetPolicy{}
+	for _, addr := range []string{
+		"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "0.0.0.0", "::", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "224.0.0.1",
+	} {
+		if err := policy.CheckIP(net.ParseIP(addr)); err != ErrPrivateTarget {
+			t.Errorf("%s: got %v; expected %v", addr, err, ErrPrivateTarget)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946", "172.32.0.1"} {
+		if err := policy.CheckIP(net.ParseIP(addr)); err != nil {
+			t.Errorf("%s: got %v; expected public address", addr, err)
+		}
+	}
+	if err := (TargetPolicy{AllowPrivate: true}).CheckIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatalf("AllowPrivate: got %v", err)
+	}
+}
+
+func TestCreateWebhookTarget(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	hook := func(url string) r.Webhook {
+		return r.Webhook{URL: url, Events: []string{EventStatCreated}}
+	}
+
+	for _, url := range []string{"http://localhost:8080/hook", "http://127.0.0.1/hook", "http://[::1]/hook", "http://169.254.169.254/latest/meta-data"} {
+		if _, err := CreateWebhook(ctx, hook(url), TargetPolicy{}, rep); err != ErrPrivateTarget {
+			t.Errorf("%s: got %v; expected %v", url, err, ErrPrivateTarget)
+		}
+	}
+	if _, err := CreateWebhook(ctx, hook("https://93.184.216.34/hook"), TargetPolicy{}, rep); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateWebhook(ctx, hook("http://localhost:8080/hook"), TargetPolicy{AllowPrivate: true}, rep); err != nil {
+		t.Fatalf("AllowPrivate: %v", err)
+	}
+}
@@ -21,10 +21,62 @@ type Range struct {
 	From    string `schema:"from" valid:"date"`
 	To      string `schema:"to" valid:"date, isGreaterFrom"`
 	OrderBy string `schema:"orderby" valid:"in(date|cost|views|clicks|cpm|cpc), optional"`
+	// Granularity период суммирования статистики, по умолчанию день
+	Granularity string `schema:"granularity" valid:"in(day|week|month), optional"`
 }
 
-// Валидация DELETE запроса - это проверка,
-// что параметры URL пустые
+// Forecast структура для валидации входного GET запроса прогноза.
+// Horizon - количество дней прогноза после даты to
+type Forecast struct {
+	From    string `schema:"from" valid:"date"`
+	To      string `schema:"to" valid:"date, isGreaterFrom"`
+	Horizon string `schema:"horizon" valid:"int, range(1|366), optional"`
+}
+
+// InputBudget структура для валидации входного запроса
+// создания или изменения бюджета. Amount задается как cost.
+// Области бюджета (scope) нет, пока у статистики нет измерений:
+// декодер отклоняет такой параметр как неизвестный
+type InputBudget struct {
+	Name      string `schema:"name" valid:"stringlength(1|255)"`
+	Amount    string `schema:"amount" valid:"cost"`
+	Period    string `schema:"period" valid:"in(day|week|month)"`
+	Threshold string `schema:"threshold" valid:"float, optional"`
+}
+
+// BudgetDate структура для валидации запроса состояния бюджета на дату
+type BudgetDate struct {
+	Date string `schema:"date" valid:"date, optional"`
+}
+
+// InputWebhook структура для валидации входного запроса создания подписки.
+// Events - типы событий через запятую
+type InputWebhook struct {
+	URL    string `schema:"url" valid:"url"`
+	Events string `schema:"events" valid:"stringlength(1|255)"`
+	Secret string `schema:"secret" valid:"stringlength(16|255), optional"`
+}
+
+// InputAPIKey структура для валидации входного запроса создания ключа API.
+// Scopes - права через пробел или запятую, Tenant - арендатор ключа
+// (по умолчанию арендатор запроса)
+type InputAPIKey struct {
+	Name   string `schema:"name" valid:"stringlength(1|255)"`
+	Scopes string `schema:"scopes" valid:"stringlength(1|255)"`
+	Tenant string `schema:"tenant" valid:"stringlength(1|64), optional"`
+}
+
+// StreamRange структура для валидации запроса потока событий.
+// Границы диапазона дат необязательны
+type StreamRange struct {
+	From string `schema:"from" valid:"date, optional"`
+	To   string `schema:"to" valid:"date, optional"`
+}
+
+// Empty структура для валидации запросов без параметров.
+// Валидация DELETE запроса - это проверка, что параметры URL пустые:
+// декодер не пропускает неизвестные ключи
+type Empty struct{}
 
 func init() {
 	govalidator.SetFieldsRequiredByDefault(true)
@@ -83,6 +135,9 @@ func init() {
 		case Range:
 			return toDate(v.From).Before(toDate(v.To)) ||
 				toDate(v.From).Equal(toDate(v.To))
+		case Forecast:
+			return toDate(v.From).Before(toDate(v.To)) ||
+				toDate(v.From).Equal(toDate(v.To))
 		}
 		return false
 	})
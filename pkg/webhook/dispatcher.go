@@ -0,0 +1,273 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Заголовки запроса доставки события
+const (
+	HeaderEvent     = "X-Stats-Event"
+	HeaderDelivery  = "X-Stats-Delivery"
+	HeaderTimestamp = "X-Stats-Timestamp"
+	HeaderSignature = "X-Stats-Signature"
+)
+
+// Dispatcher ставит события сценариев в персистентную очередь доставки
+// (реализует usecases.Notifier) и доставляет их подписчикам
+// с повторными попытками и экспоненциальной задержкой
+type Dispatcher struct {
+	Rep    r.WebhookRepository
+	Client *http.Client
+	// Policy допустимые адреса получателей, проверяется клиентом NewDispatcher
+	// при каждом соединении
+	Policy uc.TargetPolicy
+	// Interval период опроса очереди
+	Interval time.Duration
+	// BatchSize количество доставок, выбираемых из очереди за раз
+	BatchSize int
+	// MaxAttempts количество попыток, после которого доставка считается неудачной
+	MaxAttempts int
+	// BaseDelay задержка перед второй попыткой, далее удваивается до MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Now источник текущего времени
+	Now func() time.Time
+
+	wake chan struct{}
+}
+
+// NewDispatcher возвращает Dispatcher с параметрами по умолчанию
+func NewDispatcher(rep r.WebhookRepository) *Dispatcher {
+	d := &Dispatcher{
+		Rep:         rep,
+		Interval:    5 * time.Second,
+		BatchSize:   50,
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    time.Hour,
+		Now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+	d.Client = &http.Client{Timeout: 10 * time.Second, Transport: d.transport()}
+	return d
+}
+
+// transport возвращает транспорт без прокси, соединяющийся только
+// с адресами, допустимыми Policy. Адрес проверяется после разрешения имени,
+// поэтому имя, начавшее разрешаться во внутренний адрес после создания
+// подписки, и перенаправления во внутреннюю сеть тоже отклоняются
+func (d *Dispatcher) transport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return d.Policy.CheckIP(net.ParseIP(host))
+		},
+	}
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func subscribed(hook r.Webhook, event string) bool {
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify ставит событие в очередь доставки каждой подписке арендатора
+// события на его тип. Событие уже произошло, поэтому постановка в очередь
+// не зависит от контекста вызвавшего его запроса
+func (d *Dispatcher) Notify(event uc.Event) {
+	ctx := r.WithTenant(context.Background(), event.Tenant)
+	hooks, err := d.Rep.FindWebhooks(ctx)
+	if err != nil {
+		logging.Error(ctx, "Webhook Notify. FindWebhooks", "err", err)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logging.Error(ctx, "Webhook Notify", "err", err)
+		return
+	}
+	now := d.Now()
+	queued := false
+	for _, hook := range hooks {
+		if !subscribed(hook, event.Type) {
+			continue
+		}
+		_, err := d.Rep.StoreDelivery(ctx, r.Delivery{
+			WebhookID:   hook.ID,
+			Event:       event.Type,
+			Payload:     string(payload),
+			Status:      r.DeliveryPending,
+			NextAttempt: now,
+			Created:     now,
+			Updated:     now,
+		})
+		if err != nil {
+			logging.Error(ctx, "Webhook Notify. StoreDelivery", "err", err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run доставляет события из очереди, пока не отменен ctx.
+// Очередь проверяется раз в Interval и сразу после постановки новых событий
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.DeliverDue(ctx); err != nil {
+			logging.Error(ctx, "Webhook Run. DeliverDue", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// DeliverDue выполняет по одной попытке для каждой доставки,
+// время которой наступило. Возвращает количество выполненных попыток
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	deliveries, err := d.Rep.FindDueDeliveries(ctx, d.Now(), d.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	hooks := map[int64]*r.Webhook{}
+	count := 0
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		hook, ok := hooks[delivery.WebhookID]
+		if !ok {
+			found, err := d.Rep.FindWebhook(r.WithTenant(ctx, delivery.Tenant), delivery.WebhookID)
+			if err != nil && err != r.ErrNotFound {
+				return count, err
+			}
+			if err == nil {
+				hook = &found
+			}
+			hooks[delivery.WebhookID] = hook
+		}
+		if !d.attempt(ctx, hook, &delivery) {
+			continue
+		}
+		if err := d.Rep.UpdateDelivery(ctx, delivery); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// attempt выполняет попытку доставки и обновляет ее состояние.
+// Возвращает false, если попытка прервана отменой ctx и не должна учитываться
+func (d *Dispatcher) attempt(ctx context.Context, hook *r.Webhook, delivery *r.Delivery) bool {
+	now := d.Now()
+	delivery.Updated = now
+	if hook == nil {
+		delivery.Status = r.DeliveryFailed
+		delivery.LastError = "webhook deleted"
+		return true
+	}
+
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Status = r.DeliveryFailed
+		delivery.LastError = err.Error()
+		return true
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return false
+	}
+	delivery.Attempts++
+	if err != nil {
+		delivery.ResponseCode = 0
+		delivery.LastError = err.Error()
+	} else {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		delivery.ResponseCode = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			delivery.Status = r.DeliveryDelivered
+			delivery.LastError = ""
+			return true
+		}
+		delivery.LastError = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	if delivery.Attempts >= d.MaxAttempts {
+		delivery.Status = r.DeliveryFailed
+		return true
+	}
+	delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+	return true
+}
+
+// backoff возвращает задержку после attempts неудачных попыток
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.MaxDelay {
+			return d.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Sign возвращает подпись доставки: hex(HMAC-SHA256(secret, timestamp + "." + body)).
+// Получатель проверяет ее по заголовкам X-Stats-Timestamp и X-Stats-Signature
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
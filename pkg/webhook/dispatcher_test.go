@@ -0,0 +1,266 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// заглушка хранилища подписок для тестирования доставки
+type MockWebhooks struct {
+	hooks      []r.Webhook
+	deliveries []r.Delivery
+}
+
+func (m *MockWebhooks) StoreWebhook(ctx context.Context, hook r.Webhook) (int64, error) {
+	hook.ID = int64(len(m.hooks) + 1)
+	m.hooks = append(m.hooks, hook)
+	return hook.ID, nil
+}
+
+func (m *MockWebhooks) FindWebhook(ctx context.Context, id int64) (r.Webhook, error) {
+	for _, hook := range m.hooks {
+		if hook.ID == id {
+			return hook, nil
+		}
+	}
+	return r.Webhook{}, r.ErrNotFound
+}
+
+func (m *MockWebhooks) FindWebhooks(ctx context.Context) ([]r.Webhook, error) {
+	return m.hooks, nil
+}
+
+func (m *MockWebhooks) DeleteWebhook(ctx context.Context, id int64) error {
+	for i, hook := range m.hooks {
+		if hook.ID == id {
+			m.hooks = append(m.hooks[:i], m.hooks[i+1:]...)
+			return nil
+		}
+	}
+	return r.ErrNotFound
+}
+
+func (m *MockWebhooks) StoreDelivery(ctx context.Context, delivery r.Delivery) (int64, error) {
+	delivery.ID = int64(len(m.deliveries) + 1)
+	m.deliveries = append(m.deliveries, delivery)
+	return delivery.ID, nil
+}
+
+func (m *MockWebhooks) UpdateDelivery(ctx context.Context, delivery r.Delivery) error {
+	m.deliveries[delivery.ID-1] = delivery
+	return nil
+}
+
+func (m *MockWebhooks) FindDueDeliveries(ctx context.Context, now time.Time, limit int) ([]r.Delivery, error) {
+	result := []r.Delivery{}
+	for _, d := range m.deliveries {
+		if d.Status == r.DeliveryPending && !d.NextAttempt.After(now) && len(result) < limit {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func (m *MockWebhooks) FindDeliveries(ctx context.Context, webhookID int64, limit int) ([]r.Delivery, error) {
+	result := []r.Delivery{}
+	for _, d := range m.deliveries {
+		if d.WebhookID == webhookID {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+// receiver локальный получатель событий, отвечающий кодами из codes по очереди
+type receiver struct {
+	mu       sync.Mutex
+	codes    []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	rc.requests = append(rc.requests, req)
+	rc.bodies = append(rc.bodies, body)
+	code := http.StatusOK
+	if len(rc.codes) > 0 {
+		code, rc.codes = rc.codes[0], rc.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+// newDispatcher возвращает Dispatcher с управляемыми часами,
+// доставляющий события локальному получателю
+func newDispatcher(rep r.WebhookRepository) (*Dispatcher, *time.Time) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := NewDispatcher(rep)
+	d.Policy.AllowPrivate = true
+	d.Now = func() time.Time { return now }
+	d.MaxAttempts = 3
+	d.BaseDelay = time.Minute
+	return d, &now
+}
+
+func TestDeliverySignedAndFiltered(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	rep := &MockWebhooks{}
+	rep.StoreWebhook(ctx, r.Webhook{URL: srv.URL, Events: []string{uc.EventStatCreated}, Secret: "secret"})
+	d, _ := newDispatcher(rep)
+
+	d.Notify(uc.Event{Type: uc.EventStatCreated, Date: "2021-01-01",
+		Total: &uc.StatValues{Views: 10, Clicks: 2, Cost: 1.5}})
+	d.Notify(uc.Event{Type: uc.EventStatsDeleted, Affected: 3})
+	if len(rep.deliveries) != 1 {
+		t.Fatalf("got %d deliveries; expected %d", len(rep.deliveries), 1)
+	}
+
+	n, err := d.DeliverDue(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d attempts, err %v; expected 1 attempt", n, err)
+	}
+	if rep.deliveries[0].Status != r.DeliveryDelivered {
+		t.Fatalf("got status %s; expected %s", rep.deliveries[0].Status, r.DeliveryDelivered)
+	}
+
+	req, body := rc.requests[0], rc.bodies[0]
+	if req.Header.Get(HeaderEvent) != uc.EventStatCreated {
+		t.Fatalf("got event header %q; expected %q", req.Header.Get(HeaderEvent), uc.EventStatCreated)
+	}
+	expect := "sha256=" + Sign("secret", req.Header.Get(HeaderTimestamp), body)
+	if req.Header.Get(HeaderSignature) != expect {
+		t.Fatalf("got signature %q; expected %q", req.Header.Get(HeaderSignature), expect)
+	}
+	event := uc.Event{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Date != "2021-01-01" || event.Total == nil || event.Total.Views != 10 {
+		t.Fatalf("got payload %s", body)
+	}
+}
+
+// События доставляются только подпискам арендатора события
+func TestDeliveryToTenantWebhooks(t *testing.T) {
+	acme := r.WithTenant(context.Background(), "acme")
+	globex := r.WithTenant(context.Background(), "globex")
+	rcAcme, rcGlobex := &receiver{}, &receiver{}
+	srvAcme, srvGlobex := httptest.NewServer(rcAcme), httptest.NewServer(rcGlobex)
+	defer srvAcme.Close()
+	defer srvGlobex.Close()
+
+	rep := r.NewMemoryDB()
+	rep.StoreWebhook(acme, r.Webhook{URL: srvAcme.URL, Events: []string{uc.EventStatCreated}})
+	rep.StoreWebhook(globex, r.Webhook{URL: srvGlobex.URL, Events: []string{uc.EventStatCreated}})
+	d, _ := newDispatcher(rep)
+
+	d.Notify(uc.Event{Type: uc.EventStatCreated, Tenant: "acme", Date: "2021-01-01"})
+	if n, err := d.DeliverDue(context.Background()); err != nil || n != 1 {
+		t.Fatalf("got %d attempts, err %v; expected 1 attempt", n, err)
+	}
+	if len(rcAcme.requests) != 1 || len(rcGlobex.requests) != 0 {
+		t.Fatalf("got %d acme and %d globex requests; expected only acme", len(rcAcme.requests), len(rcGlobex.requests))
+	}
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{codes: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	rep := &MockWebhooks{}
+	rep.StoreWebhook(ctx, r.Webhook{URL: srv.URL, Events: uc.EventTypes, Secret: "secret"})
+	d, now := newDispatcher(rep)
+	start := *now
+
+	d.Notify(uc.Event{Type: uc.EventStatsDeleted, Affected: 3})
+	d.DeliverDue(ctx)
+	delivery := rep.deliveries[0]
+	if delivery.Status != r.DeliveryPending || delivery.Attempts != 1 || delivery.ResponseCode != 500 {
+		t.Fatalf("after first attempt got %+v", delivery)
+	}
+	if !delivery.NextAttempt.Equal(start.Add(time.Minute)) {
+		t.Fatalf("got next attempt %v; expected %v", delivery.NextAttempt, start.Add(time.Minute))
+	}
+
+	// до наступления времени повтора доставка не выполняется
+	if n, _ := d.DeliverDue(ctx); n != 0 {
+		t.Fatalf("got %d attempts before backoff elapsed; expected 0", n)
+	}
+
+	*now = start.Add(time.Minute)
+	d.DeliverDue(ctx)
+	delivery = rep.deliveries[0]
+	if !delivery.NextAttempt.Equal(now.Add(2 * time.Minute)) {
+		t.Fatalf("got next attempt %v; expected %v", delivery.NextAttempt, now.Add(2*time.Minute))
+	}
+
+	*now = now.Add(2 * time.Minute)
+	d.DeliverDue(ctx)
+	delivery = rep.deliveries[0]
+	if delivery.Status != r.DeliveryDelivered || delivery.Attempts != 3 || len(rc.requests) != 3 {
+		t.Fatalf("after third attempt got %+v with %d requests", delivery, len(rc.requests))
+	}
+}
+
+func TestDeliveryFailsAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{codes: []int{500, 500, 500, 500}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	rep := &MockWebhooks{}
+	rep.StoreWebhook(ctx, r.Webhook{URL: srv.URL, Events: uc.EventTypes, Secret: "secret"})
+	d, now := newDispatcher(rep)
+
+	d.Notify(uc.Event{Type: uc.EventStatsDeleted})
+	for i := 0; i < 5; i++ {
+		d.DeliverDue(ctx)
+		*now = now.Add(time.Hour)
+	}
+	delivery := rep.deliveries[0]
+	if delivery.Status != r.DeliveryFailed || delivery.Attempts != 3 {
+		t.Fatalf("got %+v; expected failed after 3 attempts", delivery)
+	}
+}
+
+func TestDeliveryToPrivateAddressRejected(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	rep := &MockWebhooks{}
+	rep.StoreWebhook(ctx, r.Webhook{URL: srv.URL, Events: uc.EventTypes, Secret: "secret"})
+	d, _ := newDispatcher(rep)
+	d.Policy.AllowPrivate = false
+
+	// подписка на внутренний адрес, созданная до запрета или через
+	// перенаправление DNS, не доставляется: адрес проверяется при соединении
+	d.Notify(uc.Event{Type: uc.EventStatsDeleted, Affected: 1})
+	if _, err := d.DeliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.requests) != 0 {
+		t.Fatal("delivered to loopback address")
+	}
+	if delivery := rep.deliveries[0]; delivery.Status != r.DeliveryPending || !strings.Contains(delivery.LastError, uc.ErrPrivateTarget.Error()) {
+		t.Fatalf("got %+v; expected rejected attempt", delivery)
+	}
+}
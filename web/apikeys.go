@@ -0,0 +1,66 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+	"statistics/pkg/validation"
+
+	"github.com/gorilla/schema"
+)
+
+// PostAPIKey обработчик POST запроса. Запускает сценарий CreateAPIKey.
+// Права передаются через пробел или запятую. Ключ создается для арендатора
+// tenant или, если он не задан, для арендатора запроса. Возвращает ключ,
+// который больше нельзя получить
+func (h *WebserviceHandler) PostAPIKey(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	msg := &validation.InputAPIKey{}
+	decoder := schema.NewDecoder()
+	decoder.Decode(msg, req.PostForm)
+	scopes := strings.FieldsFunc(msg.Scopes, func(c rune) bool { return c == ',' || c == ' ' })
+	ctx := req.Context()
+	if msg.Tenant != "" {
+		if !uc.ValidTenant(msg.Tenant) {
+			http.Error(w, "Bad tenant name", http.StatusBadRequest)
+			return
+		}
+		ctx = r.WithTenant(ctx, msg.Tenant)
+	}
+	key, err := uc.CreateAPIKey(ctx, msg.Name, scopes, h.APIKeys)
+	if err != nil {
+		writeError(w, req, "PostAPIKey", err)
+		return
+	}
+	writeJSON(w, key)
+}
+
+// GetAPIKeys обработчик GET запроса. Запускает сценарий GetAPIKeys
+func (h *WebserviceHandler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := uc.GetAPIKeys(r.Context(), h.APIKeys)
+	if err != nil {
+		writeError(w, r, "GetAPIKeys", err)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+// DeleteAPIKey обработчик DELETE запроса. Запускает сценарий RevokeAPIKey
+func (h *WebserviceHandler) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := uc.RevokeAPIKey(r.Context(), pathID(r), h.APIKeys); err != nil {
+		writeError(w, r, "DeleteAPIKey", err)
+		return
+	}
+}
+
+// GetAudit обработчик GET запроса журнала аудита. Запускает сценарий GetAudit
+func (h *WebserviceHandler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	entries, err := uc.GetAudit(r.Context(), h.APIKeys)
+	if err != nil {
+		writeError(w, r, "GetAudit", err)
+		return
+	}
+	writeJSON(w, entries)
+}
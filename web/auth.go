@@ -0,0 +1,163 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+)
+
+// HeaderAPIKey заголовок ключа API, альтернатива Authorization: Bearer
+const HeaderAPIKey = "X-API-Key"
+
+// HeaderTenant заголовок с арендатором, данные которого читает и изменяет запрос
+const HeaderTenant = "X-Tenant-ID"
+
+// publicScope маршрут доступен без ключа
+const publicScope = ""
+
+// routeScopes сопоставляет маршруту ("МЕТОД шаблон") право, необходимое
+// для запроса. Маршруты без записи доступны только с правом admin
+var routeScopes = map[string]string{
+	"GET /metrics": publicScope,
+	"GET /healthz": publicScope,
+	"GET /readyz":  publicScope,
+
+	"GET /openapi.json": publicScope,
+	"GET /docs":         publicScope,
+
+	"POST /stats":         uc.ScopeStatsWrite,
+	"GET /stats":          uc.ScopeStatsRead,
+	"DELETE /stats":       uc.ScopeStatsDelete,
+	"GET /stats/forecast": uc.ScopeStatsRead,
+	"GET /stats/stream":   uc.ScopeStatsRead,
+	"GET /stats/cache":    uc.ScopeStatsRead,
+
+	"POST /budgets":                   uc.ScopeStatsWrite,
+	"GET /budgets":                    uc.ScopeStatsRead,
+	"GET /budgets/{id:[0-9]+}":        uc.ScopeStatsRead,
+	"PUT /budgets/{id:[0-9]+}":        uc.ScopeStatsWrite,
+	"DELETE /budgets/{id:[0-9]+}":     uc.ScopeStatsWrite,
+	"GET /budgets/{id:[0-9]+}/status": uc.ScopeStatsRead,
+	"GET /alerts":                     uc.ScopeStatsRead,
+}
+
+// apiKey возвращает ключ API запроса из заголовка Authorization: Bearer или X-API-Key
+func apiKey(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return req.Header.Get(HeaderAPIKey)
+}
+
+// authenticate проверяет ключ API или токен SSO запроса. Токен
+// отличается от ключа тремя частями, разделенными точками.
+// Запрос без ключа выполняется с ключом сертификата клиента, если он есть
+func (h *WebserviceHandler) authenticate(req *http.Request) (r.APIKey, error) {
+	plain := apiKey(req)
+	if key, ok := clientIdentity(req, h.ClientCerts); ok && plain == "" {
+		return key, nil
+	}
+	if h.Tokens != nil && (h.APIKeys == nil || strings.Count(plain, ".") == 2) {
+		return uc.AuthenticateToken(req.Context(), plain, h.Tokens, h.TokenMapping)
+	}
+	if h.APIKeys == nil {
+		return r.APIKey{}, uc.ErrUnauthorized
+	}
+	return uc.Authenticate(req.Context(), plain, h.APIKeys)
+}
+
+// AuthMiddleware проверяет ключ API, токен SSO или сертификат клиента
+// и право на маршрут: без ключа или с неверным ключом отвечает 401,
+// без нужного права - 403. Адрес, исчерпавший запас неудачных проверок
+// RateLimits.Auth, получает 429 до проверки ключа: подбор ключей
+// не нагружает базу.
+// Запрос выполняется для арендатора ключа; заголовок X-Tenant-ID
+// с другим арендатором допускается только для ключа с правом admin.
+// Изменяющие запросы записываются в журнал аудита APIKeys вместе с ключом.
+// Если не заданы ни APIKeys, ни Tokens, ни ClientCerts, ключи не проверяются,
+// а арендатор берется из X-Tenant-ID (по умолчанию default)
+func (h *WebserviceHandler) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tmpl, _ := mux.CurrentRoute(req).GetPathTemplate()
+		scope, ok := routeScopes[req.Method+" "+tmpl]
+		if !ok {
+			scope = uc.ScopeAdmin
+		}
+		if scope == publicScope {
+			next.ServeHTTP(w, req)
+			return
+		}
+		tenant := req.Header.Get(HeaderTenant)
+		if tenant != "" && !uc.ValidTenant(tenant) {
+			http.Error(w, "Bad "+HeaderTenant, http.StatusBadRequest)
+			return
+		}
+		if h.APIKeys == nil && h.Tokens == nil && h.ClientCerts == nil {
+			if tenant == "" {
+				tenant = r.DefaultTenant
+			}
+			next.ServeHTTP(w, req.WithContext(r.WithTenant(req.Context(), tenant)))
+			return
+		}
+		failures := h.RateLimits.Auth
+		if failures != nil {
+			if res := failures.Check(address(req)); !res.Allowed {
+				tooManyRequests(w, res)
+				return
+			}
+		}
+		key, err := h.authenticate(req)
+		if err == uc.ErrUnauthorized {
+			if failures != nil {
+				failures.Allow(address(req))
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="statistics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			writeError(w, req, "AuthMiddleware", err)
+			return
+		}
+		if !uc.HasScope(key, scope) {
+			http.Error(w, "Forbidden: "+scope+" scope required", http.StatusForbidden)
+			return
+		}
+		if tenant == "" {
+			tenant = key.Tenant
+		}
+		if tenant != key.Tenant && !uc.HasScope(key, uc.ScopeAdmin) {
+			http.Error(w, "Forbidden: key has no access to tenant "+tenant, http.StatusForbidden)
+			return
+		}
+		req = req.WithContext(withClient(r.WithTenant(req.Context(), tenant), key))
+		if req.Method == http.MethodGet || req.Method == http.MethodHead || h.APIKeys == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		// запрос уже выполнен, запись аудита не зависит от его отмены
+		err = uc.RecordAudit(context.Background(), r.AuditEntry{
+			KeyID:     key.ID,
+			KeyName:   key.Name,
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Status:    sw.status,
+			RequestID: logging.RequestID(req.Context()),
+		}, h.APIKeys)
+		if err != nil {
+			logging.Error(req.Context(), "AuthMiddleware. RecordAudit", "err", err)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"statistics/pkg/jwt"
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+	"statistics/pkg/validation"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+// toCents переводит сумму бюджета в рублях в копейки
+func toCents(cost string) int {
+	decimal, _ := strconv.ParseFloat(cost, 64)
+	return int(math.Round(decimal * 100))
+}
+
+func toBudget(data validation.InputBudget) r.Budget {
+	threshold, _ := strconv.ParseFloat(data.Threshold, 64)
+	return r.Budget{
+		Name:      data.Name,
+		Amount:    toCents(data.Amount),
+		Period:    data.Period,
+		Threshold: threshold,
+	}
+}
+
+// pathID возвращает идентификатор из пути запроса
+func pathID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	return id
+}
+
+// writeJSON отправляет data в формате JSON
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	result, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	fmt.Fprintln(w, string(result))
+}
+
+// statusClientClosedRequest код ответа клиенту, закрывшему соединение
+// до окончания обработки запроса (используется nginx)
+const statusClientClosedRequest = 499
+
+// writeError отвечает кодом, соответствующим ошибке сценария.
+// Драйвер базы может вернуть собственную ошибку прерванного запроса,
+// поэтому отмена и истечение срока определяются по контексту запроса
+func writeError(w http.ResponseWriter, req *http.Request, method string, err error) {
+	if ctxErr := req.Context().Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	switch {
+	case err == r.ErrNotFound:
+		http.Error(w, "Not found", http.StatusNotFound)
+	case err == uc.ErrInvalid:
+		http.Error(w, "Bad values in request", http.StatusBadRequest)
+	case err == uc.ErrPrivateTarget:
+		http.Error(w, "Bad values in request: webhook target is not a public address", http.StatusBadRequest)
+	case err == r.ErrQuotaExceeded:
+		http.Error(w, "Forbidden: tenant quota exceeded", http.StatusForbidden)
+	case err == jwt.ErrKeysUnavailable:
+		logging.Error(req.Context(), method, "err", err)
+		http.Error(w, "Service unavailable: token signing keys are not loaded", http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		logging.Warn(req.Context(), method, "err", err)
+		http.Error(w, "Request timeout", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		logging.Info(req.Context(), method, "err", err)
+		http.Error(w, "Request canceled", statusClientClosedRequest)
+	default:
+		logging.Error(req.Context(), method, "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// decodeBudget разбирает параметры бюджета из тела запроса
+func decodeBudget(req *http.Request) r.Budget {
+	req.ParseForm()
+	msg := &validation.InputBudget{}
+	decoder := schema.NewDecoder()
+	decoder.Decode(msg, req.PostForm)
+	return toBudget(*msg)
+}
+
+// PostBudget обработчик POST запроса. Запускает сценарий CreateBudget
+func (h *WebserviceHandler) PostBudget(w http.ResponseWriter, r *http.Request) {
+	budget, err := uc.CreateBudget(r.Context(), decodeBudget(r), h.Budgets)
+	if err != nil {
+		writeError(w, r, "PostBudget", err)
+		return
+	}
+	writeJSON(w, budget)
+}
+
+// GetBudgets обработчик GET запроса. Запускает сценарий GetBudgets
+func (h *WebserviceHandler) GetBudgets(w http.ResponseWriter, r *http.Request) {
+	budgets, err := uc.GetBudgets(r.Context(), h.Budgets)
+	if err != nil {
+		writeError(w, r, "GetBudgets", err)
+		return
+	}
+	writeJSON(w, budgets)
+}
+
+// GetBudget обработчик GET запроса. Запускает сценарий GetBudget
+func (h *WebserviceHandler) GetBudget(w http.ResponseWriter, r *http.Request) {
+	budget, err := uc.GetBudget(r.Context(), pathID(r), h.Budgets)
+	if err != nil {
+		writeError(w, r, "GetBudget", err)
+		return
+	}
+	writeJSON(w, budget)
+}
+
+// PutBudget обработчик PUT запроса. Запускает сценарий UpdateBudget
+func (h *WebserviceHandler) PutBudget(w http.ResponseWriter, r *http.Request) {
+	budget := decodeBudget(r)
+	budget.ID = pathID(r)
+	result, err := uc.UpdateBudget(r.Context(), budget, h.Budgets)
+	if err != nil {
+		writeError(w, r, "PutBudget", err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// DeleteBudget обработчик DELETE запроса. Запускает сценарий DeleteBudget
+func (h *WebserviceHandler) DeleteBudget(w http.ResponseWriter, r *http.Request) {
+	if err := uc.DeleteBudget(r.Context(), pathID(r), h.Budgets); err != nil {
+		writeError(w, r, "DeleteBudget", err)
+		return
+	}
+}
+
+// GetBudgetStatus обработчик GET запроса. Запускает сценарий GetBudgetStatus.
+// По умолчанию состояние считается на текущую дату
+func (h *WebserviceHandler) GetBudgetStatus(w http.ResponseWriter, r *http.Request) {
+	msg := &validation.BudgetDate{}
+	decoder := schema.NewDecoder()
+	decoder.Decode(msg, r.URL.Query())
+	if msg.Date == "" {
+		msg.Date = time.Now().Format("2006-01-02")
+	}
+	status, err := uc.GetBudgetStatus(r.Context(), pathID(r), msg.Date, h.Rep, h.Budgets)
+	if err != nil {
+		writeError(w, r, "GetBudgetStatus", err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// GetAlerts обработчик GET запроса. Запускает сценарий GetAlerts
+func (h *WebserviceHandler) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts, err := uc.GetAlerts(r.Context(), h.Budgets)
+	if err != nil {
+		writeError(w, r, "GetAlerts", err)
+		return
+	}
+	writeJSON(w, alerts)
+}
@@ -0,0 +1,591 @@
+package web
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"statistics/pkg/logging"
+	"statistics/pkg/ratelimit"
+)
+
+// Источники значений настроек в порядке применения
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// setting настройка конфигурации: ключ в файле, переменная окружения
+// и значение по умолчанию. reload - настройка применяется по SIGHUP
+// без перезапуска
+type setting struct {
+	key    string
+	env    string
+	def    string
+	reload bool
+	set    func(c *Config, value string) error
+}
+
+// text задает строковую настройку
+func text(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+// integer задает целочисленную настройку, пустое значение - 0
+func integer(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := parseInt(value)
+		*field(c) = int(n)
+		return err
+	}
+}
+
+// integer64 задает целочисленную настройку int64, пустое значение - 0
+func integer64(field func(c *Config) *int64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := parseInt(value)
+		*field(c) = n
+		return err
+	}
+}
+
+func parseInt(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q", value)
+	}
+	return n, nil
+}
+
+// number задает дробную настройку, пустое значение - 0
+func number(field func(c *Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		if value == "" {
+			*field(c) = 0
+			return nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+// boolean задает логическую настройку, пустое значение - false
+func boolean(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		if value == "" {
+			*field(c) = false
+			return nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// duration задает длительность с единицами ("15s", "1m30s").
+// Число без единиц измеряется в unit, как в прежних переменных окружения
+func duration(unit time.Duration, field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := parseDuration(value, unit)
+		*field(c) = d
+		return err
+	}
+}
+
+func parseDuration(value string, unit time.Duration) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if n, nerr := strconv.ParseInt(value, 10, 64); nerr == nil {
+		d, err = time.Duration(n)*unit, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected a number with a unit such as \"15s\"", value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", value)
+	}
+	return d, nil
+}
+
+// settings настройки сервиса
+var settings = []setting{
+	{key: "server.port", env: "PORT", set: text(func(c *Config) *string { return &c.Server.Port })},
+	{key: "server.timeout.server", env: "SERVER", def: "30s", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Server.Timeout.Server })},
+	{key: "server.timeout.write", env: "WRITE", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Server.Timeout.Write })},
+	{key: "server.timeout.read", env: "READ", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Server.Timeout.Read })},
+	{key: "server.timeout.idle", env: "IDLE", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Server.Timeout.Idle })},
+	{key: "server.timeout.request", env: "REQUEST", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Server.Timeout.Request })},
+	{key: "server.tls.cert", env: "TLS_CERT", set: text(func(c *Config) *string { return &c.Server.TLS.CertFile })},
+	{key: "server.tls.key", env: "TLS_KEY", set: text(func(c *Config) *string { return &c.Server.TLS.KeyFile })},
+	{key: "server.tls.client_ca", env: "TLS_CLIENT_CA", set: text(func(c *Config) *string { return &c.Server.TLS.ClientCA })},
+	{key: "server.tls.client_required", env: "TLS_CLIENT_REQUIRED", set: boolean(func(c *Config) *bool { return &c.Server.TLS.ClientRequired })},
+	{key: "server.tls.client_subjects", env: "TLS_CLIENT_SUBJECTS", set: func(c *Config, value string) (err error) {
+		c.Server.TLS.ClientSubjects, err = parseClientSubjects(value)
+		return err
+	}},
+	{key: "server.tls.redirect_port", env: "TLS_REDIRECT_PORT", set: text(func(c *Config) *string { return &c.Server.TLS.RedirectPort })},
+	{key: "server.tls.reload_interval", env: "TLS_RELOAD_INTERVAL", def: "10s", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Server.TLS.ReloadInterval })},
+
+	{key: "database.driver", env: "DB_DRIVER", def: "mysql", set: text(func(c *Config) *string { return &c.Database.Driver })},
+	{key: "database.dsn", env: "DB_DSN", set: text(func(c *Config) *string { return &c.Database.DSN })},
+	{key: "database.user", env: "MYSQL_USER", set: text(func(c *Config) *string { return &c.Database.User })},
+	{key: "database.password", env: "MYSQL_PASSWORD", set: text(func(c *Config) *string { return &c.Database.Password })},
+	{key: "database.name", env: "MYSQL_DATABASE", set: text(func(c *Config) *string { return &c.Database.Dbname })},
+	{key: "database.host", env: "DATABASE_HOST", set: text(func(c *Config) *string { return &c.Database.Host })},
+	{key: "database.port", env: "MYSQL_PORT", set: text(func(c *Config) *string { return &c.Database.Port })},
+	{key: "database.auto_migrate", env: "AUTO_MIGRATE", set: boolean(func(c *Config) *bool { return &c.Database.AutoMigrate })},
+	{key: "database.connect_timeout", env: "DB_CONNECT_TIMEOUT", def: "1m", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Database.ConnectTimeout })},
+	{key: "database.options", env: "DB_OPTIONS", set: text(func(c *Config) *string { return &c.Database.Options })},
+	{key: "database.pool.max_open", env: "DB_MAX_OPEN_CONNS", set: integer(func(c *Config) *int { return &c.Database.Pool.MaxOpenConns })},
+	{key: "database.pool.max_idle", env: "DB_MAX_IDLE_CONNS", set: integer(func(c *Config) *int { return &c.Database.Pool.MaxIdleConns })},
+	{key: "database.pool.max_lifetime", env: "DB_CONN_MAX_LIFETIME", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Database.Pool.ConnMaxLifetime })},
+	{key: "database.pool.max_idle_time", env: "DB_CONN_MAX_IDLE_TIME", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Database.Pool.ConnMaxIdleTime })},
+	{key: "database.retry.attempts", env: "DB_RETRY_ATTEMPTS", def: "3", set: integer(func(c *Config) *int { return &c.Database.Retry.Attempts })},
+	{key: "database.retry.delay", env: "DB_RETRY_DELAY_MS", def: "50ms", set: duration(time.Millisecond, func(c *Config) *time.Duration { return &c.Database.Retry.Delay })},
+	{key: "database.retry.max_delay", env: "DB_RETRY_MAX_DELAY_MS", def: "1s", set: duration(time.Millisecond, func(c *Config) *time.Duration { return &c.Database.Retry.MaxDelay })},
+
+	{key: "cache.size", env: "CACHE_SIZE", reload: true, set: integer(func(c *Config) *int { return &c.Cache.Size })},
+	{key: "cache.rows", env: "CACHE_ROWS", def: "100000", reload: true, set: integer(func(c *Config) *int { return &c.Cache.Rows })},
+	{key: "cache.ttl", env: "CACHE_TTL", def: "1m", reload: true, set: duration(time.Second, func(c *Config) *time.Duration { return &c.Cache.TTL })},
+
+	{key: "ingest.size", env: "INGEST_SIZE", set: integer(func(c *Config) *int { return &c.Ingest.Size })},
+	{key: "ingest.batch", env: "INGEST_BATCH", set: integer(func(c *Config) *int { return &c.Ingest.Batch })},
+	{key: "ingest.interval", env: "INGEST_INTERVAL_MS", set: duration(time.Millisecond, func(c *Config) *time.Duration { return &c.Ingest.Interval })},
+	{key: "idempotency.ttl", env: "IDEMPOTENCY_TTL", def: "24h", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Idempotency.TTL })},
+	{key: "idempotency.lease", env: "IDEMPOTENCY_LEASE", def: "5m", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Idempotency.Lease })},
+	{key: "webhooks.allow_private", env: "WEBHOOK_ALLOW_PRIVATE", set: boolean(func(c *Config) *bool { return &c.Webhooks.AllowPrivate })},
+	{key: "health.timeout", env: "READY_TIMEOUT_MS", set: duration(time.Millisecond, func(c *Config) *time.Duration { return &c.Health.Timeout })},
+
+	{key: "log.level", env: "LOG_LEVEL", def: "info", reload: true, set: func(c *Config, value string) (err error) {
+		c.Log.Level, err = logging.ParseLevel(value)
+		return err
+	}},
+	{key: "log.format", env: "LOG_FORMAT", def: logging.FormatLogfmt, set: text(func(c *Config) *string { return &c.Log.Format })},
+	{key: "trace.exporter", env: "TRACE_EXPORTER", set: text(func(c *Config) *string { return &c.Trace.Exporter })},
+	{key: "trace.endpoint", env: "OTEL_EXPORTER_OTLP_ENDPOINT", def: "http://localhost:4318", set: text(func(c *Config) *string { return &c.Trace.Endpoint })},
+	{key: "trace.ratio", env: "TRACE_SAMPLE_RATIO", def: "1", set: number(func(c *Config) *float64 { return &c.Trace.Ratio })},
+
+	{key: "auth.enabled", env: "AUTH_ENABLED", set: boolean(func(c *Config) *bool { return &c.Auth.Enabled })},
+	{key: "auth.jwks", env: "AUTH_JWKS", set: text(func(c *Config) *string { return &c.Auth.JWKS })},
+	{key: "auth.jwks_refresh", env: "AUTH_JWKS_REFRESH", def: "5m", set: duration(time.Second, func(c *Config) *time.Duration { return &c.Auth.JWKSRefresh })},
+	{key: "auth.jwt.issuer", env: "AUTH_JWT_ISSUER", set: text(func(c *Config) *string { return &c.Auth.Issuer })},
+	{key: "auth.jwt.audience", env: "AUTH_JWT_AUDIENCE", set: text(func(c *Config) *string { return &c.Auth.Audience })},
+	{key: "auth.jwt.scope_claim", env: "AUTH_JWT_SCOPE_CLAIM", set: text(func(c *Config) *string { return &c.Auth.Mapping.ScopeClaim })},
+	{key: "auth.jwt.tenant_claim", env: "AUTH_JWT_TENANT_CLAIM", set: text(func(c *Config) *string { return &c.Auth.Mapping.TenantClaim })},
+	{key: "auth.jwt.scopes", env: "AUTH_JWT_SCOPES", set: func(c *Config, value string) (err error) {
+		c.Auth.Mapping.Scopes, err = parseScopeMap(value)
+		return err
+	}},
+	{key: "tenant.max_rows", env: "TENANT_MAX_ROWS", set: integer(func(c *Config) *int { return &c.Tenant.MaxRows })},
+
+	{key: "limits.read.rate", env: "RATE_READ", reload: true, set: number(func(c *Config) *float64 { return &c.Limits.Read.Rate })},
+	{key: "limits.read.burst", env: "RATE_READ_BURST", reload: true, set: integer(func(c *Config) *int { return &c.Limits.Read.Burst })},
+	{key: "limits.write.rate", env: "RATE_WRITE", reload: true, set: number(func(c *Config) *float64 { return &c.Limits.Write.Rate })},
+	{key: "limits.write.burst", env: "RATE_WRITE_BURST", reload: true, set: integer(func(c *Config) *int { return &c.Limits.Write.Burst })},
+	{key: "limits.delete.rate", env: "RATE_DELETE", reload: true, set: number(func(c *Config) *float64 { return &c.Limits.Delete.Rate })},
+	{key: "limits.delete.burst", env: "RATE_DELETE_BURST", reload: true, set: integer(func(c *Config) *int { return &c.Limits.Delete.Burst })},
+	{key: "limits.auth.rate", env: "RATE_AUTH", def: "1", reload: true, set: number(func(c *Config) *float64 { return &c.Limits.Auth.Rate })},
+	{key: "limits.auth.burst", env: "RATE_AUTH_BURST", def: "10", reload: true, set: integer(func(c *Config) *int { return &c.Limits.Auth.Burst })},
+	{key: "limits.max_body_bytes", env: "MAX_BODY_BYTES", def: "65536", set: integer64(func(c *Config) *int64 { return &c.Limits.MaxBodyBytes })},
+}
+
+// lookupSetting возвращает настройку по ключу
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// Setting is the effective value of a configuration setting
+type Setting struct {
+	// Key is the dotted key in the config file, Env is the environment variable
+	Key string
+	Env string
+	// Value is the effective value, passwords are redacted
+	Value string
+	// Source is where the value comes from: default, file, env or flag
+	Source string
+	// Reload reports whether a changed value is applied on SIGHUP
+	Reload bool
+}
+
+// Settings returns the effective values of all settings
+func (config Config) Settings() []Setting {
+	result := make([]Setting, 0, len(settings))
+	for _, s := range settings {
+		value := config.values[s.key]
+		switch s.key {
+		case "database.password":
+			if value != "" {
+				value = "******"
+			}
+		case "database.dsn":
+			value = logging.RedactDSN(value)
+		}
+		result = append(result, Setting{Key: s.key, Env: s.env, Value: value, Source: config.sources[s.key], Reload: s.reload})
+	}
+	return result
+}
+
+// ConfigError lists the invalid settings of a configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "web: invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// add добавляет ошибку настройки key
+func (e *ConfigError) add(key string, format string, args ...interface{}) {
+	name := key
+	if s, ok := lookupSetting(key); ok {
+		name = s.env + " (" + key + ")"
+	}
+	*e = append(*e, name+": "+fmt.Sprintf(format, args...))
+}
+
+// setFlags значения -set key=value
+type setFlags []string
+
+func (f *setFlags) String() string { return strings.Join(*f, ",") }
+
+func (f *setFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// NewConfig returns the configuration layered from the defaults, the config
+// file, the environment variables and the flags at the beginning of args:
+// -config FILE (or CONFIG_FILE) and repeated -set key=value. Returns the
+// arguments after the flags. A configuration with invalid settings is returned
+// with a ConfigError listing all of them
+func NewConfig(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("statistics", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON config `file`")
+	var sets setFlags
+	fs.Var(&sets, "set", "override a setting as `key=value`, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	config := &Config{
+		args:    args[:len(args)-fs.NArg()],
+		values:  map[string]string{},
+		sources: map[string]string{},
+	}
+	var errs ConfigError
+	apply := func(key, value, source string) {
+		s, ok := lookupSetting(key)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown setting %q", source, key))
+			return
+		}
+		config.values[key], config.sources[key] = value, source
+		if err := s.set(config, value); err != nil {
+			errs.add(key, "%v", err)
+		}
+	}
+	for _, s := range settings {
+		apply(s.key, s.def, sourceDefault)
+	}
+	if *file != "" {
+		values, err := readConfigFile(*file)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			apply(key, values[key], sourceFile)
+		}
+	}
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			apply(s.key, value, sourceEnv)
+		}
+	}
+	for _, set := range sets {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 {
+			errs = append(errs, fmt.Sprintf("flag: bad -set %q, expected key=value", set))
+			continue
+		}
+		apply(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), sourceFlag)
+	}
+	// без явного значения аутентификация включена для баз данных и SSO
+	if config.sources["auth.enabled"] == sourceDefault {
+		config.Auth.Enabled = config.Database.Driver != "memory" || config.Auth.JWKS != ""
+		config.values["auth.enabled"] = strconv.FormatBool(config.Auth.Enabled)
+	}
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err.(ConfigError)...)
+	}
+	if len(errs) > 0 {
+		return config, fs.Args(), errs
+	}
+	return config, fs.Args(), nil
+}
+
+// readConfigFile читает YAML или JSON файл конфигурации и возвращает
+// значения по ключам через точку. Списки соединяются запятыми, таблицы
+// настроек (auth.jwt.scopes, server.tls.client_subjects) - парами key=value
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("web: config file: %w", err)
+	}
+	var root map[interface{}]interface{}
+	if err := yaml.UnmarshalStrict(data, &root); err != nil {
+		return nil, fmt.Errorf("web: config file %s: %w", path, err)
+	}
+	values := map[string]string{}
+	var flatten func(prefix string, node interface{})
+	flatten = func(prefix string, node interface{}) {
+		m, ok := node.(map[interface{}]interface{})
+		if _, known := lookupSetting(prefix); known || !ok {
+			values[prefix] = configValue(node)
+			return
+		}
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, v)
+		}
+	}
+	flatten("", root)
+	delete(values, "")
+	return values, nil
+}
+
+// configValue возвращает значение узла файла конфигурации строкой
+func configValue(node interface{}) string {
+	switch v := node.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configValue(item)
+		}
+		return strings.Join(items, ",")
+	case map[interface{}]interface{}:
+		items := make([]string, 0, len(v))
+		for key, item := range v {
+			value := configValue(item)
+			if list, ok := item.([]interface{}); ok {
+				// список прав таблицы разделяется пробелами
+				value = strings.Replace(configValue(list), ",", " ", -1)
+			}
+			items = append(items, fmt.Sprint(key)+"="+value)
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(node)
+}
+
+// validPort сообщает, является ли port номером порта TCP
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Validate checks the settings and their combinations,
+// the error is a ConfigError listing every invalid setting
+func (config Config) Validate() error {
+	var errs ConfigError
+	for key, port := range map[string]string{
+		"server.port": config.Server.Port, "server.tls.redirect_port": config.Server.TLS.RedirectPort, "database.port": config.Database.Port,
+	} {
+		if port != "" && !validPort(port) {
+			errs.add(key, "invalid port %q", port)
+		}
+	}
+	tls := config.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		errs.add("server.tls.key", "certificate and key must be set together")
+	}
+	if tls.ClientCA != "" && !tls.Enabled() {
+		errs.add("server.tls.client_ca", "client certificates require TLS certificate and key")
+	}
+	if tls.ClientRequired && tls.ClientCA == "" {
+		errs.add("server.tls.client_required", "required client certificates need a client CA")
+	}
+	if len(tls.ClientSubjects) > 0 && tls.ClientCA == "" {
+		errs.add("server.tls.client_subjects", "client subjects need a client CA")
+	}
+	if tls.RedirectPort != "" && !tls.Enabled() {
+		errs.add("server.tls.redirect_port", "HTTP redirect requires TLS certificate and key")
+	}
+
+	switch config.Database.Driver {
+	case "mysql", "postgres", "sqlite", "memory":
+	default:
+		errs.add("database.driver", "unknown driver %q, expected mysql, postgres, sqlite or memory", config.Database.Driver)
+	}
+	if config.Database.Driver != "memory" && config.Database.ConnectTimeout <= 0 {
+		errs.add("database.connect_timeout", "must be positive")
+	}
+
+	if config.Database.Driver == "sqlite" && config.Database.Pool.MaxOpenConns > 1 {
+		errs.add("database.pool.max_open", "sqlite allows a single connection")
+	}
+	if config.Database.Retry.Attempts < 1 {
+		errs.add("database.retry.attempts", "must be at least 1, 1 disables retries")
+	}
+	if config.Database.Retry.MaxDelay < config.Database.Retry.Delay {
+		errs.add("database.retry.max_delay", "must not be less than the delay")
+	}
+
+	for key, n := range map[string]int{
+		"database.pool.max_open": config.Database.Pool.MaxOpenConns, "database.pool.max_idle": config.Database.Pool.MaxIdleConns,
+		"cache.size": config.Cache.Size, "cache.rows": config.Cache.Rows, "ingest.size": config.Ingest.Size,
+		"ingest.batch": config.Ingest.Batch, "tenant.max_rows": config.Tenant.MaxRows,
+		"limits.read.burst": config.Limits.Read.Burst, "limits.write.burst": config.Limits.Write.Burst,
+		"limits.delete.burst": config.Limits.Delete.Burst, "limits.auth.burst": config.Limits.Auth.Burst,
+	} {
+		if n < 0 {
+			errs.add(key, "must not be negative")
+		}
+	}
+	for key, rate := range map[string]float64{
+		"limits.read.rate": config.Limits.Read.Rate, "limits.write.rate": config.Limits.Write.Rate,
+		"limits.delete.rate": config.Limits.Delete.Rate, "limits.auth.rate": config.Limits.Auth.Rate,
+	} {
+		if rate < 0 {
+			errs.add(key, "must not be negative")
+		}
+	}
+	if config.Cache.Size > 0 && config.Cache.Rows == 0 {
+		errs.add("cache.rows", "must be positive when the cache is enabled")
+	}
+	if config.Cache.Size > 0 && config.Cache.TTL == 0 {
+		errs.add("cache.ttl", "must be positive when the cache is enabled")
+	}
+	if config.Server.Timeout.Server == 0 {
+		errs.add("server.timeout.server", "must be positive")
+	}
+	if config.Idempotency.TTL == 0 {
+		errs.add("idempotency.ttl", "must be positive")
+	}
+	if config.Idempotency.Lease == 0 {
+		errs.add("idempotency.lease", "must be positive")
+	} else if request := config.Server.Timeout.Request; request > 0 && config.Idempotency.Lease <= request {
+		errs.add("idempotency.lease", "must exceed server.timeout.request")
+	}
+
+	if config.Log.Format != logging.FormatLogfmt && config.Log.Format != logging.FormatJSON {
+		errs.add("log.format", "unknown format %q, expected logfmt or json", config.Log.Format)
+	}
+	switch config.Trace.Exporter {
+	case "", "stdout", "otlp":
+	default:
+		errs.add("trace.exporter", "unknown exporter %q, expected stdout or otlp", config.Trace.Exporter)
+	}
+	if config.Trace.Ratio < 0 || config.Trace.Ratio > 1 {
+		errs.add("trace.ratio", "must be between 0 and 1")
+	}
+	if config.Auth.JWKS != "" && config.Auth.JWKSRefresh == 0 {
+		errs.add("auth.jwks_refresh", "must be positive")
+	}
+	// без проверки iss и aud принимались бы токены SSO, выданные другим сервисам
+	if config.Auth.JWKS != "" && config.Auth.Issuer == "" {
+		errs.add("auth.jwt.issuer", "must be set when auth.jwks is set")
+	}
+	if config.Auth.JWKS != "" && config.Auth.Audience == "" {
+		errs.add("auth.jwt.audience", "must be set when auth.jwks is set")
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errs
+	}
+	return nil
+}
+
+// changedSettings возвращает ключи настроек, значения которых
+// в next отличаются от config
+func (config Config) changedSettings(next *Config) []string {
+	var keys []string
+	for _, s := range settings {
+		if config.values[s.key] != next.values[s.key] {
+			keys = append(keys, s.key)
+		}
+	}
+	return keys
+}
+
+// Reload reads the configuration again with the flags it was loaded with
+func (config Config) Reload() (*Config, error) {
+	next, _, err := NewConfig(config.args)
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// applyConfig применяет к работающему сервису изменения настроек next,
+// допускающих применение без перезапуска. Об измененных настройках,
+// требующих перезапуска, пишет предупреждение
+func (w WebserviceHandler) applyConfig(config, next *Config) {
+	changed := config.changedSettings(next)
+	if len(changed) == 0 {
+		logging.Default().Info("Configuration is not changed")
+		return
+	}
+	var restart []string
+	for _, key := range changed {
+		s, _ := lookupSetting(key)
+		if !s.reload || strings.HasPrefix(key, "cache.") && w.Cache == nil {
+			restart = append(restart, key)
+		}
+	}
+	logging.Default().SetLevel(next.Log.Level)
+	limits := next.Limits
+	for _, pair := range []struct {
+		limiter *ratelimit.Limiter
+		limit   ratelimit.Limit
+	}{{w.RateLimits.Read, limits.Read}, {w.RateLimits.Write, limits.Write}, {w.RateLimits.Delete, limits.Delete},
+		{w.RateLimits.Auth, limits.Auth}} {
+		if pair.limiter != nil {
+			pair.limiter.SetLimit(pair.limit)
+		}
+	}
+	if w.Cache != nil {
+		w.Cache.SetLimits(next.Cache.TTL, next.Cache.Size, next.Cache.Rows)
+	}
+	logging.Default().Info("Configuration reloaded", "changed", strings.Join(changed, ","))
+	if len(restart) > 0 {
+		logging.Default().Warn("Changed settings are applied after restart", "settings", strings.Join(restart, ","))
+	}
+}
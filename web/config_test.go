@@ -0,0 +1,196 @@
+package web
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"statistics/pkg/logging"
+	"statistics/pkg/ratelimit"
+	r "statistics/pkg/repository"
+)
+
+// setenv задает переменные окружения на время теста
+func setenv(t *testing.T, kv ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := kv[i]
+		old, had := os.LookupEnv(key)
+		os.Setenv(key, kv[i+1])
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		unit     time.Duration
+		expected time.Duration
+	}{
+		{"", time.Second, 0},
+		{"15", time.Second, 15 * time.Second},
+		{"250", time.Millisecond, 250 * time.Millisecond},
+		{"15s", time.Millisecond, 15 * time.Second},
+		{"1m30s", time.Second, 90 * time.Second},
+	} {
+		if d, err := parseDuration(tc.value, tc.unit); err != nil || d != tc.expected {
+			t.Errorf("parseDuration(%q): got %v, %v; expected %v", tc.value, d, err, tc.expected)
+		}
+	}
+	for _, bad := range []string{"1O", "15 s", "-5s", "-5"} {
+		if _, err := parseDuration(bad, time.Second); err == nil {
+			t.Errorf("parseDuration(%q) accepted", bad)
+		}
+	}
+}
+
+func TestConfigLayers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "statistics.yaml")
+	writeFile(t, file, []byte(`
+server:
+  port: 8080
+  timeout:
+    read: 15s
+    write: 10
+database:
+  driver: memory
+log:
+  level: warn
+auth:
+  jwt:
+    scopes:
+      admins: [admin, "stats:read"]
+limits:
+  read: {rate: 5, burst: 10}
+`))
+	setenv(t, "LOG_LEVEL", "error", "CACHE_SIZE", "256", "PORT", "")
+
+	config, rest, err := NewConfig([]string{"-config", file, "-set", "log.level=debug", "migrate", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 2 || rest[0] != "migrate" {
+		t.Fatalf("got arguments %v", rest)
+	}
+	// флаги важнее окружения, окружение важнее файла, пустые переменные не учитываются
+	if config.Log.Level != logging.LevelDebug || config.Cache.Size != 256 || config.Server.Port != "8080" {
+		t.Fatalf("got level %v, cache %d, port %q", config.Log.Level, config.Cache.Size, config.Server.Port)
+	}
+	if config.Server.Timeout.Read != 15*time.Second || config.Server.Timeout.Write != 10*time.Second || config.Cache.TTL != time.Minute {
+		t.Fatalf("got %+v, cache TTL %v", config.Server.Timeout, config.Cache.TTL)
+	}
+	if config.Limits.Read != (ratelimit.Limit{Rate: 5, Burst: 10}) || len(config.Auth.Mapping.Scopes["admins"]) != 2 {
+		t.Fatalf("got %+v, %v", config.Limits.Read, config.Auth.Mapping.Scopes)
+	}
+	// без AUTH_ENABLED аутентификация выключена для памяти без SSO
+	if config.Auth.Enabled {
+		t.Fatal("expected authentication disabled for memory driver")
+	}
+
+	sources := map[string]string{}
+	for _, s := range config.Settings() {
+		sources[s.Key] = s.Source
+	}
+	if sources["log.level"] != sourceFlag || sources["cache.size"] != sourceEnv || sources["server.port"] != sourceFile || sources["cache.ttl"] != sourceDefault {
+		t.Fatalf("got sources %v", sources)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "statistics.yaml")
+	writeFile(t, file, []byte("server:\n  prot: 8080\nlog:\n  format: xml\n"))
+	setenv(t, "READ", "1O", "CACHE_SIZE", "-1", "MYSQL_PASSWORD", "secret")
+
+	config, _, err := NewConfig([]string{"-config", file, "-set", "trace.ratio=2", "-set", "server.tls.cert=cert.pem",
+		"-set", "auth.jwks=jwks.json", "-set", "auth.jwt.issuer=https://sso.example.com"})
+	invalid, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("got %v; expected ConfigError", err)
+	}
+	for _, expected := range []string{
+		`READ (server.timeout.read): invalid duration "1O"`,
+		`file: unknown setting "server.prot"`,
+		`LOG_FORMAT (log.format): unknown format "xml"`,
+		`CACHE_SIZE (cache.size): must not be negative`,
+		`TRACE_SAMPLE_RATIO (trace.ratio): must be between 0 and 1`,
+		`TLS_KEY (server.tls.key): certificate and key must be set together`,
+		`AUTH_JWT_AUDIENCE (auth.jwt.audience): must be set when auth.jwks is set`,
+	} {
+		if !strings.Contains(invalid.Error(), expected) {
+			t.Errorf("%q is not reported in:\n%v", expected, invalid)
+		}
+	}
+	if strings.Contains(invalid.Error(), "auth.jwt.issuer") {
+		t.Errorf("issuer is set, but reported in:\n%v", invalid)
+	}
+	// недопустимая конфигурация возвращается для config check без секретов
+	for _, s := range config.Settings() {
+		if s.Key == "database.password" && s.Value != "******" {
+			t.Fatalf("got password %q", s.Value)
+		}
+	}
+
+	writeFile(t, file, []byte("log: {level: [\n"))
+	if _, _, err := NewConfig([]string{"-config", file}); err == nil {
+		t.Fatal("expected error of malformed file")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "statistics.yaml")
+	writeFile(t, file, []byte("database: {driver: memory}\ncache: {size: 10}\n"))
+	config, _, err := NewConfig([]string{"-config", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logging.Default()
+	defer logging.SetDefault(logger)
+	out := &strings.Builder{}
+	l, _ := logging.New(out, logging.LevelInfo, logging.FormatLogfmt)
+	logging.SetDefault(l)
+
+	cache := r.NewCachedStats(r.NewMemoryDB(), time.Minute, 10, 100)
+	w := WebserviceHandler{Cache: cache, RateLimits: config.Limits.NewRateLimits()}
+	writeFile(t, file, []byte(`
+database: {driver: memory}
+server: {port: 9090}
+log: {level: debug}
+cache: {size: 1}
+limits: {delete: {rate: 2, burst: 4}}
+`))
+	next, err := config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.applyConfig(config, next)
+	if !l.Enabled(logging.LevelDebug) || w.RateLimits.Delete.Limit() != (ratelimit.Limit{Rate: 2, Burst: 4}) {
+		t.Fatalf("got debug %v, delete limit %+v", l.Enabled(logging.LevelDebug), w.RateLimits.Delete.Limit())
+	}
+	if !strings.Contains(out.String(), `msg="Changed settings are applied after restart" settings=server.port`) {
+		t.Fatalf("got log %s", out.String())
+	}
+}
+
+func TestConnStringOptions(t *testing.T) {
+	for _, tc := range []struct {
+		db       Database
+		expected string
+	}{
+		{Database{Driver: "mysql", User: "u", Password: "p", Host: "db", Port: "3306", Dbname: "stats", Options: "timeout=5s"},
+			"u:p@tcp(db:3306)/stats?charset=utf8&parseTime=True&loc=Local&timeout=5s"},
+		{Database{Driver: "sqlite", Options: "?_busy_timeout=5000"}, "statistics.db?_busy_timeout=5000"},
+		{Database{Driver: "postgres", DSN: "postgres://db/stats"}, "postgres://db/stats"},
+	} {
+		if dsn := tc.db.ConnString(); dsn != tc.expected {
+			t.Errorf("got %q; expected %q", dsn, tc.expected)
+		}
+	}
+}
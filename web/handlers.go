@@ -1,18 +1,27 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
 
 	"net/http"
+	"statistics/pkg/ingest"
+	"statistics/pkg/logging"
 	r "statistics/pkg/repository"
+	"statistics/pkg/stream"
+	"statistics/pkg/tracing"
 	uc "statistics/pkg/usecases"
 	"statistics/pkg/validation"
+	"statistics/pkg/webhook"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 )
 
@@ -32,28 +41,126 @@ func toData(data validation.InputStat) r.Data {
 // WebserviceHandler is ...
 type WebserviceHandler struct {
 	Rep r.StatsRepository
+	// Cache кэш периодов статистики, обернутый в Rep, может быть nil
+	Cache    *r.CachedStats
+	Budgets  r.BudgetRepository
+	Webhooks r.WebhookRepository
+	// Notifier получатель событий сценариев, может быть nil
+	Notifier uc.Notifier
+	// Dispatcher доставляет события подписчикам, запускается в Run
+	Dispatcher *webhook.Dispatcher
+	// WebhookPolicy допустимые адреса получателей событий
+	WebhookPolicy uc.TargetPolicy
+	// Broker рассылает изменения статистики в поток /stats/stream
+	Broker *stream.Broker
+	// Heartbeat период комментариев в потоке, по умолчанию 15 секунд
+	Heartbeat time.Duration
+	// StreamTimeout максимальная длительность одного соединения потока
+	StreamTimeout time.Duration
+	// RequestTimeout срок обработки запроса, по истечении которого
+	// запросы к базе прерываются, 0 - без ограничения
+	RequestTimeout time.Duration
+	// Buffer буфер отложенной записи POST /stats, nil - запись сразу.
+	// Запускается в Run
+	Buffer *ingest.Buffer
+	// Idempotency хранилище ключей идемпотентности, nil - заголовок
+	// Idempotency-Key не обрабатывается
+	Idempotency r.IdempotencyRepository
+	// IdempotencyTTL время хранения ключа идемпотентности
+	IdempotencyTTL time.Duration
+	// IdempotencyLease время резервирования ключа обрабатываемого запроса,
+	// 0 - до истечения IdempotencyTTL
+	IdempotencyLease time.Duration
+	// Metrics метрики сервиса, nil - метрики не собираются
+	Metrics *Metrics
+	// DB соединения с базой, закрываются после остановки Run, может быть nil
+	DB io.Closer
+	// Checks проверки готовности для /readyz
+	Checks []Check
+	// ReadyTimeout срок проверок готовности, по умолчанию 2 секунды
+	ReadyTimeout time.Duration
+	// Tracer трассировка запросов, nil - трассировка выключена
+	Tracer *tracing.Tracer
+	// APIKeys хранилище ключей API и журнала аудита,
+	// nil - запросы выполняются без ключа
+	APIKeys r.APIKeyRepository
+	// Tokens проверка токенов SSO в Authorization: Bearer,
+	// nil - принимаются только ключи API
+	Tokens uc.TokenValidator
+	// TokenMapping сопоставление утверждений токена правам и арендатору
+	TokenMapping uc.TokenMapping
+	// ClientCerts ключи клиентов по имени сертификата mTLS,
+	// nil - сертификаты клиентов не дают доступа
+	ClientCerts map[string]r.APIKey
+	// RateLimits ограничения частоты запросов клиентов
+	RateLimits RateLimits
+	// MaxBodyBytes наибольший размер тела запроса, 0 - без ограничения
+	MaxBodyBytes int64
+}
+
+// notifiers возвращает получателей событий для передачи в сценарии
+func (h *WebserviceHandler) notifiers() []uc.Notifier {
+	if h.Notifier == nil {
+		return nil
+	}
+	return []uc.Notifier{h.Notifier}
+}
+
+// routeParams сопоставляет маршруту ("МЕТОД шаблон") структуру
+// для валидации его параметров. Запросы к маршрутам без записи отклоняются
+var routeParams = map[string]func() interface{}{
+	"POST /stats":         func() interface{} { return &validation.InputStat{} },
+	"GET /stats":          func() interface{} { return &validation.Range{} },
+	"DELETE /stats":       func() interface{} { return &validation.Empty{} },
+	"GET /stats/forecast": func() interface{} { return &validation.Forecast{} },
+	"GET /stats/stream":   func() interface{} { return &validation.StreamRange{} },
+	"GET /stats/cache":    func() interface{} { return &validation.Empty{} },
+	"GET /metrics":        func() interface{} { return &validation.Empty{} },
+	"GET /healthz":        func() interface{} { return &validation.Empty{} },
+	"GET /readyz":         func() interface{} { return &validation.Empty{} },
+	"GET /openapi.json":   func() interface{} { return &validation.Empty{} },
+	"GET /docs":           func() interface{} { return &validation.Empty{} },
+
+	"POST /budgets":                   func() interface{} { return &validation.InputBudget{} },
+	"GET /budgets":                    func() interface{} { return &validation.Empty{} },
+	"GET /budgets/{id:[0-9]+}":        func() interface{} { return &validation.Empty{} },
+	"PUT /budgets/{id:[0-9]+}":        func() interface{} { return &validation.InputBudget{} },
+	"DELETE /budgets/{id:[0-9]+}":     func() interface{} { return &validation.Empty{} },
+	"GET /budgets/{id:[0-9]+}/status": func() interface{} { return &validation.BudgetDate{} },
+	"GET /alerts":                     func() interface{} { return &validation.Empty{} },
+
+	"POST /webhooks":                       func() interface{} { return &validation.InputWebhook{} },
+	"GET /webhooks":                        func() interface{} { return &validation.Empty{} },
+	"GET /webhooks/{id:[0-9]+}":            func() interface{} { return &validation.Empty{} },
+	"DELETE /webhooks/{id:[0-9]+}":         func() interface{} { return &validation.Empty{} },
+	"GET /webhooks/{id:[0-9]+}/deliveries": func() interface{} { return &validation.Empty{} },
+
+	"POST /apikeys":               func() interface{} { return &validation.InputAPIKey{} },
+	"GET /apikeys":                func() interface{} { return &validation.Empty{} },
+	"DELETE /apikeys/{id:[0-9]+}": func() interface{} { return &validation.Empty{} },
+	"GET /audit":                  func() interface{} { return &validation.Empty{} },
 }
 
 // ValidationMiddleware прослойка валидации входных параметров
 // Исполняется до основного обрабочика
 func (h *WebserviceHandler) ValidationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl, _ := mux.CurrentRoute(r).GetPathTemplate()
+		newParams, ok := routeParams[r.Method+" "+tmpl]
+		if !ok {
+			logging.Error(r.Context(), "ValidationMiddleware: route has no parameters to validate", "route", r.Method+" "+tmpl)
+			http.Error(w, "ValidationMiddleware: route is not validated", http.StatusInternalServerError)
+			return
+		}
 		decoder := schema.NewDecoder()
-		var params interface{}
+		params := newParams()
 		var err error
 		switch r.Method {
-		case http.MethodPost:
-			params = &validation.InputStat{}
+		case http.MethodPost, http.MethodPut:
 			r.ParseForm()
 			err = decoder.Decode(params, r.PostForm)
-		case http.MethodGet:
-			params = &validation.Range{}
+		default:
 			err = decoder.Decode(params, r.URL.Query())
-		case http.MethodDelete:
-			params := r.URL.Query()
-			if len(params) != 0 {
-				err = errors.New("ValidationMiddleware: query isn't empty")
-			}
 		}
 		if err != nil {
 			http.Error(w, "ValidationMiddleware: bad keys in request", http.StatusBadRequest)
@@ -68,56 +175,141 @@ func (h *WebserviceHandler) ValidationMiddleware(next http.Handler) http.Handler
 	})
 }
 
+// TimeoutMiddleware ограничивает обработку запроса сроком RequestTimeout.
+// Поток событий ограничивается отдельно StreamTimeout
+func (h *WebserviceHandler) TimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl, _ := mux.CurrentRoute(r).GetPathTemplate()
+		if h.RequestTimeout <= 0 || tmpl == "/stats/stream" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), h.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CacheControlMiddleware читает данные в обход кэша для запросов
+// с заголовком Cache-Control: no-cache
+func (h *WebserviceHandler) CacheControlMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-cache") {
+			req = req.WithContext(r.WithoutCache(req.Context()))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
 // PostStats обработчик POST запроса. Запускает сценарий AddStat
-func (h *WebserviceHandler) PostStats(w http.ResponseWriter, r *http.Request) {
-	log.Println("POST request")
-	r.ParseForm()
+func (h *WebserviceHandler) PostStats(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
 	msg := &validation.InputStat{}
 	decoder := schema.NewDecoder()
-	decoder.Decode(msg, r.PostForm)
+	decoder.Decode(msg, req.PostForm)
 	data := toData(*msg)
-	if err := uc.AddStat(data, h.Rep); err != nil {
-		log.Println("PostStats: ", err, data)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	if h.Buffer != nil {
+		h.enqueueStat(w, req, data)
+		return
+	}
+	if err := uc.AddStat(req.Context(), data, h.Rep, h.notifiers()...); err != nil {
+		if err == r.ErrQuotaExceeded {
+			h.Metrics.ingest(data, ingestRejected)
+		} else {
+			h.Metrics.ingest(data, ingestFailed)
+		}
+		writeError(w, req, "PostStats", err)
 		return
 	}
+	h.Metrics.ingest(data, ingestStored)
+	// статистика уже сохранена, ошибка проверки бюджетов не влияет на ответ
+	if _, err := uc.CheckBudgets(req.Context(), data.Date, h.Rep, h.Budgets, h.notifiers()...); err != nil {
+		logging.Error(req.Context(), "PostStats. CheckBudgets", "err", err)
+	}
+}
+
+// enqueueStat ставит приращение в буфер записи и отвечает 202.
+// Заполненный буфер отвечает 429 с Retry-After до следующей записи пакета
+func (h *WebserviceHandler) enqueueStat(w http.ResponseWriter, req *http.Request, data r.Data) {
+	if err := h.Buffer.Add(req.Context(), data); err != nil {
+		h.Metrics.ingest(data, ingestRejected)
+		retry := int(math.Ceil(h.Buffer.Interval.Seconds()))
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+	h.Metrics.ingest(data, ingestBuffered)
+	w.WriteHeader(http.StatusAccepted)
 }
 
 // GetStats обработчик GET запроса. Запускает сценарий GetStatWithinFromAndTo
 // Возвращает полученные данные в формате JSON
 func (h *WebserviceHandler) GetStats(w http.ResponseWriter, r *http.Request) {
-	log.Println("GET request")
 	msg := &validation.Range{}
 	decoder := schema.NewDecoder()
 	err := decoder.Decode(msg, r.URL.Query())
 
-	data, err := uc.GetStatWithinFromAndTo(msg.From, msg.To, msg.OrderBy, h.Rep)
+	data, err := uc.GetStatWithinFromAndTo(r.Context(), msg.From, msg.To, msg.OrderBy, msg.Granularity, h.Rep)
+	if err != nil {
+		writeError(w, r, "GetStats", err)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	_, span := tracing.Start(r.Context(), "json.Marshal", "rows", len(data))
+	result, err := json.Marshal(data)
+	span.RecordError(err)
+	span.Finish()
 	if err != nil {
-		log.Println("GetStats: ", err, data)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	logging.Debug(r.Context(), "GetStats returned", "body", string(result))
+	fmt.Fprintln(w, string(result))
+}
+
+// GetForecast обработчик GET запроса прогноза. Запускает сценарий ForecastStat
+// Возвращает прогноз в формате JSON
+func (h *WebserviceHandler) GetForecast(w http.ResponseWriter, r *http.Request) {
+	msg := &validation.Forecast{}
+	decoder := schema.NewDecoder()
+	decoder.Decode(msg, r.URL.Query())
+	horizon, _ := strconv.Atoi(msg.Horizon)
+
+	data, err := uc.ForecastStat(r.Context(), msg.From, msg.To, horizon, h.Rep)
+	if err != nil {
+		writeError(w, r, "GetForecast", err)
+		return
+	}
 	w.Header().Set("Content-type", "application/json")
 	result, err := json.Marshal(data)
 	if err != nil {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
-	log.Println("GetStats returned: ", string(result))
 	fmt.Fprintln(w, string(result))
 }
 
 // ClearStats обработчик DELETE запроса. Запускает сценарий ClearRepository
 func (h *WebserviceHandler) ClearStats(w http.ResponseWriter, r *http.Request) {
-	log.Println("DELETE request")
-	result, err := uc.ClearRepository(h.Rep)
+	result, err := uc.ClearRepository(r.Context(), h.Rep, h.notifiers()...)
 	if err != nil {
-		log.Println("ClearStats: ", err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		writeError(w, r, "ClearStats", err)
 		return
 	}
 	w.Header().Set("Content-type", "application/json")
 	resp := `{"affected": "` + strconv.Itoa(result) + `"}`
-	log.Println("ClearStats returned: ", resp)
+	logging.Debug(r.Context(), "ClearStats returned", "body", resp)
 	fmt.Fprintln(w, resp)
 }
+
+// GetCacheStats обработчик GET запроса счетчиков кэша статистики
+func (h *WebserviceHandler) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	if h.Cache == nil {
+		http.Error(w, "Cache is disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, h.Cache.Stats())
+}
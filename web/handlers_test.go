@@ -0,0 +1,1057 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"statistics/pkg/ingest"
+	"statistics/pkg/jwt"
+	"statistics/pkg/logging"
+	"statistics/pkg/metrics"
+	"statistics/pkg/ratelimit"
+	r "statistics/pkg/repository"
+	"statistics/pkg/tracing"
+	uc "statistics/pkg/usecases"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestServer запускает сервис поверх репозитория в памяти
+func newTestServer(t *testing.T) *httptest.Server {
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postForm(t *testing.T, target string, values url.Values) *http.Response {
+	resp, err := http.PostForm(target, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func getJSON(t *testing.T, target string, data interface{}) *http.Response {
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && data != nil {
+		if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+func TestStatsHandlers(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, values := range []url.Values{
+		{"date": {"2021-01-01"}, "views": {"100"}, "clicks": {"10"}, "cost": {"5.50"}},
+		{"date": {"2021-01-01"}, "views": {"50"}, "clicks": {"5"}, "cost": {"10"}},
+		{"date": {"2021-01-02"}, "views": {"10"}},
+	} {
+		if resp := postForm(t, srv.URL+"/stats", values); resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /stats %v: got status %d", values, resp.StatusCode)
+		}
+	}
+
+	data := []uc.OutputData{}
+	// сортировка по дате - от новых к старым
+	resp := getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31&orderby=date", &data)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stats: got status %d", resp.StatusCode)
+	}
+	if len(data) != 2 || data[1].Date != "2021-01-01" || data[1].Views != 150 ||
+		data[1].Clicks != 15 || data[1].Cost != 10 {
+		t.Fatalf("GET /stats: got %+v", data)
+	}
+
+	// суммы по месяцам, date - первое число месяца
+	resp = getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31&granularity=month", &data)
+	if resp.StatusCode != http.StatusOK || len(data) != 1 || data[0].Date != "2021-01-01" || data[0].Views != 160 {
+		t.Fatalf("GET /stats by month: got status %d and %+v", resp.StatusCode, data)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/stats", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	affected := map[string]string{}
+	json.NewDecoder(resp.Body).Decode(&affected)
+	if affected["affected"] != "2" {
+		t.Fatalf("DELETE /stats: got %v; expected 2 affected", affected)
+	}
+	if getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", &data); len(data) != 0 {
+		t.Fatalf("GET /stats after delete: got %+v", data)
+	}
+}
+
+func TestStatsHandlersValidation(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, values := range []url.Values{
+		{"date": {"2021-13-01"}},
+		{"date": {"2021-01-01"}, "views": {"many"}},
+		{"date": {"2021-01-01"}, "unknown": {"1"}},
+	} {
+		if resp := postForm(t, srv.URL+"/stats", values); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("POST /stats %v: got status %d; expected %d", values, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	for _, query := range []string{
+		"from=2021-02-01&to=2021-01-01", "from=2021-01-01", "from=2021-01-01&to=2021-01-31&granularity=year",
+	} {
+		if resp := getJSON(t, srv.URL+"/stats?"+query, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("GET /stats?%s: got status %d; expected %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	// история прогноза ограничена, чтобы запрос не читал всю таблицу
+	if resp := getJSON(t, srv.URL+"/stats/forecast?from=0001-01-01&to=2021-01-31", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET /stats/forecast over %d days: got status %d; expected %d", uc.MaxForecastHistory, resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestRoutesAreValidated(t *testing.T) {
+	router := NewRouter(WebserviceHandler{})
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			if _, ok := routeParams[method+" "+tmpl]; !ok {
+				t.Errorf("%s %s has no entry in routeParams", method, tmpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// маршрут без записи отклоняется, а не пропускается без валидации
+	router.HandleFunc("/unvalidated", func(w http.ResponseWriter, req *http.Request) {
+		t.Fatal("unvalidated route is served")
+	}).Methods("GET")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unvalidated?from=x", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d; expected %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestBudgetHandlers(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.PostForm(srv.URL+"/budgets",
+		url.Values{"name": {"january"}, "amount": {"310"}, "period": {"month"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := uc.OutputBudget{}
+	json.NewDecoder(resp.Body).Decode(&budget)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || budget.ID == 0 || budget.Amount != 310 {
+		t.Fatalf("POST /budgets: got status %d, %+v", resp.StatusCode, budget)
+	}
+	// статистика без измерений, бюджет на кампанию не создается
+	resp = postForm(t, srv.URL+"/budgets",
+		url.Values{"name": {"campaign"}, "amount": {"310"}, "period": {"month"}, "scope": {"campaign=1"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("POST /budgets with scope: got status %d; expected %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// 100 рублей за первый день месяца при бюджете 10 рублей в день
+	postForm(t, srv.URL+"/stats", url.Values{"date": {"2021-01-01"}, "cost": {"100"}})
+	alerts := []uc.OutputAlert{}
+	if getJSON(t, srv.URL+"/alerts", &alerts); len(alerts) != 1 || alerts[0].BudgetID != budget.ID {
+		t.Fatalf("GET /alerts: got %+v; expected alert of budget %d", alerts, budget.ID)
+	}
+
+	id := srv.URL + "/budgets/" + strconv.FormatInt(budget.ID, 10)
+	req, _ := http.NewRequest(http.MethodDelete, id, nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp = getJSON(t, id, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET deleted budget: got status %d; expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// slowStats заглушка базы, отвечающая только после отмены запроса
+// ошибкой драйвера, а не ошибкой контекста
+type slowStats struct {
+	*r.MemoryDB
+}
+
+func (s slowStats) FindByPeriodDate(ctx context.Context, from, to string) ([]r.Data, error) {
+	<-ctx.Done()
+	return nil, errors.New("driver: query interrupted")
+}
+
+func (s slowStats) FindByPeriodGranularity(ctx context.Context, from, to, granularity string) ([]r.Data, error) {
+	return s.FindByPeriodDate(ctx, from, to)
+}
+
+func TestRequestDeadline(t *testing.T) {
+	h := WebserviceHandler{Rep: slowStats{r.NewMemoryDB()}, RequestTimeout: 20 * time.Millisecond}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	resp := getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", nil)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("got status %d; expected %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestRequestCanceled(t *testing.T) {
+	h := WebserviceHandler{Rep: slowStats{r.NewMemoryDB()}}
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/stats?from=2021-01-01&to=2021-01-31", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	go cancel()
+	NewRouter(h).ServeHTTP(rec, req)
+	if rec.Code != statusClientClosedRequest {
+		t.Fatalf("got status %d; expected %d", rec.Code, statusClientClosedRequest)
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	rep := r.NewMemoryDB()
+	cache := r.NewCachedStats(rep, time.Minute, 10, 100)
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: cache, Cache: cache, Budgets: rep}))
+	defer srv.Close()
+	target := srv.URL + "/stats?from=2021-01-01&to=2021-01-31"
+
+	getJSON(t, target, nil)
+	postForm(t, srv.URL+"/stats", url.Values{"date": {"2021-01-02"}, "views": {"10"}})
+	data := []uc.OutputData{}
+	if getJSON(t, target, &data); len(data) != 1 {
+		t.Fatalf("GET /stats after POST: got %+v; expected new row", data)
+	}
+	getJSON(t, target, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	stats := r.CacheStats{}
+	if getJSON(t, srv.URL+"/stats/cache", &stats); stats.Hits != 1 || stats.Misses != 3 {
+		t.Fatalf("GET /stats/cache: got %+v; expected 1 hit and 3 misses", stats)
+	}
+}
+
+func TestBufferedStats(t *testing.T) {
+	rep := r.NewMemoryDB()
+	buffer := ingest.NewBuffer(rep, 1)
+	buffer.Interval = 2500 * time.Millisecond
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Buffer: buffer}))
+	defer srv.Close()
+
+	if resp := postForm(t, srv.URL+"/stats", url.Values{"date": {"2021-01-01"}, "views": {"1"}}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d; expected %d", resp.StatusCode, http.StatusAccepted)
+	}
+	// та же дата объединяется, новая не помещается в буфер
+	if resp := postForm(t, srv.URL+"/stats", url.Values{"date": {"2021-01-01"}, "views": {"2"}}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d; expected %d", resp.StatusCode, http.StatusAccepted)
+	}
+	resp := postForm(t, srv.URL+"/stats", url.Values{"date": {"2021-01-02"}})
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3" {
+		t.Fatalf("got status %d, Retry-After %q; expected %d, 3",
+			resp.StatusCode, resp.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	if err := buffer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data := []uc.OutputData{}
+	if getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", &data); len(data) != 1 || data[0].Views != 3 {
+		t.Fatalf("got %+v; expected one row with 3 views", data)
+	}
+}
+
+func postWithKey(t *testing.T, target, key string, values url.Values) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, target, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(HeaderIdempotencyKey, key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	rep := r.NewMemoryDB()
+	h := WebserviceHandler{Rep: rep, Budgets: rep, Idempotency: rep, IdempotencyTTL: time.Hour}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	values := url.Values{"date": {"2021-01-01"}, "views": {"10"}}
+	for i := 0; i < 2; i++ {
+		resp := postWithKey(t, srv.URL+"/stats", "k1", values)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("attempt %d: got status %d", i, resp.StatusCode)
+		}
+		if replayed := resp.Header.Get(HeaderIdempotentReplay) == "true"; replayed != (i == 1) {
+			t.Fatalf("attempt %d: got replayed %v", i, replayed)
+		}
+	}
+	if got, _ := rep.FindByDate(context.Background(), "2021-01-01"); got.Views != 10 {
+		t.Fatalf("got %d views; expected retried request counted once", got.Views)
+	}
+
+	// тот же ключ с другими параметрами
+	resp := postWithKey(t, srv.URL+"/stats", "k1", url.Values{"date": {"2021-01-01"}, "views": {"11"}})
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("key reuse: got status %d; expected %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	// ответ с ошибкой валидации сохраняется, ключ другого маршрута не учитывается
+	if resp = postWithKey(t, srv.URL+"/stats", "k2", url.Values{"date": {"bad"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad request: got status %d", resp.StatusCode)
+	}
+	if resp = postWithKey(t, srv.URL+"/budgets", "k1", url.Values{"name": {"b"}, "amount": {"1"}, "period": {"day"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /budgets with key: got status %d", resp.StatusCode)
+	}
+}
+
+// failingStats заглушка базы, отклоняющая запись статистики
+type failingStats struct {
+	*r.MemoryDB
+}
+
+func (f failingStats) Storage(ctx context.Context, data r.Data) error {
+	return errors.New("storage failed")
+}
+
+// Batch выполняет fn над заглушкой, а не над MemoryDB
+func (f failingStats) Batch(ctx context.Context, fn func(rep r.StatsRepository) error) error {
+	return fn(f)
+}
+
+func TestIdempotencyKeyRetryAfterError(t *testing.T) {
+	rep := r.NewMemoryDB()
+	h := WebserviceHandler{Rep: failingStats{rep}, Budgets: rep, Idempotency: rep, IdempotencyTTL: time.Hour}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	values := url.Values{"date": {"2021-01-01"}, "views": {"10"}}
+	if resp := postWithKey(t, srv.URL+"/stats", "k", values); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got status %d; expected %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	// ошибка сервера не сохраняется: повтор выполняется заново
+	h.Rep = rep
+	srv.Config.Handler = NewRouter(h)
+	resp := postWithKey(t, srv.URL+"/stats", "k", values)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(HeaderIdempotentReplay) != "" {
+		t.Fatalf("retry: got status %d, replayed %q", resp.StatusCode, resp.Header.Get(HeaderIdempotentReplay))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rep := r.NewMemoryDB()
+	reg := metrics.NewRegistry()
+	h := WebserviceHandler{Rep: r.NewMeteredStats(rep, reg), Budgets: rep, Metrics: NewMetrics(reg)}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	postForm(t, srv.URL+"/stats", url.Values{"date": {"2021-01-01"}, "views": {"10"}, "clicks": {"2"}})
+	postForm(t, srv.URL+"/stats", url.Values{"date": {"bad"}})
+	getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", nil)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("got content type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`statistics_http_requests_total{route="/stats",method="POST",status="200"} 1`,
+		`statistics_http_requests_total{route="/stats",method="POST",status="400"} 1`,
+		`statistics_http_requests_total{route="/stats",method="GET",status="200"} 1`,
+		`statistics_http_request_duration_seconds_count{route="/stats",method="GET",status="200"} 1`,
+		`statistics_repository_duration_seconds_count{method="Storage"} 1`,
+		`statistics_ingested_total{metric="views"} 10`,
+		`statistics_ingested_total{metric="clicks"} 2`,
+		`statistics_ingest_requests_total{result="stored"} 1`,
+		`statistics_build_info{version="dev",goversion="` + runtime.Version() + `"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics have no line %s", line)
+		}
+	}
+}
+
+func getReadiness(t *testing.T, target string) (int, Readiness) {
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ready := Readiness{}
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ready
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	sdb, err := r.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.DB.Close()
+	buffer := ingest.NewBuffer(sdb, 1)
+	h := WebserviceHandler{
+		Rep:    sdb,
+		Buffer: buffer,
+		Checks: []Check{DatabaseCheck(sdb), MigrationsCheck(sdb), BufferCheck(buffer)},
+	}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	if resp := getJSON(t, srv.URL+"/healthz", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz: got status %d", resp.StatusCode)
+	}
+
+	// схема не создана
+	status, ready := getReadiness(t, srv.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || ready.Status != statusFail ||
+		ready.Components["database"].Status != statusOK || ready.Components["migrations"].Status != statusFail {
+		t.Fatalf("before migrations: got %d %+v", status, ready)
+	}
+
+	if _, err := sdb.Migrate(context.Background(), r.LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	status, ready = getReadiness(t, srv.URL+"/readyz")
+	if status != http.StatusOK || ready.Status != statusOK || len(ready.Components) != 3 {
+		t.Fatalf("after migrations: got %d %+v", status, ready)
+	}
+
+	if err := buffer.Add(context.Background(), r.Data{Date: "2021-01-01", Views: 1}); err != nil {
+		t.Fatal(err)
+	}
+	status, ready = getReadiness(t, srv.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || ready.Components["ingest"].Status != statusFail {
+		t.Fatalf("full buffer: got %d %+v", status, ready)
+	}
+
+	buffer.Flush(context.Background())
+	sdb.DB.Close()
+	status, ready = getReadiness(t, srv.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || ready.Components["database"].Status != statusFail ||
+		ready.Components["ingest"].Status != statusOK {
+		t.Fatalf("closed database: got %d %+v", status, ready)
+	}
+}
+
+func TestWaitForDB(t *testing.T) {
+	sdb, err := r.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForDB(context.Background(), sdb, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sdb.DB.Close()
+	start := time.Now()
+	if err := waitForDB(context.Background(), sdb, 100*time.Millisecond); err == nil {
+		t.Fatal("expected error for closed database")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waitForDB took %s with 100ms timeout", elapsed)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger, err := logging.New(out, logging.LevelInfo, logging.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logging.SetDefault(logging.Default())
+	logging.SetDefault(logger)
+	srv := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", nil)
+	req.Header.Set(HeaderRequestID, "client-id-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(HeaderRequestID) != "client-id-1" {
+		t.Fatalf("got request id %q; expected client-id-1", resp.Header.Get(HeaderRequestID))
+	}
+	// недопустимый идентификатор заменяется случайным
+	req.Header.Set(HeaderRequestID, "bad id")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(HeaderRequestID); len(id) != 32 {
+		t.Fatalf("got request id %q; expected a generated one", id)
+	}
+
+	records := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(records) != 2 {
+		t.Fatalf("got %d records; expected 2 access log records without bodies:\n%s", len(records), out.String())
+	}
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(records[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "http request" || record["request_id"] != "client-id-1" || record["route"] != "/stats" ||
+		record["status"] != 200.0 || record["method"] != "GET" {
+		t.Fatalf("got access log record %v", record)
+	}
+
+	// тела ответов пишутся только на уровне debug
+	debug, _ := logging.New(out, logging.LevelDebug, logging.FormatJSON)
+	logging.SetDefault(debug)
+	out.Reset()
+	getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", nil)
+	if !strings.Contains(out.String(), `"msg":"GetStats returned"`) {
+		t.Fatalf("debug log has no response body:\n%s", out.String())
+	}
+}
+
+// spanRecorder экспортер, сохраняющий span в памяти
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (s *spanRecorder) ExportSpan(span *tracing.Span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, span)
+}
+
+func TestTracing(t *testing.T) {
+	sdb, err := r.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.DB.Close()
+	if _, err := sdb.Migrate(context.Background(), r.LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	spans := &spanRecorder{}
+	h := WebserviceHandler{Rep: r.NewTracedStats(sdb), Budgets: sdb, Tracer: tracing.NewTracer(spans)}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", nil)
+	req.Header.Set(HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	byName := map[string]*tracing.Span{}
+	for _, span := range spans.spans {
+		if span.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %s does not continue the incoming trace", span.Name)
+		}
+		byName[span.Name] = span
+	}
+	// span и их родители
+	for name, parent := range map[string]string{
+		"GET /stats":                              "",
+		"usecases.GetStatWithinFromAndTo":         "GET /stats",
+		"StatsRepository.FindByPeriodGranularity": "usecases.GetStatWithinFromAndTo",
+		"SELECT stat":                             "StatsRepository.FindByPeriodGranularity",
+		"usecases.By":                             "usecases.GetStatWithinFromAndTo",
+		"json.Marshal":                            "GET /stats",
+	} {
+		span, ok := byName[name]
+		if !ok {
+			t.Errorf("no span %s, got %d spans", name, len(spans.spans))
+			continue
+		}
+		expected := "00f067aa0ba902b7"
+		if parent != "" && byName[parent] != nil {
+			expected = byName[parent].Context.SpanID.String()
+		}
+		if span.Parent.String() != expected {
+			t.Errorf("span %s has parent %s; expected %s", name, span.Parent, parent)
+		}
+	}
+	if root := byName["GET /stats"]; root == nil || root.Kind != tracing.KindServer {
+		t.Fatalf("got root span %+v", root)
+	}
+}
+
+func doWithKey(t *testing.T, method, target, key string, values url.Values) *http.Response {
+	req, err := http.NewRequest(method, target, strings.NewReader(values.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep, APIKeys: rep}))
+	defer srv.Close()
+	admin, _ := uc.CreateAPIKey(ctx, "admin", []string{uc.ScopeAdmin}, rep)
+	reader, _ := uc.CreateAPIKey(ctx, "reader", []string{uc.ScopeStatsRead}, rep)
+	stats := srv.URL + "/stats?from=2021-01-01&to=2021-01-31"
+
+	for _, tc := range []struct {
+		method, target, key string
+		status              int
+	}{
+		{http.MethodGet, stats, "", http.StatusUnauthorized},
+		{http.MethodGet, stats, "sk_bad_key", http.StatusUnauthorized},
+		{http.MethodGet, srv.URL + "/healthz", "", http.StatusOK},
+		{http.MethodGet, stats, reader.Key, http.StatusOK},
+		{http.MethodDelete, srv.URL + "/stats", reader.Key, http.StatusForbidden},
+		{http.MethodGet, srv.URL + "/webhooks", reader.Key, http.StatusForbidden},
+		{http.MethodGet, srv.URL + "/apikeys", reader.Key, http.StatusForbidden},
+		{http.MethodDelete, srv.URL + "/stats", admin.Key, http.StatusOK},
+	} {
+		resp := doWithKey(t, tc.method, tc.target, tc.key, nil)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s with key %q: got %d; expected %d", tc.method, tc.target, tc.key, resp.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: 401 without WWW-Authenticate", tc.method, tc.target)
+		}
+	}
+
+	// ключ для записи создается через API и передается в X-API-Key
+	resp := doWithKey(t, http.MethodPost, srv.URL+"/apikeys", admin.Key, url.Values{"name": {"ingest"}, "scopes": {"stats:write"}})
+	writer := uc.OutputAPIKey{}
+	json.NewDecoder(resp.Body).Decode(&writer)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || writer.Key == "" {
+		t.Fatalf("POST /apikeys: got %d %+v", resp.StatusCode, writer)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/stats", strings.NewReader("date=2021-01-01&views=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(HeaderAPIKey, writer.Key)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /stats with X-API-Key: got %v, %v", resp, err)
+	}
+
+	resp = doWithKey(t, http.MethodDelete, srv.URL+"/apikeys/"+strconv.FormatInt(writer.ID, 10), admin.Key, nil)
+	resp.Body.Close()
+	if resp = doWithKey(t, http.MethodPost, srv.URL+"/stats", writer.Key, url.Values{"date": {"2021-01-02"}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked key: got %d; expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// в журнале аудита только изменяющие запросы с проверенным ключом
+	resp = doWithKey(t, http.MethodGet, srv.URL+"/audit", admin.Key, nil)
+	entries := []uc.OutputAuditEntry{}
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, e.KeyName+" "+e.Method+" "+e.Path+" "+strconv.Itoa(e.Status))
+	}
+	expected := []string{
+		"admin DELETE /apikeys/" + strconv.FormatInt(writer.ID, 10) + " 200",
+		"ingest POST /stats 200",
+		"admin POST /apikeys 200",
+		"admin DELETE /stats 200",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("got audit:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+	if entries[0].RequestID == "" {
+		t.Fatal("audit entry has no request id")
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	stats := r.NewQuotaStats(r.NewCachedStats(rep, time.Minute, 10, 1000), rep, 0)
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: stats, Budgets: rep, Webhooks: rep,
+		Idempotency: rep, IdempotencyTTL: time.Hour, APIKeys: rep}))
+	defer srv.Close()
+	scopes := []string{uc.ScopeStatsRead, uc.ScopeStatsWrite, uc.ScopeStatsDelete}
+	acme, _ := uc.CreateAPIKey(r.WithTenant(ctx, "acme"), "acme", scopes, rep)
+	globex, _ := uc.CreateAPIKey(r.WithTenant(ctx, "globex"), "globex", scopes, rep)
+	admin, _ := uc.CreateAPIKey(ctx, "admin", []string{uc.ScopeAdmin}, rep)
+
+	do := func(method, target, key string, header http.Header, values url.Values) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+target, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+key)
+		for name, values := range header {
+			req.Header.Set(name, values[0])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+	views := func(key string, header http.Header) string {
+		status, body := do("GET", "/stats?from=2021-01-01&to=2021-01-31", key, header, nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET /stats: got %d %s", status, body)
+		}
+		result := []uc.OutputData{}
+		json.Unmarshal([]byte(body), &result)
+		got := []string{}
+		for _, row := range result {
+			got = append(got, row.Date+"="+strconv.Itoa(row.Views))
+		}
+		return strings.Join(got, " ")
+	}
+
+	// одинаковый ключ идемпотентности у разных арендаторов не пересекается
+	idem := http.Header{HeaderIdempotencyKey: {"k1"}}
+	do("POST", "/stats", acme.Key, idem, url.Values{"date": {"2021-01-01"}, "views": {"1"}})
+	if status, body := do("POST", "/stats", globex.Key, idem, url.Values{"date": {"2021-01-01"}, "views": {"100"}}); status != http.StatusOK {
+		t.Fatalf("POST /stats of globex with the same Idempotency-Key: got %d %s", status, body)
+	}
+	// кэш периода acme не отдается globex
+	if got := views(acme.Key, nil); got != "2021-01-01=1" {
+		t.Fatalf("acme: got %q", got)
+	}
+	if got := views(globex.Key, nil); got != "2021-01-01=100" {
+		t.Fatalf("globex: got %q", got)
+	}
+
+	// чужой арендатор в заголовке доступен только ключу admin
+	other := http.Header{HeaderTenant: {"acme"}}
+	if status, _ := do("GET", "/stats?from=2021-01-01&to=2021-01-31", globex.Key, other, nil); status != http.StatusForbidden {
+		t.Fatalf("globex reading acme: got %d; expected %d", status, http.StatusForbidden)
+	}
+	if status, _ := do("DELETE", "/stats", globex.Key, other, nil); status != http.StatusForbidden {
+		t.Fatalf("globex deleting acme: got %d; expected %d", status, http.StatusForbidden)
+	}
+	if got := views(admin.Key, other); got != "2021-01-01=1" {
+		t.Fatalf("admin reading acme: got %q", got)
+	}
+	if got := views(admin.Key, nil); got != "" {
+		t.Fatalf("admin reading default tenant: got %q", got)
+	}
+
+	if status, body := do("DELETE", "/stats", globex.Key, nil, nil); status != http.StatusOK || !strings.Contains(body, `"1"`) {
+		t.Fatalf("DELETE /stats of globex: got %d %s", status, body)
+	}
+	if got := views(acme.Key, nil); got != "2021-01-01=1" {
+		t.Fatalf("acme after DELETE of globex: got %q", got)
+	}
+
+	// квота арендатора
+	uc.SetTenantQuota(ctx, "acme", 1, rep)
+	if status, _ := do("POST", "/stats", acme.Key, nil, url.Values{"date": {"2021-01-02"}}); status != http.StatusForbidden {
+		t.Fatalf("POST over quota: got %d; expected %d", status, http.StatusForbidden)
+	}
+	if status, _ := do("POST", "/stats", acme.Key, nil, url.Values{"date": {"2021-01-01"}, "views": {"1"}}); status != http.StatusOK {
+		t.Fatalf("POST of an existing date over quota: got %d; expected %d", status, http.StatusOK)
+	}
+	if status, _ := do("POST", "/stats", globex.Key, nil, url.Values{"date": {"2021-01-02"}}); status != http.StatusOK {
+		t.Fatalf("POST of another tenant: got %d; expected %d", status, http.StatusOK)
+	}
+
+	// ключ, созданный администратором для арендатора
+	status, body := do("POST", "/apikeys", admin.Key, nil, url.Values{"name": {"reader"}, "scopes": {"stats:read"}, "tenant": {"acme"}})
+	reader := uc.OutputAPIKey{}
+	json.Unmarshal([]byte(body), &reader)
+	if status != http.StatusOK || reader.Tenant != "acme" {
+		t.Fatalf("POST /apikeys: got %d %s", status, body)
+	}
+	if got := views(reader.Key, nil); got != "2021-01-01=2" {
+		t.Fatalf("acme reader: got %q", got)
+	}
+}
+
+func TestTenantHeaderWithoutAuth(t *testing.T) {
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep}))
+	defer srv.Close()
+	post := func(tenant string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/stats", strings.NewReader("date=2021-01-01&views=1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(HeaderTenant, tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("acme"); status != http.StatusOK {
+		t.Fatalf("got %d; expected %d", status, http.StatusOK)
+	}
+	if status := post("Bad Tenant"); status != http.StatusBadRequest {
+		t.Fatalf("bad tenant: got %d; expected %d", status, http.StatusBadRequest)
+	}
+	if _, err := rep.FindByDate(r.WithTenant(context.Background(), "acme"), "2021-01-01"); err != nil {
+		t.Fatalf("acme: %v", err)
+	}
+	if _, err := rep.FindByDate(context.Background(), "2021-01-01"); err == nil {
+		t.Fatal("default tenant got the date of acme")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	ctx := context.Background()
+	signing, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, _ := json.Marshal(jwt.NewKeySet(jwt.Key{ID: "k1", Public: &signing.PublicKey}))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Auth{JWKS: filepath.Join(t.TempDir(), "missing.json")}).NewValidator(); err == nil {
+		t.Fatal("expected error of missing JWKS file")
+	}
+	auth := Auth{JWKS: path, JWKSRefresh: time.Minute, Issuer: "https://sso.example.com"}
+	if auth.Mapping.Scopes, err = parseScopeMap("stats-admins=admin, analysts=stats:read stats:write"); err != nil {
+		t.Fatal(err)
+	}
+	auth.Mapping.ScopeClaim = "groups"
+	if _, err := parseScopeMap("analysts=stats:everything"); err == nil {
+		t.Fatal("expected error of unknown scope")
+	}
+	validator, err := auth.NewValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep,
+		APIKeys: rep, Tokens: validator, TokenMapping: auth.Mapping}))
+	defer srv.Close()
+	token := func(key *ecdsa.PrivateKey, claims jwt.Claims) string {
+		base := jwt.Claims{"iss": "https://sso.example.com", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range claims {
+			base[k] = v
+		}
+		signed, err := jwt.Sign(base, key, "k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	analyst := token(signing, jwt.Claims{"sub": "alice", "groups": []string{"analysts"}, "tenant": "acme"})
+	admin := token(signing, jwt.Claims{"sub": "bob", "groups": []string{"stats-admins"}})
+	reader, _ := uc.CreateAPIKey(ctx, "reader", []string{uc.ScopeStatsRead}, rep)
+	stats := srv.URL + "/stats?from=2021-01-01&to=2021-01-31"
+
+	resp := doWithKey(t, http.MethodPost, srv.URL+"/stats", analyst, url.Values{"date": {"2021-01-01"}, "views": {"5"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /stats with token: got %d", resp.StatusCode)
+	}
+	for _, tc := range []struct {
+		name, method, target, key string
+		status                    int
+	}{
+		{"analyst reads", http.MethodGet, stats, analyst, http.StatusOK},
+		{"analyst deletes", http.MethodDelete, srv.URL + "/stats", analyst, http.StatusForbidden},
+		{"admin", http.MethodGet, srv.URL + "/apikeys", admin, http.StatusOK},
+		{"api key", http.MethodGet, stats, reader.Key, http.StatusOK},
+		{"expired", http.MethodGet, stats, token(signing, jwt.Claims{"exp": time.Now().Add(-time.Hour).Unix(), "scope": "admin"}), http.StatusUnauthorized},
+		{"issuer", http.MethodGet, stats, token(signing, jwt.Claims{"iss": "https://evil.example.com", "scope": "admin"}), http.StatusUnauthorized},
+		{"unknown key", http.MethodGet, stats, token(other, jwt.Claims{"scope": "admin"}), http.StatusUnauthorized},
+		{"bad tenant", http.MethodGet, stats, token(signing, jwt.Claims{"scope": "admin", "tenant": "ACME"}), http.StatusUnauthorized},
+	} {
+		resp := doWithKey(t, tc.method, tc.target, tc.key, nil)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d; expected %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+
+	// статистика записана для арендатора токена
+	for key, views := range map[string]int{analyst: 5, reader.Key: 0} {
+		resp := doWithKey(t, http.MethodGet, stats, key, nil)
+		data := []uc.OutputData{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		got := 0
+		for _, row := range data {
+			got += row.Views
+		}
+		if got != views {
+			t.Errorf("got %d views; expected %d", got, views)
+		}
+	}
+
+	// изменяющие запросы по токену записываются в аудит с его sub
+	entries, _ := uc.GetAudit(ctx, rep)
+	if len(entries) != 1 || entries[0].KeyName != "jwt:alice" || entries[0].KeyID != 0 {
+		t.Fatalf("got audit %+v", entries)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep, APIKeys: rep,
+		RateLimits: RateLimits{
+			Read:  ratelimit.New(ratelimit.Limit{Rate: 0.01, Burst: 2}),
+			Write: ratelimit.New(ratelimit.Limit{Rate: 0.01, Burst: 1}),
+		},
+		MaxBodyBytes: 64,
+	}))
+	defer srv.Close()
+	first, _ := uc.CreateAPIKey(ctx, "first", []string{uc.ScopeAdmin}, rep)
+	second, _ := uc.CreateAPIKey(ctx, "second", []string{uc.ScopeAdmin}, rep)
+	stats := srv.URL + "/stats?from=2021-01-01&to=2021-01-31"
+
+	for i, expected := range []struct {
+		status    int
+		remaining string
+	}{{http.StatusOK, "1"}, {http.StatusOK, "0"}, {http.StatusTooManyRequests, "0"}} {
+		resp := doWithKey(t, http.MethodGet, stats, first.Key, nil)
+		resp.Body.Close()
+		if resp.StatusCode != expected.status {
+			t.Fatalf("read %d: got %d; expected %d", i+1, resp.StatusCode, expected.status)
+		}
+		if remaining := resp.Header.Get("RateLimit-Remaining"); resp.Header.Get("RateLimit-Limit") != "2" || remaining != expected.remaining {
+			t.Fatalf("read %d: got RateLimit-Limit %q, RateLimit-Remaining %q", i+1, resp.Header.Get("RateLimit-Limit"), remaining)
+		}
+		if expected.status == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "100" {
+			t.Fatalf("got Retry-After %q", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// запись, удаление, другие ключи и проверки готовности ограничиваются отдельно
+	for _, tc := range []struct {
+		name, method, target, key string
+		status                    int
+	}{
+		{"write", http.MethodPost, srv.URL + "/stats", first.Key, http.StatusOK},
+		{"second write", http.MethodPost, srv.URL + "/stats", first.Key, http.StatusTooManyRequests},
+		{"delete", http.MethodDelete, srv.URL + "/stats", first.Key, http.StatusOK},
+		{"other key", http.MethodGet, stats, second.Key, http.StatusOK},
+		{"health", http.MethodGet, srv.URL + "/healthz", "", http.StatusOK},
+	} {
+		resp := doWithKey(t, tc.method, tc.target, tc.key, url.Values{"date": {"2021-01-01"}, "views": {"1"}})
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d; expected %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+
+	// тело больше MaxBodyBytes отклоняется, в том числе без Content-Length
+	body := url.Values{"name": {strings.Repeat("x", 100)}, "scopes": {"admin"}}.Encode()
+	resp := doWithKey(t, http.MethodPost, srv.URL+"/apikeys", second.Key, url.Values{"name": {strings.Repeat("x", 100)}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d; expected %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/apikeys", ioutil.NopCloser(strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+second.Key)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked body: got %v, %v", resp, err)
+	}
+}
+
+// Неудачные проверки ключа ограничиваются по адресу до обращения к базе
+func TestAuthRateLimit(t *testing.T) {
+	ctx := context.Background()
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep, APIKeys: rep,
+		RateLimits: RateLimits{Auth: ratelimit.New(ratelimit.Limit{Rate: 0.01, Burst: 2})}}))
+	defer srv.Close()
+	valid, _ := uc.CreateAPIKey(ctx, "valid", []string{uc.ScopeAdmin}, rep)
+	stats := srv.URL + "/stats?from=2021-01-01&to=2021-01-31"
+
+	// успешные запросы не расходуют запас
+	for i := 0; i < 3; i++ {
+		if resp := doWithKey(t, http.MethodGet, stats, valid.Key, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("valid key: got %d", resp.StatusCode)
+		}
+	}
+	for i, tc := range []struct {
+		key    string
+		status int
+	}{
+		{"guess", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+		{"guess", http.StatusTooManyRequests},
+		{valid.Key, http.StatusTooManyRequests},
+	} {
+		resp := doWithKey(t, http.MethodGet, stats, tc.key, nil)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("request %d: got %d; expected %d", i+1, resp.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "100" {
+			t.Fatalf("got Retry-After %q", resp.Header.Get("Retry-After"))
+		}
+	}
+	// проверки готовности не требуют ключа и не ограничиваются
+	if resp := doWithKey(t, http.MethodGet, srv.URL+"/healthz", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("health: got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimitByAddress(t *testing.T) {
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep,
+		RateLimits: RateLimits{Delete: ratelimit.New(ratelimit.Limit{Rate: 0.01})}}))
+	defer srv.Close()
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp := doWithKey(t, http.MethodDelete, srv.URL+"/stats", "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("got %d; expected %d", resp.StatusCode, expected)
+		}
+	}
+	if resp := getJSON(t, srv.URL+"/stats?from=2021-01-01&to=2021-01-31", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("read: got %d", resp.StatusCode)
+	}
+}
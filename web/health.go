@@ -0,0 +1,125 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"statistics/pkg/ingest"
+	r "statistics/pkg/repository"
+)
+
+// Состояния компонентов в ответе /readyz
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// defaultReadyTimeout срок проверки готовности по умолчанию
+const defaultReadyTimeout = 2 * time.Second
+
+// Check проверка готовности компонента сервиса.
+// Fn возвращает ошибку, если компонент не готов обслуживать запросы
+type Check struct {
+	Name string
+	Fn   func(ctx context.Context) error
+}
+
+// ComponentStatus состояние компонента в ответе /readyz
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Readiness ответ /readyz
+type Readiness struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// DatabaseCheck проверяет, что база отвечает
+func DatabaseCheck(sdb *r.StatsDB) Check {
+	return Check{Name: "database", Fn: func(ctx context.Context) error {
+		return sdb.DB.PingContext(ctx)
+	}}
+}
+
+// MigrationsCheck проверяет, что схема базы соответствует миграциям
+func MigrationsCheck(sdb *r.StatsDB) Check {
+	return Check{Name: "migrations", Fn: func(ctx context.Context) error {
+		states, err := sdb.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		pending, modified := 0, 0
+		for _, state := range states {
+			switch {
+			case state.Pending():
+				pending++
+			case state.Modified:
+				modified++
+			}
+		}
+		if pending > 0 || modified > 0 {
+			return fmt.Errorf("%d pending and %d modified migrations", pending, modified)
+		}
+		return nil
+	}}
+}
+
+// BufferCheck проверяет, что буфер записи статистики не заполнен
+func BufferCheck(buffer *ingest.Buffer) Check {
+	return Check{Name: "ingest", Fn: func(ctx context.Context) error {
+		if stats := buffer.Stats(); stats.Pending >= buffer.MaxDates {
+			return fmt.Errorf("buffer is full: %d dates pending", stats.Pending)
+		}
+		return nil
+	}}
+}
+
+// GetHealth обработчик GET запроса живости процесса
+func (h *WebserviceHandler) GetHealth(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]string{"status": statusOK})
+}
+
+// GetReady обработчик GET запроса готовности. Проверки выполняются
+// параллельно не дольше ReadyTimeout, при неготовности хотя бы одного
+// компонента возвращается код 503
+func (h *WebserviceHandler) GetReady(w http.ResponseWriter, req *http.Request) {
+	timeout := h.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	type outcome struct {
+		name string
+		err  error
+	}
+	results := make(chan outcome, len(h.Checks))
+	for _, check := range h.Checks {
+		go func(check Check) {
+			results <- outcome{check.Name, check.Fn(ctx)}
+		}(check)
+	}
+	ready := Readiness{Status: statusOK, Components: map[string]ComponentStatus{}}
+	for range h.Checks {
+		res := <-results
+		status := ComponentStatus{Status: statusOK}
+		if res.err != nil {
+			status = ComponentStatus{Status: statusFail, Error: res.err.Error()}
+			ready.Status = statusFail
+		}
+		ready.Components[res.name] = status
+	}
+
+	result, _ := json.Marshal(ready)
+	w.Header().Set("Content-type", "application/json")
+	if ready.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, string(result))
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+
+	"github.com/gorilla/mux"
+)
+
+// Заголовки запросов с ключом идемпотентности
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplay отмечает ответ, повторенный по ключу
+	HeaderIdempotentReplay = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKey максимальная длина ключа идемпотентности
+const maxIdempotencyKey = 255
+
+// idempotentRoutes маршруты ("МЕТОД шаблон"), поддерживающие Idempotency-Key
+var idempotentRoutes = map[string]bool{
+	"POST /stats": true,
+}
+
+// fingerprint отпечаток запроса: метод, путь и параметры формы
+func fingerprint(req *http.Request) string {
+	req.ParseForm()
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.Path + "\n" + req.PostForm.Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+// recorder запоминает код и тело ответа, передавая их клиенту
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware выполняет запрос с заголовком Idempotency-Key
+// не более одного раза за IdempotencyTTL. Ключи разных арендаторов
+// не пересекаются: ключ хранится с именем арендатора. Повтор того же запроса получает
+// сохраненный ответ, ключ с другими параметрами отклоняется кодом 422,
+// пока первый запрос обрабатывается - кодом 409
+func (h *WebserviceHandler) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(HeaderIdempotencyKey)
+		tmpl, _ := mux.CurrentRoute(req).GetPathTemplate()
+		if key == "" || h.Idempotency == nil || !idempotentRoutes[req.Method+" "+tmpl] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		key = r.TenantFromContext(req.Context()) + "/" + key
+		digest := fingerprint(req)
+		lease := h.IdempotencyLease
+		if lease <= 0 {
+			lease = h.IdempotencyTTL
+		}
+		reservation, saved, err := uc.BeginIdempotent(req.Context(), key, digest, time.Now(), h.IdempotencyTTL, lease, h.Idempotency)
+		switch {
+		case err == uc.ErrKeyReused:
+			http.Error(w, "Idempotency-Key is used with another request", http.StatusUnprocessableEntity)
+			return
+		case err == uc.ErrKeyInProgress:
+			http.Error(w, "Request with this Idempotency-Key is in progress", http.StatusConflict)
+			return
+		case err != nil:
+			writeError(w, req, "IdempotencyMiddleware", err)
+			return
+		case saved != nil:
+			if saved.ContentType != "" {
+				w.Header().Set("Content-Type", saved.ContentType)
+			}
+			w.Header().Set(HeaderIdempotentReplay, "true")
+			w.WriteHeader(saved.Status)
+			w.Write([]byte(saved.Body))
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// результат сохраняется и после отмены запроса клиентом
+		reservation.Status = rec.status
+		reservation.ContentType = w.Header().Get("Content-Type")
+		reservation.Body = rec.body.String()
+		err = uc.FinishIdempotent(context.Background(), reservation, h.Idempotency)
+		if err == r.ErrLeaseLost {
+			logging.Warn(req.Context(), "Idempotency key lease expired before the request finished, result is not saved", "key", key)
+		} else if err != nil {
+			logging.Error(req.Context(), "IdempotencyMiddleware. FinishIdempotent", "err", err)
+		}
+	})
+}
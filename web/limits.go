@@ -0,0 +1,135 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"statistics/pkg/ratelimit"
+	r "statistics/pkg/repository"
+)
+
+// RateLimits ограничения частоты запросов клиента по видам запросов,
+// nil или ограничение без скорости - вид не ограничен
+type RateLimits struct {
+	// Read GET запросы
+	Read *ratelimit.Limiter
+	// Write POST и PUT запросы
+	Write *ratelimit.Limiter
+	// Delete DELETE запросы
+	Delete *ratelimit.Limiter
+	// Auth неудачные проверки ключа или токена с одного адреса
+	Auth *ratelimit.Limiter
+}
+
+// limiter возвращает ограничение запросов метода method
+func (l RateLimits) limiter(method string) *ratelimit.Limiter {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return l.Read
+	case http.MethodDelete:
+		return l.Delete
+	}
+	return l.Write
+}
+
+// clientKey ключ контекста с клиентом запроса
+type clientKey struct{}
+
+// withClient возвращает контекст с клиентом, прошедшим проверку ключа
+func withClient(ctx context.Context, key r.APIKey) context.Context {
+	client := key.Name
+	if key.ID != 0 {
+		client = "key:" + strconv.FormatInt(key.ID, 10)
+	}
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// client возвращает клиента запроса: ключ API, токен SSO
+// или, если ключи не проверяются, адрес клиента
+func client(req *http.Request) string {
+	if client, ok := req.Context().Value(clientKey{}).(string); ok {
+		return client
+	}
+	return address(req)
+}
+
+// address возвращает клиента запроса по его адресу
+func address(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// tooManyRequests отвечает 429 с Retry-After по результату проверки res
+func tooManyRequests(w http.ResponseWriter, res ratelimit.Result) {
+	w.Header().Set("Retry-After", seconds(res.RetryAfter))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// seconds округляет d вверх до целых секунд
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// RateLimitMiddleware ограничивает частоту запросов клиента отдельно
+// для чтения, записи и удаления. Отвечает заголовками RateLimit-Limit,
+// RateLimit-Remaining и RateLimit-Reset, при превышении - 429 с Retry-After.
+// Маршруты, доступные без ключа, и виды запросов без скорости не ограничиваются
+func (h *WebserviceHandler) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tmpl, _ := mux.CurrentRoute(req).GetPathTemplate()
+		limiter := h.RateLimits.limiter(req.Method)
+		if scope, ok := routeScopes[req.Method+" "+tmpl]; limiter == nil || ok && scope == publicScope {
+			next.ServeHTTP(w, req)
+			return
+		}
+		res := limiter.Allow(client(req))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", seconds(res.Reset))
+		if !res.Allowed {
+			tooManyRequests(w, res)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// BodyLimitMiddleware отклоняет с 413 запросы с телом больше MaxBodyBytes.
+// Тело без Content-Length читается в память до MaxBodyBytes
+func (h *WebserviceHandler) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if h.MaxBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.ContentLength > h.MaxBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if req.ContentLength < 0 {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, h.MaxBodyBytes))
+			if err != nil && int64(len(body)) >= h.MaxBodyBytes {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Bad request body", http.StatusBadRequest)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
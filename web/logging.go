@@ -0,0 +1,62 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"statistics/pkg/logging"
+)
+
+// HeaderRequestID заголовок идентификатора запроса
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength наибольшая длина идентификатора запроса, принимаемого от клиента
+const maxRequestIDLength = 128
+
+// validRequestID идентификатор запроса клиента можно записывать в журнал:
+// не длиннее maxRequestIDLength и состоит из печатных ASCII символов без пробелов
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// LoggingMiddleware присваивает запросу идентификатор (из заголовка X-Request-ID
+// или случайный), возвращает его в ответе и передает в контексте запроса
+// в журналы сценариев и репозитория. После обработки пишет запись журнала
+// доступа с кодом ответа и длительностью. Исполняется первой
+func (h *WebserviceHandler) LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+		req = req.WithContext(logging.WithRequestID(req.Context(), id))
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		route, _ := mux.CurrentRoute(req).GetPathTemplate()
+		logging.Info(req.Context(), "http request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"route", route,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote", req.RemoteAddr,
+		)
+	})
+}
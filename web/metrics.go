@@ -0,0 +1,154 @@
+package web
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"statistics/pkg/ingest"
+	"statistics/pkg/metrics"
+	r "statistics/pkg/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// Version версия сборки, задается при сборке:
+// go build -ldflags "-X statistics/web.Version=1.2.3" ./cmd/statistics
+var Version = "dev"
+
+// Результаты приема статистики в метрике statistics_ingest_requests_total
+const (
+	ingestStored   = "stored"
+	ingestBuffered = "buffered"
+	ingestRejected = "rejected"
+	ingestFailed   = "failed"
+)
+
+// Metrics метрики сервиса, отдаваемые по /metrics
+type Metrics struct {
+	Registry *metrics.Registry
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	ingested *metrics.CounterVec
+	results  *metrics.CounterVec
+}
+
+// NewMetrics регистрирует в reg метрики HTTP-запросов, приема статистики
+// и сведения о сборке
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	m := &Metrics{
+		Registry: reg,
+		requests: reg.NewCounterVec("statistics_http_requests_total",
+			"Number of HTTP requests.", "route", "method", "status"),
+		duration: reg.NewHistogramVec("statistics_http_request_duration_seconds",
+			"Duration of HTTP requests.", nil, "route", "method", "status"),
+		ingested: reg.NewCounterVec("statistics_ingested_total",
+			"Sum of accepted statistics increments.", "metric"),
+		results: reg.NewCounterVec("statistics_ingest_requests_total",
+			"Number of POST /stats requests by result.", "result"),
+	}
+	reg.NewGaugeFunc("statistics_build_info", "Build information.",
+		func() float64 { return 1 }, "version", Version, "goversion", runtime.Version())
+	return m
+}
+
+// RegisterCache регистрирует счетчики кэша статистики
+func (m *Metrics) RegisterCache(cache *r.CachedStats) {
+	counter := func(name, help string, fn func(s r.CacheStats) uint64) {
+		m.Registry.NewCounterFunc(name, help, func() float64 { return float64(fn(cache.Stats())) })
+	}
+	counter("statistics_cache_hits_total", "Number of statistics ranges read from the cache.",
+		func(s r.CacheStats) uint64 { return s.Hits })
+	counter("statistics_cache_misses_total", "Number of statistics ranges read from the repository.",
+		func(s r.CacheStats) uint64 { return s.Misses })
+	counter("statistics_cache_evictions_total", "Number of ranges evicted by cache bounds.",
+		func(s r.CacheStats) uint64 { return s.Evictions })
+	counter("statistics_cache_invalidations_total", "Number of ranges invalidated by writes.",
+		func(s r.CacheStats) uint64 { return s.Invalidations })
+	m.Registry.NewGaugeFunc("statistics_cache_rows", "Number of cached rows.",
+		func() float64 { return float64(cache.Stats().Rows) })
+}
+
+// RegisterBuffer регистрирует показатели буфера записи статистики
+func (m *Metrics) RegisterBuffer(buffer *ingest.Buffer) {
+	m.Registry.NewGaugeFunc("statistics_ingest_buffer_pending", "Number of buffered dates waiting for a write.",
+		func() float64 { return float64(buffer.Stats().Pending) })
+	m.Registry.NewCounterFunc("statistics_ingest_buffer_flushes_total", "Number of written batches.",
+		func() float64 { return float64(buffer.Stats().Flushes) })
+	m.Registry.NewCounterFunc("statistics_ingest_buffer_failures_total", "Number of failed batch writes.",
+		func() float64 { return float64(buffer.Stats().Failures) })
+}
+
+// ingest учитывает результат приема приращения data
+func (m *Metrics) ingest(data r.Data, result string) {
+	if m == nil {
+		return
+	}
+	m.results.Inc(result)
+	if result == ingestStored || result == ingestBuffered {
+		m.ingested.Add(float64(data.Views), "views")
+		m.ingested.Add(float64(data.Clicks), "clicks")
+	}
+}
+
+// statusWriter запоминает код ответа и размер тела
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// Flush передает буферизованные данные клиенту (нужен потоку событий)
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// MetricsMiddleware считает запросы и их длительность по маршруту,
+// методу и коду ответа. Исполняется до остальных прослоек,
+// чтобы учитывать их ответы
+func (h *WebserviceHandler) MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if h.Metrics == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		route, _ := mux.CurrentRoute(req).GetPathTemplate()
+		status := strconv.Itoa(sw.status)
+		h.Metrics.requests.Inc(route, req.Method, status)
+		h.Metrics.duration.Observe(time.Since(start).Seconds(), route, req.Method, status)
+	})
+}
+
+// GetMetrics обработчик GET запроса метрик в формате Prometheus
+func (h *WebserviceHandler) GetMetrics(w http.ResponseWriter, req *http.Request) {
+	if h.Metrics == nil {
+		http.Error(w, "Metrics are disabled", http.StatusNotFound)
+		return
+	}
+	h.Metrics.Registry.ServeHTTP(w, req)
+}
@@ -0,0 +1,29 @@
+package web
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Спецификация OpenAPI 3 маршрутов /stats и интерактивная страница
+// документации, читающая /openapi.json, встраиваются в бинарный файл.
+// Параметры спецификации сверяются со структурами валидации, ответы
+// обработчиков - со схемами спецификации в тестах
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+//go:embed docs.html
+var docsPage []byte
+
+// GetOpenAPI обработчик GET запроса спецификации OpenAPI
+func (h *WebserviceHandler) GetOpenAPI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// GetDocs обработчик GET запроса страницы документации
+func (h *WebserviceHandler) GetDocs(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,351 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	r "statistics/pkg/repository"
+)
+
+// object узел документа JSON
+type object = map[string]interface{}
+
+// loadSpec разбирает встроенную спецификацию
+func loadSpec(t *testing.T) object {
+	t.Helper()
+	spec := object{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return spec
+}
+
+// resolve возвращает узел, на который указывает локальная ссылка $ref
+func resolve(spec, node object) object {
+	for node["$ref"] != nil {
+		ref := strings.TrimPrefix(node["$ref"].(string), "#/")
+		node = spec
+		for _, key := range strings.Split(ref, "/") {
+			node = node[key].(object)
+		}
+	}
+	return node
+}
+
+// specParam параметр запроса в спецификации или структуре валидации
+type specParam struct {
+	required bool
+	enum     string
+}
+
+// specParams возвращает параметры операции из query или формы тела запроса
+func specParams(spec, op object) map[string]specParam {
+	params := map[string]specParam{}
+	enum := func(schema object) string {
+		values := []string{}
+		for _, v := range schema["enum"].([]interface{}) {
+			values = append(values, v.(string))
+		}
+		return strings.Join(values, "|")
+	}
+	for _, p := range op["parameters"].([]interface{}) {
+		param := resolve(spec, p.(object))
+		if param["in"] != "query" {
+			continue
+		}
+		schema := param["schema"].(object)
+		required, _ := param["required"].(bool)
+		sp := specParam{required: required}
+		if schema["enum"] != nil {
+			sp.enum = enum(schema)
+		}
+		params[param["name"].(string)] = sp
+	}
+	if body, ok := op["requestBody"].(object); ok {
+		schema := resolve(spec, body["content"].(object)["application/x-www-form-urlencoded"].(object)["schema"].(object))
+		required := map[string]bool{}
+		for _, name := range schema["required"].([]interface{}) {
+			required[name.(string)] = true
+		}
+		for name, prop := range schema["properties"].(object) {
+			sp := specParam{required: required[name]}
+			if prop.(object)["enum"] != nil {
+				sp.enum = enum(prop.(object))
+			}
+			params[name] = sp
+		}
+	}
+	return params
+}
+
+var inValidator = regexp.MustCompile(`in\(([^)]*)\)`)
+
+// structParams возвращает параметры структуры валидации: поля
+// обязательны, если в теге valid нет optional
+func structParams(params interface{}) map[string]specParam {
+	result := map[string]specParam{}
+	typ := reflect.TypeOf(params).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		valid := field.Tag.Get("valid")
+		sp := specParam{required: !strings.Contains(valid, "optional")}
+		if m := inValidator.FindStringSubmatch(valid); m != nil {
+			sp.enum = m[1]
+		}
+		result[field.Tag.Get("schema")] = sp
+	}
+	return result
+}
+
+func TestOpenAPIParameters(t *testing.T) {
+	spec := loadSpec(t)
+	paths := spec["paths"].(object)
+	documented := map[string]bool{}
+	for path, item := range paths {
+		for method, op := range item.(object) {
+			route := strings.ToUpper(method) + " " + path
+			documented[route] = true
+			newParams, ok := routeParams[route]
+			if !ok {
+				t.Errorf("%s is documented but not validated", route)
+				continue
+			}
+			if _, ok := routeScopes[route]; !ok {
+				t.Errorf("%s is documented but has no scope", route)
+			}
+			expected, got := structParams(newParams()), specParams(spec, op.(object))
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: got parameters %+v; expected %+v from validation", route, got, expected)
+			}
+		}
+	}
+	for route := range routeParams {
+		if strings.Contains(route, " /stats") && !documented[route] {
+			t.Errorf("%s is not documented", route)
+		}
+	}
+}
+
+// validate проверяет значение JSON по схеме спецификации
+// и возвращает найденные расхождения
+func validate(spec, schema object, value interface{}, at string) []string {
+	schema = resolve(spec, schema)
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		return []string{at + ": null"}
+	}
+	errs := []string{}
+	fail := func(format string, args ...interface{}) []string {
+		return append(errs, at+": "+fmt.Sprintf(format, args...))
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(object)
+		if !ok {
+			return fail("got %T; expected object", value)
+		}
+		props, _ := schema["properties"].(object)
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = fail("missing %q", name)
+			}
+		}
+		for name, v := range obj {
+			prop, ok := props[name].(object)
+			if !ok {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					errs = fail("unknown property %q", name)
+				}
+				continue
+			}
+			errs = append(errs, validate(spec, prop, v, at+"."+name)...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fail("got %T; expected array", value)
+		}
+		for i, item := range items {
+			errs = append(errs, validate(spec, schema["items"].(object), item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fail("got %T; expected string", value)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			errs = fail("%q does not match %s", s, pattern)
+		}
+		if _, err := time.Parse("2006-01-02", s); schema["format"] == "date" && err != nil {
+			errs = fail("%q is not a date", s)
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			return fail("got %T; expected %s", value, schema["type"])
+		}
+		if schema["type"] == "integer" && n != math.Trunc(n) {
+			errs = fail("%v is not an integer", n)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("got %T; expected boolean", value)
+		}
+	default:
+		return fail("unsupported schema %v", schema)
+	}
+	return errs
+}
+
+// checkResponse проверяет, что код, тип содержимого и тело
+// ответа описаны в спецификации операции
+func checkResponse(t *testing.T, spec object, path, method string, resp *http.Response) {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := method + " " + path
+	op := spec["paths"].(object)[path].(object)[strings.ToLower(method)].(object)
+	described, ok := op["responses"].(object)[fmt.Sprint(resp.StatusCode)].(object)
+	if !ok {
+		t.Errorf("%s: status %d is not documented", route, resp.StatusCode)
+		return
+	}
+	described = resolve(spec, described)
+	content, ok := described["content"].(object)
+	if !ok {
+		if len(body) != 0 {
+			t.Errorf("%s %d: got body %q; expected none", route, resp.StatusCode, body)
+		}
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	media, ok := content[mediaType].(object)
+	if !ok {
+		t.Errorf("%s %d: content type %q is not documented", route, resp.StatusCode, mediaType)
+		return
+	}
+	if mediaType != "application/json" {
+		return
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		t.Errorf("%s %d: %v in %s", route, resp.StatusCode, err, body)
+		return
+	}
+	for _, e := range validate(spec, media["schema"].(object), value, "body") {
+		t.Errorf("%s %d: %s", route, resp.StatusCode, e)
+	}
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	spec := loadSpec(t)
+	rep := r.NewMemoryDB()
+	cache := r.NewCachedStats(rep, time.Minute, 10, 100)
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: cache, Cache: cache, Budgets: rep}))
+	defer srv.Close()
+
+	do := func(method, path, query string, form url.Values) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path+"?"+query, strings.NewReader(form.Encode()))
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, date := range []string{"2021-01-04", "2021-01-05", "2021-01-12"} {
+		resp := do("POST", "/stats", "", url.Values{"date": {date}, "views": {"1000"}, "clicks": {"20"}, "cost": {"12.35"}})
+		checkResponse(t, spec, "/stats", "POST", resp)
+	}
+	for _, tc := range []struct {
+		method, path, query string
+		form                url.Values
+		status              int
+	}{
+		{"POST", "/stats", "", url.Values{"date": {"2021-13-01"}}, http.StatusBadRequest},
+		{"GET", "/stats", "from=2021-01-01&to=2021-01-31&orderby=cpc", nil, http.StatusOK},
+		{"GET", "/stats", "from=2021-01-01&to=2021-01-31&granularity=week", nil, http.StatusOK},
+		{"GET", "/stats", "from=2020-01-01&to=2020-01-31", nil, http.StatusOK},
+		{"GET", "/stats", "from=2021-01-31&to=2021-01-01", nil, http.StatusBadRequest},
+		{"GET", "/stats/forecast", "from=2021-01-01&to=2021-01-20&horizon=3", nil, http.StatusOK},
+		{"GET", "/stats/forecast", "from=2021-01-01&to=2021-01-20&horizon=0", nil, http.StatusBadRequest},
+		{"GET", "/stats/cache", "", nil, http.StatusOK},
+		{"DELETE", "/stats", "", nil, http.StatusOK},
+		{"DELETE", "/stats", "date=2021-01-01", nil, http.StatusBadRequest},
+	} {
+		resp := do(tc.method, tc.path, tc.query, tc.form)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s?%s: got status %d; expected %d", tc.method, tc.path, tc.query, resp.StatusCode, tc.status)
+		}
+		checkResponse(t, spec, tc.path, tc.method, resp)
+	}
+
+	// схема отвергает ответ в формате старого описания README
+	old := []interface{}{object{"date": "2021-01-11", "views": "150", "clicks": "63", "cost": "55.51", "cpc": "0.88", "cpm": "370.07"}}
+	schema := resolve(spec, spec["paths"].(object)["/stats"].(object)["get"].(object)["responses"].(object)["200"].(object))
+	if errs := validate(spec, schema["content"].(object)["application/json"].(object)["schema"].(object), old, "body"); len(errs) == 0 {
+		t.Fatal("response with lowercase string fields is accepted")
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	rep := r.NewMemoryDB()
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Rep: rep, APIKeys: rep}))
+	defer srv.Close()
+
+	// спецификация и документация доступны без ключа
+	for path, contentType := range map[string]string{"/openapi.json": "application/json", "/docs": "text/html"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), contentType) {
+			t.Fatalf("GET %s: got %d %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if path == "/openapi.json" && string(body) != string(openAPISpec) {
+			t.Fatal("GET /openapi.json: got another document")
+		}
+	}
+	resp := doWithKey(t, http.MethodGet, srv.URL+"/stats/cache", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET /stats/cache without key: got %d", resp.StatusCode)
+	}
+
+	// ссылки $ref указывают на существующие компоненты
+	spec := loadSpec(t)
+	refs := regexp.MustCompile(`"\$ref":\s*"#/([^"]+)"`).FindAllStringSubmatch(string(openAPISpec), -1)
+	for _, ref := range refs {
+		node, ok := spec, true
+		for _, key := range strings.Split(ref[1], "/") {
+			if node, ok = node[key].(object); !ok {
+				break
+			}
+		}
+		if !ok {
+			t.Errorf("unresolved $ref %s", ref[1])
+		}
+	}
+}
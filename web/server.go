@@ -2,27 +2,41 @@ package web
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 
+	"statistics/pkg/ingest"
+	"statistics/pkg/jwt"
+	"statistics/pkg/logging"
+	"statistics/pkg/metrics"
+	"statistics/pkg/ratelimit"
 	r "statistics/pkg/repository"
+	"statistics/pkg/stream"
+	"statistics/pkg/tracing"
+	uc "statistics/pkg/usecases"
+	"statistics/pkg/webhook"
 )
 
+// replaySize количество последних событий потока,
+// доступных для возобновления по Last-Event-ID
+const replaySize = 1000
+
 // Server is ...
 type Server struct {
 	// Port is the local machine TCP Port to bind the HTTP Server to
 	Port    string
 	Timeout Timeout
+	TLS     TLS
 }
 
 // Timeout is ...
@@ -42,50 +56,286 @@ type Timeout struct {
 	// Read is the amount of time to wait
 	// until an IDLE HTTP session is closed
 	Idle time.Duration
+
+	// Request is the deadline of request processing, after which
+	// database queries of the request are cancelled
+	Request time.Duration
 }
 
 // Database is ...
 type Database struct {
+	// Driver is the database backend: mysql, postgres or sqlite
+	Driver string
+	// DSN overrides the connection string built from the fields below.
+	// For sqlite it is the database file path
+	DSN      string
 	User     string
 	Password string
 	Dbname   string
 	Host     string
 	Port     string
+	// AutoMigrate applies pending schema migrations on startup
+	AutoMigrate bool
+	// ConnectTimeout is the time to wait for the database on startup,
+	// the connection is retried with exponential backoff
+	ConnectTimeout time.Duration
+	// Options are the driver options appended to the connection string,
+	// for example "timeout=5s&readTimeout=30s" for MySQL
+	Options string
+	// Pool limits the connections, zero values keep the driver defaults
+	Pool r.Pool
+	// Retry repeats queries failed with transient errors: deadlocks,
+	// lock timeouts and, for reads, lost connections
+	Retry r.Retry
+}
+
+// Cache is the read-through cache of statistics ranges
+type Cache struct {
+	// Size is the maximum number of cached ranges, 0 disables the cache
+	Size int
+	// Rows is the maximum number of cached rows over all ranges
+	Rows int
+	// TTL is the lifetime of a cached range
+	TTL time.Duration
+}
+
+// Ingest is the write-behind buffer of POST /stats
+type Ingest struct {
+	// Size is the maximum number of buffered dates, 0 writes every request directly
+	Size int
+	// Batch is the number of buffered dates which triggers a write
+	Batch int
+	// Interval is the maximum delay of a write
+	Interval time.Duration
+}
+
+// Idempotency is the storage of Idempotency-Key results
+type Idempotency struct {
+	// TTL is the time a key and its result are kept
+	TTL time.Duration
+	// Lease is the time a key of a request in progress is reserved,
+	// after it a key left by an interrupted request can be used again
+	Lease time.Duration
+}
+
+// Webhooks is the delivery of events to subscribers
+type Webhooks struct {
+	// AllowPrivate allows loopback, link-local and private target addresses
+	AllowPrivate bool
+}
+
+// Health is the readiness probe of GET /readyz
+type Health struct {
+	// Timeout is the deadline of all readiness checks
+	Timeout time.Duration
+}
+
+// Log is the structured logger of the service
+type Log struct {
+	// Level is the minimal level of written records: debug, info, warn or error.
+	// Response bodies are logged only at debug level
+	Level logging.Level
+	// Format is the record format: logfmt or json
+	Format string
+}
+
+// Trace is the tracing of requests
+type Trace struct {
+	// Exporter is where finished spans are sent: stdout, otlp or empty to disable tracing
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector address for the otlp exporter
+	Endpoint string
+	// Ratio is the share of traced requests without an incoming traceparent
+	Ratio float64
+}
+
+// Auth is the API key authentication
+type Auth struct {
+	// Enabled requires an API key with a scope of the route for every request
+	// except health checks and metrics. Defaults to true for database drivers
+	// and to false for the memory driver, where keys cannot be created
+	Enabled bool
+	// JWKS is the file path or http(s) URL of the keys of SSO tokens,
+	// empty accepts API keys only. Setting it enables authentication
+	// unless AUTH_ENABLED is set explicitly
+	JWKS string
+	// JWKSRefresh is the lifetime of the loaded keys, a token signed
+	// with an unknown key reloads them earlier
+	JWKSRefresh time.Duration
+	// Issuer and Audience are the expected iss and aud of tokens,
+	// both are required with JWKS
+	Issuer   string
+	Audience string
+	// Mapping maps token claims to scopes and the tenant
+	Mapping uc.TokenMapping
+}
+
+// Tenant is the default quota of tenants
+type Tenant struct {
+	// MaxRows is the maximal number of dates with statistics of a tenant
+	// without its own quota, 0 means no limit
+	MaxRows int
+}
+
+// Limits is the rate limiting of clients and the request size limit
+type Limits struct {
+	// Read, Write and Delete are the rates of GET, POST/PUT and DELETE
+	// requests of a client per second and their bursts, zero rate means no limit.
+	// A client is its API key or SSO token, or its IP address without authentication
+	Read   ratelimit.Limit
+	Write  ratelimit.Limit
+	Delete ratelimit.Limit
+	// Auth is the rate of failed authentications from an IP address and
+	// their burst. An address out of it gets 429 before its key is checked
+	Auth ratelimit.Limit
+	// MaxBodyBytes is the maximal size of a request body,
+	// 64 KiB by default, zero or a negative value means no limit
+	MaxBodyBytes int64
+}
+
+// NewRateLimits returns the limiters of the configured rates. Limiters
+// without rate are created too, so that a rate set on reload applies
+func (l Limits) NewRateLimits() RateLimits {
+	return RateLimits{Read: ratelimit.New(l.Read), Write: ratelimit.New(l.Write), Delete: ratelimit.New(l.Delete),
+		Auth: ratelimit.New(l.Auth)}
 }
 
 // Config struct for webapp config
 type Config struct {
-	Server   Server
-	Database Database
-}
-
-// NewConfig returns a new decoded Config struct
-func NewConfig() (*Config, error) {
-	// Create config structure
-	server, _ := strconv.Atoi(os.Getenv("SERVER"))
-	write, _ := strconv.Atoi(os.Getenv("WRITE"))
-	read, _ := strconv.Atoi(os.Getenv("READ"))
-	idle, _ := strconv.Atoi(os.Getenv("IDLE"))
-
-	config := &Config{
-		Server: Server{
-			Port: os.Getenv("PORT"),
-			Timeout: Timeout{
-				Server: time.Duration(server),
-				Write:  time.Duration(write),
-				Read:   time.Duration(read),
-				Idle:   time.Duration(idle),
-			},
-		},
-		Database: Database{
-			User:     os.Getenv("MYSQL_USER"),
-			Password: os.Getenv("MYSQL_PASSWORD"),
-			Dbname:   os.Getenv("MYSQL_DATABASE"),
-			Host:     os.Getenv("DATABASE_HOST"),
-			Port:     os.Getenv("MYSQL_PORT"),
-		},
-	}
-	return config, nil
+	Server      Server
+	Database    Database
+	Cache       Cache
+	Ingest      Ingest
+	Idempotency Idempotency
+	Webhooks    Webhooks
+	Health      Health
+	Log         Log
+	Trace       Trace
+	Auth        Auth
+	Tenant      Tenant
+	Limits      Limits
+
+	// args are the flags the configuration is loaded with, values and
+	// sources are the effective values of settings and where they come from
+	args    []string
+	values  map[string]string
+	sources map[string]string
+}
+
+// NewLogger returns the logger writing to out, records of the standard
+// log package are redirected to it by the caller
+func (l Log) NewLogger(out io.Writer) (*logging.Logger, error) {
+	return logging.New(out, l.Level, l.Format)
+}
+
+// NewTracer returns the tracer sending spans to the configured exporter,
+// nil if tracing is disabled
+func (t Trace) NewTracer() (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch t.Exporter {
+	case "":
+		return nil, nil
+	case "stdout":
+		exporter = tracing.NewStdoutExporter(os.Stdout)
+	case "otlp":
+		exporter = tracing.NewOTLPExporter(t.Endpoint, "service.name", "statistics", "service.version", Version)
+	default:
+		return nil, fmt.Errorf("web: unknown trace exporter %q", t.Exporter)
+	}
+	tracer := tracing.NewTracer(exporter)
+	tracer.Ratio = t.Ratio
+	return tracer, nil
+}
+
+// parseScopeMap parses the mapping of token claim values to scopes
+// in the form "group=scope scope,group=scope"
+func parseScopeMap(s string) (map[string][]string, error) {
+	result := map[string][]string{}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		value := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || value == "" {
+			return nil, fmt.Errorf("web: bad scope mapping %q", entry)
+		}
+		for _, scope := range strings.Fields(parts[1]) {
+			known := false
+			for _, s := range uc.Scopes {
+				known = known || s == scope
+			}
+			if !known {
+				return nil, fmt.Errorf("web: unknown scope %q in mapping of %q", scope, value)
+			}
+			result[value] = append(result[value], scope)
+		}
+	}
+	return result, nil
+}
+
+// NewValidator returns the validator of SSO tokens signed with the keys
+// of JWKS, nil if JWKS is not configured. A JWKS file must be readable
+// on startup, a JWKS URL is retried on the first token
+func (a Auth) NewValidator() (*jwt.Validator, error) {
+	var keys *jwt.JWKS
+	switch {
+	case a.JWKS == "":
+		return nil, nil
+	case strings.HasPrefix(a.JWKS, "http://") || strings.HasPrefix(a.JWKS, "https://"):
+		keys = jwt.NewURLJWKS(a.JWKS, nil)
+	default:
+		keys = jwt.NewFileJWKS(a.JWKS)
+	}
+	keys.Refresh = a.JWKSRefresh
+	// недоступный при запуске SSO не фатален: ключи загрузятся с первым токеном
+	if err := keys.Load(context.Background()); err != nil {
+		if !strings.Contains(a.JWKS, "://") {
+			return nil, err
+		}
+		logging.Default().Warn("JWKS is not loaded", "source", a.JWKS, "err", err)
+	}
+	validator := jwt.NewValidator(keys)
+	validator.Issuer = a.Issuer
+	validator.Audience = a.Audience
+	return validator, nil
+}
+
+// ConnString returns the connection string for the configured driver
+// with the driver options
+func (d Database) ConnString() string {
+	dsn := d.DSN
+	if dsn == "" {
+		switch d.Driver {
+		case "postgres":
+			dsn = fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
+				d.User, d.Password, d.Host, d.Port, d.Dbname)
+		case "sqlite":
+			dsn = "statistics.db"
+		default:
+			dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local",
+				d.User, d.Password, d.Host, d.Port, d.Dbname)
+		}
+	}
+	if options := strings.TrimLeft(d.Options, "?&"); options != "" {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + options
+	}
+	return dsn
+}
+
+// Open opens the configured database with the pool limits and retry policy
+func (d Database) Open() (*r.StatsDB, error) {
+	sdb, err := r.Open(d.Driver, d.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	sdb.SetPool(d.Pool)
+	sdb.Retry = d.Retry
+	return sdb, nil
 }
 
 // NewRouter generates the router used in the HTTP Server
@@ -95,82 +345,435 @@ func NewRouter(w WebserviceHandler) *mux.Router {
 	r.HandleFunc("/stats", w.PostStats).Methods("POST")
 	r.HandleFunc("/stats", w.GetStats).Methods("GET")
 	r.HandleFunc("/stats", w.ClearStats).Methods("DELETE")
+	r.HandleFunc("/stats/forecast", w.GetForecast).Methods("GET")
+	r.HandleFunc("/stats/stream", w.StreamStats).Methods("GET")
+	r.HandleFunc("/stats/cache", w.GetCacheStats).Methods("GET")
+	r.HandleFunc("/metrics", w.GetMetrics).Methods("GET")
+	r.HandleFunc("/healthz", w.GetHealth).Methods("GET")
+	r.HandleFunc("/readyz", w.GetReady).Methods("GET")
+	r.HandleFunc("/openapi.json", w.GetOpenAPI).Methods("GET")
+	r.HandleFunc("/docs", w.GetDocs).Methods("GET")
+	r.HandleFunc("/budgets", w.PostBudget).Methods("POST")
+	r.HandleFunc("/budgets", w.GetBudgets).Methods("GET")
+	r.HandleFunc("/budgets/{id:[0-9]+}", w.GetBudget).Methods("GET")
+	r.HandleFunc("/budgets/{id:[0-9]+}", w.PutBudget).Methods("PUT")
+	r.HandleFunc("/budgets/{id:[0-9]+}", w.DeleteBudget).Methods("DELETE")
+	r.HandleFunc("/budgets/{id:[0-9]+}/status", w.GetBudgetStatus).Methods("GET")
+	r.HandleFunc("/alerts", w.GetAlerts).Methods("GET")
+	r.HandleFunc("/webhooks", w.PostWebhook).Methods("POST")
+	r.HandleFunc("/webhooks", w.GetWebhooks).Methods("GET")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", w.GetWebhook).Methods("GET")
+	r.HandleFunc("/webhooks/{id:[0-9]+}", w.DeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", w.GetDeliveries).Methods("GET")
+	r.HandleFunc("/apikeys", w.PostAPIKey).Methods("POST")
+	r.HandleFunc("/apikeys", w.GetAPIKeys).Methods("GET")
+	r.HandleFunc("/apikeys/{id:[0-9]+}", w.DeleteAPIKey).Methods("DELETE")
+	r.HandleFunc("/audit", w.GetAudit).Methods("GET")
+	r.Use(w.LoggingMiddleware)
+	r.Use(w.TracingMiddleware)
+	r.Use(w.MetricsMiddleware)
+	r.Use(w.BodyLimitMiddleware)
+	r.Use(w.AuthMiddleware)
+	r.Use(w.RateLimitMiddleware)
 	r.Use(w.ValidationMiddleware)
+	r.Use(w.TimeoutMiddleware)
+	r.Use(w.CacheControlMiddleware)
+	r.Use(w.IdempotencyMiddleware)
 
 	return r
 }
 
-// Run will run the HTTP Server
-func (config Config) Run(w WebserviceHandler) {
-	// Set up a channel to listen to for interrupt signals
-	var runChan = make(chan os.Signal, 1)
+// Run runs the HTTP Server until SIGINT or SIGTERM and shuts it down gracefully,
+// SIGHUP reloads the configuration. Returns an error if the server fails
+// or is not shut down within the server timeout
+func (config Config) Run(w WebserviceHandler) error {
+	ln, err := net.Listen("tcp", ":"+config.Server.Port)
+	if err != nil {
+		return err
+	}
+	// Set up a channel to listen to for interrupt and reload signals
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	return config.Serve(ln, signals, w)
+}
 
-	// Set up a context to allow for graceful server shutdowns in the event
-	// of an OS interrupt (defers the cancel just in case)
-	ctx, cancel := context.WithTimeout(
-		context.Background(),
-		config.Server.Timeout.Server,
-	)
-	defer cancel()
+// worker is a background task stopped after the server drains requests
+type worker struct {
+	name string
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// startWorker runs fn until the returned worker is stopped
+func startWorker(name string, fn func(ctx context.Context)) worker {
+	ctx, stop := context.WithCancel(context.Background())
+	wk := worker{name: name, stop: stop, done: make(chan struct{})}
+	go func() {
+		defer close(wk.done)
+		fn(ctx)
+	}()
+	return wk
+}
+
+// Serve serves HTTP on ln until a signal other than SIGHUP is received
+// on signals. On shutdown the server stops accepting connections, closes
+// event streams and waits for requests in flight, then stops the background
+// workers flushing buffered statistics and spans, and closes the database.
+// All of this is limited by the server timeout started on the signal
+func (config Config) Serve(ln net.Listener, signals <-chan os.Signal, w WebserviceHandler) error {
+	// Close event streams before the write timeout breaks them,
+	// clients reconnect with Last-Event-ID
+	if write := config.Server.Timeout.Write; write > 0 {
+		w.StreamTimeout = write - write/10
+	}
+
+	w.RequestTimeout = config.Server.Timeout.Request
 
 	// Define server options
 	server := &http.Server{
-		Addr:         ":" + config.Server.Port,
 		Handler:      NewRouter(w),
-		ReadTimeout:  config.Server.Timeout.Read * time.Second,
-		WriteTimeout: config.Server.Timeout.Write * time.Second,
-		IdleTimeout:  config.Server.Timeout.Idle * time.Second,
+		ReadTimeout:  config.Server.Timeout.Read,
+		WriteTimeout: config.Server.Timeout.Write,
+		IdleTimeout:  config.Server.Timeout.Idle,
+	}
+	// Streams never become idle, they are closed when shutdown begins
+	if w.Broker != nil {
+		server.RegisterOnShutdown(w.Broker.Close)
 	}
 
-	// Handle ctrl+c/ctrl+x interrupt
-	signal.Notify(runChan, os.Interrupt, syscall.SIGTSTP)
+	// Serve HTTPS with certificates reloaded on change,
+	// plain HTTP requests are redirected by a separate listener
+	tlsConfig := config.Server.TLS
+	var redirect *http.Server
+	if tlsConfig.Enabled() {
+		var err error
+		if server.TLSConfig, err = tlsConfig.NewTLSConfig(); err != nil {
+			ln.Close()
+			return fmt.Errorf("web: TLS certificate: %w", err)
+		}
+		if tlsConfig.RedirectPort != "" {
+			redirect = &http.Server{
+				Addr:         ":" + tlsConfig.RedirectPort,
+				Handler:      redirectHandler(config.Server.Port),
+				ReadTimeout:  server.ReadTimeout,
+				WriteTimeout: server.WriteTimeout,
+				IdleTimeout:  server.IdleTimeout,
+			}
+		}
+	}
+
+	// Background workers in the order they are stopped: webhook deliveries
+	// and expiry of idempotency keys, then the final write of buffered
+	// statistics and the remaining spans after it
+	var workers []worker
+	if w.Dispatcher != nil {
+		workers = append(workers, startWorker("webhooks", w.Dispatcher.Run))
+	}
+	if w.Idempotency != nil && w.IdempotencyTTL > 0 {
+		workers = append(workers, startWorker("idempotency", w.expireIdempotencyKeys))
+	}
+	if w.Buffer != nil {
+		workers = append(workers, startWorker("ingest", w.Buffer.Run))
+	}
+	if otlp, ok := w.tracingExporter().(*tracing.OTLPExporter); ok {
+		workers = append(workers, startWorker("tracing", otlp.Run))
+	}
 
 	// Alert the user that the server is starting
-	log.Printf("Server is starting on /%s\n", server.Addr)
+	logging.Default().Info("Server is starting", "addr", ln.Addr().String(), "tls", server.TLSConfig != nil)
 
 	// Run the server on a new goroutine
+	served := make(chan error, 1)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			if err == http.ErrServerClosed {
-				// Normal interrupt operation, ignore
-			} else {
-				log.Fatalf("Server failed to start due to err: %v", err)
-			}
+		if server.TLSConfig != nil {
+			// сертификат берется из TLSConfig
+			served <- server.ServeTLS(ln, "", "")
+		} else {
+			served <- server.Serve(ln)
 		}
 	}()
 
-	// Block on this channel listeninf for those previously defined syscalls assign
-	// to variable so we can let the user know why the server is shutting down
-	interrupt := <-runChan
+	if redirect != nil {
+		logging.Default().Info("Redirecting HTTP to HTTPS", "addr", redirect.Addr)
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logging.Default().Error("HTTP redirect failed to start", "err", err)
+			}
+		}()
+	}
+
+	// Block until a shutdown signal or a server failure, an invalid
+	// configuration on SIGHUP is logged and the running one is kept
+	current := &config
+	var failure error
+	for failure == nil {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				next, err := current.Reload()
+				if err != nil {
+					logging.Default().Error("Configuration is not reloaded", "err", err)
+					continue
+				}
+				w.applyConfig(current, next)
+				current = next
+				continue
+			}
+			logging.Default().Info("Server is shutting down", "signal", sig, "timeout", config.Server.Timeout.Server)
+			failure = errShutdown
+		case err := <-served:
+			logging.Default().Error("Server failed", "err", err)
+			failure = err
+		}
+	}
+	if failure == errShutdown {
+		failure = nil
+	}
 
-	// If we get one of the pre-prescribed syscalls, gracefully terminate the server
-	// while alerting the user
-	log.Printf("Server is shutting down due to %+v\n", interrupt)
+	// The shutdown timeout starts on the signal
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.Timeout.Server)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server was unable to gracefully shutdown due to err: %+v", err)
+		logging.Default().Error("Server was unable to gracefully shutdown", "err", err)
+		failure = firstError(failure, fmt.Errorf("web: requests are not drained: %w", err))
 	}
+	for _, wk := range workers {
+		wk.stop()
+		select {
+		case <-wk.done:
+		case <-ctx.Done():
+			logging.Default().Error("Worker is not stopped in time", "worker", wk.name)
+			failure = firstError(failure, fmt.Errorf("web: %s worker is not stopped: %w", wk.name, ctx.Err()))
+		}
+	}
+	if w.DB != nil {
+		if err := w.DB.Close(); err != nil {
+			logging.Default().Error("Database is not closed", "err", err)
+			failure = firstError(failure, err)
+		}
+	}
+	if failure == nil {
+		logging.Default().Info("Server stopped")
+	}
+	return failure
 }
 
-// InitDB is connect to database and return handle
-func (config Config) InitDB() WebserviceHandler {
-	// "%s:%s@%s(%s:%s)/%s
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local",
-		config.Database.User,
-		config.Database.Password,
-		config.Database.Host,
-		config.Database.Port,
-		config.Database.Dbname,
-	)
-	db, err := sql.Open("mysql", dsn)
+// errShutdown отмечает остановку по сигналу
+var errShutdown = errors.New("web: shutdown")
+
+// firstError возвращает первую из ошибок, не равную nil
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitDB is connect to database and return handle.
+// DB_DRIVER=memory keeps data in process memory without database
+func (config Config) InitDB() (WebserviceHandler, error) {
+	registry := metrics.NewRegistry()
+	tracer, err := config.Trace.NewTracer()
 	if err != nil {
-		panic(err)
+		return WebserviceHandler{}, err
+	}
+	var rep r.Repository
+	var db io.Closer
+	var checks []Check
+	if config.Database.Driver == "memory" {
+		rep = r.NewMemoryDB()
+		logging.Default().Info("Using in-memory repository")
+	} else {
+		dsn := config.Database.ConnString()
+		sdb, err := config.Database.Open()
+		if err != nil {
+			return WebserviceHandler{}, err
+		}
+		// вот тут будет первое подключение к базе
+		if err := waitForDB(context.Background(), sdb, config.Database.ConnectTimeout); err != nil {
+			sdb.DB.Close()
+			return WebserviceHandler{}, err
+		}
+		logging.Default().Info("Connected to database", "driver", config.Database.Driver, "dsn", logging.RedactDSN(dsn))
+		if config.Database.AutoMigrate {
+			applied, err := sdb.Migrate(context.Background(), r.LatestVersion)
+			if err != nil {
+				sdb.DB.Close()
+				return WebserviceHandler{}, err
+			}
+			for _, m := range applied {
+				logging.Default().Info("Applied migration", "version", m.Version, "name", m.Name)
+			}
+		} else {
+			warnPendingMigrations(sdb)
+		}
+		registry.RegisterDBStats(sdb.DB)
+		checks = append(checks, DatabaseCheck(sdb), MigrationsCheck(sdb))
+		rep = sdb
+		db = sdb.DB
 	}
-	db.SetMaxOpenConns(10)
-	err = db.Ping() // вот тут будет первое подключение к базе
+	policy := uc.TargetPolicy{AllowPrivate: config.Webhooks.AllowPrivate}
+	dispatcher := webhook.NewDispatcher(rep)
+	dispatcher.Policy = policy
+	broker := stream.NewBroker(replaySize)
+	meters := NewMetrics(registry)
+	var keys r.APIKeyRepository
+	var tokens uc.TokenValidator
+	if config.Auth.Enabled {
+		keys = rep
+		validator, err := config.Auth.NewValidator()
+		if err != nil {
+			return WebserviceHandler{}, err
+		}
+		if validator != nil {
+			tokens = validator
+			logging.Default().Info("Accepting SSO tokens", "jwks", config.Auth.JWKS, "issuer", config.Auth.Issuer)
+		}
+	} else {
+		logging.Default().Warn("API key authentication is disabled, every client can read and delete statistics")
+	}
+	var stats r.StatsRepository = r.NewMeteredStats(rep, registry)
+	var cache *r.CachedStats
+	if config.Cache.Size > 0 {
+		cache = r.NewCachedStats(stats, config.Cache.TTL, config.Cache.Size, config.Cache.Rows)
+		meters.RegisterCache(cache)
+		stats = cache
+	}
+	if tracer != nil {
+		stats = r.NewTracedStats(stats)
+		logging.Default().Info("Tracing requests", "exporter", config.Trace.Exporter, "ratio", config.Trace.Ratio)
+	}
+	// отклоненная по квоте запись не считается ошибкой репозитория
+	stats = r.NewQuotaStats(stats, rep, config.Tenant.MaxRows)
+	notifier := uc.Notifiers{dispatcher, broker}
+	var buffer *ingest.Buffer
+	if config.Ingest.Size > 0 {
+		buffer = ingest.NewBuffer(stats, config.Ingest.Size)
+		buffer.Budgets = rep
+		buffer.Notifier = notifier
+		if config.Ingest.Batch > 0 {
+			buffer.FlushSize = config.Ingest.Batch
+		}
+		if config.Ingest.Interval > 0 {
+			buffer.Interval = config.Ingest.Interval
+		}
+		meters.RegisterBuffer(buffer)
+		checks = append(checks, BufferCheck(buffer))
+		logging.Default().Info("Buffering POST /stats", "dates", config.Ingest.Size)
+	}
+	var clientCerts map[string]r.APIKey
+	if config.Auth.Enabled && config.Server.TLS.ClientCA != "" && len(config.Server.TLS.ClientSubjects) > 0 {
+		clientCerts = config.Server.TLS.ClientSubjects
+	}
+	limits := config.Limits
+	if limits.Read.Rate > 0 || limits.Write.Rate > 0 || limits.Delete.Rate > 0 {
+		logging.Default().Info("Rate limiting clients", "read", limits.Read.Rate, "write", limits.Write.Rate, "delete", limits.Delete.Rate)
+	}
+	return WebserviceHandler{
+		Rep:        stats,
+		Cache:      cache,
+		Budgets:    rep,
+		Webhooks:   rep,
+		Notifier:   notifier,
+		Dispatcher: dispatcher,
+		Broker:     broker,
+		Buffer:     buffer,
+
+		WebhookPolicy: policy,
+
+		Idempotency:      rep,
+		IdempotencyTTL:   config.Idempotency.TTL,
+		IdempotencyLease: config.Idempotency.Lease,
+		Metrics:          meters,
+
+		DB:           db,
+		Checks:       checks,
+		ReadyTimeout: config.Health.Timeout,
+		Tracer:       tracer,
+		APIKeys:      keys,
+		Tokens:       tokens,
+		TokenMapping: config.Auth.Mapping,
+		ClientCerts:  clientCerts,
+		RateLimits:   limits.NewRateLimits(),
+		MaxBodyBytes: limits.MaxBodyBytes,
+	}, nil
+}
+
+// Задержки между попытками подключения к базе при запуске
+const (
+	connectBaseDelay = 500 * time.Millisecond
+	connectMaxDelay  = 10 * time.Second
+)
+
+// waitForDB pings the database until it answers, doubling the delay
+// between attempts up to connectMaxDelay. Returns the last error
+// if the database is not reachable within timeout
+func waitForDB(ctx context.Context, sdb *r.StatsDB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	delay := connectBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := sdb.DB.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		logging.Warn(ctx, "Database is not reachable", "attempt", attempt, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database is not reachable within %s: %w", timeout, err)
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > connectMaxDelay {
+			delay = connectMaxDelay
+		}
+	}
+}
+
+// tracingExporter returns the exporter of the tracer, nil if tracing is disabled
+func (w WebserviceHandler) tracingExporter() tracing.Exporter {
+	if w.Tracer == nil {
+		return nil
+	}
+	return w.Tracer.Exporter
+}
+
+// expireIdempotencyKeys removes expired idempotency keys
+// every tenth of their TTL until ctx is cancelled
+func (w WebserviceHandler) expireIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(w.IdempotencyTTL / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		count, err := uc.ExpireIdempotencyKeys(ctx, time.Now(), w.IdempotencyTTL, w.Idempotency)
+		if err != nil {
+			logging.Error(ctx, "ExpireIdempotencyKeys", "err", err)
+		} else if count > 0 {
+			logging.Info(ctx, "Removed expired idempotency keys", "count", count)
+		}
+	}
+}
+
+// warnPendingMigrations logs schema versions which are not applied yet
+func warnPendingMigrations(sdb *r.StatsDB) {
+	states, err := sdb.MigrationStatus(context.Background())
 	if err != nil {
-		panic(err)
+		logging.Default().Error("MigrationStatus", "err", err)
+		return
+	}
+	for _, state := range states {
+		if state.Pending() {
+			logging.Default().Warn("Migration is not applied, run `statistics migrate up` or set AUTO_MIGRATE=true",
+				"version", state.Version, "name", state.Name)
+		}
 	}
-	log.Println("Connected to: ", dsn)
-	sdb := &r.StatsDB{DB: db}
-	return WebserviceHandler{Rep: sdb}
 }
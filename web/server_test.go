@@ -0,0 +1,142 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	r "statistics/pkg/repository"
+)
+
+// closerFunc отмечает закрытие базы
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// newServeConfig возвращает конфигурацию с базой в памяти и обработчик
+func newServeConfig(t *testing.T, args ...string) (*Config, WebserviceHandler) {
+	t.Helper()
+	config, _, err := NewConfig(append([]string{"-set", "database.driver=memory"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := config.InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config, w
+}
+
+// startServe запускает Serve на свободном порту и возвращает
+// его адрес, канал сигналов и результат Serve
+func startServe(t *testing.T, config *Config, w WebserviceHandler) (string, chan os.Signal, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- config.Serve(ln, signals, w) }()
+	return ln.Addr().String(), signals, done
+}
+
+// startPost начинает POST /stats, передав только часть тела
+func startPost(t *testing.T, addr, body string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "POST /stats HTTP/1.1\r\nHost: %s\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: %d\r\n\r\n%s",
+		addr, len(body), body[:5])
+	// запрос должен начать обрабатываться до сигнала
+	time.Sleep(100 * time.Millisecond)
+	return conn, body[5:]
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	config, w := newServeConfig(t, "-set", "ingest.size=100", "-set", "ingest.interval=1h")
+	closed := false
+	w.DB = closerFunc(func() error { closed = true; return nil })
+	addr, signals, done := startServe(t, config, w)
+
+	stream, err := http.Get("http://" + addr + "/stats/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, rest := startPost(t, addr, "date=2021-01-01&views=5")
+	defer conn.Close()
+
+	signals <- syscall.SIGTERM
+
+	// поток закрывается сразу, не дожидаясь срока остановки
+	streamed := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(stream.Body)
+		stream.Body.Close()
+		close(streamed)
+	}()
+	select {
+	case <-streamed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("event stream is not closed on shutdown")
+	}
+	// новые подключения не принимаются
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("connection accepted after shutdown signal")
+	}
+
+	// начатый запрос завершается, запись буферизуется
+	fmt.Fprint(conn, rest)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("in-flight POST /stats: got %d", resp.StatusCode)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve is not stopped")
+	}
+	// буфер записан в базу после остановки приема запросов
+	data, err := w.Budgets.(*r.MemoryDB).FindByDate(context.Background(), "2021-01-01")
+	if err != nil || data.Views != 5 {
+		t.Fatalf("got %+v, %v; expected buffered statistics flushed", data, err)
+	}
+	if !closed {
+		t.Fatal("database is not closed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	config, w := newServeConfig(t, "-set", "server.timeout.server=100ms")
+	addr, signals, done := startServe(t, config, w)
+	conn, _ := startPost(t, addr, "date=2021-01-01&views=5")
+	defer conn.Close()
+
+	signals <- syscall.SIGINT
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "requests are not drained") {
+			t.Fatalf("got %v; expected error of stuck request", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve is not stopped after its timeout")
+	}
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	r "statistics/pkg/repository"
+	"statistics/pkg/stream"
+	"statistics/pkg/validation"
+
+	"github.com/gorilla/schema"
+)
+
+const (
+	// defaultHeartbeat период отправки комментария, поддерживающего соединение
+	defaultHeartbeat = 15 * time.Second
+	// streamRetry задержка переподключения клиента в миллисекундах
+	streamRetry = 1000
+)
+
+// writeEvent отправляет сообщение в формате Server-Sent Events
+func writeEvent(w io.Writer, msg stream.Message) error {
+	data, err := json.Marshal(msg.Event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.ID, msg.Event.Type, data)
+	return err
+}
+
+// StreamStats обработчик GET запроса потока изменений статистики арендатора (Server-Sent Events).
+// Поток начинается с пропущенных сообщений после Last-Event-ID, далее отправляются
+// новые события и периодические комментарии ": ping". Если задан StreamTimeout,
+// поток закрывается по его истечении, и клиент переподключается с Last-Event-ID
+func (h *WebserviceHandler) StreamStats(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || h.Broker == nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	msg := &validation.StreamRange{}
+	decoder := schema.NewDecoder()
+	decoder.Decode(msg, req.URL.Query())
+	lastID, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+
+	sub, missed := h.Broker.Subscribe(r.TenantFromContext(req.Context()), msg.From, msg.To, lastID)
+	defer h.Broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+	for _, m := range missed {
+		if err := writeEvent(w, m); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := h.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeat
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if h.StreamTimeout > 0 {
+		timer := time.NewTimer(h.StreamTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-deadline:
+			return
+		case m, ok := <-sub.C:
+			if !ok {
+				// подписчик не успевал читать и был отключен брокером
+				return
+			}
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	r "statistics/pkg/repository"
+	"statistics/pkg/stream"
+	uc "statistics/pkg/usecases"
+)
+
+// readEvent читает из потока строки одного события до пустой строки
+func readEvent(t *testing.T, body *bufio.Reader) []string {
+	lines := []string{}
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	broker := stream.NewBroker(10)
+	broker.Notify(uc.Event{Type: uc.EventStatCreated, Tenant: r.DefaultTenant, Date: "2021-01-01"})
+	broker.Notify(uc.Event{Type: uc.EventStatCreated, Tenant: r.DefaultTenant, Date: "2021-01-02"})
+	h := WebserviceHandler{Broker: broker, Heartbeat: 50 * time.Millisecond}
+	srv := httptest.NewServer(NewRouter(h))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/stats/stream?from=2021-01-02", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %q; expected %q", ct, "text/event-stream")
+	}
+	body := bufio.NewReader(resp.Body)
+
+	if lines := readEvent(t, body); lines[0] != "retry: 1000" {
+		t.Fatalf("got %q; expected retry field", lines)
+	}
+	lines := readEvent(t, body)
+	if lines[0] != "id: 2" || lines[1] != "event: stat.created" ||
+		!strings.Contains(lines[2], `"date":"2021-01-02"`) {
+		t.Fatalf("got replayed event %q", lines)
+	}
+
+	// событие вне диапазона пропускается, подходящее приходит следующим
+	broker.Notify(uc.Event{Type: uc.EventStatUpdated, Tenant: r.DefaultTenant, Date: "2021-01-01"})
+	broker.Notify(uc.Event{Type: uc.EventStatUpdated, Tenant: r.DefaultTenant, Date: "2021-01-03"})
+	for {
+		lines = readEvent(t, body)
+		if lines[0] != ": ping" {
+			break
+		}
+	}
+	if lines[0] != "id: 4" || lines[1] != "event: stat.updated" {
+		t.Fatalf("got live event %q", lines)
+	}
+
+	if lines = readEvent(t, body); lines[0] != ": ping" {
+		t.Fatalf("got %q; expected heartbeat", lines)
+	}
+}
+
+func TestStreamStatsBadRange(t *testing.T) {
+	srv := httptest.NewServer(NewRouter(WebserviceHandler{Broker: stream.NewBroker(1)}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stats/stream?from=2021-13-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d; expected %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
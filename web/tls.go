@@ -0,0 +1,246 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"statistics/pkg/logging"
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+)
+
+// TLS is the HTTPS of the server
+type TLS struct {
+	// CertFile and KeyFile are the PEM certificate chain and private key,
+	// empty values serve plain HTTP. Changed files are reloaded without restart
+	CertFile string
+	KeyFile  string
+	// ClientCA is the PEM bundle of CAs verifying client certificates (mTLS),
+	// empty disables client certificates
+	ClientCA string
+	// ClientRequired rejects connections without a client certificate,
+	// otherwise a certificate is verified only if the client sends one
+	ClientRequired bool
+	// ClientSubjects maps the common name or a DNS name of allowed client
+	// certificates to their identity. Certificates of other subjects are rejected,
+	// an empty map accepts every certificate signed by ClientCA without identity
+	ClientSubjects map[string]r.APIKey
+	// RedirectPort is the port of a plain HTTP listener redirecting to HTTPS,
+	// empty disables the listener
+	RedirectPort string
+	// ReloadInterval is the minimal time between checks of changed files
+	ReloadInterval time.Duration
+}
+
+// Enabled reports whether the server is served over HTTPS
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// parseClientSubjects parses identities of client certificates
+// in the form "subject=scope scope@tenant,subject=scope"
+func parseClientSubjects(s string) (map[string]r.APIKey, error) {
+	result := map[string]r.APIKey{}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		subject := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || subject == "" {
+			return nil, fmt.Errorf("web: bad client subject %q", entry)
+		}
+		scopes, tenant := parts[1], r.DefaultTenant
+		if i := strings.LastIndex(scopes, "@"); i >= 0 {
+			scopes, tenant = scopes[:i], strings.TrimSpace(scopes[i+1:])
+		}
+		if !uc.ValidTenant(tenant) {
+			return nil, fmt.Errorf("web: bad tenant %q of client subject %q", tenant, subject)
+		}
+		key := r.APIKey{Name: "cert:" + subject, Tenant: tenant, Scopes: strings.Fields(scopes)}
+		for _, scope := range key.Scopes {
+			known := false
+			for _, s := range uc.Scopes {
+				known = known || s == scope
+			}
+			if !known {
+				return nil, fmt.Errorf("web: unknown scope %q of client subject %q", scope, subject)
+			}
+		}
+		result[subject] = key
+	}
+	return result, nil
+}
+
+// certSubjects возвращает имена сертификата: CN и DNS-имена
+func certSubjects(cert *x509.Certificate) []string {
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+// clientIdentity возвращает ключ из ClientSubjects для проверенного
+// сертификата клиента запроса
+func clientIdentity(req *http.Request, subjects map[string]r.APIKey) (r.APIKey, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return r.APIKey{}, false
+	}
+	for _, name := range certSubjects(req.TLS.VerifiedChains[0][0]) {
+		if key, ok := subjects[name]; ok && name != "" {
+			return key, true
+		}
+	}
+	return r.APIKey{}, false
+}
+
+// certFiles сертификат, ключ и CA клиентов, перечитываемые при изменении.
+// Файлы проверяются при подключении, но не чаще ReloadInterval
+type certFiles struct {
+	t TLS
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+	checked  time.Time
+	now      func() time.Time
+}
+
+// files возвращает файлы конфигурации
+func (c *certFiles) files() []string {
+	files := []string{c.t.CertFile, c.t.KeyFile}
+	if c.t.ClientCA != "" {
+		files = append(files, c.t.ClientCA)
+	}
+	return files
+}
+
+// load читает сертификат и CA клиентов, вызывается под mu
+func (c *certFiles) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(c.t.CertFile, c.t.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.t.ClientCA != "" {
+		pem, err := ioutil.ReadFile(c.t.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("web: no certificates in %s", c.t.ClientCA)
+		}
+	}
+	c.cert, c.clientCA, c.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// changed сообщает, изменился ли какой-либо файл после загрузки
+func (c *certFiles) changed() bool {
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// current возвращает сертификат и CA клиентов, перечитывая измененные файлы.
+// При ошибке чтения остаются прежние
+func (c *certFiles) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.checked) >= c.t.ReloadInterval {
+		c.checked = now
+		if c.changed() {
+			if err := c.load(); err != nil {
+				logging.Default().Error("TLS certificate is not reloaded", "cert", c.t.CertFile, "err", err)
+			} else {
+				logging.Default().Info("TLS certificate reloaded", "cert", c.t.CertFile)
+			}
+		}
+	}
+	return c.cert, c.clientCA
+}
+
+// NewTLSConfig returns the server TLS configuration. The certificate
+// and the client CAs are reloaded on connections after their files change
+func (t TLS) NewTLSConfig() (*tls.Config, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("web: both TLS certificate and key are required")
+	}
+	if t.ClientRequired && t.ClientCA == "" {
+		return nil, errors.New("web: client certificates are required without client CA")
+	}
+	files := &certFiles{t: t, now: time.Now}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.ClientCA != "" {
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.ClientRequired {
+			base.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if len(t.ClientSubjects) > 0 {
+		base.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.VerifiedChains) == 0 {
+				return nil
+			}
+			for _, name := range certSubjects(cs.VerifiedChains[0][0]) {
+				if _, ok := t.ClientSubjects[name]; ok && name != "" {
+					return nil
+				}
+			}
+			return fmt.Errorf("web: client certificate %q is not allowed", cs.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, _ := files.current()
+		return cert, nil
+	}
+	config := base.Clone()
+	// CA клиентов задаются для каждого подключения, чтобы применялся перечитанный набор
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		_, clientCA := files.current()
+		conn := base.Clone()
+		conn.ClientCAs = clientCA
+		return conn, nil
+	}
+	return config, nil
+}
+
+// redirectHandler перенаправляет запросы HTTP на тот же путь
+// по HTTPS на порт port
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusPermanentRedirect)
+	})
+}
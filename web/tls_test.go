@@ -0,0 +1,225 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+)
+
+// testCA удостоверяющий центр для сертификатов тестов
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue выпускает сертификат name и возвращает его и ключ в PEM
+func (ca *testCA) issue(t *testing.T, serial int64, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseClientSubjects(t *testing.T) {
+	subjects, err := parseClientSubjects("ingest.acme.com=stats:write@acme, ops = admin stats:read ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest, ops := subjects["ingest.acme.com"], subjects["ops"]
+	if len(subjects) != 2 || ingest.Tenant != "acme" || ingest.Name != "cert:ingest.acme.com" || ops.Tenant != r.DefaultTenant || len(ops.Scopes) != 2 {
+		t.Fatalf("got %+v", subjects)
+	}
+	for _, bad := range []string{"ops", "=admin", "ops=stats:everything", "ops=admin@Bad Tenant"} {
+		if _, err := parseClientSubjects(bad); err == nil {
+			t.Errorf("parseClientSubjects(%q) accepted", bad)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, clientCA := newTestCA(t), newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	cert, key := serverCA.issue(t, 10, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, caFile, clientCA.pem())
+
+	subjects, _ := parseClientSubjects("ingest=stats:write@acme")
+	config := TLS{CertFile: certFile, KeyFile: keyFile, ClientCA: caFile, ClientSubjects: subjects}
+	if _, err := (TLS{CertFile: certFile, KeyFile: keyFile, ClientRequired: true}).NewTLSConfig(); err == nil {
+		t.Fatal("expected error of required client certificates without CA")
+	}
+	if _, err := (TLS{CertFile: certFile}).NewTLSConfig(); err == nil {
+		t.Fatal("expected error of missing key")
+	}
+	tlsConfig, err := config.NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := r.NewMemoryDB()
+	srv := httptest.NewUnstartedServer(NewRouter(WebserviceHandler{Rep: rep, Budgets: rep, Webhooks: rep,
+		APIKeys: rep, ClientCerts: subjects}))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	newClient := func(name string) *http.Client {
+		conf := &tls.Config{RootCAs: roots}
+		if name != "" {
+			certPEM, keyPEM := clientCA.issue(t, 20, name, x509.ExtKeyUsageClientAuth)
+			pair, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf.Certificates = []tls.Certificate{pair}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	}
+	ingest, anonymous := newClient("ingest"), newClient("")
+	reader, _ := uc.CreateAPIKey(r.WithTenant(context.Background(), "acme"), "reader", []string{uc.ScopeStatsRead}, rep)
+	stats := srv.URL + "/stats?from=2021-01-01&to=2021-01-31"
+
+	// сертификат клиента дает права и арендатора из ClientSubjects
+	resp, err := ingest.PostForm(srv.URL+"/stats", url.Values{"date": {"2021-01-01"}, "views": {"7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /stats with client certificate: got %d", resp.StatusCode)
+	}
+	if resp, err = ingest.Get(stats); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("GET /stats with write certificate: got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// без сертификата нужен ключ
+	if resp, err = anonymous.Get(stats); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET /stats without certificate: got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	req, _ := http.NewRequest(http.MethodGet, stats, nil)
+	req.Header.Set("Authorization", "Bearer "+reader.Key)
+	if resp, err = anonymous.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stats with key: got %v, %v", resp, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"Views":7`) {
+		t.Fatalf("GET /stats of tenant acme: got %s", body)
+	}
+
+	// сертификат не из списка отклоняется при подключении
+	if resp, err := newClient("stranger").Get(stats); err == nil {
+		resp.Body.Close()
+		t.Fatalf("stranger certificate accepted: %d", resp.StatusCode)
+	}
+
+	// измененный сертификат сервера применяется к новым подключениям
+	cert, key = serverCA.issue(t, 11, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	resp, err = newClient("ingest").Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 11 {
+		t.Fatalf("got server certificate %d; expected reloaded 11", serial)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tc := range []struct{ port, host, expected string }{
+		{"8443", "example.com:8080", "https://example.com:8443/stats?from=2021-01-01"},
+		{"443", "example.com", "https://example.com/stats?from=2021-01-01"},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/stats?from=2021-01-01", nil)
+		redirectHandler(tc.port).ServeHTTP(w, req)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tc.expected {
+			t.Errorf("got %d %q; expected %q", w.Code, w.Header().Get("Location"), tc.expected)
+		}
+	}
+}
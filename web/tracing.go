@@ -0,0 +1,52 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"statistics/pkg/tracing"
+)
+
+// HeaderTraceparent заголовок контекста трассировки W3C
+const HeaderTraceparent = "traceparent"
+
+// TracingMiddleware начинает span запроса, продолжающий трассу из заголовка
+// traceparent, и передает его в контексте обработчику, сценариям и репозиторию.
+// Ответы с кодом 5xx отмечаются ошибкой
+func (h *WebserviceHandler) TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if h.Tracer == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		parent, _ := tracing.ParseTraceparent(req.Header.Get(HeaderTraceparent))
+		route, _ := mux.CurrentRoute(req).GetPathTemplate()
+		ctx, span := h.Tracer.StartRemote(req.Context(), parent, req.Method+" "+route, tracing.KindServer,
+			"http.method", req.Method,
+			"http.route", route,
+			"http.target", req.URL.RequestURI(),
+		)
+		if span == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		defer span.Finish()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttributes("http.status_code", sw.status)
+		if sw.status >= http.StatusInternalServerError {
+			span.RecordError(errorStatus(sw.status))
+		}
+	})
+}
+
+// errorStatus ошибка, описывающая код ответа
+type errorStatus int
+
+func (e errorStatus) Error() string {
+	return http.StatusText(int(e))
+}
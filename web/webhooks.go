@@ -0,0 +1,79 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	r "statistics/pkg/repository"
+	uc "statistics/pkg/usecases"
+	"statistics/pkg/validation"
+
+	"github.com/gorilla/schema"
+)
+
+func toWebhook(data validation.InputWebhook) r.Webhook {
+	events := []string{}
+	for _, event := range strings.Split(data.Events, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			events = append(events, event)
+		}
+	}
+	return r.Webhook{
+		URL:    data.URL,
+		Events: events,
+		Secret: data.Secret,
+	}
+}
+
+// PostWebhook обработчик POST запроса. Запускает сценарий CreateWebhook
+// Возвращает созданную подписку вместе с секретом
+func (h *WebserviceHandler) PostWebhook(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	msg := &validation.InputWebhook{}
+	decoder := schema.NewDecoder()
+	decoder.Decode(msg, r.PostForm)
+	hook, err := uc.CreateWebhook(r.Context(), toWebhook(*msg), h.WebhookPolicy, h.Webhooks)
+	if err != nil {
+		writeError(w, r, "PostWebhook", err)
+		return
+	}
+	writeJSON(w, hook)
+}
+
+// GetWebhooks обработчик GET запроса. Запускает сценарий GetWebhooks
+func (h *WebserviceHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := uc.GetWebhooks(r.Context(), h.Webhooks)
+	if err != nil {
+		writeError(w, r, "GetWebhooks", err)
+		return
+	}
+	writeJSON(w, hooks)
+}
+
+// GetWebhook обработчик GET запроса. Запускает сценарий GetWebhook
+func (h *WebserviceHandler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := uc.GetWebhook(r.Context(), pathID(r), h.Webhooks)
+	if err != nil {
+		writeError(w, r, "GetWebhook", err)
+		return
+	}
+	writeJSON(w, hook)
+}
+
+// DeleteWebhook обработчик DELETE запроса. Запускает сценарий DeleteWebhook
+func (h *WebserviceHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := uc.DeleteWebhook(r.Context(), pathID(r), h.Webhooks); err != nil {
+		writeError(w, r, "DeleteWebhook", err)
+		return
+	}
+}
+
+// GetDeliveries обработчик GET запроса. Запускает сценарий GetDeliveries
+func (h *WebserviceHandler) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := uc.GetDeliveries(r.Context(), pathID(r), h.Webhooks)
+	if err != nil {
+		writeError(w, r, "GetDeliveries", err)
+		return
+	}
+	writeJSON(w, deliveries)
+}